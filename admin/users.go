@@ -0,0 +1,279 @@
+package admin
+
+import (
+	"chat-module/auth"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/util"
+	"log"
+	"net/http"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// Page size used when the request doesn't ask for one
+	DefaultPageSize = 20
+
+	// Largest page size a request can ask for
+	MaxPageSize = 100
+)
+
+// What admins get to see about an user. Never includes the password hash.
+type userView struct {
+	models.PrivateUser
+	Suspended             bool `json:"suspended"`
+	PasswordResetRequired bool `json:"passwordResetRequired"`
+}
+
+func newUserView(user *models.User) userView {
+	return userView{
+		PrivateUser:           user.PrivateView(),
+		Suspended:             user.Suspended,
+		PasswordResetRequired: user.PasswordReset != nil,
+	}
+}
+
+/*
+ *	Suspends or unsuspends an user. Suspending also signs them out everywhere,
+ *	so their existing tokens stop working right away.
+ */
+func SetSuspended(username string, suspended bool) error {
+	if err := db.Client.SetUserSuspended(username, suspended); err != nil {
+		return err
+	}
+
+	if suspended {
+		return auth.RevokeUserSessions(username)
+	}
+
+	return nil
+}
+
+// Deletes the account of an user and signs them out everywhere
+func DeleteUser(username string) error {
+	if err := db.Client.DeleteUser(username); err != nil {
+		return err
+	}
+
+	return auth.RevokeUserSessions(username)
+}
+
+/*
+ *	Makes sure the user exists and ranks below whoever is making the request,
+ *	so admins can't suspend, reset or delete each other. Writes the error
+ *	response and returns false otherwise.
+ */
+func checkOutranks(w http.ResponseWriter, r *http.Request, username string) bool {
+	user, err := db.Client.GetUser(username)
+
+	if err == mongo.ErrNoDocuments || (err == nil && *user.Username != username) {
+		http.Error(w, "Such an user doesn't exist", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		http.Error(w, "Failed to find document", http.StatusInternalServerError)
+		log.Printf("Failed to find document for user %s: %v", username, err)
+		return false
+	}
+
+	if !auth.GetClaims(r).Role.Outranks(user.GetRole()) {
+		http.Error(w, "You can only manage users ranked below you", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// Reads a positive integer query parameter, falling back to the default
+func queryInt(r *http.Request, name string, fallback int) (int, bool) {
+	value := r.URL.Query().Get(name)
+
+	if value == "" {
+		return fallback, true
+	}
+
+	parsed, err := strconv.Atoi(value)
+
+	if err != nil || parsed < 1 {
+		return 0, false
+	}
+
+	return parsed, true
+}
+
+/*
+ *	GET /api/admin/users?q=&page=&limit=
+ *
+ *	Pages through the users, optionally only the ones whose username or email
+ *	starts with q. Pages start from 1.
+ */
+func UsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page, ok := queryInt(r, "page", 1)
+	if !ok {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+
+	limit, ok := queryInt(r, "limit", DefaultPageSize)
+	if !ok || limit > MaxPageSize {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	users, total, err := db.Client.ListUsers(r.URL.Query().Get("q"), (page-1)*limit, limit)
+
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to list users: %v", err)
+		return
+	}
+
+	views := make([]userView, 0, len(users))
+	for i := range users {
+		views = append(views, newUserView(&users[i]))
+	}
+
+	util.WriteJSON(w, http.StatusOK, map[string]any{
+		"users": views,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+/*
+ *	GET    /api/admin/users/{username} - returns the account of the user
+ *	DELETE /api/admin/users/{username} - deletes the account of the user
+ */
+func UserHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	switch r.Method {
+	case http.MethodGet:
+		user, err := db.Client.GetUser(username)
+
+		if err == mongo.ErrNoDocuments || (err == nil && *user.Username != username) {
+			http.Error(w, "Such an user doesn't exist", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to find document", http.StatusInternalServerError)
+			log.Printf("Failed to find document for user %s: %v", username, err)
+			return
+		}
+
+		util.WriteJSON(w, http.StatusOK, newUserView(user))
+
+	case http.MethodDelete:
+		// Viewing is open to moderators, but deleting is not
+		if !auth.GetClaims(r).Role.HasPermission(models.PermissionManageUsers) {
+			http.Error(w, "You don't have permission to do this", http.StatusForbidden)
+			return
+		}
+
+		if username == auth.GetClaims(r).Username {
+			http.Error(w, "You can't delete your own account from here", http.StatusBadRequest)
+			return
+		}
+
+		if !checkOutranks(w, r, username) {
+			return
+		}
+
+		err := DeleteUser(username)
+
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Such an user doesn't exist", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+			log.Printf("Failed to delete user %s: %v", username, err)
+			return
+		}
+
+		log.Printf("User %s was deleted by %s", username, auth.GetClaims(r).Username)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+ *	POST   /api/admin/users/{username}/suspension - suspends the user
+ *	DELETE /api/admin/users/{username}/suspension - lifts the suspension
+ */
+func SuspensionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.PathValue("username")
+	suspended := r.Method == http.MethodPost
+
+	if suspended && username == auth.GetClaims(r).Username {
+		http.Error(w, "You can't suspend yourself", http.StatusBadRequest)
+		return
+	}
+
+	if !checkOutranks(w, r, username) {
+		return
+	}
+
+	err := SetSuspended(username, suspended)
+
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Such an user doesn't exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		log.Printf("Failed to set suspension of user %s: %v", username, err)
+		return
+	}
+
+	log.Printf("Suspension of user %s set to %t by %s", username, suspended, auth.GetClaims(r).Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+ *	POST /api/admin/users/{username}/password-reset
+ *
+ *	Forces the user to pick a new password. The response contains the one time
+ *	reset token, which the admin has to hand over to the user.
+ */
+func PasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.PathValue("username")
+
+	if !checkOutranks(w, r, username) {
+		return
+	}
+
+	token, err := auth.ForcePasswordReset(username)
+
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Such an user doesn't exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		log.Printf("Failed to force password reset of user %s: %v", username, err)
+		return
+	}
+
+	log.Printf("Password reset of user %s forced by %s", username, auth.GetClaims(r).Username)
+
+	util.WriteJSON(w, http.StatusCreated, map[string]any{
+		"token":     token,
+		"expiresIn": int(auth.PasswordResetLifetime.Seconds()),
+	})
+}
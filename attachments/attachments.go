@@ -0,0 +1,385 @@
+package attachments
+
+import (
+	"bytes"
+	"chat-module/auth"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/storage"
+	"chat-module/util"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// Largest file that can be uploaded
+	MaxAttachmentSize = 25 << 20
+
+	// How long a download link handed out by the API keeps working
+	LinkLifetime = time.Minute * 15
+
+	// Uploads and downloads of large files take longer than the server's
+	// default timeouts allow
+	transferTimeout = time.Minute * 5
+
+	maxFilenameLength = 255
+
+	// How much of the file http.DetectContentType looks at
+	sniffLength = 512
+)
+
+/*
+ *	What can be uploaded. The type is always sniffed from the content, whatever
+ *	the client claims it is. Anything that a browser could end up running, like
+ *	HTML or SVG, stays out.
+ */
+var allowedContentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"application/zip": true,
+	"text/plain":      true,
+	"audio/mpeg":      true,
+	"audio/wave":      true,
+	"video/mp4":       true,
+	"video/webm":      true,
+}
+
+// The key of the file of an attachment in the storage
+func StorageKey(id primitive.ObjectID) string {
+	return "attachments/" + id.Hex()
+}
+
+// Keeps only the last path element of the name the client sent, capped in length
+func cleanFilename(name string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+
+	if name == "" || name == "." || name == "/" || !utf8.ValidString(name) {
+		return "file"
+	}
+
+	if runes := []rune(name); len(runes) > maxFilenameLength {
+		name = string(runes[:maxFilenameLength])
+	}
+
+	return name
+}
+
+/*
+ *	Whether the user can see the attachment. The uploader always can, anybody
+ *	else only once it's attached to a message in a conversation they are in.
+ */
+func CanAccess(attachment *models.Attachment, username string) (bool, error) {
+	if attachment.Uploader == username {
+		return true, nil
+	}
+
+	if !attachment.IsAttached() {
+		return false, nil
+	}
+
+	room, err := db.Client.GetRoom(attachment.Conversation)
+
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return room.GetMember(username) != nil, nil
+}
+
+type thumbnailView struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// The attachment along with links to download it and its thumbnails
+type attachmentView struct {
+	models.Attachment
+	URL        string          `json:"url"`
+	Thumbnails []thumbnailView `json:"thumbnails,omitempty"`
+}
+
+func newAttachmentView(attachment *models.Attachment) attachmentView {
+	path := "/api/attachments/" + attachment.ID.Hex()
+
+	view := attachmentView{
+		Attachment: *attachment,
+		URL:        auth.SignLink(path+"/content", LinkLifetime),
+	}
+
+	for _, thumbnail := range attachment.Thumbnails {
+		view.Thumbnails = append(view.Thumbnails, thumbnailView{
+			Width:  thumbnail.Width,
+			Height: thumbnail.Height,
+			URL:    auth.SignLink(path+"/thumbnails/"+strconv.Itoa(thumbnail.Width), LinkLifetime),
+		})
+	}
+
+	return view
+}
+
+/*
+ *	POST /api/attachments?filename=
+ *
+ *	Uploads a file, sent as the raw request body. The Content-Length header is
+ *	required, so oversized uploads are turned away before they are read. The
+ *	file is streamed straight into the storage. The response carries the ID
+ *	to reference the attachment by when sending a message.
+ */
+func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+		return
+	}
+
+	if r.ContentLength == 0 {
+		http.Error(w, "The file is empty", http.StatusBadRequest)
+		return
+	}
+
+	if r.ContentLength > MaxAttachmentSize {
+		http.Error(w, "The file is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Now().Add(transferTimeout))
+	controller.SetWriteDeadline(time.Now().Add(transferTimeout))
+
+	// Sniff the type from the start of the file, then put that start back in
+	// front of the rest of the stream
+	body := http.MaxBytesReader(w, r.Body, r.ContentLength)
+	head := make([]byte, min(sniffLength, r.ContentLength))
+
+	if _, err := io.ReadFull(body, head); err != nil {
+		http.Error(w, "Failed to read the file", http.StatusBadRequest)
+		return
+	}
+
+	contentType := http.DetectContentType(head)
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	if !allowedContentTypes[mediaType] {
+		http.Error(w, "Files of type "+mediaType+" are not allowed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	claims := auth.GetClaims(r)
+	attachment := models.Attachment{
+		ID:          primitive.NewObjectID(),
+		Uploader:    claims.Username,
+		Filename:    cleanFilename(r.URL.Query().Get("filename")),
+		ContentType: contentType,
+		Size:        r.ContentLength,
+		CreatedAt:   time.Now(),
+	}
+	attachment.StorageKey = StorageKey(attachment.ID)
+
+	if getsThumbnails(&attachment) {
+		attachment.ThumbnailStatus = models.ThumbnailsPending
+	}
+
+	err := storage.Files.Put(attachment.StorageKey, io.MultiReader(bytes.NewReader(head), body), attachment.Size, contentType)
+
+	if err != nil {
+		http.Error(w, "Failed to store the file", http.StatusInternalServerError)
+		log.Printf("Failed to store upload of user %s: %v", claims.Username, err)
+		return
+	}
+
+	if err := db.Client.AddAttachment(attachment); err != nil {
+		http.Error(w, "Failed to store the file", http.StatusInternalServerError)
+		log.Printf("Failed to add attachment %s: %v", attachment.ID.Hex(), err)
+
+		if err := storage.Files.Delete(attachment.StorageKey); err != nil {
+			log.Printf("Failed to clean up file of attachment %s: %v", attachment.ID.Hex(), err)
+		}
+
+		return
+	}
+
+	if attachment.ThumbnailStatus == models.ThumbnailsPending {
+		queueThumbnails(&attachment)
+	}
+
+	util.WriteJSON(w, http.StatusCreated, newAttachmentView(&attachment))
+}
+
+// Loads the attachment from the {id} path value, writing the error response on failure
+func loadAttachment(w http.ResponseWriter, r *http.Request) *models.Attachment {
+	id, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+
+	if err != nil {
+		http.Error(w, "No such attachment", http.StatusNotFound)
+		return nil
+	}
+
+	attachment, err := db.Client.GetAttachment(id)
+
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "No such attachment", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to get attachment %s: %v", id.Hex(), err)
+		return nil
+	}
+
+	return attachment
+}
+
+/*
+ *	GET /api/attachments/{id}
+ *
+ *	Returns the attachment with a download link that is valid for LinkLifetime.
+ */
+func AttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	attachment := loadAttachment(w, r)
+
+	if attachment == nil {
+		return
+	}
+
+	allowed, err := CanAccess(attachment, auth.GetClaims(r).Username)
+
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to check access to attachment %s: %v", attachment.ID.Hex(), err)
+		return
+	}
+
+	if !allowed {
+		// Don't give away which attachments exist
+		http.Error(w, "No such attachment", http.StatusNotFound)
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, newAttachmentView(attachment))
+}
+
+/*
+ *	GET /api/attachments/{id}/content?expires=&signature=
+ *
+ *	Serves the file itself, with the metadata of images stripped. Needs no
+ *	token, the signed link handed out by AttachmentHandler is the authorization.
+ */
+func DownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !auth.VerifyLink(r) {
+		http.Error(w, "The link is invalid or has expired", http.StatusForbidden)
+		return
+	}
+
+	attachment := loadAttachment(w, r)
+
+	if attachment == nil {
+		return
+	}
+
+	serveFile(w, attachment, attachment.StorageKey, attachment.ContentType, attachment.Size)
+}
+
+/*
+ *	GET /api/attachments/{id}/thumbnails/{width}?expires=&signature=
+ *
+ *	Serves a thumbnail of an image attachment, through a signed link like the
+ *	file itself.
+ */
+func ThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !auth.VerifyLink(r) {
+		http.Error(w, "The link is invalid or has expired", http.StatusForbidden)
+		return
+	}
+
+	attachment := loadAttachment(w, r)
+
+	if attachment == nil {
+		return
+	}
+
+	width, _ := strconv.Atoi(r.PathValue("width"))
+	thumbnail := attachment.GetThumbnail(width)
+
+	if thumbnail == nil {
+		http.Error(w, "No such thumbnail", http.StatusNotFound)
+		return
+	}
+
+	serveFile(w, attachment, thumbnail.StorageKey, thumbnail.ContentType, thumbnail.Size)
+}
+
+// Streams a file of the attachment out of the storage
+func serveFile(w http.ResponseWriter, attachment *models.Attachment, key, contentType string, size int64) {
+	file, err := storage.Files.Get(key)
+
+	if err == storage.ErrNotFound {
+		http.Error(w, "No such attachment", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to read the file", http.StatusInternalServerError)
+		log.Printf("Failed to read file of attachment %s: %v", attachment.ID.Hex(), err)
+		return
+	}
+
+	defer file.Close()
+
+	content, stripped := stripMetadata(contentType, file)
+	defer content.Close()
+
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(transferTimeout))
+
+	// Images can be shown inline, everything else is downloaded
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+
+	// Stripping the metadata changes the size, so it's only known up front
+	// for files passed through as they are
+	if !stripped {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=900")
+
+	if _, err := io.Copy(w, content); err != nil {
+		log.Printf("Failed to send file of attachment %s: %v", attachment.ID.Hex(), err)
+	}
+}
@@ -0,0 +1,394 @@
+package attachments
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var errMalformedImage = errors.New("malformed image")
+
+/*
+ *	Returns the file with its metadata removed, for the formats that carry
+ *	any. Phones put the GPS position of every photo in there, which is not
+ *	something people mean to share along with the picture. JPEG and PNG are
+ *	filtered on the fly, WebP has its size up front so it is read in whole,
+ *	which the size limit on uploads keeps affordable. The second value is false
+ *	if the file is passed through as is, in which case its size is unchanged.
+ */
+func stripMetadata(contentType string, file io.Reader) (io.ReadCloser, bool) {
+	var strip func(w io.Writer, r *bufio.Reader) error
+
+	switch contentType {
+	case "image/jpeg":
+		strip = stripJPEG
+	case "image/png":
+		strip = stripPNG
+	case "image/webp":
+		strip = stripWebP
+	default:
+		return io.NopCloser(file), false
+	}
+
+	reader, writer := io.Pipe()
+
+	go func() {
+		writer.CloseWithError(strip(writer, bufio.NewReader(file)))
+	}()
+
+	return reader, true
+}
+
+/*
+ *	Copies a JPEG without its Exif, XMP, IPTC and comment segments. The one
+ *	piece of Exif worth keeping is the orientation, without it photos taken
+ *	with a rotated phone show up sideways, so it gets written back on its own.
+ */
+func stripJPEG(w io.Writer, r *bufio.Reader) error {
+	var header [2]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+
+	if header != [2]byte{0xFF, 0xD8} {
+		return errMalformedImage
+	}
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+
+	for {
+		marker, err := readJPEGMarker(r)
+
+		if err != nil {
+			return err
+		}
+
+		switch {
+		// End of image, anything after it is left behind too
+		case marker == 0xD9:
+			_, err := w.Write([]byte{0xFF, marker})
+			return err
+
+		// Markers without a segment
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x01:
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		segment, err := readJPEGSegment(r)
+
+		if err != nil {
+			return err
+		}
+
+		switch marker {
+		case 0xE1:
+			if orientation := exifOrientation(segment); orientation > 1 {
+				if err := writeJPEGSegment(w, 0xE1, orientationExif(orientation)); err != nil {
+					return err
+				}
+			}
+
+		case 0xED, 0xFE:
+			// IPTC and comments go
+
+		default:
+			if err := writeJPEGSegment(w, marker, segment); err != nil {
+				return err
+			}
+		}
+
+		// Start of scan, the compressed image data follows and there is no more
+		// metadata to look for
+		if marker == 0xDA {
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+}
+
+func readJPEGMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if b != 0xFF {
+		return 0, errMalformedImage
+	}
+
+	// Any number of 0xFF can pad the marker
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+
+	return b, nil
+}
+
+func readJPEGSegment(r *bufio.Reader) ([]byte, error) {
+	var length uint16
+
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	if length < 2 {
+		return nil, errMalformedImage
+	}
+
+	segment := make([]byte, length-2)
+
+	if _, err := io.ReadFull(r, segment); err != nil {
+		return nil, err
+	}
+
+	return segment, nil
+}
+
+func writeJPEGSegment(w io.Writer, marker byte, segment []byte) error {
+	header := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(segment)
+	return err
+}
+
+/*
+ *	Reads the orientation out of an Exif segment, from 1 to 8. Returns 0 if
+ *	the segment isn't Exif or has no orientation.
+ */
+func exifOrientation(segment []byte) int {
+	if !bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+		return 0
+	}
+
+	tiff := segment[6:]
+
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+
+		if entry+12 > len(tiff) {
+			return 0
+		}
+
+		// The orientation tag, stored as a SHORT
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+
+			return 0
+		}
+	}
+
+	return 0
+}
+
+// An Exif segment holding nothing but the orientation
+func orientationExif(orientation int) []byte {
+	segment := []byte("Exif\x00\x00MM\x00\x2A\x00\x00\x00\x08")
+
+	entry := make([]byte, 2+12+4)
+	binary.BigEndian.PutUint16(entry[0:], 1)      // one entry
+	binary.BigEndian.PutUint16(entry[2:], 0x0112) // orientation
+	binary.BigEndian.PutUint16(entry[4:], 3)      // SHORT
+	binary.BigEndian.PutUint32(entry[6:], 1)      // one value
+	binary.BigEndian.PutUint16(entry[10:], uint16(orientation))
+
+	// The offset of the next directory stays zero, there is none
+	return append(segment, entry...)
+}
+
+// Finds the orientation in the Exif of a JPEG held in memory, 0 if it has none
+func jpegOrientation(data []byte) int {
+	r := bufio.NewReader(bytes.NewReader(data))
+
+	if _, err := r.Discard(2); err != nil {
+		return 0
+	}
+
+	for {
+		marker, err := readJPEGMarker(r)
+
+		if err != nil || marker == 0xDA || marker == 0xD9 {
+			return 0
+		}
+
+		if marker >= 0xD0 && marker <= 0xD7 || marker == 0x01 {
+			continue
+		}
+
+		segment, err := readJPEGSegment(r)
+
+		if err != nil {
+			return 0
+		}
+
+		if marker == 0xE1 {
+			if orientation := exifOrientation(segment); orientation != 0 {
+				return orientation
+			}
+		}
+	}
+}
+
+// PNG chunks that only carry metadata
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// Copies a PNG without its metadata chunks
+func stripPNG(w io.Writer, r *bufio.Reader) error {
+	signature := make([]byte, 8)
+
+	if _, err := io.ReadFull(r, signature); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(signature, []byte("\x89PNG\r\n\x1a\n")) {
+		return errMalformedImage
+	}
+
+	if _, err := w.Write(signature); err != nil {
+		return err
+	}
+
+	for {
+		header := make([]byte, 8)
+
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+
+		// The data is followed by a 4 byte checksum
+		length := int64(binary.BigEndian.Uint32(header)) + 4
+		chunkType := string(header[4:])
+
+		if pngMetadataChunks[chunkType] {
+			if _, err := io.CopyN(io.Discard, r, length); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+
+		if _, err := io.CopyN(w, r, length); err != nil {
+			return err
+		}
+
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
+
+/*
+ *	Copies a WebP without its EXIF and XMP chunks. The RIFF header holds the
+ *	size of everything after it, so the whole file is read in first.
+ */
+func stripWebP(w io.Writer, r *bufio.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(r, MaxAttachmentSize+1))
+
+	if err != nil {
+		return err
+	}
+
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return errMalformedImage
+	}
+
+	stripped := []byte("WEBP")
+
+	for offset := 12; offset < len(data); {
+		if offset+8 > len(data) {
+			return errMalformedImage
+		}
+
+		chunkType := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+
+		// Chunks are padded to an even size
+		end := offset + 8 + size + size%2
+
+		if size < 0 || end > len(data) {
+			return errMalformedImage
+		}
+
+		chunk := data[offset:end]
+		offset = end
+
+		switch chunkType {
+		case "EXIF", "XMP ":
+			continue
+
+		case "VP8X":
+			if size < 1 {
+				return errMalformedImage
+			}
+
+			// Clear the flags announcing the chunks we dropped
+			chunk = append([]byte{}, chunk...)
+			chunk[8] &^= 0x08 | 0x04
+		}
+
+		stripped = append(stripped, chunk...)
+	}
+
+	header := []byte("RIFF\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(stripped)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err = w.Write(stripped)
+	return err
+}
@@ -0,0 +1,340 @@
+package attachments
+
+import (
+	"bytes"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/storage"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/image/draw"
+
+	// Formats image.Decode understands on top of JPEG and PNG
+	_ "golang.org/x/image/webp"
+	_ "image/gif"
+)
+
+const (
+	// Images with more pixels than this are not decoded, so a small file that
+	// decompresses into a huge image can't take the server down
+	maxThumbnailSourcePixels = 50_000_000
+
+	thumbnailJPEGQuality = 80
+
+	// Uploads waiting for their thumbnails, past this they don't get any
+	thumbnailQueueSize = 256
+)
+
+// The widths thumbnails are made in. Images narrower than that aren't scaled up.
+var ThumbnailWidths = []int{320, 960}
+
+var thumbnailContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+var errImageTooLarge = errors.New("image has too many pixels")
+
+// Workers making thumbnails in the background, so uploads don't wait for them
+type ThumbnailPool struct {
+	jobs    chan primitive.ObjectID
+	workers sync.WaitGroup
+
+	// Guards against queueing after Stop
+	lock    sync.Mutex
+	stopped bool
+}
+
+// The running pool, nil until StartThumbnailWorkers is called
+var thumbnails *ThumbnailPool
+
+/*
+ *	Starts the workers that make thumbnails of uploaded images. Until this is
+ *	called, uploads simply get no thumbnails.
+ */
+func StartThumbnailWorkers(count int) *ThumbnailPool {
+	pool := &ThumbnailPool{jobs: make(chan primitive.ObjectID, thumbnailQueueSize)}
+
+	for i := 0; i < count; i++ {
+		pool.workers.Add(1)
+		go pool.work()
+	}
+
+	thumbnails = pool
+
+	return pool
+}
+
+// Stops taking new images and waits for the queued ones to be done
+func (pool *ThumbnailPool) Stop() {
+	pool.lock.Lock()
+	if !pool.stopped {
+		pool.stopped = true
+		close(pool.jobs)
+	}
+	pool.lock.Unlock()
+
+	pool.workers.Wait()
+}
+
+// Queues the attachment, returning false if the pool is stopped or full
+func (pool *ThumbnailPool) enqueue(id primitive.ObjectID) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if pool.stopped {
+		return false
+	}
+
+	select {
+	case pool.jobs <- id:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pool *ThumbnailPool) work() {
+	defer pool.workers.Done()
+
+	for id := range pool.jobs {
+		status := models.ThumbnailsReady
+		made, err := makeThumbnails(id)
+
+		if err != nil {
+			log.Printf("Failed to make thumbnails of attachment %s: %v", id.Hex(), err)
+			status = models.ThumbnailsFailed
+		}
+
+		if err := db.Client.SetThumbnails(id, status, made); err != nil {
+			log.Printf("Failed to store thumbnails of attachment %s: %v", id.Hex(), err)
+		}
+	}
+}
+
+func thumbnailKey(id primitive.ObjectID, width int) string {
+	return fmt.Sprintf("thumbnails/%s-%d", id.Hex(), width)
+}
+
+/*
+ *	Makes the thumbnails of an image attachment. They are encoded from scratch,
+ *	so none of the metadata of the original makes it into them, but the Exif
+ *	orientation of JPEGs is applied first so they come out the right way up.
+ */
+func makeThumbnails(id primitive.ObjectID) ([]models.Thumbnail, error) {
+	attachment, err := db.Client.GetAttachment(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := storage.Files.Get(attachment.StorageKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, MaxAttachmentSize+1))
+	file.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return nil, errImageTooLarge
+	}
+
+	source, _, err := image.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = max(jpegOrientation(data), 1)
+	}
+
+	// Orientations from 5 up swap the width and the height
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if orientation >= 5 {
+		width, height = height, width
+	}
+
+	made := []models.Thumbnail{}
+
+	for _, maxWidth := range ThumbnailWidths {
+		thumbWidth, thumbHeight := width, height
+
+		if width > maxWidth {
+			thumbWidth = maxWidth
+			thumbHeight = max(1, (height*maxWidth+width/2)/width)
+		}
+
+		// Small images end up the same size for every width
+		if len(made) > 0 && made[len(made)-1].Width == thumbWidth {
+			continue
+		}
+
+		scaledWidth, scaledHeight := thumbWidth, thumbHeight
+		if orientation >= 5 {
+			scaledWidth, scaledHeight = thumbHeight, thumbWidth
+		}
+
+		scaled := image.NewRGBA(image.Rect(0, 0, scaledWidth, scaledHeight))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), source, bounds, draw.Src, nil)
+
+		thumbnail, err := storeThumbnail(id, orient(scaled, orientation))
+
+		if err != nil {
+			return nil, err
+		}
+
+		made = append(made, thumbnail)
+	}
+
+	return made, nil
+}
+
+// Encodes the thumbnail, as a JPEG unless it needs the transparency of a PNG
+func storeThumbnail(id primitive.ObjectID, img *image.RGBA) (models.Thumbnail, error) {
+	var buffer bytes.Buffer
+	var err error
+
+	contentType := "image/jpeg"
+
+	if img.Opaque() {
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	} else {
+		contentType = "image/png"
+		err = png.Encode(&buffer, img)
+	}
+
+	if err != nil {
+		return models.Thumbnail{}, err
+	}
+
+	thumbnail := models.Thumbnail{
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+		ContentType: contentType,
+		Size:        int64(buffer.Len()),
+		StorageKey:  thumbnailKey(id, img.Bounds().Dx()),
+	}
+
+	if err := storage.Files.Put(thumbnail.StorageKey, &buffer, thumbnail.Size, contentType); err != nil {
+		return models.Thumbnail{}, err
+	}
+
+	return thumbnail, nil
+}
+
+// Turns the image the way the Exif orientation says it has to be shown
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = width-1-x, y
+			case 3: // upside down
+				dx, dy = width-1-x, height-1-y
+			case 4: // upside down and mirrored
+				dx, dy = x, height-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated a quarter clockwise
+				dx, dy = height-1-y, x
+			case 7: // transversed
+				dx, dy = height-1-y, width-1-x
+			case 8: // rotated a quarter counterclockwise
+				dx, dy = y, width-1-x
+			}
+
+			from := src.PixOffset(x, y)
+			to := dst.PixOffset(dx, dy)
+			copy(dst.Pix[to:to+4], src.Pix[from:from+4])
+		}
+	}
+
+	return dst
+}
+
+// Whether thumbnails will be made for the attachment once it's stored
+func getsThumbnails(attachment *models.Attachment) bool {
+	return thumbnails != nil && thumbnailContentTypes[attachment.ContentType]
+}
+
+/*
+ *	Queues a stored attachment for thumbnails. Its status has to be pending
+ *	already, the workers can get to it before this even returns.
+ */
+func queueThumbnails(attachment *models.Attachment) {
+	if thumbnails.enqueue(attachment.ID) {
+		return
+	}
+
+	log.Printf("Thumbnail queue is unavailable, attachment %s gets no thumbnails", attachment.ID.Hex())
+	attachment.ThumbnailStatus = models.ThumbnailsFailed
+
+	if err := db.Client.SetThumbnails(attachment.ID, attachment.ThumbnailStatus, nil); err != nil {
+		log.Printf("Failed to update thumbnail status of attachment %s: %v", attachment.ID.Hex(), err)
+	}
+}
+
+/*
+ *	Deletes an attachment along with its file and thumbnails. Used once the
+ *	message it was attached to is deleted.
+ */
+func Remove(id primitive.ObjectID) error {
+	attachment, err := db.Client.GetAttachment(id)
+
+	if err != nil {
+		return err
+	}
+
+	keys := []string{attachment.StorageKey}
+	for _, thumbnail := range attachment.Thumbnails {
+		keys = append(keys, thumbnail.StorageKey)
+	}
+
+	for _, key := range keys {
+		if err := storage.Files.Delete(key); err != nil && err != storage.ErrNotFound {
+			return err
+		}
+	}
+
+	return db.Client.DeleteAttachment(id)
+}
@@ -1,43 +1,82 @@
 package auth
 
 import (
-	"chat-module/util"
+	"chat-module/config"
+	"chat-module/db"
+	"chat-module/models"
+	"errors"
 	"fmt"
-	"os"
+	"log"
+	"net/http"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func loadJwtKey() []byte {
-	err := util.LoadEnvFile()
+// The key tokens are signed with, set by Init
+var jwtKey []byte
 
-	if err != nil {
-		return []byte{}
-	} else {
-		return []byte(os.Getenv("jwtKey"))
-	}
+// Sets up signing tokens and links with the configured key
+func Init(cfg config.Auth) {
+	jwtKey = []byte(cfg.JWTKey)
+	linkKey = hmacSHA256(jwtKey, "signed-links")
 }
 
-var jwtKey = loadJwtKey()
+const (
+	// The issuer we put in every token and expect back on validation
+	TokenIssuer = "react-go-chat-app"
+
+	// The audience the tokens are meant for, the chat clients
+	TokenAudience = "react-go-chat-client"
+
+	// How long a freshly generated token stays valid
+	TokenLifetime = time.Hour * 5
+
+	// Allowed clock skew between us and whoever is presenting the token
+	TokenLeeway = time.Second * 30
+
+	// How often the last activity of a session gets written back to the database
+	sessionTouchInterval = time.Minute
+)
+
+// Only the algorithms listed here are accepted, anything else (including "none")
+// is rejected before the signature is even looked at.
+var validSigningMethods = []string{jwt.SigningMethodHS256.Alg()}
+
+var (
+	// The token was fine, but its lifetime has run out. Clients should log in again.
+	ErrTokenExpired = errors.New("token has expired")
+
+	// The token is malformed, forged, or was not meant for us.
+	ErrTokenInvalid = errors.New("invalid token")
+)
 
 type Claims struct {
-	username string `json:"username"`
+	Username string      `json:"username"`
+	Role     models.Role `json:"role"`
 	jwt.RegisteredClaims
 }
 
-func GenerateJWTToken(username string) (string, error) {
-	// Set the expiration time for the token
-	expirationTime := time.Now().Add(time.Hour * 5)
-
+/*
+ *	Generates the token for a session. The session ID becomes the token ID, and
+ *	the token lives exactly as long as the session does. The role is the one the
+ *	user had when logging in, so role changes take effect on the next login.
+ */
+func GenerateJWTToken(session *models.Session) (string, error) {
 	// Create the JWT claims, which includes the username and expiry time
 	claims := &Claims{
-		username: username,
+		Username: session.Username,
+		Role:     session.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    "react-go-chat-app",
-			Subject:   username,
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			ID:        session.ID.Hex(),
+			Issuer:    TokenIssuer,
+			Subject:   session.Username,
+			Audience:  jwt.ClaimStrings{TokenAudience},
+			IssuedAt:  jwt.NewNumericDate(session.CreatedAt),
+			NotBefore: jwt.NewNumericDate(session.CreatedAt),
+			ExpiresAt: jwt.NewNumericDate(session.ExpiresAt),
 		},
 	}
 
@@ -53,23 +92,101 @@ func GenerateJWTToken(username string) (string, error) {
 	return tokenString, nil
 }
 
+/*
+ *	Parses and validates a token, and checks that the session it belongs to
+ *	hasn't been revoked. On failure the returned error wraps either
+ *	ErrTokenExpired or ErrTokenInvalid, so callers can use errors.Is to tell
+ *	the two apart. Any other error means we failed to look up the session.
+ */
 func ValidateJWT(tokenString string) (*Claims, error) {
 	// Parse the token
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		return jwtKey, nil
-	})
+	},
+		jwt.WithValidMethods(validSigningMethods),
+		jwt.WithIssuer(TokenIssuer),
+		jwt.WithAudience(TokenAudience),
+		jwt.WithLeeway(TokenLeeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
 
 	if err != nil {
-		if err == jwt.ErrSignatureInvalid {
-			return nil, fmt.Errorf("invalid token signature")
+		// The signature gets verified before the claims, so an expired error
+		// means that the token itself is genuine.
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, ErrTokenExpired
 		}
-		return nil, fmt.Errorf("error parsing token")
+
+		if errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			return nil, fmt.Errorf("%w: invalid token signature", ErrTokenInvalid)
+		}
+
+		return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
 	}
 
-	if !token.Valid {
-		return nil, fmt.Errorf("invalid token")
+	if !token.Valid || claims.Subject == "" || claims.Username != claims.Subject || !claims.Role.IsValid() {
+		return nil, ErrTokenInvalid
+	}
+
+	err = checkSession(claims)
+
+	if err != nil {
+		return nil, err
 	}
 
 	return claims, nil
 }
+
+func checkSession(claims *Claims) error {
+	sessionID, err := primitive.ObjectIDFromHex(claims.ID)
+
+	if err != nil {
+		return fmt.Errorf("%w: malformed token ID", ErrTokenInvalid)
+	}
+
+	session, err := db.Client.GetSession(sessionID)
+
+	if err == mongo.ErrNoDocuments {
+		return fmt.Errorf("%w: unknown session", ErrTokenInvalid)
+	} else if err != nil {
+		return fmt.Errorf("failed to look up session: %v", err)
+	}
+
+	if session.Revoked || session.Username != claims.Username {
+		return fmt.Errorf("%w: session has been revoked", ErrTokenInvalid)
+	}
+
+	// Keep track of the activity, but don't hit the database on every request
+	now := time.Now()
+	if now.Sub(session.LastActivity) > sessionTouchInterval {
+		if err := db.Client.TouchSession(sessionID, now); err != nil {
+			log.Printf("Failed to update activity of session %s: %v", claims.ID, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+ *	Writes the appropriate response for an error returned by ValidateJWT.
+ *	Both token errors are a 401, but the WWW-Authenticate header tells the client
+ *	whether it simply needs a fresh token or whether the token is no good at all.
+ */
+func WriteTokenError(w http.ResponseWriter, err error) {
+	if !errors.Is(err, ErrTokenExpired) && !errors.Is(err, ErrTokenInvalid) {
+		http.Error(w, "Failed to validate token", http.StatusInternalServerError)
+		log.Printf("Failed to validate token: %v", err)
+		return
+	}
+
+	if errors.Is(err, ErrTokenExpired) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="token expired"`)
+		http.Error(w, ErrTokenExpired.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	http.Error(w, ErrTokenInvalid.Error(), http.StatusUnauthorized)
+}
@@ -5,9 +5,11 @@ import (
 	"chat-module/models"
 	"chat-module/util"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -17,12 +19,56 @@ import (
 /*
  *	TODO:
  *  - Make the handlers take a Repo interface for the db operations
- *	- Implemente black-listing of jwt tokens
  *	- add a way to extend the jwt token if a user is nearing his expiration date, but there is still activity going on,
  *    so we don't force him to relogin (figure this out in a safe way, could be dangerous if a malicious user got his hand on
 	  the token of another person)
 */
 
+// Returned by CreateUser when the username or the email is taken
+var ErrUserExists = errors.New("user with this email or username already exists")
+
+/*
+ *	Creates an user with the given role, hashing the password. Returns
+ *	ErrUserExists if the username or the email is taken, and
+ *	bcrypt.ErrPasswordTooLong if the password can't be hashed.
+ */
+func CreateUser(username, email, password string, role models.Role) (*models.User, error) {
+	exists, err := db.Client.CheckUserExists(username, email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		return nil, ErrUserExists
+	}
+
+	// TODO:
+	// We expect the email and password validation to have been done on the front end part
+	// Still, do some validation here
+	hashedPassword, err := util.HashPassword(password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	user := models.User{
+		ID:        primitive.NewObjectID(),
+		Username:  &username,
+		Email:     &email,
+		Password:  &hashedPassword,
+		Role:      role,
+		CreatedAt: time.Now(),
+	}
+	user.UpdatedAt = user.CreatedAt
+
+	if err := db.Client.AddUser(user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
@@ -42,55 +88,36 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Unmarshal the JSON data into a User struct
-	var user models.User
-	if err := json.Unmarshal(body, &user); err != nil {
+	type RegisterUser struct {
+		Username *string `json:"username"`
+		Password *string `json:"password"`
+		Email    *string `json:"email"`
+	}
+
+	// Unmarshal the JSON data into a RegisterUser struct
+	var registerUser RegisterUser
+	if err := json.Unmarshal(body, &registerUser); err != nil {
 		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
 		return
 	}
 
-	if user.Email == nil || user.Password == nil || user.Username == nil {
+	if registerUser.Email == nil || registerUser.Password == nil || registerUser.Username == nil {
 		http.Error(w, "Missing required fields", http.StatusBadRequest)
 		return
 	}
 
-	exists, err := db.Client.CheckUserExists(*user.Username, *user.Email)
+	_, err = CreateUser(*registerUser.Username, *registerUser.Email, *registerUser.Password, models.RoleUser)
 
-	if err != nil {
-		http.Error(w, "Failed to query database", http.StatusInternalServerError)
-		log.Printf("Failed to query database for user %s: %v", *user.Username, err)
-		return
-	}
-
-	if exists {
+	if err == ErrUserExists {
 		http.Error(w, "User with this email/username already exists.", http.StatusBadRequest)
 		return
-	}
-
-	// TODO:
-	// We expect the email and password validation to have been done on the front end part
-	// Still, do some validation here
-	user.ID = primitive.NewObjectID()
-
-	// Hash and salt the password
-	hashedPassword, err := util.HashPassword(*user.Password)
-
-	if err == bcrypt.ErrPasswordTooLong {
+	} else if err == bcrypt.ErrPasswordTooLong {
 		http.Error(w, "Password exceeds 72 characters", http.StatusBadRequest)
 		return
 	} else if err != nil {
-		http.Error(w, "Something went wrong with hashing the password", http.StatusInternalServerError)
-		log.Printf("Failed to hash password: %v", err)
-		return
-	}
-
-	user.Password = &hashedPassword
-
-	err = db.Client.AddUser(user)
-
-	if err != nil {
 		http.Error(w, "Failed to register user to the database", http.StatusInternalServerError)
-		log.Printf("Failed to insert user %s to the database: %v", *user.Username, err)
+		log.Printf("Failed to register user %s: %v", *registerUser.Username, err)
+		return
 	}
 
 	// Send a success response
@@ -160,8 +187,18 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// We have logged in, generate a JWT token for this user and send it back
-	token, err := GenerateJWTToken(*user.Username)
+	if user.Suspended {
+		http.Error(w, "This account has been suspended", http.StatusForbidden)
+		return
+	}
+
+	if user.PasswordReset != nil {
+		http.Error(w, "A password reset is required for this account", http.StatusForbidden)
+		return
+	}
+
+	// We have logged in, start a session and send back the JWT token for it
+	token, _, err := CreateSession(user, r)
 
 	if err != nil {
 		http.Error(w, "Failed to generate session token", http.StatusInternalServerError)
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"chat-module/models"
+	"chat-module/util"
+	"context"
+	"net/http"
+)
+
+type contextKey int
+
+const claimsContextKey contextKey = iota
+
+/*
+ *	Middleware that only lets requests with a valid token through. The claims of
+ *	the token are stored in the request context and can be retrieved by the
+ *	handler with GetClaims.
+ */
+func RequireAuth(callback func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := util.GetAuthHeader(r)
+
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := ValidateJWT(token)
+
+		if err != nil {
+			WriteTokenError(w, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		callback(w, r.WithContext(ctx))
+	}
+}
+
+// Returns the claims stored by RequireAuth, or nil if the request didn't go through it
+func GetClaims(r *http.Request) *Claims {
+	claims, _ := r.Context().Value(claimsContextKey).(*Claims)
+	return claims
+}
+
+/*
+ *	Middleware that only lets through requests with a valid token whose role
+ *	grants the given permission. Implies RequireAuth.
+ */
+func RequirePermission(permission models.Permission, callback func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !GetClaims(r).Role.HasPermission(permission) {
+			http.Error(w, "You don't have permission to do this", http.StatusForbidden)
+			return
+		}
+
+		callback(w, r)
+	})
+}
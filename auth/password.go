@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/util"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// How long the token handed out by ForcePasswordReset can be used
+const PasswordResetLifetime = time.Hour * 24
+
+/*
+ *	Forces the user to pick a new password. Signs them out everywhere, blocks
+ *	logging in until the password is changed, and returns the one time token
+ *	they need to change it. Returns mongo.ErrNoDocuments if there is no such user.
+ */
+func ForcePasswordReset(username string) (string, error) {
+	token, err := util.GenerateRandomToken(32)
+
+	if err != nil {
+		return "", err
+	}
+
+	reset := &models.PasswordReset{
+		TokenHash: util.HashToken(token),
+		ExpiresAt: time.Now().Add(PasswordResetLifetime),
+	}
+
+	if err := db.Client.SetPasswordReset(username, reset); err != nil {
+		return "", err
+	}
+
+	if err := RevokeUserSessions(username); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+/*
+ *	POST /reset-password
+ *
+ *	Sets a new password using the token from a forced password reset.
+ */
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Username *string `json:"username"`
+		Token    *string `json:"token"`
+		Password *string `json:"password"`
+	}
+
+	if err := util.ReadJSON(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Username == nil || request.Token == nil || request.Password == nil {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	user, err := db.Client.GetUser(*request.Username)
+
+	if err != nil && err != mongo.ErrNoDocuments {
+		http.Error(w, "Failed to find document", http.StatusInternalServerError)
+		log.Printf("Failed to find document for user %s: %v", *request.Username, err)
+		return
+	}
+
+	// Whatever the reason, the answer is the same so we don't leak which accounts exist
+	if err == mongo.ErrNoDocuments || user.PasswordReset == nil ||
+		time.Now().After(user.PasswordReset.ExpiresAt) ||
+		subtle.ConstantTimeCompare([]byte(util.HashToken(*request.Token)), []byte(user.PasswordReset.TokenHash)) != 1 {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := util.HashPassword(*request.Password)
+
+	if err == bcrypt.ErrPasswordTooLong {
+		http.Error(w, "Password exceeds 72 characters", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Something went wrong with hashing the password", http.StatusInternalServerError)
+		log.Printf("Failed to hash password: %v", err)
+		return
+	}
+
+	if err := db.Client.UpdatePassword(*user.Username, hashedPassword); err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		log.Printf("Failed to update password of user %s: %v", *user.Username, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Password updated successfully"))
+}
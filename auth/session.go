@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/supervisor"
+	"chat-module/util"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// Longest user agent we are willing to store for a session
+	maxUserAgentLength = 256
+
+	// How often revoked and expired sessions are cleaned up
+	SessionCleanupInterval = time.Hour
+)
+
+/*
+ *	Background job that deletes the sessions nobody can use anymore, so
+ *	they don't pile up. Expired ones would go away in MongoDB on their own,
+ *	revoked ones wouldn't until they expire.
+ */
+var SessionJanitor = supervisor.Every(SessionCleanupInterval, func(ctx context.Context) {
+	deleted, err := db.Client.DeleteStaleSessions(time.Now())
+
+	if err != nil {
+		log.Printf("Failed to delete stale sessions: %v", err)
+		return
+	}
+
+	if deleted > 0 {
+		log.Printf("Deleted %d stale sessions", deleted)
+	}
+})
+
+var (
+	revokeListenersMu  sync.Mutex
+	revokeListeners    = make(map[int]func(username, sessionID string))
+	nextRevokeListener int
+)
+
+/*
+ *	Registers a function called whenever sessions are revoked, so whatever
+ *	they have connected can be cut off. An empty session ID means every
+ *	session of the user was revoked. Returns a function that unregisters it
+ *	again.
+ */
+func OnRevoke(listener func(username, sessionID string)) func() {
+	revokeListenersMu.Lock()
+	defer revokeListenersMu.Unlock()
+
+	id := nextRevokeListener
+	nextRevokeListener++
+	revokeListeners[id] = listener
+
+	return func() {
+		revokeListenersMu.Lock()
+		defer revokeListenersMu.Unlock()
+
+		delete(revokeListeners, id)
+	}
+}
+
+func notifyRevoked(username, sessionID string) {
+	revokeListenersMu.Lock()
+	listeners := make([]func(username, sessionID string), 0, len(revokeListeners))
+	for _, listener := range revokeListeners {
+		listeners = append(listeners, listener)
+	}
+	revokeListenersMu.Unlock()
+
+	for _, listener := range listeners {
+		listener(username, sessionID)
+	}
+}
+
+// Revokes every session of the user, signing them out everywhere
+func RevokeUserSessions(username string) error {
+	if err := db.Client.RevokeUserSessions(username); err != nil {
+		return err
+	}
+
+	notifyRevoked(username, "")
+	return nil
+}
+
+/*
+ *	Records a new session for the user making the request and returns the token
+ *	that belongs to it.
+ */
+func CreateSession(user *models.User, r *http.Request) (string, *models.Session, error) {
+	now := time.Now()
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	session := models.Session{
+		ID:           primitive.NewObjectID(),
+		Username:     *user.Username,
+		Role:         user.GetRole(),
+		UserAgent:    userAgent,
+		IP:           ip,
+		CreatedAt:    now,
+		LastActivity: now,
+		ExpiresAt:    now.Add(TokenLifetime),
+	}
+
+	err = db.Client.AddSession(session)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := GenerateJWTToken(&session)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, &session, nil
+}
+
+/*
+ *	GET /api/sessions
+ *
+ *	Lists the active sessions of the logged in user. The session the request
+ *	was made with is marked as current.
+ */
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := GetClaims(r)
+
+	sessions, err := db.Client.GetUserSessions(claims.Username)
+
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to get sessions of user %s: %v", claims.Username, err)
+		return
+	}
+
+	type sessionResponse struct {
+		models.Session
+		Current bool `json:"current"`
+	}
+
+	response := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, sessionResponse{
+			Session: session,
+			Current: session.ID.Hex() == claims.ID,
+		})
+	}
+
+	util.WriteJSON(w, http.StatusOK, response)
+}
+
+/*
+ *	DELETE /api/sessions/{id}
+ *
+ *	Revokes one of the sessions of the logged in user, signing out that device.
+ *	Revoking the current session is the same as logging out.
+ */
+func SessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := GetClaims(r)
+
+	sessionID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	err = db.Client.RevokeSession(claims.Username, sessionID)
+
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		log.Printf("Failed to revoke session %s of user %s: %v", sessionID.Hex(), claims.Username, err)
+		return
+	}
+
+	notifyRevoked(claims.Username, sessionID.Hex())
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,59 @@
+package bus
+
+import (
+	"chat-module/config"
+	"chat-module/db"
+	"errors"
+	"fmt"
+)
+
+// Returned by Publish and Subscribe once the bus is closed
+var ErrClosed = errors.New("bus is closed")
+
+// Called with every message published to the topic subscribed to
+type Handler func(data []byte)
+
+/*
+ *	Carries messages between the instances of the server, so something that
+ *	happens on one of them reaches the users connected to the others.
+ *
+ *	Every subscriber of a topic gets the messages published to it in the order
+ *	they were published, the publisher's own subscriptions included. Handlers
+ *	of one subscription are called one at a time and shouldn't block for long.
+ *	Delivery is best effort, a message can get lost when an instance falls
+ *	behind or loses its connection.
+ */
+type Bus interface {
+	Publish(topic string, data []byte) error
+
+	// Returns a function that ends the subscription
+	Subscribe(topic string, handler Handler) (func(), error)
+
+	Close() error
+}
+
+/*
+ *	Sets up the bus picked in the configuration. The default is "memory",
+ *	which only reaches this process and is all a single instance needs.
+ *	"mongo" goes through the database the server already uses, so instances
+ *	sharing it can reach each other. That needs change streams, which MongoDB
+ *	only has on replica sets.
+ */
+func Init(cfg config.Bus) (Bus, error) {
+	switch cfg.Backend {
+	case "", "memory":
+		return NewMemoryBus(), nil
+
+	case "mongo":
+		repo, ok := db.Client.(*db.MongoRepo)
+
+		if !ok {
+			return nil, fmt.Errorf("the mongo bus needs the database to be MongoDB")
+		}
+
+		return NewMongoBus(repo.Database().Collection(cfg.Collection))
+
+	default:
+		return nil, fmt.Errorf("unknown bus backend %q", cfg.Backend)
+	}
+}
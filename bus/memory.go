@@ -0,0 +1,119 @@
+package bus
+
+import (
+	"sync"
+)
+
+// How many messages a subscription can fall behind before publishing waits for it
+const memoryQueueSize = 1024
+
+type memorySubscription struct {
+	handler Handler
+	queue   chan []byte
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (subscription *memorySubscription) stop() {
+	subscription.once.Do(func() { close(subscription.done) })
+}
+
+func (subscription *memorySubscription) run() {
+	for {
+		select {
+		case data := <-subscription.queue:
+			subscription.handler(data)
+		case <-subscription.done:
+			return
+		}
+	}
+}
+
+/*
+ *	Bus within a single process. Several hubs sharing one behave like instances
+ *	of the server on different machines, which is how the tests run them.
+ */
+type MemoryBus struct {
+	lock          sync.RWMutex
+	subscriptions map[string]map[*memorySubscription]bool
+	closed        bool
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{subscriptions: make(map[string]map[*memorySubscription]bool)}
+}
+
+func (bus *MemoryBus) Publish(topic string, data []byte) error {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+
+	if bus.closed {
+		return ErrClosed
+	}
+
+	// Subscribers get their own copy, so nobody can change it under anybody else
+	for subscription := range bus.subscriptions[topic] {
+		message := append([]byte(nil), data...)
+
+		select {
+		case subscription.queue <- message:
+		case <-subscription.done:
+		}
+	}
+
+	return nil
+}
+
+func (bus *MemoryBus) Subscribe(topic string, handler Handler) (func(), error) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.closed {
+		return nil, ErrClosed
+	}
+
+	subscription := &memorySubscription{
+		handler: handler,
+		queue:   make(chan []byte, memoryQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	if bus.subscriptions[topic] == nil {
+		bus.subscriptions[topic] = make(map[*memorySubscription]bool)
+	}
+
+	bus.subscriptions[topic][subscription] = true
+	go subscription.run()
+
+	unsubscribe := func() {
+		// Stopped first, so a publisher waiting on the queue gives up
+		subscription.stop()
+
+		bus.lock.Lock()
+		delete(bus.subscriptions[topic], subscription)
+		bus.lock.Unlock()
+	}
+
+	return unsubscribe, nil
+}
+
+func (bus *MemoryBus) Close() error {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if bus.closed {
+		return nil
+	}
+
+	bus.closed = true
+
+	for _, subscriptions := range bus.subscriptions {
+		for subscription := range subscriptions {
+			subscription.stop()
+		}
+	}
+
+	bus.subscriptions = nil
+
+	return nil
+}
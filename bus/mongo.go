@@ -0,0 +1,197 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// How long published messages stay in the collection. Subscribers read them
+	// from the change stream as they come in, this only keeps the collection
+	// from growing forever.
+	mongoMessageLifetime = time.Minute
+
+	// Longest wait before reopening a change stream that failed
+	maxReconnectDelay = time.Second * 30
+)
+
+// Server errors after which a change stream can't be resumed where it left off
+const (
+	errorInvalidResumeToken       = 260
+	errorChangeStreamFatal        = 280
+	errorChangeStreamHistoryLost  = 286
+	labelNonResumableChangeStream = "NonResumableChangeStreamError"
+)
+
+type mongoMessage struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Topic     string             `bson:"topic"`
+	Data      []byte             `bson:"data"`
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+/*
+ *	Bus on top of a MongoDB collection. Publishing inserts a document and every
+ *	subscriber follows the inserts through a change stream. A stream that
+ *	breaks is resumed where it left off, as long as the oplog still goes back
+ *	that far. If it doesn't, the stream starts over from the current messages
+ *	and whatever was published in between is lost.
+ */
+type MongoBus struct {
+	collection *mongo.Collection
+
+	// Cancelled on Close, which ends every subscription
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewMongoBus(collection *mongo.Collection) (*MongoBus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"createdAt": 1},
+		Options: options.Index().
+			SetName("bus-expiry-index").
+			SetExpireAfterSeconds(int32(mongoMessageLifetime.Seconds())),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	bus := &MongoBus{collection: collection}
+	bus.ctx, bus.cancel = context.WithCancel(context.Background())
+
+	return bus, nil
+}
+
+func (bus *MongoBus) Publish(topic string, data []byte) error {
+	if bus.ctx.Err() != nil {
+		return ErrClosed
+	}
+
+	ctx, cancel := context.WithTimeout(bus.ctx, time.Second*5)
+	defer cancel()
+
+	_, err := bus.collection.InsertOne(ctx, mongoMessage{
+		ID:        primitive.NewObjectID(),
+		Topic:     topic,
+		Data:      data,
+		CreatedAt: time.Now(),
+	})
+
+	return err
+}
+
+func (bus *MongoBus) watch(ctx context.Context, topic string, resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"operationType": "insert", "fullDocument.topic": topic}}},
+	}
+
+	opts := options.ChangeStream()
+	if resumeToken != nil {
+		opts.SetResumeAfter(resumeToken)
+	}
+
+	return bus.collection.Watch(ctx, pipeline, opts)
+}
+
+/*
+ *	Opens the change stream right away, so everything published once this
+ *	returns reaches the handler.
+ */
+func (bus *MongoBus) Subscribe(topic string, handler Handler) (func(), error) {
+	if bus.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+
+	ctx, cancel := context.WithCancel(bus.ctx)
+	stream, err := bus.watch(ctx, topic, nil)
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go bus.follow(ctx, topic, stream, handler)
+
+	return cancel, nil
+}
+
+// Whether the stream can still be resumed with its token after the error
+func resumable(err error) bool {
+	var serverErr mongo.ServerError
+
+	if !errors.As(err, &serverErr) {
+		return true
+	}
+
+	return !serverErr.HasErrorLabel(labelNonResumableChangeStream) &&
+		!serverErr.HasErrorCode(errorInvalidResumeToken) &&
+		!serverErr.HasErrorCode(errorChangeStreamFatal) &&
+		!serverErr.HasErrorCode(errorChangeStreamHistoryLost)
+}
+
+// Passes the messages on to the handler until the context is cancelled
+func (bus *MongoBus) follow(ctx context.Context, topic string, stream *mongo.ChangeStream, handler Handler) {
+	delay := time.Second
+
+	for {
+		for stream.Next(ctx) {
+			var change struct {
+				FullDocument mongoMessage `bson:"fullDocument"`
+			}
+
+			if err := stream.Decode(&change); err != nil {
+				log.Printf("Failed to decode message on topic %s: %v", topic, err)
+				continue
+			}
+
+			delay = time.Second
+			handler(change.FullDocument.Data)
+		}
+
+		resumeToken := stream.ResumeToken()
+		err := stream.Err()
+		stream.Close(context.Background())
+
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Printf("Change stream of topic %s broke, reopening in %v: %v", topic, delay, err)
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+
+			delay = min(delay*2, maxReconnectDelay)
+
+			// Retrying with the same token would fail the same way forever
+			if resumeToken != nil && !resumable(err) {
+				log.Printf("Change stream of topic %s can't be resumed, messages published since it broke are lost: %v", topic, err)
+				resumeToken = nil
+			}
+
+			if stream, err = bus.watch(ctx, topic, resumeToken); err == nil {
+				break
+			}
+		}
+	}
+}
+
+func (bus *MongoBus) Close() error {
+	bus.cancel()
+	return nil
+}
@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"chat-module/attachments"
+	"chat-module/db"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Most attachments a single message can carry
+const MaxAttachmentsPerMessage = 10
+
+var errInvalidAttachment = &ClientError{http.StatusBadRequest, "invalid attachment"}
+
+/*
+ *	Checks that the sender uploaded every one of the attachments and hasn't
+ *	used them on another message yet. Repeats are dropped.
+ */
+func checkAttachments(username string, ids []string) ([]primitive.ObjectID, error) {
+	if len(ids) > MaxAttachmentsPerMessage {
+		return nil, &ClientError{http.StatusBadRequest, "too many attachments"}
+	}
+
+	checked := []primitive.ObjectID{}
+	seen := make(map[primitive.ObjectID]bool)
+
+	for _, value := range ids {
+		id, err := primitive.ObjectIDFromHex(value)
+
+		if err != nil {
+			return nil, errInvalidAttachment
+		}
+
+		if seen[id] {
+			continue
+		}
+
+		attachment, err := db.Client.GetAttachment(id)
+
+		if err == mongo.ErrNoDocuments || (err == nil && (attachment.Uploader != username || attachment.IsAttached())) {
+			return nil, errInvalidAttachment
+		} else if err != nil {
+			return nil, err
+		}
+
+		seen[id] = true
+		checked = append(checked, id)
+	}
+
+	return checked, nil
+}
+
+/*
+ *	Attaches the checked attachments to the stored message. Fails if another
+ *	message got to one of them first, which can only happen when the same user
+ *	sends two messages with it at once, and then none of them stay attached.
+ */
+func attach(username string, conversation, message primitive.ObjectID, ids []primitive.ObjectID) error {
+	for i, id := range ids {
+		err := db.Client.AttachToMessage(id, username, conversation, message)
+
+		if err == nil {
+			continue
+		}
+
+		for _, attached := range ids[:i] {
+			if err := db.Client.DetachFromMessage(attached, message); err != nil {
+				log.Printf("Failed to detach attachment %s from message %s: %v", attached.Hex(), message.Hex(), err)
+			}
+		}
+
+		if err == mongo.ErrNoDocuments {
+			return errInvalidAttachment
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Gets rid of the attachments of a deleted message, files included
+func removeAttachments(ids []primitive.ObjectID) {
+	for _, id := range ids {
+		if err := attachments.Remove(id); err != nil {
+			log.Printf("Failed to remove attachment %s of deleted message: %v", id.Hex(), err)
+		}
+	}
+}
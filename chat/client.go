@@ -0,0 +1,405 @@
+package chat
+
+import (
+	"chat-module/auth"
+	"chat-module/models"
+	"chat-module/util"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+
+	// Clients authenticate with a token rather than a cookie, so a page from
+	// another origin can't piggyback on the user's credentials.
+	CheckOrigin: func(r *http.Request) bool { return true },
+
+	Subprotocols: []string{SubprotocolCBOR, SubprotocolJSON},
+}
+
+/*
+ *	A single connection of an user, which is a socket unless it is the stream
+ *	session of an event stream or long-polling client.
+ */
+type Client struct {
+	hub       *Hub
+	conn      *websocket.Conn
+	username  string
+	role      models.Role
+	sessionID string
+
+	// Outbound events, only ever closed by the hub
+	send chan *Event
+
+	// Set by the hub when events were dropped from the queue, so the write
+	// pump sends a resync event first
+	lost atomic.Bool
+
+	// Queue metrics. Sent is counted by the write pump, the rest only ever
+	// touched from the Run loop.
+	connectedAt time.Time
+	peakQueued  int
+	dropped     int64
+	sent        atomic.Int64
+
+	// Whether the socket speaks CBOR instead of JSON
+	binary bool
+
+	// What the close frame says once the hub lets go of the client. Set by
+	// the hub before it closes send.
+	closeMessage []byte
+
+	// When a typing frame was last let through, per conversation. Only used
+	// from the read pump, so it needs no locking.
+	lastTyping map[string]time.Time
+}
+
+/*
+ *	Reads frames from the connection until it closes. Every frame counts as
+ *	activity for the presence tracking.
+ */
+func (client *Client) readPump() {
+	defer func() {
+		select {
+		case client.hub.unregister <- client:
+		case <-client.hub.quit:
+		}
+
+		client.conn.Close()
+	}()
+
+	options := client.hub.Sockets
+
+	client.conn.SetReadLimit(options.MaxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(options.PongTimeout))
+	client.conn.SetPongHandler(func(string) error {
+		client.conn.SetReadDeadline(time.Now().Add(options.PongTimeout))
+		return nil
+	})
+
+	for {
+		_, message, err := client.conn.ReadMessage()
+
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("Unexpected close of socket for user %s: %v", client.username, err)
+			}
+			break
+		}
+
+		client.hub.Presence.touch(client)
+
+		frame, err := decodeFrame(message, client.binary)
+
+		if err != nil {
+			client.hub.sendToClient(client, newErrorEvent("", http.StatusBadRequest, "Invalid frame format"))
+			continue
+		}
+
+		client.handleFrame(frame)
+	}
+}
+
+/*
+ *	Carries out a frame from the client, unless it breaks the flood limits.
+ *	Frames with an ID are acked once they went through, failures are reported
+ *	as error events either way.
+ */
+func (client *Client) handleFrame(frame *Frame) {
+	action := "handle frame"
+	if frameType, ok := frameTypes[frame.Type]; ok {
+		action = frameType.action
+	}
+
+	payload, err := parseFrame(frame)
+
+	if err == nil && !client.checkFlood(frame.ID, payload) {
+		return
+	}
+
+	var result any
+	if err == nil {
+		result, err = payload.handle(client)
+	}
+
+	if err != nil {
+		client.reportError(frame.ID, err, action)
+		return
+	}
+
+	if frame.ID != "" {
+		client.hub.sendToClient(client, NewEvent(EventAck, AckPayload{Frame: frame.ID, Result: result}))
+	}
+}
+
+// Lets the client know why the frame with the given ID failed
+func (client *Client) reportError(frameID string, err error, action string) {
+	var clientErr *ClientError
+
+	if errors.As(err, &clientErr) {
+		client.hub.sendToClient(client, newErrorEvent(frameID, clientErr.Status, clientErr.Message))
+		return
+	}
+
+	log.Printf("Failed to %s for user %s: %v", action, client.username, err)
+	client.hub.sendToClient(client, newErrorEvent(frameID, http.StatusInternalServerError, "Failed to "+action))
+}
+
+func (frame *PresenceFrame) handle(client *Client) (any, error) {
+	client.hub.Presence.setAway(client, frame.Status == StatusAway)
+	return nil, nil
+}
+
+func (frame *TypingFrame) handle(client *Client) (any, error) {
+	if !frame.Typing {
+		client.hub.Typing.stop(frame.Conversation, client.username)
+		return nil, nil
+	}
+
+	now := time.Now()
+
+	// Clients hammering us get silently ignored, the indicator stays up anyway
+	if now.Sub(client.lastTyping[frame.Conversation]) < typingThrottle {
+		return nil, nil
+	}
+
+	// Forget conversations that went quiet, so the map doesn't keep growing
+	for conversation, last := range client.lastTyping {
+		if now.Sub(last) > TypingTimeout {
+			delete(client.lastTyping, conversation)
+		}
+	}
+
+	client.lastTyping[frame.Conversation] = now
+
+	members, err := conversationMembers(frame.Conversation, client.username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client.hub.Typing.start(frame.Conversation, client.username, members)
+
+	return nil, nil
+}
+
+func (frame *MessageFrame) handle(client *Client) (any, error) {
+	message, created, err := client.hub.PostMessage(client.username, frame.Conversation, frame.MessageDraft)
+
+	// A message sent again after a reconnect. Only this client needs to
+	// hear about it, to know it went through.
+	if err == nil && !created {
+		event := NewEvent(EventMessage, message)
+		event.Conversation = frame.Conversation
+
+		client.hub.sendToClient(client, event)
+	}
+
+	return message, err
+}
+
+func (frame *ReadFrame) handle(client *Client) (any, error) {
+	return nil, client.hub.MarkRead(client.username, frame.Conversation, frame.MessageID)
+}
+
+func (frame *EditFrame) handle(client *Client) (any, error) {
+	return client.hub.EditMessage(client.username, frame.Conversation, frame.MessageID, frame.Body)
+}
+
+func (frame *DeleteFrame) handle(client *Client) (any, error) {
+	return client.hub.DeleteMessage(client.username, client.role, frame.Conversation, frame.MessageID)
+}
+
+func (frame *ReactionFrame) handle(client *Client) (any, error) {
+	return client.hub.React(client.username, frame.Conversation, frame.MessageID, frame.Emoji, !frame.Remove)
+}
+
+/*
+ *	Queues the event unless the queue is full, keeping track of how full it
+ *	got. Must only be called from the Run loop.
+ */
+func (client *Client) enqueue(event *Event) bool {
+	select {
+	case client.send <- event:
+		client.peakQueued = max(client.peakQueued, len(client.send))
+		return true
+	default:
+		return false
+	}
+}
+
+func (client *Client) writeEvent(event *Event) error {
+	data, err := encodeEvent(event, client.binary)
+
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", event.Type, err)
+		return nil
+	}
+
+	messageType := websocket.TextMessage
+	if client.binary {
+		messageType = websocket.BinaryMessage
+	}
+
+	client.conn.SetWriteDeadline(time.Now().Add(client.hub.Sockets.WriteTimeout))
+
+	if err := client.conn.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+
+	client.sent.Add(1)
+	return nil
+}
+
+// Writes the queued events to the connection and keeps it alive with pings
+func (client *Client) writePump() {
+	ticker := time.NewTicker(client.hub.Sockets.pingPeriod())
+
+	defer func() {
+		ticker.Stop()
+		client.conn.Close()
+		client.hub.pumps.Done()
+	}()
+
+	for {
+		select {
+		case event, ok := <-client.send:
+			if !ok {
+				// The hub closed the channel, once everything before was sent
+				client.conn.SetWriteDeadline(time.Now().Add(client.hub.Sockets.WriteTimeout))
+				client.conn.WriteMessage(websocket.CloseMessage, client.closeMessage)
+				return
+			}
+
+			if client.lost.Swap(false) {
+				if err := client.writeEvent(NewEvent(EventResync, nil)); err != nil {
+					return
+				}
+			}
+
+			if err := client.writeEvent(event); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(client.hub.Sockets.WriteTimeout))
+
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+/*
+ *	Closes the socket with the given code, without waiting for the events
+ *	still queued. Safe to call alongside the write pump.
+ */
+func (client *Client) disconnect(code int, reason string) {
+	deadline := time.Now().Add(client.hub.Sockets.WriteTimeout)
+
+	client.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	client.conn.Close()
+}
+
+/*
+ *	Checks the token of a request for real-time events, writing the error
+ *	response if it doesn't let the user chat. Browsers can't set headers on
+ *	socket or event stream requests, so the token may also be passed in the
+ *	token query parameter.
+ */
+func authenticateRealtime(w http.ResponseWriter, r *http.Request) *auth.Claims {
+	token, err := util.GetAuthHeader(r)
+
+	if err != nil {
+		token = r.URL.Query().Get("token")
+	}
+
+	if token == "" {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
+
+	claims, err := auth.ValidateJWT(token)
+
+	if err != nil {
+		auth.WriteTokenError(w, err)
+		return nil
+	}
+
+	if !claims.Role.HasPermission(models.PermissionChat) {
+		http.Error(w, "You don't have permission to do this", http.StatusForbidden)
+		return nil
+	}
+
+	return claims
+}
+
+// A client of the user the claims belong to. Conn is nil for clients that aren't sockets.
+func newClient(hub *Hub, conn *websocket.Conn, claims *auth.Claims) *Client {
+	return &Client{
+		hub:       hub,
+		conn:      conn,
+		username:  claims.Username,
+		role:      claims.Role,
+		sessionID: claims.ID,
+		send:      make(chan *Event, hub.Sockets.QueueSize),
+
+		connectedAt: time.Now(),
+
+		lastTyping: make(map[string]time.Time),
+	}
+}
+
+/*
+ *	GET /api/ws
+ *
+ *	Upgrades the request to a socket connection. Clients pick JSON or CBOR
+ *	through the subprotocol, JSON is the default.
+ */
+func (hub *Hub) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if hub.refuseWhileDraining(w) {
+		return
+	}
+
+	claims := authenticateRealtime(w, r)
+
+	if claims == nil {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		// The upgrader has already written the error response
+		log.Printf("Failed to upgrade connection of user %s: %v", claims.Username, err)
+		return
+	}
+
+	client := newClient(hub, conn, claims)
+	client.binary = conn.Subprotocol() == SubprotocolCBOR
+
+	hub.pumps.Add(1)
+
+	// Stopped since we checked, the socket is already open so it gets a close frame instead of a 503
+	if !hub.registerClient(client) {
+		hub.pumps.Done()
+		client.disconnect(websocket.CloseServiceRestart, "Server is shutting down, reconnect")
+		return
+	}
+
+	go client.writePump()
+	go client.readPump()
+}
@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"chat-module/bus"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Topics of the bus the hubs talk to each other on
+const (
+	topicEvents   = "chat.events"
+	topicPresence = "chat.presence"
+
+	topicRevocations = "chat.revocations"
+)
+
+// An event for users, on its way to the other instances
+type busEnvelope struct {
+	Origin    string          `json:"origin"`
+	Usernames []string        `json:"usernames"`
+	Event     json.RawMessage `json:"event"`
+	Ephemeral bool            `json:"ephemeral,omitempty"`
+}
+
+// Sends the events for users out on the bus one at a time, so they keep their order
+func (hub *Hub) publishLoop() {
+	defer hub.loops.Done()
+
+	for {
+		select {
+		case delivery := <-hub.outbound:
+			hub.publish(delivery)
+
+		case <-hub.quit:
+			// Whatever was sent before the hub stopped still goes out
+			for {
+				select {
+				case delivery := <-hub.outbound:
+					hub.publish(delivery)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (hub *Hub) publish(delivery delivery) {
+	event, err := json.Marshal(delivery.event)
+
+	if err != nil {
+		log.Printf("Failed to encode %s event for the bus: %v", delivery.event.Type, err)
+		return
+	}
+
+	data, err := json.Marshal(busEnvelope{
+		Origin:    hub.instance,
+		Usernames: delivery.usernames,
+		Event:     event,
+		Ephemeral: delivery.ephemeral,
+	})
+
+	if err != nil {
+		log.Printf("Failed to encode %s event for the bus: %v", delivery.event.Type, err)
+		return
+	}
+
+	if err := hub.bus.Publish(topicEvents, data); err != nil {
+		log.Printf("Failed to publish %s event: %v", delivery.event.Type, err)
+	}
+}
+
+// Delivers an event from another instance to the users connected to this one
+func (hub *Hub) receive(data []byte) {
+	var envelope busEnvelope
+
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		log.Printf("Failed to decode event from the bus: %v", err)
+		return
+	}
+
+	// This hub delivered its own events when it sent them
+	if envelope.Origin == hub.instance {
+		return
+	}
+
+	var received struct {
+		Version      int             `json:"v"`
+		Type         string          `json:"type"`
+		ID           string          `json:"id"`
+		Conversation string          `json:"conversation"`
+		Payload      json.RawMessage `json:"payload"`
+		Timestamp    time.Time       `json:"timestamp"`
+	}
+
+	if err := json.Unmarshal(envelope.Event, &received); err != nil {
+		log.Printf("Failed to decode event from the bus: %v", err)
+		return
+	}
+
+	event := &Event{
+		Version:      received.Version,
+		Type:         received.Type,
+		ID:           received.ID,
+		Conversation: received.Conversation,
+		Timestamp:    received.Timestamp,
+	}
+
+	// The payload goes out the way it came in
+	if len(received.Payload) > 0 {
+		event.Payload = received.Payload
+	}
+
+	if !envelope.Ephemeral {
+		hub.deliveries <- delivery{usernames: envelope.Usernames, event: event}
+		return
+	}
+
+	select {
+	case hub.ephemerals <- delivery{usernames: envelope.Usernames, event: event, ephemeral: true}:
+	default:
+	}
+}
+
+// Sessions that were revoked, on their way to the other instances
+type revocation struct {
+	Origin   string `json:"origin"`
+	Username string `json:"username"`
+
+	// Empty when every session of the user was revoked
+	Session string `json:"session,omitempty"`
+}
+
+/*
+ *	Disconnects every client of the session, or of every session of the user
+ *	if sessionID is empty, on this instance and the others. Sockets are told
+ *	the session was revoked, event streams and polls simply end.
+ */
+func (hub *Hub) Revoke(username, sessionID string) {
+	revoked := revocation{Origin: hub.instance, Username: username, Session: sessionID}
+
+	select {
+	case hub.revocations <- revoked:
+	case <-hub.quit:
+		return
+	}
+
+	if err := PublishRevocation(hub.bus, hub.instance, username, sessionID); err != nil {
+		log.Printf("Failed to publish revocation of %s: %v", username, err)
+	}
+}
+
+/*
+ *	Tells every instance on the bus to disconnect the clients of the session,
+ *	or of every session of the user if sessionID is empty. The origin is left
+ *	out by the instance it names, which already took care of its own clients.
+ */
+func PublishRevocation(messageBus bus.Bus, origin, username, sessionID string) error {
+	data, err := json.Marshal(revocation{Origin: origin, Username: username, Session: sessionID})
+
+	if err != nil {
+		return err
+	}
+
+	return messageBus.Publish(topicRevocations, data)
+}
+
+// Disconnects the clients of a session revoked on another instance
+func (hub *Hub) receiveRevocation(data []byte) {
+	var revoked revocation
+
+	if err := json.Unmarshal(data, &revoked); err != nil {
+		log.Printf("Failed to decode revocation from the bus: %v", err)
+		return
+	}
+
+	if revoked.Origin == hub.instance {
+		return
+	}
+
+	select {
+	case hub.revocations <- revoked:
+	case <-hub.quit:
+	}
+}
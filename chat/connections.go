@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"chat-module/models"
+	"chat-module/util"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// What happens to a client whose queue of outbound events is full
+type SlowClientPolicy string
+
+const (
+	// Drops the oldest queued event to make room. The client gets a resync
+	// event before the next one it receives, so it knows to catch up.
+	PolicyDropOldest SlowClientPolicy = "drop-oldest"
+
+	// Closes the socket with CloseSlowClient, the client catches up once it
+	// reconnects
+	PolicyDisconnect SlowClientPolicy = "disconnect"
+)
+
+// Close code of sockets that were disconnected for falling behind
+const CloseSlowClient = websocket.CloseTryAgainLater
+
+type SocketOptions struct {
+	// How many events can be queued for a client before it counts as slow
+	QueueSize int
+
+	Policy SlowClientPolicy
+
+	// Time allowed to write a message to the peer
+	WriteTimeout time.Duration
+
+	// Time allowed to read the next pong message from the peer. Pings go out
+	// a bit more often than that.
+	PongTimeout time.Duration
+
+	// Largest frame a client may send
+	MaxMessageSize int64
+}
+
+func (options SocketOptions) pingPeriod() time.Duration {
+	return options.PongTimeout * 9 / 10
+}
+
+var DefaultSocketOptions = SocketOptions{
+	QueueSize:    256,
+	Policy:       PolicyDisconnect,
+	WriteTimeout: 10 * time.Second,
+	PongTimeout:  60 * time.Second,
+
+	// Enough for a message of the longest allowed length
+	MaxMessageSize: models.MaxMessageFrameSize,
+}
+
+// How a single connection is keeping up with its events
+type ConnectionStats struct {
+	Username    string    `json:"username"`
+	Transport   string    `json:"transport"`
+	ConnectedAt time.Time `json:"connectedAt"`
+
+	// Events waiting in the queue right now, and the most there ever were
+	Queued     int `json:"queued"`
+	PeakQueued int `json:"peakQueued"`
+	QueueSize  int `json:"queueSize"`
+
+	Sent    int64 `json:"sent"`
+	Dropped int64 `json:"dropped"`
+}
+
+// Must only be called from the Run loop
+func (hub *Hub) connectionStats() []ConnectionStats {
+	stats := []ConnectionStats{}
+
+	for _, clients := range hub.clients {
+		for client := range clients {
+			transport := "socket"
+			if client.conn == nil {
+				transport = "stream"
+			}
+
+			stats = append(stats, ConnectionStats{
+				Username:    client.username,
+				Transport:   transport,
+				ConnectedAt: client.connectedAt,
+				Queued:      len(client.send),
+				PeakQueued:  client.peakQueued,
+				QueueSize:   cap(client.send),
+				Sent:        client.sent.Load(),
+				Dropped:     client.dropped,
+			})
+		}
+	}
+
+	return stats
+}
+
+/*
+ *	GET /api/admin/connections?user=
+ *
+ *	Returns the queue metrics of every connection to this instance, or only
+ *	those of the given user.
+ */
+func (hub *Hub) ConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reply := make(chan []ConnectionStats, 1)
+
+	select {
+	case hub.inspections <- reply:
+	case <-hub.quit:
+		writeShuttingDown(w)
+		return
+	}
+
+	stats := <-reply
+
+	if username := r.URL.Query().Get("user"); username != "" {
+		filtered := []ConnectionStats{}
+
+		for _, connection := range stats {
+			if connection.Username == username {
+				filtered = append(filtered, connection)
+			}
+		}
+
+		stats = filtered
+	}
+
+	util.WriteJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"chat-module/db"
+	"chat-module/models"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+ *	An error caused by what the client asked for, rather than by us. The
+ *	message is safe to send back, over HTTP with the given status or as an
+ *	error event over the socket.
+ */
+type ClientError struct {
+	Status  int
+	Message string
+}
+
+func (err *ClientError) Error() string {
+	return err.Message
+}
+
+var (
+	errNotMember     = &ClientError{http.StatusNotFound, "not a member of this conversation"}
+	errNotAllowed    = &ClientError{http.StatusForbidden, "you don't have permission to do this"}
+	errNoSuchMessage = &ClientError{http.StatusNotFound, "no such message"}
+	errEditConflict  = &ClientError{http.StatusConflict, "the message was changed in the meantime"}
+)
+
+// Loads the conversation, returning errNotMember if it doesn't exist
+func getConversation(conversation string) (*models.Room, error) {
+	roomID, err := primitive.ObjectIDFromHex(conversation)
+
+	if err != nil {
+		return nil, errNotMember
+	}
+
+	room, err := db.Client.GetRoom(roomID)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, errNotMember
+	} else if err != nil {
+		return nil, err
+	}
+
+	return room, nil
+}
+
+/*
+ *	Loads the conversation, as long as the user is a member of it. Returns
+ *	errNotMember for conversations that don't exist too, so the two can't be
+ *	told apart.
+ */
+func loadConversation(conversation string, username string) (*models.Room, *models.RoomMember, error) {
+	room, err := getConversation(conversation)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	member := room.GetMember(username)
+
+	if member == nil {
+		return nil, nil, errNotMember
+	}
+
+	return room, member, nil
+}
+
+func memberUsernames(room *models.Room) []string {
+	members := make([]string, 0, len(room.Members))
+	for _, member := range room.Members {
+		members = append(members, member.Username)
+	}
+
+	return members
+}
+
+// Returns the members of the conversation, as long as the user is one of them
+func conversationMembers(conversation string, username string) ([]string, error) {
+	room, _, err := loadConversation(conversation, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return memberUsernames(room), nil
+}
@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Types of the events sent to clients
+const (
+	EventPresence = "presence"
+	EventTyping   = "typing"
+	EventMessage  = "message"
+	EventRead     = "read"
+	EventEdit     = "edit"
+	EventDelete   = "delete"
+	EventThread   = "thread"
+	EventReaction = "reaction"
+	EventMention  = "mention"
+	EventSync     = "sync"
+	EventAck      = "ack"
+	EventError    = "error"
+
+	// The user broke the flood limits and got a penalty for it
+	EventPenalty = "penalty"
+
+	// Events went missing on the way to the client. It should catch
+	// up on its conversations through sync.
+	EventResync = "resync"
+)
+
+// Types of the frames clients send to us
+const (
+	FramePresence = "presence"
+	FrameTyping   = "typing"
+	FrameMessage  = "message"
+	FrameRead     = "read"
+	FrameEdit     = "edit"
+	FrameDelete   = "delete"
+	FrameReaction = "reaction"
+	FrameSync     = "sync"
+)
+
+/*
+ *	Something that happened, sent to the connected clients it concerns.
+ *	Conversation is the ID of the room the event belongs to, if any. Every
+ *	event has an ID of its own and the version of the protocol it follows.
+ */
+type Event struct {
+	Version      int       `json:"v"`
+	Type         string    `json:"type"`
+	ID           string    `json:"id"`
+	Conversation string    `json:"conversation,omitempty"`
+	Payload      any       `json:"payload,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+func NewEvent(eventType string, payload any) *Event {
+	return &Event{
+		Version:   ProtocolVersion,
+		Type:      eventType,
+		ID:        primitive.NewObjectID().Hex(),
+		Payload:   payload,
+		Timestamp: time.Now(),
+	}
+}
+
+// An error event about the frame with the given ID, if it had one
+func newErrorEvent(frameID string, status int, message string) *Event {
+	return NewEvent(EventError, ErrorPayload{Frame: frameID, Status: status, Message: message})
+}
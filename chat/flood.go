@@ -0,0 +1,443 @@
+package chat
+
+import (
+	"chat-module/util"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// What a user gets for breaking the flood limits, worse the more often it happens
+type Penalty string
+
+const (
+	PenaltyWarning    Penalty = "warning"
+	PenaltyMute       Penalty = "mute"
+	PenaltyDisconnect Penalty = "disconnect"
+)
+
+type FloodLimits struct {
+	// Messages an user can send per second, across all conversations, and
+	// how many they can send in a burst
+	UserRate  float64
+	UserBurst int
+
+	// Messages per second of everyone in a conversation together
+	RoomRate  float64
+	RoomBurst int
+
+	// How many times in a row the same message can be sent within the window
+	MaxDuplicates   int
+	DuplicateWindow time.Duration
+
+	// Strikes after which users get muted, and disconnected. Every mute after
+	// the first lasts twice as long as the one before.
+	MuteAfter       int
+	DisconnectAfter int
+	MuteDuration    time.Duration
+
+	// How long an user has to behave for their strikes to be forgotten
+	StrikeDecay time.Duration
+}
+
+var DefaultFloodLimits = FloodLimits{
+	UserRate:        1,
+	UserBurst:       10,
+	RoomRate:        10,
+	RoomBurst:       30,
+	MaxDuplicates:   3,
+	DuplicateWindow: 30 * time.Second,
+	MuteAfter:       3,
+	DisconnectAfter: 6,
+	MuteDuration:    30 * time.Second,
+	StrikeDecay:     5 * time.Minute,
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Takes a token if there is one, refilling the bucket for the time that passed
+func (bucket *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	if bucket.last.IsZero() {
+		bucket.tokens = float64(burst)
+	} else {
+		bucket.tokens = min(float64(burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	}
+
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// Whether the bucket would be full by now, so forgetting it changes nothing
+func (bucket *tokenBucket) full(rate float64, burst int, now time.Time) bool {
+	return bucket.tokens+now.Sub(bucket.last).Seconds()*rate >= float64(burst)
+}
+
+type floodState struct {
+	bucket tokenBucket
+
+	strikes       int
+	mutes         int
+	lastViolation time.Time
+	mutedUntil    time.Time
+
+	// The last message and how often it was sent in a row
+	lastBody    string
+	lastSent    time.Time
+	repetitions int
+
+	// Conversation and client ID of the last message, to tell retries apart
+	lastDraft string
+}
+
+type PenaltyPayload struct {
+	Penalty Penalty `json:"penalty"`
+	Reason  string  `json:"reason"`
+	Strikes int     `json:"strikes"`
+
+	// When a mute ends
+	Until *time.Time `json:"until,omitempty"`
+}
+
+/*
+ *	Keeps users from flooding conversations, over their sockets and the API
+ *	alike. Messages, edits and reactions are rate limited per user and per
+ *	conversation, and
+ *	overly long or repeated messages are refused too. Every time a user gets
+ *	caught they get a strike, and enough of those get them muted for a while
+ *	or disconnected. Every instance keeps its own state, for the users
+ *	connected to it.
+ */
+type FloodGuard struct {
+	hub  *Hub
+	lock sync.Mutex
+
+	limits FloodLimits
+	users  map[string]*floodState
+	rooms  map[string]*tokenBucket
+}
+
+func newFloodGuard(hub *Hub) *FloodGuard {
+	return &FloodGuard{
+		hub:    hub,
+		limits: DefaultFloodLimits,
+		users:  make(map[string]*floodState),
+		rooms:  make(map[string]*tokenBucket),
+	}
+}
+
+func (guard *FloodGuard) SetLimits(limits FloodLimits) {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+
+	guard.limits = limits
+}
+
+// The conversation and body of the frames the guard cares about
+func floodedContent(payload framePayload) (conversation string, body string, limited bool) {
+	switch frame := payload.(type) {
+	case *MessageFrame:
+		return frame.Conversation, frame.Body, true
+	case *EditFrame:
+		return frame.Conversation, frame.Body, true
+	case *ReactionFrame:
+		return frame.Conversation, "", true
+	}
+
+	return "", "", false
+}
+
+/*
+ *	Checks whether the user may go ahead with the frame. If not, the error
+ *	says why, along with the penalty the user got for it if any.
+ */
+func (guard *FloodGuard) check(username string, payload framePayload) (*PenaltyPayload, error) {
+	conversation, body, limited := floodedContent(payload)
+
+	if !limited {
+		return nil, nil
+	}
+
+	// Looked up before locking, it may take a trip to the database. Frames
+	// for conversations the user isn't in still count against the user, but
+	// never against the conversation.
+	_, _, notMember := loadConversation(conversation, username)
+
+	if _, ok := notMember.(*ClientError); notMember != nil && !ok {
+		return nil, notMember
+	}
+
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+
+	now := time.Now()
+	limits := guard.limits
+
+	state := guard.users[username]
+	if state == nil {
+		state = &floodState{}
+		guard.users[username] = state
+	}
+
+	if state.strikes > 0 && now.Sub(state.lastViolation) > limits.StrikeDecay {
+		state.strikes = 0
+		state.mutes = 0
+	}
+
+	if now.Before(state.mutedUntil) {
+		return nil, &ClientError{http.StatusTooManyRequests, fmt.Sprintf("You are muted for another %v", state.mutedUntil.Sub(now).Round(time.Second))}
+	}
+
+	// Retries of a message are only ever stored once, so they come for free
+	var draft string
+	if frame, ok := payload.(*MessageFrame); ok && frame.ClientID != "" {
+		draft = conversation + "/" + frame.ClientID
+	}
+
+	if draft != "" && draft == state.lastDraft && notMember == nil {
+		return nil, nil
+	}
+
+	var reason string
+
+	switch body = strings.ToLower(strings.TrimSpace(body)); {
+	case utf8.RuneCountInString(body) > MaxMessageLength:
+		reason = "Message is too long"
+	case body != "" && body == state.lastBody && now.Sub(state.lastSent) < limits.DuplicateWindow && state.repetitions >= limits.MaxDuplicates:
+		reason = "Stop repeating yourself"
+	case !state.bucket.take(limits.UserRate, limits.UserBurst, now):
+		reason = "You are sending messages too fast"
+	}
+
+	if reason == "" && notMember != nil {
+		return nil, notMember
+	}
+
+	if reason == "" {
+		room := guard.rooms[conversation]
+		if room == nil {
+			room = &tokenBucket{}
+			guard.rooms[conversation] = room
+		}
+
+		// Everyone in the room is equally to blame, so nobody gets a strike
+		if !room.take(limits.RoomRate, limits.RoomBurst, now) {
+			return nil, &ClientError{http.StatusTooManyRequests, "The conversation is too busy, try again in a moment"}
+		}
+
+		if body != "" && body == state.lastBody && now.Sub(state.lastSent) < limits.DuplicateWindow {
+			state.repetitions++
+		} else {
+			state.repetitions = 1
+		}
+
+		state.lastBody = body
+		state.lastSent = now
+		state.lastDraft = draft
+
+		return nil, nil
+	}
+
+	penalty := guard.strike(state, now)
+
+	announcement := &PenaltyPayload{Penalty: penalty, Reason: reason, Strikes: state.strikes}
+	if penalty != PenaltyWarning {
+		mutedUntil := state.mutedUntil
+		announcement.Until = &mutedUntil
+	}
+
+	return announcement, &ClientError{http.StatusTooManyRequests, reason}
+}
+
+// Gives the user another strike, returning what they get for it. Must be called with the lock held.
+func (guard *FloodGuard) strike(state *floodState, now time.Time) Penalty {
+	limits := guard.limits
+
+	state.strikes++
+	state.lastViolation = now
+
+	if state.strikes < limits.MuteAfter {
+		return PenaltyWarning
+	}
+
+	// Users that get disconnected are muted too, so they can't just reconnect
+	state.mutedUntil = now.Add(limits.MuteDuration << state.mutes)
+	state.mutes++
+
+	if state.strikes >= limits.DisconnectAfter {
+		return PenaltyDisconnect
+	}
+
+	return PenaltyMute
+}
+
+// Lets the client go ahead with the frame, or reports why not, disconnecting it if it came to that
+func (client *Client) checkFlood(frameID string, payload framePayload) bool {
+	penalty, err := client.hub.Flood.check(client.username, payload)
+
+	if err == nil {
+		return true
+	}
+
+	client.reportError(frameID, err, "check flood limits")
+
+	if penalty == nil {
+		return false
+	}
+
+	client.hub.sendToClient(client, NewEvent(EventPenalty, penalty))
+
+	if penalty.Penalty == PenaltyDisconnect && client.conn != nil {
+		client.disconnect(websocket.ClosePolicyViolation, "Flooding")
+	}
+
+	return false
+}
+
+/*
+ *	Lets the user go ahead with a request to the API the same way as with a
+ *	frame over their socket, so switching over doesn't get around the limits.
+ *	Penalties are announced on their sockets, but only ever mute them.
+ */
+func (hub *Hub) checkFlood(username string, payload framePayload) error {
+	penalty, err := hub.Flood.check(username, payload)
+
+	if penalty != nil {
+		hub.sendLocally([]string{username}, NewEvent(EventPenalty, penalty))
+	}
+
+	return err
+}
+
+// Forgets the users and conversations that have nothing left to remember
+func (guard *FloodGuard) sweep(now time.Time) {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+
+	limits := guard.limits
+
+	for username, state := range guard.users {
+		forgiven := state.strikes == 0 || now.Sub(state.lastViolation) > limits.StrikeDecay
+
+		if forgiven && !now.Before(state.mutedUntil) && now.Sub(state.lastSent) > limits.DuplicateWindow &&
+			state.bucket.full(limits.UserRate, limits.UserBurst, now) {
+			delete(guard.users, username)
+		}
+	}
+
+	for conversation, bucket := range guard.rooms {
+		if bucket.full(limits.RoomRate, limits.RoomBurst, now) {
+			delete(guard.rooms, conversation)
+		}
+	}
+}
+
+// Forgives the user their strikes and lifts any mute
+func (guard *FloodGuard) Pardon(username string) bool {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+
+	_, ok := guard.users[username]
+	delete(guard.users, username)
+
+	return ok
+}
+
+// Where an user stands with the flood limits
+type FloodState struct {
+	Username string `json:"username"`
+	Strikes  int    `json:"strikes"`
+
+	// Messages they can still send right away
+	Tokens float64 `json:"tokens"`
+
+	LastViolation *time.Time `json:"lastViolation,omitempty"`
+	MutedUntil    *time.Time `json:"mutedUntil,omitempty"`
+}
+
+// The users that recently sent anything over this instance, those with the most strikes first
+func (guard *FloodGuard) States() []FloodState {
+	guard.lock.Lock()
+	defer guard.lock.Unlock()
+
+	now := time.Now()
+	states := []FloodState{}
+
+	for username, state := range guard.users {
+		flood := FloodState{
+			Username: username,
+			Strikes:  state.strikes,
+			Tokens:   min(float64(guard.limits.UserBurst), state.bucket.tokens+now.Sub(state.bucket.last).Seconds()*guard.limits.UserRate),
+		}
+
+		if !state.lastViolation.IsZero() {
+			lastViolation := state.lastViolation
+			flood.LastViolation = &lastViolation
+		}
+
+		if now.Before(state.mutedUntil) {
+			mutedUntil := state.mutedUntil
+			flood.MutedUntil = &mutedUntil
+		}
+
+		states = append(states, flood)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Strikes != states[j].Strikes {
+			return states[i].Strikes > states[j].Strikes
+		}
+
+		return states[i].Username < states[j].Username
+	})
+
+	return states
+}
+
+/*
+ *	GET /api/admin/flood
+ *
+ *	Returns where the users connected to this instance stand with the flood
+ *	limits: their strikes, mutes and how much they can still send.
+ */
+func (hub *Hub) FloodHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, hub.Flood.States())
+}
+
+/*
+ *	DELETE /api/admin/flood/{username}
+ *
+ *	Forgives the user their strikes and lifts their mute.
+ */
+func (hub *Hub) FloodUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !hub.Flood.Pardon(r.PathValue("username")) {
+		http.Error(w, "User has no strikes", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,421 @@
+package chat
+
+import (
+	"chat-module/bus"
+	"chat-module/config"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How often the hub checks whether connected users have gone idle
+const presenceSweepInterval = time.Second * 15
+
+// An event together with the users it should be delivered to. If client is
+// set, the event only goes to that one connection instead.
+type delivery struct {
+	usernames []string
+	client    *Client
+	event     *Event
+
+	// Ephemeral events are only of interest right now and are never stored,
+	// so they are dropped rather than queued when a client falls behind
+	ephemeral bool
+}
+
+/*
+ *	Keeps track of every connected client and routes events to them. All of the
+ *	bookkeeping happens in the Run loop, everything else talks to it through
+ *	channels, so the maps don't need any locking.
+ *
+ *	Every instance of the server runs its own hub. Events for users go out on
+ *	the bus too, and the hubs of the other instances deliver them to whoever
+ *	of those users is connected to them.
+ */
+type Hub struct {
+	// Connected clients, grouped by username since an user can be connected
+	// from several devices at once
+	clients map[string]map[*Client]bool
+
+	register   chan *Client
+	unregister chan *Client
+	deliveries chan delivery
+
+	// Kept apart from deliveries, so a burst of ephemeral events can never
+	// hold up the ones that matter
+	ephemerals chan delivery
+
+	bus bus.Bus
+
+	// Tells the events of this hub apart from those of the other instances
+	instance string
+
+	// Events waiting to go out on the bus, in the order they were sent
+	outbound chan delivery
+
+	// Clients getting their events over plain HTTP
+	streams *streamRegistry
+
+	// Requests for the metrics of every connection
+	inspections chan chan []ConnectionStats
+
+	// Sessions whose clients have to be disconnected
+	revocations chan revocation
+
+	// How sockets are kept alive and what happens when they fall behind.
+	// Must not be changed once the hub runs.
+	Sockets SocketOptions
+
+	// Set once the hub is shutting down, after which it turns away new
+	// connections. The Run loop disconnects everyone when told to drain.
+	draining atomic.Bool
+	drain    chan struct{}
+
+	// Write pumps of sockets that haven't finished yet
+	pumps sync.WaitGroup
+
+	// Closed when the hub stops, and the loops that finish up once it is
+	quit     chan struct{}
+	stopOnce sync.Once
+	loops    sync.WaitGroup
+
+	Presence *PresenceTracker
+	Typing   *TypingTracker
+	Flood    *FloodGuard
+}
+
+// Applies the configured settings. Has to be called before any hub is created.
+func Configure(cfg config.Chat) {
+	EditWindow = cfg.EditWindow
+
+	DefaultSocketOptions = SocketOptions{
+		QueueSize:      cfg.Sockets.QueueSize,
+		Policy:         SlowClientPolicy(cfg.Sockets.SlowClientPolicy),
+		WriteTimeout:   cfg.Sockets.WriteTimeout,
+		PongTimeout:    cfg.Sockets.PongTimeout,
+		MaxMessageSize: cfg.Sockets.MaxMessageSize,
+	}
+}
+
+/*
+ *	Creates a hub connected to the other instances through the bus. The hub is
+ *	subscribed by the time this returns, but only delivers anything once it
+ *	runs.
+ */
+func NewHub(messageBus bus.Bus) (*Hub, error) {
+	hub := &Hub{
+		clients:    make(map[string]map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		deliveries: make(chan delivery, 256),
+		ephemerals: make(chan delivery, 256),
+		bus:        messageBus,
+		instance:   primitive.NewObjectID().Hex(),
+		outbound:   make(chan delivery, 256),
+
+		inspections: make(chan chan []ConnectionStats),
+		revocations: make(chan revocation, 16),
+		drain:       make(chan struct{}),
+		quit:        make(chan struct{}),
+		Sockets:     DefaultSocketOptions,
+	}
+
+	hub.Presence = newPresenceTracker(hub)
+	hub.Typing = newTypingTracker(hub)
+	hub.Flood = newFloodGuard(hub)
+	hub.streams = newStreamRegistry(hub)
+
+	if _, err := messageBus.Subscribe(topicEvents, hub.receive); err != nil {
+		return nil, err
+	}
+
+	if _, err := messageBus.Subscribe(topicPresence, hub.Presence.receive); err != nil {
+		return nil, err
+	}
+
+	if _, err := messageBus.Subscribe(topicRevocations, hub.receiveRevocation); err != nil {
+		return nil, err
+	}
+
+	return hub, nil
+}
+
+func (hub *Hub) Run() {
+	sweepTicker := time.NewTicker(presenceSweepInterval)
+	defer sweepTicker.Stop()
+
+	hub.loops.Add(2)
+
+	go hub.Presence.announceLoop()
+	go hub.Presence.publishLoop()
+	go hub.publishLoop()
+	go hub.streams.expireLoop()
+
+	// The other instances share their users with the newcomer
+	hub.Presence.heartbeat()
+
+	for {
+		select {
+		case client := <-hub.register:
+			// Slipped in while the hub was draining
+			if hub.draining.Load() {
+				client.closeMessage = closeShuttingDown
+				close(client.send)
+				continue
+			}
+
+			if hub.clients[client.username] == nil {
+				hub.clients[client.username] = make(map[*Client]bool)
+			}
+
+			hub.clients[client.username][client] = true
+			hub.Presence.connect(client)
+
+		case client := <-hub.unregister:
+			if _, ok := hub.clients[client.username][client]; ok {
+				hub.removeClient(client)
+			}
+
+		case delivery := <-hub.deliveries:
+			hub.deliver(delivery)
+
+		case delivery := <-hub.ephemerals:
+			hub.deliver(delivery)
+
+		case reply := <-hub.inspections:
+			reply <- hub.connectionStats()
+
+		case revoked := <-hub.revocations:
+			for client := range hub.clients[revoked.Username] {
+				if revoked.Session == "" || client.sessionID == revoked.Session {
+					client.closeMessage = closeSessionRevoked
+					hub.removeClient(client)
+				}
+			}
+
+		case now := <-sweepTicker.C:
+			hub.Presence.sweep(now)
+			hub.Flood.sweep(now)
+
+		case <-hub.drain:
+			for _, clients := range hub.clients {
+				for client := range clients {
+					client.closeMessage = closeShuttingDown
+					hub.removeClient(client)
+				}
+			}
+
+		case <-hub.quit:
+			return
+		}
+	}
+}
+
+// What sockets are told when the server goes away, so they reconnect to another instance
+var closeShuttingDown = websocket.FormatCloseMessage(websocket.CloseServiceRestart, "Server is shutting down, reconnect")
+
+// Close code of sockets whose session was revoked, which mustn't reconnect with the same token
+const CloseSessionRevoked = 4001
+
+var closeSessionRevoked = websocket.FormatCloseMessage(CloseSessionRevoked, "Session was revoked, log in again")
+
+// Waits for the group, giving up once the context is done
+func waitGroup(ctx context.Context, group *sync.WaitGroup) error {
+	done := make(chan struct{})
+
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+ *	Disconnects every client, turning away new ones from then on. Sockets
+ *	are told to reconnect elsewhere once they have been sent what was already
+ *	queued for them, event streams and polls simply end. Returns once every
+ *	socket is closed, or the context is done. The hub keeps delivering
+ *	events until it is stopped, so requests still in flight can finish.
+ */
+func (hub *Hub) Drain(ctx context.Context) error {
+	hub.draining.Store(true)
+
+	select {
+	case hub.drain <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return waitGroup(ctx, &hub.pumps)
+}
+
+/*
+ *	Stops the hub and its background loops, once the events already sent
+ *	went out on the bus. Nothing gets delivered afterwards. Stopping it again
+ *	only waits for the loops.
+ */
+func (hub *Hub) Stop(ctx context.Context) error {
+	hub.draining.Store(true)
+	hub.stopOnce.Do(func() { close(hub.quit) })
+
+	return waitGroup(ctx, &hub.loops)
+}
+
+// Turns the request away if the hub is shutting down, returning whether it did
+func (hub *Hub) refuseWhileDraining(w http.ResponseWriter) bool {
+	if !hub.draining.Load() {
+		return false
+	}
+
+	writeShuttingDown(w)
+	return true
+}
+
+// Tells the client to try again in a moment, on another instance if there is one
+func writeShuttingDown(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+}
+
+// Returned when a client comes in after the hub stopped
+var errHubStopped = errors.New("hub has stopped")
+
+/*
+ *	Hands the client over to the Run loop. Returns false if the hub stopped
+ *	first, since nothing would ever take it then.
+ */
+func (hub *Hub) registerClient(client *Client) bool {
+	select {
+	case hub.register <- client:
+		return true
+	case <-hub.quit:
+		return false
+	}
+}
+
+// Must only be called from the Run loop
+func (hub *Hub) removeClient(client *Client) {
+	delete(hub.clients[client.username], client)
+
+	if len(hub.clients[client.username]) == 0 {
+		delete(hub.clients, client.username)
+	}
+
+	close(client.send)
+	hub.Presence.disconnect(client)
+}
+
+// Must only be called from the Run loop
+func (hub *Hub) deliver(delivery delivery) {
+	if delivery.client != nil {
+		if _, ok := hub.clients[delivery.client.username][delivery.client]; ok {
+			hub.send(delivery.client, delivery.event, delivery.ephemeral)
+		}
+
+		return
+	}
+
+	for _, username := range delivery.usernames {
+		for client := range hub.clients[username] {
+			hub.send(client, delivery.event, delivery.ephemeral)
+		}
+	}
+}
+
+/*
+ *	Queues the event for the client. What happens to a client that can't keep
+ *	up with its queue is up to the slow client policy. Ephemeral events are
+ *	simply dropped either way, missing one does no harm. Must only be called
+ *	from the Run loop.
+ */
+func (hub *Hub) send(client *Client, event *Event, ephemeral bool) {
+	if client.enqueue(event) {
+		return
+	}
+
+	if ephemeral {
+		client.dropped++
+		return
+	}
+
+	if hub.Sockets.Policy == PolicyDropOldest {
+		// The write pump may have made room in the meantime, in which case
+		// nothing needs to go
+		select {
+		case <-client.send:
+			client.dropped++
+			client.lost.Store(true)
+		default:
+		}
+
+		if client.enqueue(event) {
+			return
+		}
+
+		client.dropped++
+		client.lost.Store(true)
+		return
+	}
+
+	log.Printf("Disconnecting slow client of user %s", client.username)
+	hub.removeClient(client)
+
+	if client.conn != nil {
+		go client.disconnect(CloseSlowClient, "Too slow to keep up")
+	}
+}
+
+// Hands the delivery to the channel, unless the hub has stopped
+func (hub *Hub) submit(channel chan delivery, delivery delivery) {
+	select {
+	case channel <- delivery:
+	case <-hub.quit:
+	}
+}
+
+// Delivers the event to every connected client of the given users, on every instance
+func (hub *Hub) SendToUsers(usernames []string, event *Event) {
+	hub.submit(hub.deliveries, delivery{usernames: usernames, event: event})
+	hub.submit(hub.outbound, delivery{usernames: usernames, event: event})
+}
+
+// Delivers the event to the given users connected to this instance only
+func (hub *Hub) sendLocally(usernames []string, event *Event) {
+	hub.submit(hub.deliveries, delivery{usernames: usernames, event: event})
+}
+
+// Delivers the event to a single connection, if it is still connected
+func (hub *Hub) sendToClient(client *Client, event *Event) {
+	hub.submit(hub.deliveries, delivery{client: client, event: event})
+}
+
+/*
+ *	Delivers an ephemeral event to every connected client of the given users.
+ *	Never blocks, if the hub is backed up the event is dropped.
+ */
+func (hub *Hub) SendEphemeral(usernames []string, event *Event) {
+	delivery := delivery{usernames: usernames, event: event, ephemeral: true}
+
+	select {
+	case hub.ephemerals <- delivery:
+	default:
+	}
+
+	select {
+	case hub.outbound <- delivery:
+	default:
+	}
+}
@@ -0,0 +1,200 @@
+package chat
+
+import (
+	"chat-module/auth"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/util"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Mentions past this many different users in one message are ignored
+	MaxMentionsPerMessage = 50
+
+	// How much of the message a mention notification carries along
+	mentionPreviewLength = 140
+
+	// Reaches every member of the conversation
+	MentionRoom = "room"
+
+	// Reaches the members of the conversation who are online right now
+	MentionHere = "here"
+)
+
+// An @ that doesn't follow a word character, so email addresses don't count
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([\w.-]+)`)
+
+// Sent to the users a message mentions, wherever they are in the app
+type MentionPayload struct {
+	MessageID    primitive.ObjectID `json:"messageId"`
+	Conversation primitive.ObjectID `json:"conversation"`
+	RoomName     string             `json:"roomName"`
+	Sender       string             `json:"sender"`
+	Preview      string             `json:"preview"`
+	GroupMention string             `json:"groupMention,omitempty"`
+}
+
+/*
+ *	Finds the usernames mentioned in the body, in order and without repeats.
+ *	@room and @here are returned separately, as the group mention.
+ */
+func parseMentions(body string) ([]string, string) {
+	usernames := []string{}
+	group := ""
+	seen := make(map[string]bool)
+
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		// Trailing punctuation ends the sentence, not the username
+		name := strings.TrimRight(match[1], ".-")
+
+		switch {
+		case name == "":
+			continue
+
+		case name == MentionRoom:
+			group = MentionRoom
+
+		case name == MentionHere:
+			if group == "" {
+				group = MentionHere
+			}
+
+		case !seen[name] && len(usernames) < MaxMentionsPerMessage:
+			seen[name] = true
+			usernames = append(usernames, name)
+		}
+	}
+
+	return usernames, group
+}
+
+/*
+ *	Works out who a message from the sender mentions. Only existing users who
+ *	are members of the room count, everybody else couldn't see the message
+ *	anyway. The sender never mentions themselves. Mentions are only worked out
+ *	when the message is sent, editing it later doesn't notify anybody.
+ */
+func (hub *Hub) resolveMentions(room *models.Room, sender, body string) ([]string, string, error) {
+	usernames, group := parseMentions(body)
+
+	targets := make(map[string]bool)
+
+	if len(usernames) > 0 {
+		existing, err := db.Client.FindUsernames(usernames)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, username := range existing {
+			if room.GetMember(username) != nil {
+				targets[username] = true
+			}
+		}
+	}
+
+	for _, member := range room.Members {
+		if group == MentionRoom || (group == MentionHere && hub.Presence.IsOnline(member.Username)) {
+			targets[member.Username] = true
+		}
+	}
+
+	delete(targets, sender)
+
+	mentions := []string{}
+	for _, member := range room.Members {
+		if targets[member.Username] {
+			mentions = append(mentions, member.Username)
+		}
+	}
+
+	return mentions, group, nil
+}
+
+// Lets everybody mentioned in the message know, on all of their connections
+func (hub *Hub) notifyMentions(room *models.Room, message models.Message) {
+	if len(message.Mentions) == 0 {
+		return
+	}
+
+	preview := []rune(message.Body)
+	if len(preview) > mentionPreviewLength {
+		preview = preview[:mentionPreviewLength]
+	}
+
+	event := NewEvent(EventMention, MentionPayload{
+		MessageID:    message.ID,
+		Conversation: room.ID,
+		RoomName:     room.Name,
+		Sender:       message.Sender,
+		Preview:      string(preview),
+		GroupMention: message.GroupMention,
+	})
+	event.Conversation = room.ID.Hex()
+
+	hub.SendToUsers(message.Mentions, event)
+}
+
+/*
+ *	GET /api/users/me/mentions?before=&limit=
+ *
+ *	Pages back through the messages that mention the user, newest first. Only
+ *	conversations the user is still a member of are included.
+ */
+func MentionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := auth.GetClaims(r)
+
+	var err error
+	before := primitive.NilObjectID
+
+	if value := r.URL.Query().Get("before"); value != "" {
+		if before, err = primitive.ObjectIDFromHex(value); err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := DefaultHistoryLimit
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > MaxHistoryLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rooms, err := db.Client.GetUserRooms(claims.Username)
+
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to get rooms of user %s: %v", claims.Username, err)
+		return
+	}
+
+	conversations := make([]primitive.ObjectID, 0, len(rooms))
+	for _, room := range rooms {
+		conversations = append(conversations, room.ID)
+	}
+
+	messages, err := db.Client.GetMentions(claims.Username, conversations, before, limit)
+
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to get mentions of user %s: %v", claims.Username, err)
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, messages)
+}
@@ -0,0 +1,538 @@
+package chat
+
+import (
+	"chat-module/auth"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/util"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	MaxMessageLength = models.MaxMessageLength
+
+	// Page size of the message history when the request doesn't ask for one
+	DefaultHistoryLimit = 50
+
+	// Largest page of message history a request can ask for
+	MaxHistoryLimit = 100
+
+	// How long senders get to edit or delete their messages, unless the
+	// configuration says otherwise
+	DefaultEditWindow = time.Minute * 15
+
+	// Longest ID a client can give its messages
+	MaxClientIDLength = 64
+)
+
+// How long after sending a message its sender can still edit or delete it
+var EditWindow = DefaultEditWindow
+
+var errEditWindowPassed = &ClientError{http.StatusForbidden, "the message can no longer be changed"}
+
+type ReadPayload struct {
+	Username  string             `json:"username"`
+	MessageID primitive.ObjectID `json:"messageId"`
+}
+
+// Messages with attachments can do without a body
+func validateBody(body string, allowEmpty bool) (string, error) {
+	body = strings.TrimSpace(body)
+
+	if (body == "" && !allowEmpty) || utf8.RuneCountInString(body) > MaxMessageLength {
+		return "", &ClientError{http.StatusBadRequest, "message must be between 1 and 4000 characters"}
+	}
+
+	return body, nil
+}
+
+// Loads a message, as long as it belongs to the room
+func loadMessage(room *models.Room, messageID string) (*models.Message, error) {
+	id, err := primitive.ObjectIDFromHex(messageID)
+
+	if err != nil {
+		return nil, errNoSuchMessage
+	}
+
+	message, err := db.Client.GetMessage(id)
+
+	if err == mongo.ErrNoDocuments || (err == nil && message.Conversation != room.ID) {
+		return nil, errNoSuchMessage
+	} else if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// A message as the client sends it
+type MessageDraft struct {
+	// The message to reply to, if the message goes into a thread
+	Parent string `json:"parent"`
+
+	Body string `json:"body"`
+
+	// IDs of attachments the sender uploaded for this message
+	Attachments []string `json:"attachments"`
+
+	// Any ID the client picks, unique among its messages to the conversation.
+	// Sending a draft with the same one again doesn't send another message.
+	ClientID string `json:"clientId"`
+}
+
+// Returns the message the user already sent under the draft's client ID, if any
+func findSent(room *models.Room, username string, draft MessageDraft) (*models.Message, error) {
+	if draft.ClientID == "" {
+		return nil, nil
+	}
+
+	message, err := db.Client.GetMessageByClientID(room.ID, username, draft.ClientID)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+
+	return message, err
+}
+
+/*
+ *	Stores a message from the user and delivers it to everybody in the
+ *	conversation, the sender's other devices included.
+ *
+ *	A draft with a client ID the user already sent a message under isn't sent
+ *	again. The message sent before is returned instead, with false.
+ */
+func (hub *Hub) PostMessage(username, conversation string, draft MessageDraft) (*models.Message, bool, error) {
+	room, member, err := loadConversation(conversation, username)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !member.Role.HasPermission(models.RoomPermissionSend) {
+		return nil, false, errNotAllowed
+	}
+
+	if len(draft.ClientID) > MaxClientIDLength {
+		return nil, false, &ClientError{http.StatusBadRequest, "client ID must be at most 64 characters"}
+	}
+
+	if sent, err := findSent(room, username, draft); sent != nil || err != nil {
+		return sent, false, err
+	}
+
+	body, err := validateBody(draft.Body, len(draft.Attachments) > 0)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	attachments, err := checkAttachments(username, draft.Attachments)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	message := models.Message{
+		ID:           primitive.NewObjectID(),
+		Conversation: room.ID,
+		Sender:       username,
+		Body:         body,
+		CreatedAt:    time.Now(),
+		ClientID:     draft.ClientID,
+	}
+
+	if draft.Parent != "" {
+		if message.Parent, err = threadRoot(room, draft.Parent); err != nil {
+			return nil, false, err
+		}
+	}
+
+	message.Mentions, message.GroupMention, err = hub.resolveMentions(room, username, body)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(attachments) > 0 {
+		message.Attachments = attachments
+	}
+
+	if message.Seq, err = db.Client.NextSequence(room.ID); err != nil {
+		return nil, false, err
+	}
+
+	err = db.Client.AddMessage(message)
+
+	// Only once the message is stored, so a send that fails leaves the
+	// uploads free for the next try
+	if err == nil {
+		if err = attach(username, room.ID, message.ID, attachments); err != nil {
+			if err := db.Client.DiscardMessage(message.ID); err != nil {
+				log.Printf("Failed to discard message %s: %v", message.ID.Hex(), err)
+			}
+		}
+	}
+
+	// Stored or not, sync can move past the number now
+	if err := db.Client.ReleaseSequence(room.ID, message.Seq); err != nil {
+		log.Printf("Failed to release sequence number %d of room %s: %v", message.Seq, room.ID.Hex(), err)
+	}
+
+	// Sent twice at the same time, the other one won
+	if err == db.ErrDuplicateMessage {
+		sent, err := findSent(room, username, draft)
+		return sent, false, err
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if message.IsReply() {
+		hub.updateThread(room, message)
+	}
+
+	// Whoever sent a message has obviously read everything up to it
+	if _, err := db.Client.SetLastRead(room.ID, username, message.ID); err != nil {
+		log.Printf("Failed to update last read message of %s: %v", username, err)
+	}
+
+	event := NewEvent(EventMessage, message)
+	event.Conversation = conversation
+
+	hub.SendToUsers(memberUsernames(room), event)
+	hub.notifyMentions(room, message)
+
+	return &message, true, nil
+}
+
+/*
+ *	Records that the user has read the conversation up to the given message
+ *	and lets the other members know. Going back to an older message is
+ *	ignored, the read position only ever moves forward.
+ */
+func (hub *Hub) MarkRead(username, conversation, messageID string) error {
+	room, _, err := loadConversation(conversation, username)
+
+	if err != nil {
+		return err
+	}
+
+	message, err := loadMessage(room, messageID)
+
+	if err != nil {
+		return err
+	}
+
+	moved, err := db.Client.SetLastRead(room.ID, username, message.ID)
+
+	if err != nil || !moved {
+		return err
+	}
+
+	event := NewEvent(EventRead, ReadPayload{Username: username, MessageID: message.ID})
+	event.Conversation = conversation
+
+	hub.SendToUsers(memberUsernames(room), event)
+
+	return nil
+}
+
+/*
+ *	Replaces the body of one of the user's own messages, as long as they sent
+ *	it less than EditWindow ago. The previous version is kept with the message.
+ */
+func (hub *Hub) EditMessage(username, conversation, messageID, body string) (*models.Message, error) {
+	room, _, err := loadConversation(conversation, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := loadMessage(room, messageID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Deleted {
+		return nil, errNoSuchMessage
+	}
+
+	if message.Sender != username {
+		return nil, errNotAllowed
+	}
+
+	if time.Since(message.CreatedAt) > EditWindow {
+		return nil, errEditWindowPassed
+	}
+
+	body, err = validateBody(body, len(message.Attachments) > 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if body == message.Body {
+		return message, nil
+	}
+
+	edited, err := db.Client.EditMessage(message.ID, message.Body, body, time.Now())
+
+	if err == mongo.ErrNoDocuments {
+		return nil, errEditConflict
+	} else if err != nil {
+		return nil, err
+	}
+
+	event := NewEvent(EventEdit, edited)
+	event.Conversation = conversation
+
+	hub.SendToUsers(memberUsernames(room), event)
+
+	return edited, nil
+}
+
+/*
+ *	Deletes a message, leaving a tombstone in its place. Senders can delete
+ *	their own messages within EditWindow, moderators of the room can delete
+ *	any message at any time.
+ */
+func (hub *Hub) DeleteMessage(username string, siteRole models.Role, conversation, messageID string) (*models.Message, error) {
+	room, err := getConversation(conversation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	role, ok := effectiveRoomRole(room, username, siteRole)
+
+	if !ok {
+		return nil, errNotMember
+	}
+
+	message, err := loadMessage(room, messageID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Deleted {
+		return nil, errNoSuchMessage
+	}
+
+	moderating := role.HasPermission(models.RoomPermissionDeleteMessages)
+
+	if message.Sender != username && !moderating {
+		return nil, errNotAllowed
+	}
+
+	if message.Sender == username && !moderating && time.Since(message.CreatedAt) > EditWindow {
+		return nil, errEditWindowPassed
+	}
+
+	deleted, err := db.Client.DeleteMessage(message.ID, username, time.Now())
+
+	if err == mongo.ErrNoDocuments {
+		return nil, errNoSuchMessage
+	} else if err != nil {
+		return nil, err
+	}
+
+	if message.Sender != username {
+		log.Printf("Message %s of %s was deleted by %s", message.ID.Hex(), message.Sender, username)
+	}
+
+	if len(message.Attachments) > 0 {
+		go removeAttachments(message.Attachments)
+	}
+
+	event := NewEvent(EventDelete, deleted)
+	event.Conversation = conversation
+
+	hub.SendToUsers(memberUsernames(room), event)
+
+	return deleted, nil
+}
+
+// Writes the response for an error returned by the hub
+func writeChatError(w http.ResponseWriter, err error, action string) {
+	var clientErr *ClientError
+
+	if errors.As(err, &clientErr) {
+		http.Error(w, clientErr.Message, clientErr.Status)
+		return
+	}
+
+	http.Error(w, "Failed to "+action, http.StatusInternalServerError)
+	log.Printf("Failed to %s: %v", action, err)
+}
+
+/*
+ *	GET  /api/rooms/{id}/messages?before=&limit= - pages back through the history, newest first
+ *	POST /api/rooms/{id}/messages                - sends a message to the room, or to a thread
+ *	                                               when the draft has a parent
+ */
+func (hub *Hub) MessagesHandler(w http.ResponseWriter, r *http.Request) {
+	claims := auth.GetClaims(r)
+	conversation := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		room, _, err := loadConversation(conversation, claims.Username)
+
+		if err != nil {
+			writeChatError(w, err, "load conversation")
+			return
+		}
+
+		before := primitive.NilObjectID
+
+		if value := r.URL.Query().Get("before"); value != "" {
+			if before, err = primitive.ObjectIDFromHex(value); err != nil {
+				http.Error(w, "Invalid message ID", http.StatusBadRequest)
+				return
+			}
+		}
+
+		limit := DefaultHistoryLimit
+
+		if value := r.URL.Query().Get("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > MaxHistoryLimit {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		messages, err := db.Client.GetMessages(room.ID, before, limit)
+
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Printf("Failed to get messages of room %s: %v", conversation, err)
+			return
+		}
+
+		util.WriteJSON(w, http.StatusOK, messages)
+
+	case http.MethodPost:
+		var draft MessageDraft
+
+		if err := util.ReadJSON(r, &draft); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		frame := &MessageFrame{conversationRef: conversationRef{conversation}, MessageDraft: draft}
+
+		if err := hub.checkFlood(claims.Username, frame); err != nil {
+			writeChatError(w, err, "check flood limits")
+			return
+		}
+
+		message, created, err := hub.PostMessage(claims.Username, conversation, draft)
+
+		if err != nil {
+			writeChatError(w, err, "send message")
+			return
+		}
+
+		if !created {
+			util.WriteJSON(w, http.StatusOK, message)
+			return
+		}
+
+		util.WriteJSON(w, http.StatusCreated, message)
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+ *	PATCH  /api/rooms/{id}/messages/{messageId} - edits one of the user's messages
+ *	DELETE /api/rooms/{id}/messages/{messageId} - deletes a message, leaving a tombstone
+ */
+func (hub *Hub) MessageHandler(w http.ResponseWriter, r *http.Request) {
+	claims := auth.GetClaims(r)
+	conversation := r.PathValue("id")
+	messageID := r.PathValue("messageId")
+
+	switch r.Method {
+	case http.MethodPatch:
+		var request struct {
+			Body string `json:"body"`
+		}
+
+		if err := util.ReadJSON(r, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		frame := &EditFrame{conversationRef: conversationRef{conversation}, MessageID: messageID, Body: request.Body}
+
+		if err := hub.checkFlood(claims.Username, frame); err != nil {
+			writeChatError(w, err, "check flood limits")
+			return
+		}
+
+		message, err := hub.EditMessage(claims.Username, conversation, messageID, request.Body)
+
+		if err != nil {
+			writeChatError(w, err, "edit message")
+			return
+		}
+
+		util.WriteJSON(w, http.StatusOK, message)
+
+	case http.MethodDelete:
+		message, err := hub.DeleteMessage(claims.Username, claims.Role, conversation, messageID)
+
+		if err != nil {
+			writeChatError(w, err, "delete message")
+			return
+		}
+
+		util.WriteJSON(w, http.StatusOK, message)
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+ *	POST /api/rooms/{id}/read
+ *
+ *	Marks the room as read up to the given message.
+ */
+func (hub *Hub) ReadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		MessageID string `json:"messageId"`
+	}
+
+	if err := util.ReadJSON(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := hub.MarkRead(auth.GetClaims(r).Username, r.PathValue("id"), request.MessageID)
+
+	if err != nil {
+		writeChatError(w, err, "mark conversation as read")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,621 @@
+package chat
+
+import (
+	"chat-module/auth"
+	"chat-module/db"
+	"chat-module/util"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type PresenceStatus string
+
+const (
+	StatusOnline  PresenceStatus = "online"
+	StatusAway    PresenceStatus = "away"
+	StatusOffline PresenceStatus = "offline"
+)
+
+const (
+	// How long a connection can go without any activity before it counts as idle
+	IdleTimeout = time.Minute * 5
+
+	// How many users can be asked about in a single presence query
+	MaxPresenceQueryUsers = 100
+
+	// How long the presence another instance reported counts without hearing
+	// from it. Instances send a heartbeat on every presence sweep, so only the
+	// users of an instance that went away expire.
+	presenceStaleAfter = presenceSweepInterval * 3
+)
+
+type Presence struct {
+	Username string         `json:"username"`
+	Status   PresenceStatus `json:"status"`
+	LastSeen *time.Time     `json:"lastSeen,omitempty"`
+}
+
+type connectionState struct {
+	lastActivity time.Time
+
+	// Set when the client tells us the user stepped away, regardless of activity
+	away bool
+}
+
+/*
+ *	What an instance tells the others about the connections of an user to it.
+ *	Offline means the user has none left there. Heartbeats are about no user,
+ *	they only tell that the instance is still around.
+ */
+type presenceUpdate struct {
+	Instance  string         `json:"instance"`
+	Username  string         `json:"username,omitempty"`
+	Status    PresenceStatus `json:"status,omitempty"`
+	LastSeen  time.Time      `json:"lastSeen"`
+	Heartbeat bool           `json:"heartbeat,omitempty"`
+}
+
+// The presence of an user on one instance
+type instancePresence struct {
+	status     PresenceStatus
+	lastSeen   time.Time
+	receivedAt time.Time
+}
+
+/*
+ *	Tracks the presence of users across all of their connections, on every
+ *	instance. An user is online if any of their connections is active, away if
+ *	all of them are idle or marked as away, and offline once the last one
+ *	disconnects. Changes are announced to everybody sharing a room with the
+ *	user.
+ *
+ *	Each instance only knows the connections to itself, and publishes the
+ *	presence they add up to on the bus whenever it changes. Every instance,
+ *	this one included, combines what it hears into the presence of the user,
+ *	and announces the changes to the users connected to it. Instances hearing
+ *	from another one for the first time publish all of theirs once, so the
+ *	newcomer catches up.
+ */
+type PresenceTracker struct {
+	hub  *Hub
+	lock sync.Mutex
+
+	// Connections to this instance
+	connections map[string]map[*Client]*connectionState
+
+	// The last status this instance published for each user connected to it
+	published map[string]PresenceStatus
+
+	// What every instance last said about each user, by instance
+	instances map[string]map[string]*instancePresence
+
+	// When we last heard a heartbeat of each of the other instances
+	heartbeats map[string]time.Time
+
+	// The last status we announced for each user who is online or away
+	statuses map[string]PresenceStatus
+
+	// When users who disconnected while we were running were last seen, so we
+	// don't have to go to the database for them
+	lastSeen map[string]time.Time
+
+	announcements chan Presence
+	updates       chan presenceUpdate
+}
+
+func newPresenceTracker(hub *Hub) *PresenceTracker {
+	return &PresenceTracker{
+		hub:           hub,
+		connections:   make(map[string]map[*Client]*connectionState),
+		published:     make(map[string]PresenceStatus),
+		instances:     make(map[string]map[string]*instancePresence),
+		heartbeats:    make(map[string]time.Time),
+		statuses:      make(map[string]PresenceStatus),
+		lastSeen:      make(map[string]time.Time),
+		announcements: make(chan Presence, 256),
+		updates:       make(chan presenceUpdate, 256),
+	}
+}
+
+/*
+ *	Works out the presence of an user from their connections to this instance
+ *	alone. Must be called with the lock held, for an user with connections.
+ */
+func (tracker *PresenceTracker) computeLocal(username string, now time.Time) presenceUpdate {
+	status := StatusAway
+	var lastActivity time.Time
+
+	for _, state := range tracker.connections[username] {
+		if state.lastActivity.After(lastActivity) {
+			lastActivity = state.lastActivity
+		}
+
+		if !state.away && now.Sub(state.lastActivity) < IdleTimeout {
+			status = StatusOnline
+		}
+	}
+
+	return presenceUpdate{
+		Instance: tracker.hub.instance,
+		Username: username,
+		Status:   status,
+		LastSeen: lastActivity,
+	}
+}
+
+// Works out the current presence of an user. Must be called with the lock held.
+func (tracker *PresenceTracker) compute(username string) Presence {
+	instances := tracker.instances[username]
+
+	if len(instances) == 0 {
+		presence := Presence{Username: username, Status: StatusOffline}
+
+		if lastSeen, ok := tracker.lastSeen[username]; ok {
+			presence.LastSeen = &lastSeen
+		}
+
+		return presence
+	}
+
+	status := StatusAway
+	var lastSeen time.Time
+
+	for _, instance := range instances {
+		if instance.lastSeen.After(lastSeen) {
+			lastSeen = instance.lastSeen
+		}
+
+		if instance.status == StatusOnline {
+			status = StatusOnline
+		}
+	}
+
+	return Presence{Username: username, Status: status, LastSeen: &lastSeen}
+}
+
+// Queues an update for the other instances. Must be called with the lock held.
+func (tracker *PresenceTracker) publish(update presenceUpdate) {
+	select {
+	case tracker.updates <- update:
+	default:
+		log.Printf("Presence update queue is full, dropping update for %s", update.Username)
+	}
+}
+
+/*
+ *	Recomputes the presence of an user connected to this instance and publishes
+ *	it if it changed. Must be called with the lock held.
+ */
+func (tracker *PresenceTracker) update(username string, now time.Time) {
+	update := tracker.computeLocal(username, now)
+
+	if tracker.published[username] == update.Status {
+		return
+	}
+
+	tracker.published[username] = update.Status
+	tracker.publish(update)
+}
+
+/*
+ *	Announces the presence of an user if it changed since it was last announced.
+ *	The instance the user disconnected from last stores when they were last
+ *	seen. Must be called with the lock held.
+ */
+func (tracker *PresenceTracker) reconcile(username string, persist bool) {
+	presence := tracker.compute(username)
+
+	if tracker.statuses[username] == presence.Status {
+		return
+	}
+
+	if presence.Status == StatusOffline {
+		delete(tracker.statuses, username)
+
+		if persist && presence.LastSeen != nil {
+			go tracker.persistLastSeen(username, *presence.LastSeen)
+		}
+	} else {
+		tracker.statuses[username] = presence.Status
+	}
+
+	select {
+	case tracker.announcements <- presence:
+	default:
+		log.Printf("Presence announcement queue is full, dropping update for %s", username)
+	}
+}
+
+// Drops what an instance said about the user, keeping when they were last seen there
+func (tracker *PresenceTracker) forget(username, instance string) {
+	if state, ok := tracker.instances[username][instance]; ok && state.lastSeen.After(tracker.lastSeen[username]) {
+		tracker.lastSeen[username] = state.lastSeen
+	}
+
+	delete(tracker.instances[username], instance)
+
+	if len(tracker.instances[username]) == 0 {
+		delete(tracker.instances, username)
+	}
+}
+
+// Takes in a presence update from the bus, which may come from this instance
+func (tracker *PresenceTracker) receive(data []byte) {
+	var update presenceUpdate
+
+	if err := json.Unmarshal(data, &update); err != nil {
+		log.Printf("Failed to decode presence update from the bus: %v", err)
+		return
+	}
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	if update.Heartbeat {
+		tracker.receiveHeartbeat(update.Instance)
+		return
+	}
+
+	if update.Status == StatusOffline {
+		if update.LastSeen.After(tracker.lastSeen[update.Username]) {
+			tracker.lastSeen[update.Username] = update.LastSeen
+		}
+
+		tracker.forget(update.Username, update.Instance)
+	} else {
+		if tracker.instances[update.Username] == nil {
+			tracker.instances[update.Username] = make(map[string]*instancePresence)
+		}
+
+		tracker.instances[update.Username][update.Instance] = &instancePresence{
+			status:     update.Status,
+			lastSeen:   update.LastSeen,
+			receivedAt: time.Now(),
+		}
+	}
+
+	tracker.reconcile(update.Username, update.Instance == tracker.hub.instance)
+}
+
+/*
+ *	Keeps the users of another instance from expiring. An instance we haven't
+ *	heard from before, or not for a while, gets the presence of everybody
+ *	connected here. Must be called with the lock held.
+ */
+func (tracker *PresenceTracker) receiveHeartbeat(instance string) {
+	if instance == tracker.hub.instance {
+		return
+	}
+
+	_, known := tracker.heartbeats[instance]
+	now := time.Now()
+	tracker.heartbeats[instance] = now
+
+	if known {
+		return
+	}
+
+	for username := range tracker.connections {
+		update := tracker.computeLocal(username, now)
+		tracker.published[username] = update.Status
+		tracker.publish(update)
+	}
+}
+
+// Tells the other instances this one is still around
+func (tracker *PresenceTracker) heartbeat() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	tracker.publish(presenceUpdate{Instance: tracker.hub.instance, LastSeen: time.Now(), Heartbeat: true})
+}
+
+/*
+ *	Sends the presence updates out on the bus one at a time, so they arrive in
+ *	order. Once the hub stops, the updates still queued go out, so the other
+ *	instances hear about the users that were disconnected on the way.
+ */
+func (tracker *PresenceTracker) publishLoop() {
+	defer tracker.hub.loops.Done()
+
+	for {
+		select {
+		case update := <-tracker.updates:
+			tracker.sendUpdate(update)
+
+		case <-tracker.hub.quit:
+			for {
+				select {
+				case update := <-tracker.updates:
+					tracker.sendUpdate(update)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (tracker *PresenceTracker) sendUpdate(update presenceUpdate) {
+	data, err := json.Marshal(update)
+
+	if err != nil {
+		log.Printf("Failed to encode presence update: %v", err)
+		return
+	}
+
+	if err := tracker.hub.bus.Publish(topicPresence, data); err != nil {
+		log.Printf("Failed to publish presence update for %s: %v", update.Username, err)
+	}
+}
+
+func (tracker *PresenceTracker) connect(client *Client) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	now := time.Now()
+
+	if tracker.connections[client.username] == nil {
+		tracker.connections[client.username] = make(map[*Client]*connectionState)
+	}
+
+	tracker.connections[client.username][client] = &connectionState{lastActivity: now}
+
+	tracker.update(client.username, now)
+}
+
+func (tracker *PresenceTracker) disconnect(client *Client) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	state, ok := tracker.connections[client.username][client]
+
+	if !ok {
+		return
+	}
+
+	delete(tracker.connections[client.username], client)
+
+	if len(tracker.connections[client.username]) > 0 {
+		tracker.update(client.username, time.Now())
+		return
+	}
+
+	delete(tracker.connections, client.username)
+
+	// The user was last seen whenever any of their connections was last active
+	lastSeen := state.lastActivity
+	if tracker.published[client.username] == StatusOnline {
+		lastSeen = time.Now()
+	}
+
+	delete(tracker.published, client.username)
+
+	tracker.publish(presenceUpdate{
+		Instance: tracker.hub.instance,
+		Username: client.username,
+		Status:   StatusOffline,
+		LastSeen: lastSeen,
+	})
+}
+
+// Records activity on a connection
+func (tracker *PresenceTracker) touch(client *Client) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	state, ok := tracker.connections[client.username][client]
+
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	state.lastActivity = now
+
+	tracker.update(client.username, now)
+}
+
+// Marks a connection as away, or back from being away
+func (tracker *PresenceTracker) setAway(client *Client, away bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	state, ok := tracker.connections[client.username][client]
+
+	if !ok {
+		return
+	}
+
+	state.away = away
+
+	tracker.update(client.username, time.Now())
+}
+
+/*
+ *	Catches users whose connections went idle since we last looked, publishing
+ *	only the ones that did, and sends the heartbeat of this instance. Users of
+ *	instances we stopped hearing from are dropped.
+ */
+func (tracker *PresenceTracker) sweep(now time.Time) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	for username := range tracker.connections {
+		tracker.update(username, now)
+	}
+
+	tracker.publish(presenceUpdate{Instance: tracker.hub.instance, LastSeen: now, Heartbeat: true})
+
+	for instance, heardAt := range tracker.heartbeats {
+		if now.Sub(heardAt) > presenceStaleAfter {
+			delete(tracker.heartbeats, instance)
+		}
+	}
+
+	for username, instances := range tracker.instances {
+		for instance, state := range instances {
+			if instance == tracker.hub.instance {
+				continue
+			}
+
+			_, alive := tracker.heartbeats[instance]
+
+			if !alive && now.Sub(state.receivedAt) > presenceStaleAfter {
+				tracker.forget(username, instance)
+				tracker.reconcile(username, false)
+			}
+		}
+	}
+}
+
+func (tracker *PresenceTracker) persistLastSeen(username string, lastSeen time.Time) {
+	if err := db.Client.SetLastSeen(username, lastSeen); err != nil && err != mongo.ErrNoDocuments {
+		log.Printf("Failed to store last seen time of user %s: %v", username, err)
+	}
+}
+
+/*
+ *	Returns everybody who should hear about presence changes of the user, which
+ *	is the user themselves and everybody sharing a room with them.
+ */
+func presenceAudience(username string) ([]string, error) {
+	rooms, err := db.Client.GetUserRooms(username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{username: true}
+	audience := []string{username}
+
+	for _, room := range rooms {
+		for _, member := range room.Members {
+			if !seen[member.Username] {
+				seen[member.Username] = true
+				audience = append(audience, member.Username)
+			}
+		}
+	}
+
+	return audience, nil
+}
+
+// Sends out the presence changes one at a time, so they arrive in order
+func (tracker *PresenceTracker) announceLoop() {
+	for {
+		var presence Presence
+
+		select {
+		case presence = <-tracker.announcements:
+		case <-tracker.hub.quit:
+			return
+		}
+
+		audience, err := presenceAudience(presence.Username)
+
+		if err != nil {
+			log.Printf("Failed to find presence audience of user %s: %v", presence.Username, err)
+			continue
+		}
+
+		// Every instance announces the change to its own users
+		tracker.hub.sendLocally(audience, NewEvent(EventPresence, presence))
+	}
+}
+
+// Whether the user is connected and active right now
+func (tracker *PresenceTracker) IsOnline(username string) bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	return tracker.compute(username).Status == StatusOnline
+}
+
+// Returns the presence of an user, going to the database for the last seen time if needed
+func (tracker *PresenceTracker) Get(username string) (Presence, error) {
+	tracker.lock.Lock()
+	presence := tracker.compute(username)
+	tracker.lock.Unlock()
+
+	if presence.Status != StatusOffline || presence.LastSeen != nil {
+		return presence, nil
+	}
+
+	user, err := db.Client.GetUser(username)
+
+	// Users are only ever looked up by their exact username, never their email
+	if err == nil && *user.Username != username {
+		err = mongo.ErrNoDocuments
+	}
+
+	if err != nil {
+		return presence, err
+	}
+
+	presence.LastSeen = user.LastSeen
+
+	return presence, nil
+}
+
+/*
+ *	GET /api/presence?users=alice,bob
+ *
+ *	Returns the presence of each of the given users. Unknown users and users
+ *	who don't share a room with the caller are left out, the same way they
+ *	never hear about presence changes of each other.
+ */
+func (hub *Hub) PresenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	usernames := strings.Split(r.URL.Query().Get("users"), ",")
+
+	if len(usernames) > MaxPresenceQueryUsers {
+		http.Error(w, "Too many users requested", http.StatusBadRequest)
+		return
+	}
+
+	audience, err := presenceAudience(auth.GetClaims(r).Username)
+
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to find presence audience of user %s: %v", auth.GetClaims(r).Username, err)
+		return
+	}
+
+	visible := make(map[string]bool, len(audience))
+	for _, username := range audience {
+		visible[username] = true
+	}
+
+	response := []Presence{}
+
+	for _, username := range usernames {
+		if !visible[username] {
+			continue
+		}
+
+		presence, err := hub.Presence.Get(username)
+
+		if err == mongo.ErrNoDocuments {
+			continue
+		} else if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Printf("Failed to get presence of user %s: %v", username, err)
+			return
+		}
+
+		response = append(response, presence)
+	}
+
+	util.WriteJSON(w, http.StatusOK, response)
+}
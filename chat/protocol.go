@@ -0,0 +1,378 @@
+package chat
+
+import (
+	"bytes"
+	"chat-module/models"
+	"chat-module/schema"
+	"chat-module/util"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"github.com/fxamacker/cbor/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Version of what goes over sockets, event streams and polls. Frames that
+	// don't say which version they are count as this one.
+	ProtocolVersion = 1
+
+	// Socket subprotocols. Both carry the same documents, CBOR is just more
+	// compact. Sockets that don't ask for either speak JSON.
+	SubprotocolJSON = "chat.v1.json"
+	SubprotocolCBOR = "chat.v1.cbor"
+
+	// Longest ID a client can give a frame
+	MaxFrameIDLength = 64
+)
+
+/*
+ *	A frame received from a client. Frames with an ID get an ack event once
+ *	they are done, and the error event if they fail refers to them by it.
+ *	The conversation is used for payloads that leave theirs out.
+ */
+type Frame struct {
+	Version      int             `json:"v,omitempty"`
+	Type         string          `json:"type"`
+	ID           string          `json:"id,omitempty"`
+	Conversation string          `json:"conversation,omitempty"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+// Confirms that the frame with the given ID went through
+type AckPayload struct {
+	Frame string `json:"frame"`
+
+	// What came out of it, such as the message that was sent
+	Result any `json:"result,omitempty"`
+}
+
+type ErrorPayload struct {
+	// The frame that failed, if it had an ID
+	Frame string `json:"frame,omitempty"`
+
+	// The HTTP status the same failure gets over the REST API
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// The payload of a frame, which knows how to check and carry out itself
+type framePayload interface {
+	validate() error
+	handle(client *Client) (any, error)
+}
+
+// Embedded in the payloads of frames about a conversation
+type conversationRef struct {
+	Conversation string `json:"conversation"`
+}
+
+func (ref *conversationRef) useConversation(conversation string) {
+	if ref.Conversation == "" {
+		ref.Conversation = conversation
+	}
+}
+
+func (ref *conversationRef) validate() error {
+	if ref.Conversation == "" {
+		return &ClientError{http.StatusBadRequest, "conversation is required"}
+	}
+
+	return nil
+}
+
+type PresenceFrame struct {
+	Status PresenceStatus `json:"status"`
+}
+
+type TypingFrame struct {
+	conversationRef
+	Typing bool `json:"typing"`
+}
+
+type MessageFrame struct {
+	conversationRef
+	MessageDraft
+}
+
+type ReadFrame struct {
+	conversationRef
+	MessageID string `json:"messageId"`
+}
+
+type EditFrame struct {
+	conversationRef
+	MessageID string `json:"messageId"`
+	Body      string `json:"body"`
+}
+
+type DeleteFrame struct {
+	conversationRef
+	MessageID string `json:"messageId"`
+}
+
+type ReactionFrame struct {
+	conversationRef
+	MessageID string `json:"messageId"`
+	Emoji     string `json:"emoji"`
+	Remove    bool   `json:"remove"`
+}
+
+type SyncFrame struct {
+	// The last sequence number the client saw, by conversation
+	Conversations map[string]int64 `json:"conversations"`
+}
+
+type frameType struct {
+	// What the frame does, for the messages of errors
+	action  string
+	payload func() framePayload
+}
+
+var frameTypes = map[string]frameType{
+	FramePresence: {"update presence", func() framePayload { return &PresenceFrame{} }},
+	FrameTyping:   {"announce typing", func() framePayload { return &TypingFrame{} }},
+	FrameMessage:  {"send message", func() framePayload { return &MessageFrame{} }},
+	FrameRead:     {"mark conversation as read", func() framePayload { return &ReadFrame{} }},
+	FrameEdit:     {"edit message", func() framePayload { return &EditFrame{} }},
+	FrameDelete:   {"delete message", func() framePayload { return &DeleteFrame{} }},
+	FrameReaction: {"update reaction", func() framePayload { return &ReactionFrame{} }},
+	FrameSync:     {"catch up on conversations", func() framePayload { return &SyncFrame{} }},
+}
+
+// What the payload of each type of event looks like, nil for events without one
+var eventPayloads = map[string]any{
+	EventPresence: Presence{},
+	EventTyping:   TypingPayload{},
+	EventMessage:  models.Message{},
+	EventRead:     ReadPayload{},
+	EventEdit:     models.Message{},
+	EventDelete:   models.Message{},
+	EventThread:   ThreadPayload{},
+	EventReaction: ReactionPayload{},
+	EventMention:  MentionPayload{},
+	EventSync:     SyncPayload{},
+	EventResync:   nil,
+	EventAck:      AckPayload{},
+	EventError:    ErrorPayload{},
+	EventPenalty:  PenaltyPayload{},
+}
+
+/*
+ *	Checks the envelope of the frame and decodes its payload into the type
+ *	the frame calls for.
+ */
+func parseFrame(frame *Frame) (framePayload, error) {
+	if frame.Version != 0 && frame.Version != ProtocolVersion {
+		return nil, &ClientError{http.StatusBadRequest, fmt.Sprintf("unsupported protocol version %d", frame.Version)}
+	}
+
+	if len(frame.ID) > MaxFrameIDLength {
+		return nil, &ClientError{http.StatusBadRequest, "frame ID must be at most 64 characters"}
+	}
+
+	frameType, ok := frameTypes[frame.Type]
+
+	if !ok {
+		return nil, &ClientError{http.StatusBadRequest, "Unknown frame type"}
+	}
+
+	payload := frameType.payload()
+
+	if err := json.Unmarshal(frame.Payload, payload); err != nil || bytes.Equal(frame.Payload, []byte("null")) {
+		return nil, &ClientError{http.StatusBadRequest, "Invalid " + frame.Type + " payload"}
+	}
+
+	if ref, ok := payload.(interface{ useConversation(string) }); ok {
+		ref.useConversation(frame.Conversation)
+	}
+
+	if err := payload.validate(); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+func (frame *PresenceFrame) validate() error {
+	if frame.Status != StatusOnline && frame.Status != StatusAway {
+		return &ClientError{http.StatusBadRequest, "Invalid presence status"}
+	}
+
+	return nil
+}
+
+func (frame *SyncFrame) validate() error {
+	if len(frame.Conversations) > MaxSyncConversations {
+		return &ClientError{http.StatusBadRequest, "Too many conversations to catch up on"}
+	}
+
+	return nil
+}
+
+var (
+	cborEncoding, _ = cbor.CoreDetEncOptions().EncMode()
+	cborDecoding, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any{})}.DecMode()
+)
+
+/*
+ *	Turns JSON numbers into integers where they are whole, so they stay
+ *	integers in CBOR instead of becoming floats.
+ */
+func withIntegers(value any) any {
+	switch value := value.(type) {
+	case json.Number:
+		if integer, err := value.Int64(); err == nil {
+			return integer
+		}
+
+		float, _ := value.Float64()
+		return float
+
+	case map[string]any:
+		for key, entry := range value {
+			value[key] = withIntegers(entry)
+		}
+
+	case []any:
+		for i, entry := range value {
+			value[i] = withIntegers(entry)
+		}
+	}
+
+	return value
+}
+
+/*
+ *	Encodes an event for a client. In CBOR the event is the same document as
+ *	in JSON, so the schema describes both.
+ */
+func encodeEvent(event *Event, binary bool) ([]byte, error) {
+	data, err := json.Marshal(event)
+
+	if err != nil || !binary {
+		return data, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	return cborEncoding.Marshal(withIntegers(document))
+}
+
+func decodeFrame(data []byte, binary bool) (*Frame, error) {
+	if binary {
+		var document any
+		if err := cborDecoding.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if data, err = json.Marshal(document); err != nil {
+			return nil, err
+		}
+	}
+
+	var frame Frame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return nil, err
+	}
+
+	return &frame, nil
+}
+
+func sortedKeys[T any](entries map[string]T) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+ *	JSON Schema of the protocol, generated from the types above. ClientFrame
+ *	describes what clients send, ServerEvent what they get back.
+ */
+func ProtocolSchema() map[string]any {
+	generator := schema.NewGenerator()
+
+	generator.Override(reflect.TypeOf(primitive.ObjectID{}), map[string]any{"type": "string", "pattern": "^[0-9a-f]{24}$"})
+	generator.Override(reflect.TypeOf(PresenceStatus("")), map[string]any{"enum": []any{StatusOnline, StatusAway, StatusOffline}})
+	generator.Override(reflect.TypeOf(models.RoomRole("")), map[string]any{"type": "string"})
+
+	frames := []any{}
+
+	for _, name := range sortedKeys(frameTypes) {
+		frames = append(frames, map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"v":            map[string]any{"const": ProtocolVersion},
+				"type":         map[string]any{"const": name},
+				"id":           map[string]any{"type": "string", "maxLength": MaxFrameIDLength},
+				"conversation": map[string]any{"type": "string"},
+				"payload":      generator.Schema(reflect.TypeOf(frameTypes[name].payload()).Elem()),
+			},
+			"required":             []string{"type", "payload"},
+			"additionalProperties": false,
+		})
+	}
+
+	events := []any{}
+
+	for _, name := range sortedKeys(eventPayloads) {
+		properties := map[string]any{
+			"v":            map[string]any{"const": ProtocolVersion},
+			"type":         map[string]any{"const": name},
+			"id":           map[string]any{"type": "string"},
+			"conversation": map[string]any{"type": "string"},
+			"timestamp":    map[string]any{"type": "string", "format": "date-time"},
+		}
+
+		if payload := eventPayloads[name]; payload != nil {
+			properties["payload"] = generator.Schema(reflect.TypeOf(payload))
+		}
+
+		events = append(events, map[string]any{
+			"type":                 "object",
+			"properties":           properties,
+			"required":             []string{"v", "type", "id", "timestamp"},
+			"additionalProperties": false,
+		})
+	}
+
+	definitions := generator.Definitions()
+	definitions["ClientFrame"] = map[string]any{"oneOf": frames}
+	definitions["ServerEvent"] = map[string]any{"oneOf": events}
+
+	return map[string]any{
+		"$schema": schema.Draft,
+		"$id":     fmt.Sprintf("chat-protocol-v%d", ProtocolVersion),
+		"title":   "Chat protocol",
+		"oneOf":   []any{map[string]any{"$ref": "#/$defs/ClientFrame"}, map[string]any{"$ref": "#/$defs/ServerEvent"}},
+		"$defs":   definitions,
+	}
+}
+
+/*
+ *	GET /api/protocol/schema
+ *
+ *	The JSON Schema of the frames and events, for building clients against.
+ */
+func ProtocolSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, ProtocolSchema())
+}
@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"chat-module/auth"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/util"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// How many different emoji a single message can collect
+	MaxReactionsPerMessage = 20
+
+	// Long enough for emoji made of several code points and for :shortcodes:
+	MaxEmojiLength = 32
+)
+
+var errTooManyReactions = &ClientError{http.StatusConflict, "the message can't take any more different reactions"}
+
+// Sent to the members of a conversation whenever a reaction is added or removed
+type ReactionPayload struct {
+	MessageID primitive.ObjectID `json:"messageId"`
+	Emoji     string             `json:"emoji"`
+	Username  string             `json:"username"`
+	Added     bool               `json:"added"`
+
+	// All reactions of the message after the change
+	Reactions []models.Reaction `json:"reactions"`
+}
+
+func validateEmoji(emoji string) error {
+	if emoji == "" || utf8.RuneCountInString(emoji) > MaxEmojiLength || strings.IndexFunc(emoji, unicode.IsSpace) >= 0 {
+		return &ClientError{http.StatusBadRequest, "invalid reaction"}
+	}
+
+	return nil
+}
+
+/*
+ *	Adds or removes the reaction of the user on a message and lets the members
+ *	of the conversation know. Adding a reaction the user already has, or
+ *	removing one they don't, changes nothing but is not an error.
+ */
+func (hub *Hub) React(username, conversation, messageID, emoji string, add bool) (*models.Message, error) {
+	room, member, err := loadConversation(conversation, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !member.Role.HasPermission(models.RoomPermissionSend) {
+		return nil, errNotAllowed
+	}
+
+	if err := validateEmoji(emoji); err != nil {
+		return nil, err
+	}
+
+	message, err := loadMessage(room, messageID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Deleted {
+		return nil, errNoSuchMessage
+	}
+
+	if add {
+		message, err = db.Client.AddReaction(message.ID, emoji, username, MaxReactionsPerMessage)
+	} else {
+		message, err = db.Client.RemoveReaction(message.ID, emoji, username)
+	}
+
+	if err == mongo.ErrNoDocuments {
+		return nil, errNoSuchMessage
+	} else if err == db.ErrTooManyReactions {
+		return nil, errTooManyReactions
+	} else if err != nil {
+		return nil, err
+	}
+
+	event := NewEvent(EventReaction, ReactionPayload{
+		MessageID: message.ID,
+		Emoji:     emoji,
+		Username:  username,
+		Added:     add,
+		Reactions: message.Reactions,
+	})
+	event.Conversation = conversation
+
+	hub.SendToUsers(memberUsernames(room), event)
+
+	return message, nil
+}
+
+/*
+ *	PUT    /api/rooms/{id}/messages/{messageId}/reactions/{emoji} - reacts to the message
+ *	DELETE /api/rooms/{id}/messages/{messageId}/reactions/{emoji} - takes the reaction back
+ */
+func (hub *Hub) ReactionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := auth.GetClaims(r).Username
+	frame := &ReactionFrame{
+		conversationRef: conversationRef{r.PathValue("id")},
+		MessageID:       r.PathValue("messageId"),
+		Emoji:           r.PathValue("emoji"),
+		Remove:          r.Method == http.MethodDelete,
+	}
+
+	if err := hub.checkFlood(username, frame); err != nil {
+		writeChatError(w, err, "check flood limits")
+		return
+	}
+
+	message, err := hub.React(username, frame.Conversation, frame.MessageID, frame.Emoji, !frame.Remove)
+
+	if err != nil {
+		writeChatError(w, err, "update reaction")
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, message)
+}
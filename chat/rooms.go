@@ -0,0 +1,429 @@
+package chat
+
+import (
+	"chat-module/auth"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/util"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const MaxRoomNameLength = 64
+
+/*
+ *	Returns the role the user effectively has in the room. Site moderators and
+ *	admins act as room moderators everywhere, even in rooms they aren't in,
+ *	except for direct conversations which stay private to their two members.
+ *	The second value is false if the user has no business in the room at all.
+ */
+func effectiveRoomRole(room *models.Room, username string, siteRole models.Role) (models.RoomRole, bool) {
+	role := models.RoomRole("")
+
+	if member := room.GetMember(username); member != nil {
+		role = member.Role
+	}
+
+	if room.IsDirect() {
+		return role, role != ""
+	}
+
+	if siteRole.HasPermission(models.PermissionModerateRooms) && models.RoomRoleModerator.Outranks(role) {
+		role = models.RoomRoleModerator
+	}
+
+	return role, role != ""
+}
+
+/*
+ *	Loads the room from the {id} path value and checks that the user making the
+ *	request is allowed to see it. Writes the error response and returns nil if
+ *	anything goes wrong.
+ */
+func loadRoom(w http.ResponseWriter, r *http.Request) (*models.Room, models.RoomRole) {
+	roomID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return nil, ""
+	}
+
+	room, err := db.Client.GetRoom(roomID)
+
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "No such room", http.StatusNotFound)
+		return nil, ""
+	} else if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to get room %s: %v", roomID.Hex(), err)
+		return nil, ""
+	}
+
+	claims := auth.GetClaims(r)
+	role, ok := effectiveRoomRole(room, claims.Username, claims.Role)
+
+	if !ok {
+		// Don't give away which rooms exist
+		http.Error(w, "No such room", http.StatusNotFound)
+		return nil, ""
+	}
+
+	return room, role
+}
+
+// An entry of the conversation list
+type roomSummary struct {
+	models.Room
+	UnreadCount int64 `json:"unreadCount"`
+}
+
+/*
+ *	GET  /api/rooms - lists the rooms the user is a member of, with the number
+ *	                  of messages they haven't read in each
+ *	POST /api/rooms - creates a new room, with the user as its owner
+ */
+func RoomsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := auth.GetClaims(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		rooms, err := db.Client.GetUserRooms(claims.Username)
+
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Printf("Failed to get rooms of user %s: %v", claims.Username, err)
+			return
+		}
+
+		lastRead := make(map[primitive.ObjectID]primitive.ObjectID, len(rooms))
+		for i := range rooms {
+			lastRead[rooms[i].ID] = rooms[i].GetMember(claims.Username).LastRead
+		}
+
+		unread, err := db.Client.CountUnread(claims.Username, lastRead)
+
+		if err != nil {
+			http.Error(w, "Failed to query database", http.StatusInternalServerError)
+			log.Printf("Failed to count unread messages of user %s: %v", claims.Username, err)
+			return
+		}
+
+		summaries := make([]roomSummary, 0, len(rooms))
+		for _, room := range rooms {
+			summaries = append(summaries, roomSummary{Room: room, UnreadCount: unread[room.ID]})
+		}
+
+		util.WriteJSON(w, http.StatusOK, summaries)
+
+	case http.MethodPost:
+		var request struct {
+			Name string `json:"name"`
+		}
+
+		if err := util.ReadJSON(r, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		request.Name = strings.TrimSpace(request.Name)
+
+		if request.Name == "" || len(request.Name) > MaxRoomNameLength {
+			http.Error(w, "Room name must be between 1 and 64 characters", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+
+		room := models.Room{
+			ID:        primitive.NewObjectID(),
+			Kind:      models.RoomKindGroup,
+			Name:      request.Name,
+			CreatedBy: claims.Username,
+			CreatedAt: now,
+			Members: []models.RoomMember{
+				{Username: claims.Username, Role: models.RoomRoleOwner, JoinedAt: now},
+			},
+		}
+
+		if err := db.Client.AddRoom(room); err != nil {
+			http.Error(w, "Failed to create room", http.StatusInternalServerError)
+			log.Printf("Failed to create room %s: %v", room.Name, err)
+			return
+		}
+
+		util.WriteJSON(w, http.StatusCreated, room)
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+ *	GET    /api/rooms/{id} - returns the room with its members
+ *	DELETE /api/rooms/{id} - deletes the room, only for its owner
+ */
+func RoomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room, role := loadRoom(w, r)
+
+	if room == nil {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		util.WriteJSON(w, http.StatusOK, room)
+		return
+	}
+
+	claims := auth.GetClaims(r)
+
+	// Site admins can get rid of any room, everybody else needs to own it
+	if !role.HasPermission(models.RoomPermissionDeleteRoom) && !claims.Role.HasPermission(models.PermissionManageUsers) {
+		http.Error(w, "You don't have permission to do this", http.StatusForbidden)
+		return
+	}
+
+	if err := db.Client.DeleteRoom(room.ID); err != nil && err != mongo.ErrNoDocuments {
+		http.Error(w, "Failed to delete room", http.StatusInternalServerError)
+		log.Printf("Failed to delete room %s: %v", room.ID.Hex(), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+ *	POST /api/rooms/{id}/members
+ *
+ *	Adds an user to the room as a regular member.
+ */
+func RoomMembersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room, role := loadRoom(w, r)
+
+	if room == nil {
+		return
+	}
+
+	if room.IsDirect() {
+		http.Error(w, "Direct conversations can't have more members", http.StatusBadRequest)
+		return
+	}
+
+	if !role.HasPermission(models.RoomPermissionInvite) {
+		http.Error(w, "You don't have permission to do this", http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Username *string `json:"username"`
+	}
+
+	if err := util.ReadJSON(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Username == nil {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	user, err := db.Client.GetUser(*request.Username)
+
+	if err == mongo.ErrNoDocuments || (err == nil && *user.Username != *request.Username) {
+		http.Error(w, "Such an user doesn't exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to find user %s: %v", *request.Username, err)
+		return
+	}
+
+	member := models.RoomMember{
+		Username: *user.Username,
+		Role:     models.RoomRoleMember,
+		JoinedAt: time.Now(),
+	}
+
+	err = db.Client.AddRoomMember(room.ID, member)
+
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "User is already a member of this room", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to add member", http.StatusInternalServerError)
+		log.Printf("Failed to add %s to room %s: %v", member.Username, room.ID.Hex(), err)
+		return
+	}
+
+	util.WriteJSON(w, http.StatusCreated, member)
+}
+
+/*
+ *	DELETE /api/rooms/{id}/members/{username} - kicks the member out of the room,
+ *	                                            or leaves it if it's the user themselves
+ *	PATCH  /api/rooms/{id}/members/{username} - changes the role of the member
+ */
+func RoomMemberHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPatch {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room, role := loadRoom(w, r)
+
+	if room == nil {
+		return
+	}
+
+	if room.IsDirect() {
+		http.Error(w, "Members of direct conversations can't be changed", http.StatusBadRequest)
+		return
+	}
+
+	claims := auth.GetClaims(r)
+	target := room.GetMember(r.PathValue("username"))
+
+	if target == nil {
+		http.Error(w, "No such member", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		leaving := target.Username == claims.Username
+
+		if leaving && target.Role == models.RoomRoleOwner {
+			http.Error(w, "The owner can't leave the room, delete it instead", http.StatusBadRequest)
+			return
+		}
+
+		if !leaving && (!role.HasPermission(models.RoomPermissionKick) || !role.Outranks(target.Role)) {
+			http.Error(w, "You don't have permission to do this", http.StatusForbidden)
+			return
+		}
+
+		err := db.Client.RemoveRoomMember(room.ID, target.Username)
+
+		if err != nil && err != mongo.ErrNoDocuments {
+			http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+			log.Printf("Failed to remove %s from room %s: %v", target.Username, room.ID.Hex(), err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var request struct {
+		Role models.RoomRole `json:"role"`
+	}
+
+	if err := util.ReadJSON(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Ownership can't be handed out through here, there is only ever one owner
+	if !request.Role.IsValid() || request.Role == models.RoomRoleOwner {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	if !role.HasPermission(models.RoomPermissionManageRoles) || !role.Outranks(target.Role) {
+		http.Error(w, "You don't have permission to do this", http.StatusForbidden)
+		return
+	}
+
+	err := db.Client.SetRoomMemberRole(room.ID, target.Username, request.Role)
+
+	if err != nil && err != mongo.ErrNoDocuments {
+		http.Error(w, "Failed to change role", http.StatusInternalServerError)
+		log.Printf("Failed to change role of %s in room %s: %v", target.Username, room.ID.Hex(), err)
+		return
+	}
+
+	target.Role = request.Role
+	util.WriteJSON(w, http.StatusOK, target)
+}
+
+/*
+ *	POST /api/dms
+ *
+ *	Opens the direct conversation with another user, creating it the first time.
+ */
+func DirectMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := auth.GetClaims(r)
+
+	var request struct {
+		Username *string `json:"username"`
+	}
+
+	if err := util.ReadJSON(r, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Username == nil {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	if *request.Username == claims.Username {
+		http.Error(w, "You can't open a conversation with yourself", http.StatusBadRequest)
+		return
+	}
+
+	user, err := db.Client.GetUser(*request.Username)
+
+	if err == mongo.ErrNoDocuments || (err == nil && *user.Username != *request.Username) {
+		http.Error(w, "Such an user doesn't exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to find user %s: %v", *request.Username, err)
+		return
+	}
+
+	now := time.Now()
+
+	room := models.Room{
+		ID:        primitive.NewObjectID(),
+		Kind:      models.RoomKindDirect,
+		CreatedBy: claims.Username,
+		CreatedAt: now,
+		Members: []models.RoomMember{
+			{Username: claims.Username, Role: models.RoomRoleMember, JoinedAt: now},
+			{Username: *user.Username, Role: models.RoomRoleMember, JoinedAt: now},
+		},
+		DirectKey: models.DirectKey(claims.Username, *user.Username),
+	}
+
+	stored, err := db.Client.GetOrAddDirectRoom(room)
+
+	if err != nil {
+		http.Error(w, "Failed to open conversation", http.StatusInternalServerError)
+		log.Printf("Failed to open conversation between %s and %s: %v", claims.Username, *user.Username, err)
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, stored)
+}
@@ -0,0 +1,242 @@
+package chat
+
+import (
+	"chat-module/auth"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/util"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 50
+
+	// Queries with more words than this are refused
+	MaxSearchTerms = 10
+
+	// How much of the message shows around the first match, on either side
+	snippetContext = 60
+)
+
+// A message matching a search, with the matches highlighted
+type SearchResult struct {
+	models.Message
+	RoomName string `json:"roomName"`
+
+	// HTML escaped body excerpt, with the matching words wrapped in <mark>
+	Snippet string `json:"snippet"`
+}
+
+/*
+ *	Cuts the part of the body around the first word matching one of the terms
+ *	and highlights every matching word in it. The text is escaped, so the
+ *	snippet is safe to render as HTML.
+ */
+func highlight(body string, terms []string) string {
+	wanted := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		wanted[term] = true
+	}
+
+	text := []rune(body)
+
+	// Spans of the matching words, in runes
+	type span struct{ start, end int }
+	var matches []span
+
+	for start := 0; start < len(text); {
+		if !isWordRune(text[start]) {
+			start++
+			continue
+		}
+
+		end := start
+		for end < len(text) && isWordRune(text[end]) {
+			end++
+		}
+
+		terms := util.SearchTerms(string(text[start:end]))
+		if len(terms) == 1 && wanted[terms[0]] {
+			matches = append(matches, span{start, end})
+		}
+
+		start = end
+	}
+
+	from, to := 0, len(text)
+
+	if len(matches) > 0 {
+		from = max(0, matches[0].start-snippetContext)
+		to = min(len(text), matches[0].end+snippetContext)
+	} else {
+		to = min(len(text), 2*snippetContext)
+	}
+
+	var snippet strings.Builder
+
+	if from > 0 {
+		snippet.WriteString("…")
+	}
+
+	position := from
+
+	for _, match := range matches {
+		if match.start < from || match.end > to {
+			continue
+		}
+
+		snippet.WriteString(html.EscapeString(string(text[position:match.start])))
+		snippet.WriteString("<mark>")
+		snippet.WriteString(html.EscapeString(string(text[match.start:match.end])))
+		snippet.WriteString("</mark>")
+		position = match.end
+	}
+
+	snippet.WriteString(html.EscapeString(string(text[position:to])))
+
+	if to < len(text) {
+		snippet.WriteString("…")
+	}
+
+	return snippet.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Reads an RFC 3339 timestamp or a plain date from the query, if it's there
+func parseSearchTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if date, err := time.Parse(time.DateOnly, value); err == nil {
+		return date, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+/*
+ *	GET /api/search?q=&sender=&room=&from=&to=&hasAttachment=&before=&limit=
+ *
+ *	Searches the messages of the rooms and direct conversations the user is a
+ *	member of, newest first. Every word of the query has to appear in the
+ *	message. A room the user isn't in searches nothing, the same as a room
+ *	that doesn't exist.
+ */
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := auth.GetClaims(r)
+	query := r.URL.Query()
+
+	search := models.MessageSearch{
+		Terms:  util.SearchTerms(query.Get("q")),
+		Sender: query.Get("sender"),
+		Limit:  DefaultSearchLimit,
+	}
+
+	if len(search.Terms) == 0 {
+		http.Error(w, "Search query is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(search.Terms) > MaxSearchTerms {
+		http.Error(w, "Too many search terms", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+
+	if search.From, err = parseSearchTime(query.Get("from")); err != nil {
+		http.Error(w, "Invalid from date", http.StatusBadRequest)
+		return
+	}
+
+	if search.To, err = parseSearchTime(query.Get("to")); err != nil {
+		http.Error(w, "Invalid to date", http.StatusBadRequest)
+		return
+	}
+
+	if value := query.Get("hasAttachment"); value != "" {
+		hasAttachment, err := strconv.ParseBool(value)
+
+		if err != nil {
+			http.Error(w, "Invalid hasAttachment", http.StatusBadRequest)
+			return
+		}
+
+		search.HasAttachment = &hasAttachment
+	}
+
+	if value := query.Get("before"); value != "" {
+		if search.Before, err = primitive.ObjectIDFromHex(value); err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		if search.Limit, err = strconv.Atoi(value); err != nil || search.Limit < 1 || search.Limit > MaxSearchLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rooms, err := db.Client.GetUserRooms(claims.Username)
+
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to get rooms of user %s: %v", claims.Username, err)
+		return
+	}
+
+	roomNames := make(map[primitive.ObjectID]string, len(rooms))
+	onlyRoom := query.Get("room")
+
+	for _, room := range rooms {
+		if onlyRoom == "" || onlyRoom == room.ID.Hex() {
+			roomNames[room.ID] = room.Name
+			search.Conversations = append(search.Conversations, room.ID)
+		}
+	}
+
+	results := []SearchResult{}
+
+	if len(search.Conversations) == 0 {
+		util.WriteJSON(w, http.StatusOK, results)
+		return
+	}
+
+	messages, err := db.Client.SearchMessages(search)
+
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to search messages for user %s: %v", claims.Username, err)
+		return
+	}
+
+	for _, message := range messages {
+		results = append(results, SearchResult{
+			Message:  message,
+			RoomName: roomNames[message.Conversation],
+			Snippet:  highlight(message.Body, search.Terms),
+		})
+	}
+
+	util.WriteJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,463 @@
+package chat
+
+import (
+	"chat-module/auth"
+	"chat-module/util"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Events a stream session holds on to, so a client that comes back can
+	// pick up where it left off
+	streamBacklog = 256
+
+	// How long a stream session outlives the last request that used it
+	streamGracePeriod = time.Minute
+
+	// How long a long-polling request waits for events before returning empty handed
+	LongPollTimeout = time.Second * 25
+
+	// How often an idle event stream gets a comment, so proxies keep it open
+	streamKeepAlive = time.Second * 15
+)
+
+type streamEvent struct {
+	id    int64
+	event *Event
+}
+
+/*
+ *	Stands in for a socket for clients that get their events over plain HTTP,
+ *	either as an event stream or by polling. The session is a client of the
+ *	hub like any socket, and collects its events in between requests, so none
+ *	go missing while the client reconnects or polls again.
+ */
+type streamSession struct {
+	id     string
+	client *Client
+
+	lock sync.Mutex
+
+	// The last streamBacklog events, oldest first, numbered from 1
+	events []streamEvent
+	lastID int64
+
+	// Closed and replaced whenever an event comes in or the session ends
+	changed chan struct{}
+	ended   bool
+
+	// How many requests use the session right now, and when the last one ended
+	attached int
+	lastUsed time.Time
+}
+
+// The ID of an event of the session, which is what clients resume from
+func (session *streamSession) cursor(id int64) string {
+	return fmt.Sprintf("%s-%d", session.id, id)
+}
+
+func parseCursor(cursor string) (string, int64, bool) {
+	index := strings.LastIndexByte(cursor, '-')
+
+	if index < 0 {
+		return "", 0, false
+	}
+
+	id, err := strconv.ParseInt(cursor[index+1:], 10, 64)
+
+	if err != nil || id < 0 {
+		return "", 0, false
+	}
+
+	return cursor[:index], id, true
+}
+
+// Must be called with the lock held
+func (session *streamSession) signal() {
+	close(session.changed)
+	session.changed = make(chan struct{})
+}
+
+// Collects the events the hub sends to the session until the hub lets go of it
+func (session *streamSession) pump(streams *streamRegistry) {
+	for event := range session.client.send {
+		session.lock.Lock()
+
+		session.client.sent.Add(1)
+		session.lastID++
+		session.events = append(session.events, streamEvent{id: session.lastID, event: event})
+
+		if excess := len(session.events) - streamBacklog; excess > 0 {
+			session.events = session.events[:copy(session.events, session.events[excess:])]
+		}
+
+		session.signal()
+		session.lock.Unlock()
+	}
+
+	session.lock.Lock()
+	session.ended = true
+	session.signal()
+	session.lock.Unlock()
+
+	streams.remove(session)
+}
+
+/*
+ *	Returns the events after the given one, and a channel that is closed once
+ *	there is more. Gap is set when some of the events after it are gone
+ *	already, so the client has to catch up some other way.
+ */
+func (session *streamSession) since(after int64) (events []streamEvent, changed <-chan struct{}, gap bool, ended bool) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	oldest := session.lastID - int64(len(session.events)) + 1
+	gap = after+1 < oldest || after > session.lastID
+
+	for _, event := range session.events {
+		if event.id > after {
+			events = append(events, event)
+		}
+	}
+
+	return events, session.changed, gap, session.ended
+}
+
+// Lets go of the events up to the given one, which the client confirmed it has
+func (session *streamSession) acknowledge(id int64) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	kept := 0
+	for kept < len(session.events) && session.events[kept].id <= id {
+		kept++
+	}
+
+	session.events = session.events[:copy(session.events, session.events[kept:])]
+}
+
+// The stream sessions of a hub, by ID
+type streamRegistry struct {
+	hub      *Hub
+	lock     sync.Mutex
+	sessions map[string]*streamSession
+}
+
+func newStreamRegistry(hub *Hub) *streamRegistry {
+	return &streamRegistry{
+		hub:      hub,
+		sessions: make(map[string]*streamSession),
+	}
+}
+
+/*
+ *	Picks up the session the cursor belongs to, or starts a new one if there is
+ *	no cursor. Resync is set when the cursor points to a session that is gone,
+ *	which leaves the client with a new one and a gap to fill. The session has
+ *	to be released once the request is done with it. Fails with errHubStopped
+ *	if a new session is needed but the hub has stopped.
+ */
+func (streams *streamRegistry) open(claims *auth.Claims, cursor string) (session *streamSession, after int64, resync bool, err error) {
+	if id, after, ok := parseCursor(cursor); ok {
+		streams.lock.Lock()
+		session := streams.sessions[id]
+
+		if session != nil && session.client.username == claims.Username {
+			session.lock.Lock()
+			session.attached++
+			session.lock.Unlock()
+		}
+
+		streams.lock.Unlock()
+
+		if session != nil && session.client.username == claims.Username {
+			streams.hub.Presence.touch(session.client)
+			return session, after, false, nil
+		}
+	}
+
+	session = &streamSession{
+		id:       primitive.NewObjectID().Hex(),
+		client:   newClient(streams.hub, nil, claims),
+		changed:  make(chan struct{}),
+		attached: 1,
+	}
+
+	streams.lock.Lock()
+	streams.sessions[session.id] = session
+	streams.lock.Unlock()
+
+	if !streams.hub.registerClient(session.client) {
+		streams.remove(session)
+		return nil, 0, false, errHubStopped
+	}
+
+	go session.pump(streams)
+
+	return session, 0, cursor != "", nil
+}
+
+func (streams *streamRegistry) release(session *streamSession) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	session.attached--
+	session.lastUsed = time.Now()
+}
+
+func (streams *streamRegistry) remove(session *streamSession) {
+	streams.lock.Lock()
+	defer streams.lock.Unlock()
+
+	delete(streams.sessions, session.id)
+}
+
+// Disconnects the sessions nobody came back for within the grace period
+func (streams *streamRegistry) expireLoop() {
+	ticker := time.NewTicker(streamGracePeriod / 4)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+
+		select {
+		case now = <-ticker.C:
+		case <-streams.hub.quit:
+			return
+		}
+
+		var expired []*streamSession
+
+		streams.lock.Lock()
+		for _, session := range streams.sessions {
+			session.lock.Lock()
+			if session.attached == 0 && now.Sub(session.lastUsed) > streamGracePeriod {
+				expired = append(expired, session)
+			}
+			session.lock.Unlock()
+		}
+		streams.lock.Unlock()
+
+		// The pump removes them once the hub has let go
+		for _, session := range expired {
+			select {
+			case streams.hub.unregister <- session.client:
+			case <-streams.hub.quit:
+				return
+			}
+		}
+	}
+}
+
+// Pushes the write deadline of the server out, so it doesn't cut long requests short
+func extendWriteDeadline(w http.ResponseWriter, by time.Duration) {
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(by))
+}
+
+func writeStreamEvent(w http.ResponseWriter, id string, event *Event) error {
+	data, err := json.Marshal(event)
+
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", event.Type, err)
+		return nil
+	}
+
+	_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", id, data)
+	return err
+}
+
+/*
+ *	GET /api/events
+ *
+ *	The events of the socket as server-sent events, for clients behind
+ *	proxies that break sockets. Every event has an ID, and a client that
+ *	reconnects with the last one it got in the Last-Event-ID header, which
+ *	browsers do on their own, gets everything it missed in between. If that
+ *	is no longer possible, the stream starts with a resync event, after which
+ *	the client should catch up on its conversations through sync.
+ */
+func (hub *Hub) EventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if hub.refuseWhileDraining(w) {
+		return
+	}
+
+	claims := authenticateRealtime(w, r)
+
+	if claims == nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Clients that can't set headers can pass the ID in the query
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("lastEventId")
+	}
+
+	session, after, resync, err := hub.streams.open(claims, cursor)
+
+	if err != nil {
+		writeShuttingDown(w)
+		return
+	}
+
+	defer hub.streams.release(session)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		events, changed, gap, ended := session.since(after)
+
+		extendWriteDeadline(w, hub.Sockets.WriteTimeout)
+
+		if resync || gap {
+			resync = false
+
+			if err := writeStreamEvent(w, session.cursor(after), NewEvent(EventResync, nil)); err != nil {
+				return
+			}
+		}
+
+		for _, event := range events {
+			if err := writeStreamEvent(w, session.cursor(event.id), event.event); err != nil {
+				return
+			}
+
+			after = event.id
+		}
+
+		flusher.Flush()
+
+		if ended {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			extendWriteDeadline(w, hub.Sockets.WriteTimeout)
+
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+type PollResponse struct {
+	// Where the next poll should continue from
+	Cursor string   `json:"cursor"`
+	Events []*Event `json:"events"`
+}
+
+/*
+ *	GET /api/poll?cursor=
+ *
+ *	The events of the socket for clients that can't keep any connection open.
+ *	The first request, without a cursor, starts a session and returns right
+ *	away. Every later one passes the cursor of the response before, and waits
+ *	up to LongPollTimeout for events after it. Events start with a resync
+ *	event when some went missing, as on the event stream.
+ */
+func (hub *Hub) LongPollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if hub.refuseWhileDraining(w) {
+		return
+	}
+
+	claims := authenticateRealtime(w, r)
+
+	if claims == nil {
+		return
+	}
+
+	cursor := r.URL.Query().Get("cursor")
+
+	session, after, resync, err := hub.streams.open(claims, cursor)
+
+	if err != nil {
+		writeShuttingDown(w)
+		return
+	}
+
+	defer hub.streams.release(session)
+
+	response := PollResponse{Cursor: session.cursor(after), Events: []*Event{}}
+
+	if resync {
+		response.Events = append(response.Events, NewEvent(EventResync, nil))
+	}
+
+	if resync || cursor == "" {
+		util.WriteJSON(w, http.StatusOK, response)
+		return
+	}
+
+	session.acknowledge(after)
+	extendWriteDeadline(w, LongPollTimeout+hub.Sockets.WriteTimeout)
+
+	timeout := time.NewTimer(LongPollTimeout)
+	defer timeout.Stop()
+
+	for {
+		events, changed, gap, ended := session.since(after)
+
+		if gap {
+			response.Events = append(response.Events, NewEvent(EventResync, nil))
+		}
+
+		for _, event := range events {
+			response.Events = append(response.Events, event.event)
+			response.Cursor = session.cursor(event.id)
+		}
+
+		if len(response.Events) > 0 || ended {
+			util.WriteJSON(w, http.StatusOK, response)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			util.WriteJSON(w, http.StatusOK, response)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
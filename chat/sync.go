@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"chat-module/auth"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/util"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Most conversations a client can catch up on with one sync frame
+const MaxSyncConversations = 100
+
+/*
+ *	The messages of a conversation a client missed, oldest first. While
+ *	HasMore is set there are more after them, which the client gets by asking
+ *	again from the sequence number of the last one.
+ */
+type SyncPayload struct {
+	Conversation string           `json:"conversation"`
+	Messages     []models.Message `json:"messages"`
+	LastSeq      int64            `json:"lastSeq"`
+	HasMore      bool             `json:"hasMore"`
+}
+
+/*
+ *	Returns up to limit messages of the conversation the user hasn't seen,
+ *	which are the ones numbered after afterSeq. Those deleted since come along
+ *	as tombstones. Deletions of messages from before afterSeq don't, clients
+ *	only hear of them through the delete event. Messages still being stored
+ *	hold the rest back, so none can be skipped by moving past it.
+ */
+func CatchUp(username, conversation string, afterSeq int64, limit int) (*SyncPayload, error) {
+	room, _, err := loadConversation(conversation, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if afterSeq < 0 {
+		return nil, &ClientError{http.StatusBadRequest, "sequence number can't be negative"}
+	}
+
+	// Nothing past a message that is still being stored, or the client would
+	// never see it. The room was loaded first, so everything up to here is in.
+	committed := room.CommittedSeq(time.Now())
+
+	// One more than asked for, to know whether there are more
+	messages, err := db.Client.GetMessagesSince(room.ID, afterSeq, committed, limit+1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &SyncPayload{
+		Conversation: conversation,
+		Messages:     messages,
+		LastSeq:      committed,
+	}
+
+	if len(messages) > limit {
+		payload.Messages = messages[:limit]
+		payload.HasMore = true
+	}
+
+	return payload, nil
+}
+
+/*
+ *	Catches a reconnecting client up on every conversation it lists, with the
+ *	last sequence number it saw in each. Anything sent after the client
+ *	connected reaches it as a message event anyway, so nothing falls in between.
+ */
+func (frame *SyncFrame) handle(client *Client) (any, error) {
+	for conversation, afterSeq := range frame.Conversations {
+		sync, err := CatchUp(client.username, conversation, afterSeq, MaxHistoryLimit)
+
+		if err != nil {
+			client.reportError("", err, "catch up on conversation")
+			continue
+		}
+
+		event := NewEvent(EventSync, sync)
+		event.Conversation = conversation
+
+		client.hub.sendToClient(client, event)
+	}
+
+	return nil, nil
+}
+
+/*
+ *	GET /api/rooms/{id}/sync?after=&limit=
+ *
+ *	The messages of the conversation numbered after the given sequence number,
+ *	oldest first, for clients catching up without a socket.
+ */
+func SyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := auth.GetClaims(r)
+
+	var err error
+	var afterSeq int64
+
+	if value := r.URL.Query().Get("after"); value != "" {
+		if afterSeq, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, "Invalid sequence number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := DefaultHistoryLimit
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > MaxHistoryLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sync, err := CatchUp(claims.Username, r.PathValue("id"), afterSeq, limit)
+
+	if err != nil {
+		writeChatError(w, err, "catch up on conversation")
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, sync)
+}
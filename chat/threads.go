@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"chat-module/auth"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/util"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Sent to the members of a conversation whenever a thread in it gets a reply
+type ThreadPayload struct {
+	Parent      primitive.ObjectID `json:"parent"`
+	ReplyCount  int64              `json:"replyCount"`
+	LastReplyAt *time.Time         `json:"lastReplyAt"`
+}
+
+/*
+ *	Returns the message a reply to the given message belongs under. Threads
+ *	are only one level deep, so replying to a reply continues the same thread.
+ */
+func threadRoot(room *models.Room, parentID string) (primitive.ObjectID, error) {
+	parent, err := loadMessage(room, parentID)
+
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	if parent.IsReply() {
+		return parent.Parent, nil
+	}
+
+	if parent.Deleted {
+		return primitive.NilObjectID, errNoSuchMessage
+	}
+
+	return parent.ID, nil
+}
+
+// Counts the reply on its parent and lets the members know about the new count
+func (hub *Hub) updateThread(room *models.Room, reply models.Message) {
+	parent, err := db.Client.AddReply(reply.Parent, reply.CreatedAt)
+
+	if err != nil {
+		log.Printf("Failed to count reply %s in thread %s: %v", reply.ID.Hex(), reply.Parent.Hex(), err)
+		return
+	}
+
+	event := NewEvent(EventThread, ThreadPayload{
+		Parent:      parent.ID,
+		ReplyCount:  parent.ReplyCount,
+		LastReplyAt: parent.LastReplyAt,
+	})
+	event.Conversation = room.ID.Hex()
+
+	hub.SendToUsers(memberUsernames(room), event)
+}
+
+/*
+ *	GET /api/rooms/{id}/messages/{messageId}/thread?after=&limit=
+ *
+ *	Pages through the replies to a message, oldest first.
+ */
+func (hub *Hub) ThreadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room, _, err := loadConversation(r.PathValue("id"), auth.GetClaims(r).Username)
+
+	if err != nil {
+		writeChatError(w, err, "load conversation")
+		return
+	}
+
+	parent, err := loadMessage(room, r.PathValue("messageId"))
+
+	if err != nil {
+		writeChatError(w, err, "load message")
+		return
+	}
+
+	after := primitive.NilObjectID
+
+	if value := r.URL.Query().Get("after"); value != "" {
+		if after, err = primitive.ObjectIDFromHex(value); err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := DefaultHistoryLimit
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > MaxHistoryLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	replies, err := db.Client.GetThread(parent.ID, after, limit)
+
+	if err != nil {
+		http.Error(w, "Failed to query database", http.StatusInternalServerError)
+		log.Printf("Failed to get thread of message %s: %v", parent.ID.Hex(), err)
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, map[string]any{
+		"parent":  parent,
+		"replies": replies,
+	})
+}
@@ -0,0 +1,132 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// How long someone counts as typing after their last typing frame. Clients
+	// are expected to repeat the frame while the user keeps typing.
+	TypingTimeout = time.Second * 6
+
+	// Typing frames for the same conversation arriving faster than this on a
+	// single connection are ignored
+	typingThrottle = time.Second
+)
+
+type typingKey struct {
+	conversation string
+	username     string
+}
+
+type typingEntry struct {
+	expiresAt time.Time
+	members   []string
+	timer     *time.Timer
+}
+
+type TypingPayload struct {
+	Username string `json:"username"`
+	Typing   bool   `json:"typing"`
+}
+
+/*
+ *	Keeps track of who is typing where. Nothing in here is ever stored, an
+ *	entry lives until the user stops typing or TypingTimeout passes without
+ *	them telling us they are still at it.
+ */
+type TypingTracker struct {
+	hub     *Hub
+	lock    sync.Mutex
+	entries map[typingKey]*typingEntry
+}
+
+func newTypingTracker(hub *Hub) *TypingTracker {
+	return &TypingTracker{
+		hub:     hub,
+		entries: make(map[typingKey]*typingEntry),
+	}
+}
+
+func (tracker *TypingTracker) announce(key typingKey, members []string, typing bool) {
+	audience := make([]string, 0, len(members))
+	for _, member := range members {
+		if member != key.username {
+			audience = append(audience, member)
+		}
+	}
+
+	event := NewEvent(EventTyping, TypingPayload{Username: key.username, Typing: typing})
+	event.Conversation = key.conversation
+
+	tracker.hub.SendEphemeral(audience, event)
+}
+
+// Marks the user as typing in the conversation, announcing it if they weren't already
+func (tracker *TypingTracker) start(conversation, username string, members []string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	key := typingKey{conversation: conversation, username: username}
+	expiresAt := time.Now().Add(TypingTimeout)
+
+	if entry, ok := tracker.entries[key]; ok {
+		entry.expiresAt = expiresAt
+		return
+	}
+
+	entry := &typingEntry{expiresAt: expiresAt, members: members}
+	entry.timer = time.AfterFunc(TypingTimeout, func() { tracker.expire(key) })
+	tracker.entries[key] = entry
+
+	tracker.announce(key, members, true)
+}
+
+// Marks the user as no longer typing in the conversation
+func (tracker *TypingTracker) stop(conversation, username string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	key := typingKey{conversation: conversation, username: username}
+	entry, ok := tracker.entries[key]
+
+	if !ok {
+		return
+	}
+
+	entry.timer.Stop()
+	delete(tracker.entries, key)
+
+	tracker.announce(key, entry.members, false)
+}
+
+func (tracker *TypingTracker) expire(key typingKey) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	entry, ok := tracker.entries[key]
+
+	if !ok {
+		return
+	}
+
+	// Refreshed since the timer was set, check again once the new time is up
+	if remaining := time.Until(entry.expiresAt); remaining > 0 {
+		entry.timer.Reset(remaining)
+		return
+	}
+
+	delete(tracker.entries, key)
+
+	tracker.announce(key, entry.members, false)
+}
+
+// Whether the user is currently typing in the conversation
+func (tracker *TypingTracker) IsTyping(conversation, username string) bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	_, ok := tracker.entries[typingKey{conversation: conversation, username: username}]
+	return ok
+}
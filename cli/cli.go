@@ -0,0 +1,191 @@
+package cli
+
+import (
+	"chat-module/bus"
+	"chat-module/config"
+	"chat-module/db"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Name of the program in usage messages
+const programName = "chat-module"
+
+/*
+ *	The command line of the server. Every command takes the flags of the
+ *	config package along with its own, and reads the rest of its configuration
+ *	from the config file, .env and the environment the same way the server does.
+ */
+type App struct {
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Runs the server until it is shut down
+	Serve func(cfg config.Config) error
+
+	// Sets up db.Client. Only called by the commands that need the database.
+	Connect func(cfg config.Database) error
+
+	// Opens the bus the servers talk to each other on. Only called by the
+	// commands that sign users out, once the database is connected.
+	OpenBus func(cfg config.Bus) (bus.Bus, error)
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(app *App, flags *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"serve", "", "Runs the chat server", serve},
+	{"check-config", "", "Checks the configuration and prints it, without the secrets", checkConfig},
+	{"migrate up", "", "Runs the database migrations that haven't run yet", migrateUp},
+	{"migrate status", "", "Lists the database migrations and whether they ran", migrateStatus},
+	{"create-admin", "", "Creates an admin account", createAdmin},
+	{"user create", "", "Creates an account", createUser},
+	{"user disable", "USERNAME", "Suspends an account and signs it out everywhere", disableUser},
+	{"user enable", "USERNAME", "Lifts the suspension of an account", enableUser},
+	{"user reset-password", "USERNAME", "Forces a new password, printing the one time token needed to pick it", resetPassword},
+}
+
+// Returned by commands called with the wrong arguments, so the usage is printed
+type usageError string
+
+func (err usageError) Error() string { return string(err) }
+
+// Returned once the flag set already told the user what they got wrong
+var errFlagsReported = errors.New("invalid flags")
+
+// Loads the configuration, leaving the arguments after the flags in flags.Args()
+func loadConfig(flags *flag.FlagSet, args []string) (config.Config, error) {
+	cfg, err := config.Load(flags, args)
+
+	var invalid *config.Error
+
+	if err != nil && !errors.Is(err, flag.ErrHelp) && !errors.As(err, &invalid) {
+		return cfg, errFlagsReported
+	}
+
+	return cfg, err
+}
+
+/*
+ *	Runs the command the arguments name and returns the exit code: 0 if it
+ *	succeeded, 1 if it failed and 2 if it was used wrong. Without a command,
+ *	or with flags only, the server is started.
+ */
+func (app *App) Run(args []string) int {
+	if len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		app.usage(app.Stdout)
+		return 0
+	}
+
+	command, rest, ok := findCommand(args)
+
+	if !ok {
+		fmt.Fprintf(app.Stderr, "Unknown command %q\n\n", strings.Join(args[:min(len(args), 2)], " "))
+		app.usage(app.Stderr)
+		return 2
+	}
+
+	flags := flag.NewFlagSet(programName+" "+command.name, flag.ContinueOnError)
+	flags.SetOutput(app.Stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] %s\n\n%s.\n\nFlags:\n", programName, command.name, command.args, command.summary)
+		flags.PrintDefaults()
+	}
+
+	err := command.run(app, flags, rest)
+
+	var usage usageError
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errFlagsReported):
+		return 2
+	case errors.As(err, &usage):
+		fmt.Fprintf(app.Stderr, "%v\n\n", err)
+		flags.Usage()
+		return 2
+	default:
+		fmt.Fprintf(app.Stderr, "Error: %v\n", err)
+		return 1
+	}
+}
+
+func findCommand(args []string) (command, []string, bool) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return commands[0], args, true
+	}
+
+	for _, command := range commands {
+		words := strings.Fields(command.name)
+
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == command.name {
+			return command, args[len(words):], true
+		}
+	}
+
+	return command{}, nil, false
+}
+
+func (app *App) usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", programName)
+
+	for _, command := range commands {
+		fmt.Fprintf(w, "  %-36s %s\n", strings.TrimSpace(command.name+" "+command.args), command.summary)
+	}
+
+	fmt.Fprintf(w, "\nRun %s <command> -help for the flags of a command.\n", programName)
+}
+
+// Connects to the database, returning the function that disconnects
+func (app *App) connect(cfg config.Config) (func(), error) {
+	if err := app.Connect(cfg.Database); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		db.Close(ctx)
+	}, nil
+}
+
+func serve(app *App, flags *flag.FlagSet, args []string) error {
+	cfg, err := loadConfig(flags, args)
+
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 {
+		return usageError("serve takes no arguments")
+	}
+
+	return app.Serve(cfg)
+}
+
+func checkConfig(app *App, flags *flag.FlagSet, args []string) error {
+	cfg, err := loadConfig(flags, args)
+
+	if err != nil {
+		return err
+	}
+
+	cfg.Print(app.Stdout)
+	fmt.Fprintln(app.Stdout, "\nThe configuration is valid")
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"chat-module/db"
+	"flag"
+	"fmt"
+	"text/tabwriter"
+	"time"
+)
+
+// Connects to the database for the migrate commands, which only work on MongoDB
+func (app *App) connectForMigrations(flags *flag.FlagSet, args []string) (*db.MongoRepo, func(), error) {
+	cfg, err := loadConfig(flags, args)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if flags.NArg() > 0 {
+		return nil, nil, usageError("too many arguments")
+	}
+
+	disconnect, err := app.connect(cfg)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	repo, ok := db.Client.(*db.MongoRepo)
+
+	if !ok {
+		disconnect()
+		return nil, nil, fmt.Errorf("migrations need the database to be MongoDB")
+	}
+
+	return repo, disconnect, nil
+}
+
+func migrateUp(app *App, flags *flag.FlagSet, args []string) error {
+	repo, disconnect, err := app.connectForMigrations(flags, args)
+
+	if err != nil {
+		return err
+	}
+
+	defer disconnect()
+
+	applied, err := repo.Migrate()
+
+	for _, migration := range applied {
+		fmt.Fprintf(app.Stdout, "Applied %d %s\n", migration.Version, migration.Name)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		fmt.Fprintln(app.Stdout, "The database is up to date")
+	}
+
+	return nil
+}
+
+func migrateStatus(app *App, flags *flag.FlagSet, args []string) error {
+	repo, disconnect, err := app.connectForMigrations(flags, args)
+
+	if err != nil {
+		return err
+	}
+
+	defer disconnect()
+
+	statuses, err := repo.MigrationStatus()
+
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(app.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "VERSION\tNAME\tAPPLIED")
+
+	for _, status := range statuses {
+		applied := "pending"
+		if status.AppliedAt != nil {
+			applied = status.AppliedAt.Local().Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(table, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+	}
+
+	return table.Flush()
+}
@@ -0,0 +1,254 @@
+package cli
+
+import (
+	"chat-module/admin"
+	"chat-module/auth"
+	"chat-module/bus"
+	"chat-module/chat"
+	"chat-module/config"
+	"chat-module/models"
+	"chat-module/util"
+	"errors"
+	"flag"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+ *	Loads the configuration for the user commands. If the command takes a
+ *	username it is the only argument left after the flags, and is returned.
+ */
+func loadForUsers(flags *flag.FlagSet, args []string, takesUsername bool) (config.Config, string, error) {
+	cfg, err := loadConfig(flags, args)
+
+	if err != nil {
+		return cfg, "", err
+	}
+
+	switch {
+	case takesUsername && flags.NArg() != 1:
+		return cfg, "", usageError("expected the username and nothing else after the flags")
+	case takesUsername:
+		return cfg, flags.Arg(0), nil
+	case flags.NArg() > 0:
+		return cfg, "", usageError("too many arguments")
+	}
+
+	return cfg, "", nil
+}
+
+func createUser(app *App, flags *flag.FlagSet, args []string) error {
+	role := flags.String("role", string(models.RoleUser), "role of the account, user, moderator or admin")
+	return app.createAccount(flags, args, role)
+}
+
+func createAdmin(app *App, flags *flag.FlagSet, args []string) error {
+	role := string(models.RoleAdmin)
+	return app.createAccount(flags, args, &role)
+}
+
+/*
+ *	Creates the account described by the flags. Without -password a random one
+ *	is made up and printed, which keeps passwords out of the shell history.
+ */
+func (app *App) createAccount(flags *flag.FlagSet, args []string, role *string) error {
+	username := flags.String("username", "", "username of the account")
+	email := flags.String("email", "", "email of the account")
+	password := flags.String("password", "", "password of the account, made up and printed if not given")
+
+	cfg, _, err := loadForUsers(flags, args, false)
+
+	if err != nil {
+		return err
+	}
+
+	if *username == "" || *email == "" {
+		return usageError("-username and -email are required")
+	}
+
+	if !models.Role(*role).IsValid() {
+		return usageError(fmt.Sprintf("invalid role %q", *role))
+	}
+
+	disconnect, err := app.connect(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	defer disconnect()
+
+	generated := *password == ""
+
+	if generated {
+		if *password, err = util.GenerateRandomToken(12); err != nil {
+			return err
+		}
+	}
+
+	_, err = auth.CreateUser(*username, *email, *password, models.Role(*role))
+
+	if err == bcrypt.ErrPasswordTooLong {
+		return fmt.Errorf("the password exceeds 72 characters")
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(app.Stdout, "Created %s %s\n", *role, *username)
+
+	if generated {
+		fmt.Fprintf(app.Stdout, "Password: %s\n", *password)
+	}
+
+	return nil
+}
+
+// Passes the sessions a command revokes on to the running servers
+type revocationRelay struct {
+	bus        bus.Bus
+	unregister func()
+
+	// The first revocation that didn't get through
+	err error
+}
+
+/*
+ *	Starts passing the sessions the command revokes on to the running servers,
+ *	so whatever those sessions have connected is cut off right away. A memory
+ *	bus only reaches the process it lives in, so there is nothing to pass them
+ *	to then, and the relay is nil.
+ */
+func (app *App) relayRevocations(cfg config.Config) (*revocationRelay, error) {
+	if cfg.Bus.Backend == "memory" {
+		return nil, nil
+	}
+
+	messageBus, err := app.OpenBus(cfg.Bus)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the message bus: %w", err)
+	}
+
+	relay := &revocationRelay{bus: messageBus}
+
+	// No server is named "cli", so every one of them takes it in
+	relay.unregister = auth.OnRevoke(func(username, sessionID string) {
+		if err := chat.PublishRevocation(messageBus, "cli", username, sessionID); err != nil && relay.err == nil {
+			relay.err = err
+		}
+	})
+
+	return relay, nil
+}
+
+func (relay *revocationRelay) close() {
+	if relay != nil {
+		relay.unregister()
+		relay.bus.Close()
+	}
+}
+
+// Tells what became of the sessions of the user, which depends on whether they reached the servers
+func (app *App) reportSignOut(relay *revocationRelay, username string) error {
+	if relay == nil {
+		fmt.Fprintf(app.Stdout, "Signed %s out. Connections already open to the server stay up, the memory bus doesn't reach it.\n", username)
+		return nil
+	}
+
+	if relay.err != nil {
+		return fmt.Errorf("signed %s out, but failed to tell the servers to close their connections: %w", username, relay.err)
+	}
+
+	fmt.Fprintf(app.Stdout, "Signed %s out everywhere\n", username)
+	return nil
+}
+
+func disableUser(app *App, flags *flag.FlagSet, args []string) error {
+	return app.setSuspended(flags, args, true)
+}
+
+func enableUser(app *App, flags *flag.FlagSet, args []string) error {
+	return app.setSuspended(flags, args, false)
+}
+
+func (app *App) setSuspended(flags *flag.FlagSet, args []string, suspended bool) error {
+	cfg, username, err := loadForUsers(flags, args, true)
+
+	if err != nil {
+		return err
+	}
+
+	disconnect, err := app.connect(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	defer disconnect()
+
+	var relay *revocationRelay
+
+	if suspended {
+		if relay, err = app.relayRevocations(cfg); err != nil {
+			return err
+		}
+
+		defer relay.close()
+	}
+
+	err = admin.SetSuspended(username, suspended)
+
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("user %s doesn't exist", username)
+	} else if err != nil {
+		return err
+	}
+
+	if !suspended {
+		fmt.Fprintf(app.Stdout, "Enabled %s\n", username)
+		return nil
+	}
+
+	fmt.Fprintf(app.Stdout, "Disabled %s\n", username)
+
+	return app.reportSignOut(relay, username)
+}
+
+func resetPassword(app *App, flags *flag.FlagSet, args []string) error {
+	cfg, username, err := loadForUsers(flags, args, true)
+
+	if err != nil {
+		return err
+	}
+
+	disconnect, err := app.connect(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	defer disconnect()
+
+	relay, err := app.relayRevocations(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	defer relay.close()
+
+	token, err := auth.ForcePasswordReset(username)
+
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("user %s doesn't exist", username)
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(app.Stdout, "They can pick a new password at /reset-password within %v using the token:\n%s\n",
+		auth.PasswordResetLifetime, token)
+
+	return app.reportSignOut(relay, username)
+}
@@ -0,0 +1,220 @@
+package config
+
+import (
+	"chat-module/models"
+	"time"
+)
+
+/*
+ *	Every setting of the server. Load fills it in from, in increasing order of
+ *	precedence: the defaults below, the YAML file given with -config, the .env
+ *	file, the environment and the command line flags. Every setting has a
+ *	flag named after its place in the file, such as -database.url, and most
+ *	have an environment variable, given in the env tag.
+ */
+type Config struct {
+	Server    Server    `yaml:"server"`
+	Database  Database  `yaml:"database"`
+	Auth      Auth      `yaml:"auth"`
+	Storage   Storage   `yaml:"storage"`
+	Bus       Bus       `yaml:"bus"`
+	Chat      Chat      `yaml:"chat"`
+	RateLimit RateLimit `yaml:"rateLimit"`
+}
+
+type Server struct {
+	Addr           string        `yaml:"addr" env:"SERVER_ADDR" usage:"address to listen on"`
+	ReadTimeout    time.Duration `yaml:"readTimeout" env:"SERVER_READ_TIMEOUT" usage:"longest a request may take to read"`
+	WriteTimeout   time.Duration `yaml:"writeTimeout" env:"SERVER_WRITE_TIMEOUT" usage:"longest a response may take to write"`
+	MaxHeaderBytes int           `yaml:"maxHeaderBytes" env:"SERVER_MAX_HEADER_BYTES" usage:"largest request headers accepted"`
+
+	// Connections and requests still going once this is up are cut short
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" usage:"how long shutting down may take"`
+
+	// Zero makes one for every CPU
+	ThumbnailWorkers int `yaml:"thumbnailWorkers" env:"THUMBNAIL_WORKERS" usage:"workers making image thumbnails, 0 for one per CPU"`
+}
+
+type Database struct {
+	URL            string        `yaml:"url" env:"MONGODB_URL" usage:"MongoDB connection string"`
+	Name           string        `yaml:"name" env:"DB_NAME" usage:"name of the database"`
+	ConnectTimeout time.Duration `yaml:"connectTimeout" env:"DB_CONNECT_TIMEOUT" usage:"how long connecting may take"`
+
+	Collections Collections `yaml:"collections"`
+}
+
+type Collections struct {
+	Users       string `yaml:"users" env:"USER_DOCUMENT" usage:"collection of users"`
+	Sessions    string `yaml:"sessions" env:"SESSION_DOCUMENT" usage:"collection of sessions"`
+	Rooms       string `yaml:"rooms" env:"ROOM_DOCUMENT" usage:"collection of rooms"`
+	Messages    string `yaml:"messages" env:"MESSAGE_DOCUMENT" usage:"collection of messages"`
+	Attachments string `yaml:"attachments" env:"ATTACHMENT_DOCUMENT" usage:"collection of attachments"`
+	Migrations  string `yaml:"migrations" env:"MIGRATION_DOCUMENT" usage:"collection recording the migrations that ran"`
+}
+
+type Auth struct {
+	// Signs the tokens, so it has to be the same on every instance
+	JWTKey string `yaml:"jwtKey" env:"jwtKey" usage:"secret the tokens are signed with" secret:"true"`
+}
+
+// Shortest JWT key accepted, the size of the SHA-256 output the tokens are signed with
+const MinJWTKeyLength = 32
+
+type Storage struct {
+	Backend string `yaml:"backend" env:"STORAGE_BACKEND" usage:"where uploads go, local or s3"`
+	Dir     string `yaml:"dir" env:"STORAGE_DIR" usage:"directory of the local backend"`
+	S3      S3     `yaml:"s3"`
+}
+
+type S3 struct {
+	Endpoint  string `yaml:"endpoint" env:"S3_ENDPOINT" usage:"URL of the S3 service"`
+	Bucket    string `yaml:"bucket" env:"S3_BUCKET" usage:"bucket uploads go to"`
+	Region    string `yaml:"region" env:"S3_REGION" usage:"region of the bucket"`
+	AccessKey string `yaml:"accessKey" env:"S3_ACCESS_KEY" usage:"S3 access key"`
+	SecretKey string `yaml:"secretKey" env:"S3_SECRET_KEY" usage:"S3 secret key" secret:"true"`
+}
+
+type Bus struct {
+	Backend    string `yaml:"backend" env:"BUS_BACKEND" usage:"how instances talk to each other, memory or mongo"`
+	Collection string `yaml:"collection" env:"BUS_DOCUMENT" usage:"collection of the mongo backend"`
+}
+
+type Chat struct {
+	EditWindow time.Duration `yaml:"editWindow" env:"MESSAGE_EDIT_WINDOW" usage:"how long senders can edit or delete their messages"`
+
+	Sockets Sockets `yaml:"sockets"`
+}
+
+type Sockets struct {
+	QueueSize        int           `yaml:"queueSize" env:"SOCKET_QUEUE_SIZE" usage:"events queued for a client before it counts as slow"`
+	SlowClientPolicy string        `yaml:"slowClientPolicy" env:"SOCKET_SLOW_CLIENT_POLICY" usage:"what happens to slow clients, drop-oldest or disconnect"`
+	WriteTimeout     time.Duration `yaml:"writeTimeout" env:"SOCKET_WRITE_TIMEOUT" usage:"longest a write to a socket may take"`
+	PongTimeout      time.Duration `yaml:"pongTimeout" env:"SOCKET_PONG_TIMEOUT" usage:"how long a socket may go without answering pings"`
+	MaxMessageSize   int64         `yaml:"maxMessageSize" env:"SOCKET_MAX_MESSAGE_SIZE" usage:"largest frame clients may send"`
+}
+
+type RateLimit struct {
+	Requests   int           `yaml:"requests" env:"RATE_LIMIT_REQUESTS" usage:"requests a client may make per window"`
+	Window     time.Duration `yaml:"window" env:"RATE_LIMIT_WINDOW" usage:"how often request counts are reset"`
+	CacheClear time.Duration `yaml:"cacheClear" env:"RATE_LIMIT_CACHE_CLEAR" usage:"how often the clients seen are forgotten"`
+}
+
+// The settings used for whatever isn't configured
+func Default() Config {
+	return Config{
+		Server: Server{
+			Addr:            ":8080",
+			ReadTimeout:     10 * time.Second,
+			WriteTimeout:    10 * time.Second,
+			MaxHeaderBytes:  1 << 20,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Database: Database{
+			ConnectTimeout: 10 * time.Second,
+			Collections: Collections{
+				Users:       "users",
+				Sessions:    "sessions",
+				Rooms:       "rooms",
+				Messages:    "messages",
+				Attachments: "attachments",
+				Migrations:  "migrations",
+			},
+		},
+		Storage: Storage{
+			Backend: "local",
+			Dir:     "uploads",
+		},
+		Bus: Bus{
+			Backend:    "memory",
+			Collection: "bus",
+		},
+		Chat: Chat{
+			EditWindow: 15 * time.Minute,
+			Sockets: Sockets{
+				QueueSize:        256,
+				SlowClientPolicy: "disconnect",
+				WriteTimeout:     10 * time.Second,
+				PongTimeout:      60 * time.Second,
+
+				// Enough for a message of the longest allowed length
+				MaxMessageSize: models.MaxMessageFrameSize,
+			},
+		},
+		RateLimit: RateLimit{
+			Requests:   20,
+			Window:     time.Minute,
+			CacheClear: 24 * time.Hour,
+		},
+	}
+}
+
+// Checks every setting, returning what is wrong with them
+func (config *Config) validate() []string {
+	var problems []string
+
+	check := func(ok bool, setting, problem string) {
+		if !ok {
+			problems = append(problems, describe(setting, problem))
+		}
+	}
+
+	server := config.Server
+	check(server.Addr != "", "server.addr", "is required")
+	check(server.ReadTimeout > 0, "server.readTimeout", "must be positive")
+	check(server.WriteTimeout > 0, "server.writeTimeout", "must be positive")
+	check(server.MaxHeaderBytes > 0, "server.maxHeaderBytes", "must be positive")
+	check(server.ShutdownTimeout > 0, "server.shutdownTimeout", "must be positive")
+	check(server.ThumbnailWorkers >= 0, "server.thumbnailWorkers", "can't be negative")
+
+	database := config.Database
+	check(database.URL != "", "database.url", "is required")
+	check(database.Name != "", "database.name", "is required")
+	check(database.ConnectTimeout > 0, "database.connectTimeout", "must be positive")
+	check(database.Collections.Users != "", "database.collections.users", "is required")
+	check(database.Collections.Sessions != "", "database.collections.sessions", "is required")
+	check(database.Collections.Rooms != "", "database.collections.rooms", "is required")
+	check(database.Collections.Messages != "", "database.collections.messages", "is required")
+	check(database.Collections.Attachments != "", "database.collections.attachments", "is required")
+	check(database.Collections.Migrations != "", "database.collections.migrations", "is required")
+
+	check(config.Auth.JWTKey != "", "auth.jwtKey", "is required")
+	check(config.Auth.JWTKey == "" || len(config.Auth.JWTKey) >= MinJWTKeyLength, "auth.jwtKey", "must be at least 32 bytes long")
+
+	switch storage := config.Storage; storage.Backend {
+	case "local":
+		check(storage.Dir != "", "storage.dir", "is required for the local backend")
+	case "s3":
+		check(storage.S3.Endpoint != "", "storage.s3.endpoint", "is required for the s3 backend")
+		check(storage.S3.Bucket != "", "storage.s3.bucket", "is required for the s3 backend")
+		check(storage.S3.AccessKey != "", "storage.s3.accessKey", "is required for the s3 backend")
+		check(storage.S3.SecretKey != "", "storage.s3.secretKey", "is required for the s3 backend")
+	default:
+		check(false, "storage.backend", "must be local or s3")
+	}
+
+	switch bus := config.Bus; bus.Backend {
+	case "memory":
+	case "mongo":
+		check(bus.Collection != "", "bus.collection", "is required for the mongo backend")
+	default:
+		check(false, "bus.backend", "must be memory or mongo")
+	}
+
+	chat := config.Chat
+	check(chat.EditWindow >= 0, "chat.editWindow", "can't be negative")
+
+	sockets := chat.Sockets
+	check(sockets.QueueSize > 0, "chat.sockets.queueSize", "must be positive")
+	check(sockets.SlowClientPolicy == "drop-oldest" || sockets.SlowClientPolicy == "disconnect",
+		"chat.sockets.slowClientPolicy", "must be drop-oldest or disconnect")
+	check(sockets.WriteTimeout > 0, "chat.sockets.writeTimeout", "must be positive")
+	check(sockets.PongTimeout > 0, "chat.sockets.pongTimeout", "must be positive")
+	check(sockets.MaxMessageSize > 0, "chat.sockets.maxMessageSize", "must be positive")
+
+	rateLimit := config.RateLimit
+	check(rateLimit.Requests > 0, "rateLimit.requests", "must be positive")
+	check(rateLimit.Window > 0, "rateLimit.window", "must be positive")
+	check(rateLimit.CacheClear > 0, "rateLimit.cacheClear", "must be positive")
+
+	return problems
+}
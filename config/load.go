@@ -0,0 +1,251 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Where the environment file is looked for unless -env-file says otherwise
+const DefaultEnvFile = ".env"
+
+// What is wrong with the configuration, every problem found at once
+type Error struct {
+	Problems []string
+}
+
+func (err *Error) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(err.Problems, "\n\t")
+}
+
+// A single setting, found by walking the fields of Config
+type setting struct {
+	path   string
+	env    string
+	usage  string
+	secret bool
+	value  reflect.Value
+}
+
+// Lists the settings of the config, pointing into it so they can be set
+func settingsOf(config *Config) []setting {
+	var settings []setting
+
+	var walk func(value reflect.Value, prefix string)
+	walk = func(value reflect.Value, prefix string) {
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			path := prefix + field.Tag.Get("yaml")
+
+			if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+				walk(value.Field(i), path+".")
+				continue
+			}
+
+			settings = append(settings, setting{
+				path:   path,
+				env:    field.Tag.Get("env"),
+				usage:  field.Tag.Get("usage"),
+				secret: field.Tag.Get("secret") == "true",
+				value:  value.Field(i),
+			})
+		}
+	}
+
+	walk(reflect.ValueOf(config).Elem(), "")
+
+	return settings
+}
+
+// Names the setting in a problem, along with the environment variable that sets it
+func describe(path, problem string) string {
+	for _, setting := range settingsOf(&Config{}) {
+		if setting.path == path && setting.env != "" {
+			return fmt.Sprintf("%s (%s) %s", path, setting.env, problem)
+		}
+	}
+
+	return path + " " + problem
+}
+
+// Parses the text into the setting, whatever its type
+func (setting setting) set(text string) error {
+	switch setting.value.Interface().(type) {
+	case time.Duration:
+		duration, err := time.ParseDuration(text)
+		if err != nil {
+			return fmt.Errorf("is not a duration like 30s or 5m")
+		}
+		setting.value.SetInt(int64(duration))
+
+	case int, int64:
+		number, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return fmt.Errorf("is not a whole number")
+		}
+		setting.value.SetInt(number)
+
+	default:
+		setting.value.SetString(text)
+	}
+
+	return nil
+}
+
+// Keeps what a flag was given for until the flags can be applied last
+type flagValue struct {
+	text  *string
+	shown string
+}
+
+func (value flagValue) String() string { return value.shown }
+
+func (value flagValue) Set(text string) error {
+	*value.text = text
+	return nil
+}
+
+/*
+ *	Loads the configuration, registering a flag for every setting on the flag
+ *	set along with -config, the YAML file to read, and -env-file. Whatever the
+ *	flags don't take is left in flags.Args(). Asking for -help returns
+ *	flag.ErrHelp. Every setting that is missing or invalid is reported
+ *	together in an *Error.
+ */
+func Load(flags *flag.FlagSet, args []string) (Config, error) {
+	config := Default()
+	settings := settingsOf(&config)
+
+	file := flags.String("config", "", "YAML file to read the settings from")
+	envFile := flags.String("env-file", DefaultEnvFile, "file of environment variables to read, if it exists")
+
+	given := make(map[string]*string)
+
+	for _, setting := range settings {
+		text := new(string)
+		given[setting.path] = text
+
+		usage := setting.usage
+		if setting.env != "" {
+			usage += " ($" + setting.env + ")"
+		}
+
+		shown := ""
+		if !setting.secret {
+			shown = fmt.Sprint(setting.value.Interface())
+		}
+
+		flags.Var(flagValue{text: text, shown: shown}, setting.path, usage)
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+
+	var problems []string
+
+	if *file != "" {
+		if err := readFile(*file, &config); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	env, err := godotenv.Read(*envFile)
+
+	if err != nil {
+		// Only complain about the default file if it is there but can't be read
+		if explicitlySet(flags, "env-file") || !errors.Is(err, os.ErrNotExist) {
+			problems = append(problems, fmt.Sprintf("env file %s can't be read: %v", *envFile, err))
+		}
+		env = nil
+	}
+
+	for _, setting := range settings {
+		text, source, ok := "", "", false
+
+		if setting.env != "" {
+			if value, exists := env[setting.env]; exists {
+				text, source, ok = value, *envFile, true
+			}
+			if value, exists := os.LookupEnv(setting.env); exists {
+				text, source, ok = value, "the environment", true
+			}
+		}
+
+		if explicitlySet(flags, setting.path) {
+			text, source, ok = *given[setting.path], "-"+setting.path, true
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err := setting.set(strings.TrimSpace(text)); err != nil {
+			problems = append(problems, describe(setting.path, fmt.Sprintf("from %s %v", source, err)))
+		}
+	}
+
+	problems = append(problems, config.validate()...)
+
+	if len(problems) > 0 {
+		return config, &Error{Problems: problems}
+	}
+
+	return config, nil
+}
+
+// Reads the YAML file over the config, refusing settings it doesn't know
+func readFile(path string, config *Config) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file %s can't be read: %v", path, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+
+	// An empty file is fine, it just doesn't change anything
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s is invalid: %v", path, err)
+	}
+
+	return nil
+}
+
+func explicitlySet(flags *flag.FlagSet, name string) bool {
+	set := false
+
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+// Writes every setting with its value, one per line, hiding the values of secrets
+func (config *Config) Print(w io.Writer) {
+	for _, setting := range settingsOf(config) {
+		value := fmt.Sprint(setting.value.Interface())
+
+		if setting.secret {
+			value = "(not set)"
+			if !setting.value.IsZero() {
+				value = "(set)"
+			}
+		}
+
+		fmt.Fprintf(w, "%s = %s\n", setting.path, value)
+	}
+}
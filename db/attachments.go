@@ -0,0 +1,122 @@
+package db
+
+import (
+	"chat-module/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (repo *MongoRepo) attachments() *mongo.Collection {
+	return repo.database.Collection(repo.collections.Attachments)
+}
+
+func (repo *MongoRepo) AddAttachment(attachment models.Attachment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := repo.attachments().InsertOne(ctx, attachment)
+
+	return err
+}
+
+func (repo *MongoRepo) GetAttachment(id primitive.ObjectID) (*models.Attachment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	var attachment models.Attachment
+	err := repo.attachments().FindOne(ctx, bson.M{"_id": id}).Decode(&attachment)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachment, nil
+}
+
+/*
+ *	Attaches the upload to a message. Only works once, and only for the user
+ *	who uploaded it, otherwise returns mongo.ErrNoDocuments.
+ */
+func (repo *MongoRepo) AttachToMessage(id primitive.ObjectID, uploader string, conversation, message primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":      id,
+		"uploader": uploader,
+		"message":  bson.M{"$exists": false},
+	}
+
+	update := bson.M{"$set": bson.M{
+		"conversation": conversation,
+		"message":      message,
+	}}
+
+	result, err := repo.attachments().UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// Turns the upload back into an unattached one, if it is attached to the message
+func (repo *MongoRepo) DetachFromMessage(id, message primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "message": message}
+	update := bson.M{"$unset": bson.M{"conversation": "", "message": ""}}
+
+	_, err := repo.attachments().UpdateOne(ctx, filter, update)
+
+	return err
+}
+
+func (repo *MongoRepo) SetThumbnails(id primitive.ObjectID, status models.ThumbnailStatus, thumbnails []models.Thumbnail) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{
+		"thumbnailStatus": status,
+		"thumbnails":      thumbnails,
+	}}
+
+	result, err := repo.attachments().UpdateOne(ctx, bson.M{"_id": id}, update)
+
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (repo *MongoRepo) DeleteAttachment(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	result, err := repo.attachments().DeleteOne(ctx, bson.M{"_id": id})
+
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
@@ -1,11 +1,11 @@
 package db
 
 import (
+	"chat-module/config"
 	"chat-module/models"
-	"chat-module/util"
 	"context"
+	"fmt"
 	"log"
-	"os"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -15,47 +15,50 @@ import (
 
 type MongoRepo struct {
 	MongoClient *mongo.Client
-}
-
-func newMongoRepo() *MongoRepo {
-	err := util.LoadEnvFile()
-
-	if err != nil {
-		log.Fatalf("On initializing the .env file")
-	}
 
-	MongoDb := os.Getenv("MONGODB_URL")
+	database    *mongo.Database
+	collections config.Collections
+}
 
-	// Give it max 10 seconds to connect
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func newMongoRepo(cfg config.Database) (*MongoRepo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
 
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(MongoDb))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.URL))
 
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
 	err = client.Ping(ctx, nil /* rp */)
 
 	if err != nil {
-		log.Fatalf("Failed to ping the client: %v", err)
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("failed to ping the database: %w", err)
 	}
 
 	log.Println("Successfully established connection to database")
 
 	return &MongoRepo{
 		MongoClient: client,
-	}
+		database:    client.Database(cfg.Name),
+		collections: cfg.Collections,
+	}, nil
+}
+
+// The database everything is stored in, for the packages that keep their own collections
+func (repo *MongoRepo) Database() *mongo.Database {
+	return repo.database
 }
 
 /*
  *	Singleton db instance. Outside packages should access the database through
  *	this object. MongoDB client is thread-safe so we can use it across multiple
- * 	threads without worries.
+ * 	threads without worries. The connection is established in Init, so importing
+ *	this package doesn't require a running database.
  */
-var Client *MongoRepo = newMongoRepo()
+var Client Repository
 
 func indexExists(collection *mongo.Collection, indexName string) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
@@ -84,26 +87,11 @@ func indexExists(collection *mongo.Collection, indexName string) (bool, error) {
 }
 
 /*
- * 	Function that opens/creates a collection in our database.
+ *	Creates an index with the given name, unless it already exists. Assumes that
+ *	the collection already exists.
  */
 
-func openCollection(client *mongo.Client, collectionName string) *mongo.Collection {
-	if collectionName == "" {
-		log.Fatal("Tried to create an empty collection")
-	}
-
-	// DB_NAME should be loaded at Init time, so we don't have to check it here.
-	collection := client.Database(os.Getenv("DB_NAME")).Collection(collectionName)
-
-	return collection
-}
-
-/*
- *	Creates a unique index with a name for a given field. Assumes that the collection
- *	already exists.
- */
-
-func createUniqueIndex(collection *mongo.Collection, field, name string) error {
+func createIndex(collection *mongo.Collection, name string, indexModel mongo.IndexModel) error {
 	exists, err := indexExists(collection, name)
 
 	if err != nil {
@@ -115,18 +103,12 @@ func createUniqueIndex(collection *mongo.Collection, field, name string) error {
 		return nil
 	}
 
-	options := options.Index()
-	options.SetUnique(true)
-	options.SetName(name)
-
-	// Define the index model
-	indexModel := mongo.IndexModel{
-		Keys: bson.M{
-			field: 1, // Create an ascending index on the "email" field
-		},
-		Options: options, // Optional: Set the index to be unique
+	if indexModel.Options == nil {
+		indexModel.Options = options.Index()
 	}
 
+	indexModel.Options.SetName(name)
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 
@@ -144,35 +126,87 @@ func createUniqueIndex(collection *mongo.Collection, field, name string) error {
 }
 
 /*
- *	Initializes the database. For now this is just opening the collections, so they
- *	are initialized. If this is the first time the collections are
- *	created, creates unique indexes also.
+ *	Creates a unique index with a name for a given field. Assumes that the collection
+ *	already exists.
+ */
+
+func createUniqueIndex(collection *mongo.Collection, field, name string) error {
+	options := options.Index()
+	options.SetUnique(true)
+
+	// Define the index model
+	indexModel := mongo.IndexModel{
+		Keys: bson.M{
+			field: 1, // Create an ascending index on the given field
+		},
+		Options: options,
+	}
+
+	return createIndex(collection, name, indexModel)
+}
+
+/*
+ *	Creates a TTL index on a date field, so MongoDB removes documents on its own
+ *	once the time in that field has passed.
  */
 
-func Init() error {
-	collection := openCollection(Client.MongoClient, os.Getenv("USER_DOCUMENT"))
+func createExpiryIndex(collection *mongo.Collection, field, name string) error {
+	options := options.Index()
+	options.SetExpireAfterSeconds(0)
+
+	indexModel := mongo.IndexModel{
+		Keys:    bson.M{field: 1},
+		Options: options,
+	}
 
-	err := createUniqueIndex(collection, "email", "users-email-index")
+	return createIndex(collection, name, indexModel)
+}
+
+/*
+ *	Connects to the database and makes it the Client, without touching what is
+ *	stored in it.
+ */
+
+func Connect(cfg config.Database) error {
+	repo, err := newMongoRepo(cfg)
 
 	if err != nil {
-		log.Printf("Failed to create unique index for email: %v", err)
 		return err
 	}
 
-	err = createUniqueIndex(collection, "username", "users-username-index")
+	Client = repo
 
-	if err != nil {
-		log.Printf("Failed to create unique index for username: %v", err)
+	return nil
+}
+
+/*
+ *	Connects to the database and brings it up to date, running the migrations
+ *	that haven't been yet.
+ */
+
+func Init(cfg config.Database) error {
+	if err := Connect(cfg); err != nil {
 		return err
 	}
 
+	_, err := Client.(*MongoRepo).Migrate()
+
+	return err
+}
+
+// Disconnects from the database, waiting for the operations in progress to finish
+func Close(ctx context.Context) error {
+	if repo, ok := Client.(*MongoRepo); ok {
+		return repo.MongoClient.Disconnect(ctx)
+	}
+
 	return nil
 }
 
 // INTERFACE METHODS
 
 func (repo *MongoRepo) CheckUserExists(username, email string) (bool, error) {
-	collection := openCollection(repo.MongoClient, os.Getenv("USER_DOCUMENT"))
+	collection := repo.users()
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
@@ -199,7 +233,7 @@ func (repo *MongoRepo) CheckUserExists(username, email string) (bool, error) {
 }
 
 func (repo *MongoRepo) AddUser(user models.User) error {
-	collection := openCollection(repo.MongoClient, os.Getenv("USER_DOCUMENT"))
+	collection := repo.users()
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
@@ -214,7 +248,7 @@ func (repo *MongoRepo) AddUser(user models.User) error {
 }
 
 func (repo *MongoRepo) GetUser(usernameOrEmail string) (*models.User, error) {
-	collection := openCollection(repo.MongoClient, os.Getenv("USER_DOCUMENT"))
+	collection := repo.users()
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
 
@@ -0,0 +1,1071 @@
+package db
+
+import (
+	"chat-module/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+ *	Repository implementation that keeps everything in memory. Used by the tests
+ *	and for running the server locally without a database. Everything is lost
+ *	once the process exits.
+ */
+type MemoryRepo struct {
+	lock     sync.RWMutex
+	users    map[primitive.ObjectID]models.User
+	sessions map[primitive.ObjectID]models.Session
+	rooms    map[primitive.ObjectID]models.Room
+	messages map[primitive.ObjectID]models.Message
+
+	attachments map[primitive.ObjectID]models.Attachment
+
+	// Bodies of the messages, for searching
+	searchIndex *invertedIndex
+}
+
+func NewMemoryRepo() *MemoryRepo {
+	return &MemoryRepo{
+		users:    make(map[primitive.ObjectID]models.User),
+		sessions: make(map[primitive.ObjectID]models.Session),
+		rooms:    make(map[primitive.ObjectID]models.Room),
+		messages: make(map[primitive.ObjectID]models.Message),
+
+		attachments: make(map[primitive.ObjectID]models.Attachment),
+		searchIndex: newInvertedIndex(),
+	}
+}
+
+func matchesUser(user models.User, usernameOrEmail string) bool {
+	return (user.Username != nil && *user.Username == usernameOrEmail) ||
+		(user.Email != nil && *user.Email == usernameOrEmail)
+}
+
+func (repo *MemoryRepo) CheckUserExists(username, email string) (bool, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	for _, user := range repo.users {
+		if matchesUser(user, username) || matchesUser(user, email) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (repo *MemoryRepo) AddUser(user models.User) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	for _, existing := range repo.users {
+		if existing.ID == user.ID ||
+			(user.Username != nil && matchesUser(existing, *user.Username)) ||
+			(user.Email != nil && matchesUser(existing, *user.Email)) {
+			return mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "duplicate key"}}}
+		}
+	}
+
+	repo.users[user.ID] = user
+
+	return nil
+}
+
+func (repo *MemoryRepo) GetUser(usernameOrEmail string) (*models.User, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	for _, user := range repo.users {
+		if matchesUser(user, usernameOrEmail) {
+			return &user, nil
+		}
+	}
+
+	return nil, mongo.ErrNoDocuments
+}
+
+// Finds the stored user by username. Must be called with the lock held.
+func (repo *MemoryRepo) findUser(username string) (models.User, bool) {
+	for _, user := range repo.users {
+		if user.Username != nil && *user.Username == username {
+			return user, true
+		}
+	}
+
+	return models.User{}, false
+}
+
+func (repo *MemoryRepo) FindUsernames(usernames []string) ([]string, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	found := []string{}
+
+	for _, username := range usernames {
+		if _, ok := repo.findUser(username); ok {
+			found = append(found, username)
+		}
+	}
+
+	return found, nil
+}
+
+func (repo *MemoryRepo) ListUsers(query string, skip, limit int) ([]models.User, int64, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	query = strings.ToLower(query)
+	matching := []models.User{}
+
+	for _, user := range repo.users {
+		if (user.Username != nil && strings.HasPrefix(strings.ToLower(*user.Username), query)) ||
+			(user.Email != nil && strings.HasPrefix(strings.ToLower(*user.Email), query)) {
+			matching = append(matching, user)
+		}
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		return *matching[i].Username < *matching[j].Username
+	})
+
+	total := int64(len(matching))
+
+	if skip >= len(matching) {
+		return []models.User{}, total, nil
+	}
+
+	matching = matching[skip:]
+	if limit < len(matching) {
+		matching = matching[:limit]
+	}
+
+	return matching, total, nil
+}
+
+func (repo *MemoryRepo) UpdateProfile(username string, update models.ProfileUpdate) (*models.User, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	user, ok := repo.findUser(username)
+
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	fields := map[*string]*string{
+		&user.DisplayName: update.DisplayName,
+		&user.Bio:         update.Bio,
+		&user.Avatar:      update.Avatar,
+		&user.StatusText:  update.StatusText,
+		&user.Timezone:    update.Timezone,
+	}
+
+	for field, value := range fields {
+		if value != nil {
+			*field = *value
+		}
+	}
+
+	user.UpdatedAt = time.Now()
+	repo.users[user.ID] = user
+
+	return &user, nil
+}
+
+func (repo *MemoryRepo) SetUserSuspended(username string, suspended bool) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	user, ok := repo.findUser(username)
+
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	user.Suspended = suspended
+	repo.users[user.ID] = user
+
+	return nil
+}
+
+func (repo *MemoryRepo) SetPasswordReset(username string, reset *models.PasswordReset) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	user, ok := repo.findUser(username)
+
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	user.PasswordReset = reset
+	repo.users[user.ID] = user
+
+	return nil
+}
+
+func (repo *MemoryRepo) UpdatePassword(username, passwordHash string) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	user, ok := repo.findUser(username)
+
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	user.Password = &passwordHash
+	user.PasswordReset = nil
+	repo.users[user.ID] = user
+
+	return nil
+}
+
+func (repo *MemoryRepo) SetLastSeen(username string, lastSeen time.Time) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	user, ok := repo.findUser(username)
+
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	if user.LastSeen == nil || lastSeen.After(*user.LastSeen) {
+		user.LastSeen = &lastSeen
+		repo.users[user.ID] = user
+	}
+
+	return nil
+}
+
+func (repo *MemoryRepo) DeleteUser(username string) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	user, ok := repo.findUser(username)
+
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	delete(repo.users, user.ID)
+
+	for id, room := range repo.rooms {
+		if room.GetMember(username) == nil {
+			continue
+		}
+
+		members := []models.RoomMember{}
+		for _, member := range room.Members {
+			if member.Username != username {
+				members = append(members, member)
+			}
+		}
+
+		room.Members = members
+		if room.Kind == models.RoomKindDirect {
+			room.DirectKey = ""
+		}
+
+		repo.rooms[id] = room
+	}
+
+	for id, message := range repo.messages {
+		mentions := []string{}
+		for _, mentioned := range message.Mentions {
+			if mentioned != username {
+				mentions = append(mentions, mentioned)
+			}
+		}
+
+		if len(mentions) != len(message.Mentions) {
+			message.Mentions = mentions
+			repo.messages[id] = message
+		}
+	}
+
+	for id, session := range repo.sessions {
+		if session.Username == username {
+			delete(repo.sessions, id)
+		}
+	}
+
+	return nil
+}
+
+func (repo *MemoryRepo) AddSession(session models.Session) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.sessions[session.ID] = session
+
+	return nil
+}
+
+func (repo *MemoryRepo) GetSession(id primitive.ObjectID) (*models.Session, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	session, ok := repo.sessions[id]
+
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return &session, nil
+}
+
+func (repo *MemoryRepo) GetUserSessions(username string) ([]models.Session, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	now := time.Now()
+	sessions := []models.Session{}
+
+	for _, session := range repo.sessions {
+		if session.Username == username && !session.Revoked && session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastActivity.After(sessions[j].LastActivity)
+	})
+
+	return sessions, nil
+}
+
+func (repo *MemoryRepo) TouchSession(id primitive.ObjectID, lastActivity time.Time) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	session, ok := repo.sessions[id]
+
+	if ok && lastActivity.After(session.LastActivity) {
+		session.LastActivity = lastActivity
+		repo.sessions[id] = session
+	}
+
+	return nil
+}
+
+func (repo *MemoryRepo) RevokeSession(username string, id primitive.ObjectID) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	session, ok := repo.sessions[id]
+
+	if !ok || session.Username != username || session.Revoked {
+		return mongo.ErrNoDocuments
+	}
+
+	session.Revoked = true
+	repo.sessions[id] = session
+
+	return nil
+}
+
+func (repo *MemoryRepo) RevokeUserSessions(username string) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	for id, session := range repo.sessions {
+		if session.Username == username {
+			session.Revoked = true
+			repo.sessions[id] = session
+		}
+	}
+
+	return nil
+}
+
+func (repo *MemoryRepo) DeleteStaleSessions(now time.Time) (int64, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	var deleted int64
+
+	for id, session := range repo.sessions {
+		if session.Revoked || !session.ExpiresAt.After(now) {
+			delete(repo.sessions, id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// Rooms are copied on the way in and out, so callers can't modify the stored members
+func copyRoom(room models.Room) models.Room {
+	room.Members = append([]models.RoomMember{}, room.Members...)
+	room.Pending = append([]models.SeqReservation{}, room.Pending...)
+	return room
+}
+
+func (repo *MemoryRepo) AddRoom(room models.Room) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.rooms[room.ID] = copyRoom(room)
+
+	return nil
+}
+
+func (repo *MemoryRepo) GetRoom(id primitive.ObjectID) (*models.Room, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	room, ok := repo.rooms[id]
+
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	room = copyRoom(room)
+	return &room, nil
+}
+
+func (repo *MemoryRepo) GetOrAddDirectRoom(room models.Room) (*models.Room, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	for _, stored := range repo.rooms {
+		if stored.DirectKey == room.DirectKey {
+			stored = copyRoom(stored)
+			return &stored, nil
+		}
+	}
+
+	room = copyRoom(room)
+	repo.rooms[room.ID] = room
+
+	stored := copyRoom(room)
+	return &stored, nil
+}
+
+func (repo *MemoryRepo) GetUserRooms(username string) ([]models.Room, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	rooms := []models.Room{}
+
+	for _, room := range repo.rooms {
+		if room.GetMember(username) != nil {
+			rooms = append(rooms, copyRoom(room))
+		}
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+
+	return rooms, nil
+}
+
+func (repo *MemoryRepo) DeleteRoom(id primitive.ObjectID) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if _, ok := repo.rooms[id]; !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	delete(repo.rooms, id)
+
+	return nil
+}
+
+func (repo *MemoryRepo) AddRoomMember(roomID primitive.ObjectID, member models.RoomMember) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	room, ok := repo.rooms[roomID]
+
+	if !ok || room.GetMember(member.Username) != nil {
+		return mongo.ErrNoDocuments
+	}
+
+	room.Members = append(copyRoom(room).Members, member)
+	repo.rooms[roomID] = room
+
+	return nil
+}
+
+func (repo *MemoryRepo) RemoveRoomMember(roomID primitive.ObjectID, username string) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	room, ok := repo.rooms[roomID]
+
+	if !ok || room.GetMember(username) == nil {
+		return mongo.ErrNoDocuments
+	}
+
+	members := []models.RoomMember{}
+	for _, member := range room.Members {
+		if member.Username != username {
+			members = append(members, member)
+		}
+	}
+
+	room.Members = members
+	repo.rooms[roomID] = room
+
+	return nil
+}
+
+func (repo *MemoryRepo) SetRoomMemberRole(roomID primitive.ObjectID, username string, role models.RoomRole) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	room, ok := repo.rooms[roomID]
+
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	room = copyRoom(room)
+	member := room.GetMember(username)
+
+	if member == nil {
+		return mongo.ErrNoDocuments
+	}
+
+	member.Role = role
+	repo.rooms[roomID] = room
+
+	return nil
+}
+
+func (repo *MemoryRepo) SetLastRead(roomID primitive.ObjectID, username string, messageID primitive.ObjectID) (bool, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	room, ok := repo.rooms[roomID]
+
+	if !ok {
+		return false, nil
+	}
+
+	room = copyRoom(room)
+	member := room.GetMember(username)
+
+	if member == nil || member.LastRead.Hex() >= messageID.Hex() {
+		return false, nil
+	}
+
+	member.LastRead = messageID
+	repo.rooms[roomID] = room
+
+	return true, nil
+}
+
+func (repo *MemoryRepo) NextSequence(roomID primitive.ObjectID) (int64, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	room, ok := repo.rooms[roomID]
+
+	if !ok {
+		return 0, mongo.ErrNoDocuments
+	}
+
+	room.LastSeq++
+	room.Pending = append(copyRoom(room).Pending, models.SeqReservation{Seq: room.LastSeq, At: time.Now()})
+	repo.rooms[roomID] = room
+
+	return room.LastSeq, nil
+}
+
+func (repo *MemoryRepo) ReleaseSequence(roomID primitive.ObjectID, seq int64) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	room, ok := repo.rooms[roomID]
+
+	if !ok {
+		return nil
+	}
+
+	pending := []models.SeqReservation{}
+
+	for _, reservation := range room.Pending {
+		if reservation.Seq != seq && time.Since(reservation.At) < models.SeqReservationTimeout {
+			pending = append(pending, reservation)
+		}
+	}
+
+	room.Pending = pending
+	repo.rooms[roomID] = room
+
+	return nil
+}
+
+func (repo *MemoryRepo) AddMessage(message models.Message) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if message.ClientID != "" {
+		for _, stored := range repo.messages {
+			if stored.Conversation == message.Conversation && stored.Sender == message.Sender && stored.ClientID == message.ClientID {
+				return ErrDuplicateMessage
+			}
+		}
+	}
+
+	repo.messages[message.ID] = message
+	repo.searchIndex.add(message.ID, message.Body)
+
+	return nil
+}
+
+func (repo *MemoryRepo) GetMessage(id primitive.ObjectID) (*models.Message, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	message, ok := repo.messages[id]
+
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return &message, nil
+}
+
+func (repo *MemoryRepo) GetMessages(conversation primitive.ObjectID, before primitive.ObjectID, limit int) ([]models.Message, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	messages := []models.Message{}
+
+	for _, message := range repo.messages {
+		if message.Conversation == conversation && !message.IsReply() && (before.IsZero() || message.ID.Hex() < before.Hex()) {
+			messages = append(messages, message)
+		}
+	}
+
+	// Object IDs sort the same way as their hex form
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID.Hex() > messages[j].ID.Hex()
+	})
+
+	if limit < len(messages) {
+		messages = messages[:limit]
+	}
+
+	return messages, nil
+}
+
+func (repo *MemoryRepo) GetMessagesSince(conversation primitive.ObjectID, afterSeq, upToSeq int64, limit int) ([]models.Message, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	messages := []models.Message{}
+
+	for _, message := range repo.messages {
+		if message.Conversation == conversation && message.Seq > afterSeq && message.Seq <= upToSeq {
+			messages = append(messages, message)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Seq < messages[j].Seq
+	})
+
+	if limit < len(messages) {
+		messages = messages[:limit]
+	}
+
+	return messages, nil
+}
+
+func (repo *MemoryRepo) GetMessageByClientID(conversation primitive.ObjectID, sender, clientID string) (*models.Message, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	for _, message := range repo.messages {
+		if message.Conversation == conversation && message.Sender == sender && message.ClientID == clientID {
+			message.Reactions = copyReactions(message.Reactions)
+			return &message, nil
+		}
+	}
+
+	return nil, mongo.ErrNoDocuments
+}
+
+func (repo *MemoryRepo) SearchMessages(search models.MessageSearch) ([]models.Message, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	inConversations := make(map[primitive.ObjectID]bool, len(search.Conversations))
+	for _, conversation := range search.Conversations {
+		inConversations[conversation] = true
+	}
+
+	messages := []models.Message{}
+
+	for id := range repo.searchIndex.search(search.Terms) {
+		message := repo.messages[id]
+
+		switch {
+		case !inConversations[message.Conversation], message.Deleted:
+		case search.Sender != "" && message.Sender != search.Sender:
+		case !search.From.IsZero() && message.CreatedAt.Before(search.From):
+		case !search.To.IsZero() && !message.CreatedAt.Before(search.To):
+		case search.HasAttachment != nil && *search.HasAttachment != (len(message.Attachments) > 0):
+		case !search.Before.IsZero() && message.ID.Hex() >= search.Before.Hex():
+		default:
+			messages = append(messages, message)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID.Hex() > messages[j].ID.Hex()
+	})
+
+	if search.Limit < len(messages) {
+		messages = messages[:search.Limit]
+	}
+
+	return messages, nil
+}
+
+func (repo *MemoryRepo) GetMentions(username string, conversations []primitive.ObjectID, before primitive.ObjectID, limit int) ([]models.Message, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	inConversations := make(map[primitive.ObjectID]bool, len(conversations))
+	for _, conversation := range conversations {
+		inConversations[conversation] = true
+	}
+
+	messages := []models.Message{}
+
+	for _, message := range repo.messages {
+		if !inConversations[message.Conversation] || (!before.IsZero() && message.ID.Hex() >= before.Hex()) {
+			continue
+		}
+
+		for _, mentioned := range message.Mentions {
+			if mentioned == username {
+				messages = append(messages, message)
+				break
+			}
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID.Hex() > messages[j].ID.Hex()
+	})
+
+	if limit < len(messages) {
+		messages = messages[:limit]
+	}
+
+	return messages, nil
+}
+
+func (repo *MemoryRepo) GetThread(parent primitive.ObjectID, after primitive.ObjectID, limit int) ([]models.Message, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	messages := []models.Message{}
+
+	for _, message := range repo.messages {
+		if message.Parent == parent && (after.IsZero() || message.ID.Hex() > after.Hex()) {
+			messages = append(messages, message)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID.Hex() < messages[j].ID.Hex()
+	})
+
+	if limit < len(messages) {
+		messages = messages[:limit]
+	}
+
+	return messages, nil
+}
+
+func (repo *MemoryRepo) AddReply(parent primitive.ObjectID, repliedAt time.Time) (*models.Message, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	message, ok := repo.messages[parent]
+
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	message.ReplyCount++
+
+	if message.LastReplyAt == nil || repliedAt.After(*message.LastReplyAt) {
+		message.LastReplyAt = &repliedAt
+	}
+
+	repo.messages[parent] = message
+
+	return &message, nil
+}
+
+func (repo *MemoryRepo) EditMessage(id primitive.ObjectID, previousBody, body string, editedAt time.Time) (*models.Message, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	message, ok := repo.messages[id]
+
+	if !ok || message.Deleted || message.Body != previousBody {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	// Copy the edits, so messages handed out earlier don't change under the caller
+	edits := make([]models.MessageEdit, 0, len(message.Edits)+1)
+	edits = append(edits, message.Edits...)
+	message.Edits = append(edits, models.MessageEdit{Body: message.Body, WrittenAt: message.WrittenAt()})
+
+	repo.searchIndex.remove(id, message.Body)
+	repo.searchIndex.add(id, body)
+
+	message.Body = body
+	message.EditedAt = &editedAt
+	repo.messages[id] = message
+
+	return &message, nil
+}
+
+func (repo *MemoryRepo) DiscardMessage(id primitive.ObjectID) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if message, ok := repo.messages[id]; ok {
+		repo.searchIndex.remove(id, message.Body)
+		delete(repo.messages, id)
+	}
+
+	return nil
+}
+
+func (repo *MemoryRepo) DeleteMessage(id primitive.ObjectID, deletedBy string, deletedAt time.Time) (*models.Message, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	message, ok := repo.messages[id]
+
+	if !ok || message.Deleted {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	repo.searchIndex.remove(id, message.Body)
+
+	message.Body = ""
+	message.Edits = nil
+	message.EditedAt = nil
+	message.Attachments = nil
+	message.Reactions = nil
+	message.Mentions = nil
+	message.GroupMention = ""
+	message.Deleted = true
+	message.DeletedAt = &deletedAt
+	message.DeletedBy = deletedBy
+	repo.messages[id] = message
+
+	return &message, nil
+}
+
+// Copies the reactions, so messages handed out earlier don't change under the caller
+func copyReactions(reactions []models.Reaction) []models.Reaction {
+	copied := make([]models.Reaction, 0, len(reactions))
+	for _, reaction := range reactions {
+		copied = append(copied, models.Reaction{Emoji: reaction.Emoji, Users: append([]string{}, reaction.Users...)})
+	}
+
+	return copied
+}
+
+func (repo *MemoryRepo) AddReaction(id primitive.ObjectID, emoji, username string, maxDistinct int) (*models.Message, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	message, ok := repo.messages[id]
+
+	if !ok || message.Deleted {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	message.Reactions = copyReactions(message.Reactions)
+
+	for i := range message.Reactions {
+		if message.Reactions[i].Emoji != emoji {
+			continue
+		}
+
+		for _, user := range message.Reactions[i].Users {
+			if user == username {
+				return &message, nil
+			}
+		}
+
+		message.Reactions[i].Users = append(message.Reactions[i].Users, username)
+		repo.messages[id] = message
+
+		return &message, nil
+	}
+
+	if len(message.Reactions) >= maxDistinct {
+		return nil, ErrTooManyReactions
+	}
+
+	message.Reactions = append(message.Reactions, models.Reaction{Emoji: emoji, Users: []string{username}})
+	repo.messages[id] = message
+
+	return &message, nil
+}
+
+func (repo *MemoryRepo) RemoveReaction(id primitive.ObjectID, emoji, username string) (*models.Message, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	message, ok := repo.messages[id]
+
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	reactions := []models.Reaction{}
+
+	for _, reaction := range copyReactions(message.Reactions) {
+		if reaction.Emoji == emoji {
+			users := []string{}
+			for _, user := range reaction.Users {
+				if user != username {
+					users = append(users, user)
+				}
+			}
+
+			if len(users) == 0 {
+				continue
+			}
+
+			reaction.Users = users
+		}
+
+		reactions = append(reactions, reaction)
+	}
+
+	if len(reactions) == 0 {
+		reactions = nil
+	}
+
+	message.Reactions = reactions
+	repo.messages[id] = message
+
+	return &message, nil
+}
+
+func (repo *MemoryRepo) CountUnread(username string, lastRead map[primitive.ObjectID]primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	counts := make(map[primitive.ObjectID]int64)
+
+	for _, message := range repo.messages {
+		last, ok := lastRead[message.Conversation]
+
+		if ok && message.Sender != username && message.ID.Hex() > last.Hex() {
+			counts[message.Conversation]++
+		}
+	}
+
+	return counts, nil
+}
+
+func (repo *MemoryRepo) AddAttachment(attachment models.Attachment) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.attachments[attachment.ID] = attachment
+
+	return nil
+}
+
+func (repo *MemoryRepo) GetAttachment(id primitive.ObjectID) (*models.Attachment, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	attachment, ok := repo.attachments[id]
+
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return &attachment, nil
+}
+
+func (repo *MemoryRepo) AttachToMessage(id primitive.ObjectID, uploader string, conversation, message primitive.ObjectID) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	attachment, ok := repo.attachments[id]
+
+	if !ok || attachment.Uploader != uploader || attachment.IsAttached() {
+		return mongo.ErrNoDocuments
+	}
+
+	attachment.Conversation = conversation
+	attachment.Message = message
+	repo.attachments[id] = attachment
+
+	return nil
+}
+
+func (repo *MemoryRepo) DetachFromMessage(id, message primitive.ObjectID) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	attachment, ok := repo.attachments[id]
+
+	if ok && attachment.Message == message {
+		attachment.Conversation = primitive.NilObjectID
+		attachment.Message = primitive.NilObjectID
+		repo.attachments[id] = attachment
+	}
+
+	return nil
+}
+
+func (repo *MemoryRepo) SetThumbnails(id primitive.ObjectID, status models.ThumbnailStatus, thumbnails []models.Thumbnail) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	attachment, ok := repo.attachments[id]
+
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	attachment.ThumbnailStatus = status
+	attachment.Thumbnails = append([]models.Thumbnail{}, thumbnails...)
+	repo.attachments[id] = attachment
+
+	return nil
+}
+
+func (repo *MemoryRepo) DeleteAttachment(id primitive.ObjectID) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if _, ok := repo.attachments[id]; !ok {
+		return mongo.ErrNoDocuments
+	}
+
+	delete(repo.attachments, id)
+
+	return nil
+}
@@ -0,0 +1,554 @@
+package db
+
+import (
+	"chat-module/models"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (repo *MongoRepo) messages() *mongo.Collection {
+	return repo.database.Collection(repo.collections.Messages)
+}
+
+func (repo *MongoRepo) AddMessage(message models.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := repo.messages().InsertOne(ctx, message)
+
+	if mongo.IsDuplicateKeyError(err) && message.ClientID != "" {
+		return ErrDuplicateMessage
+	}
+
+	return err
+}
+
+func (repo *MongoRepo) GetMessageByClientID(conversation primitive.ObjectID, sender, clientID string) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{"conversation": conversation, "sender": sender, "clientId": clientID}
+
+	var message models.Message
+	err := repo.messages().FindOne(ctx, filter).Decode(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+/*
+ *	Returns up to limit messages of the conversation with a sequence number
+ *	above afterSeq and up to upToSeq, oldest first. Unlike GetMessages, thread
+ *	replies are included, since this is what catches a client up on everything
+ *	it missed.
+ */
+func (repo *MongoRepo) GetMessagesSince(conversation primitive.ObjectID, afterSeq, upToSeq int64, limit int) ([]models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"conversation": conversation,
+		"seq":          bson.M{"$gt": afterSeq, "$lte": upToSeq},
+	}
+
+	opts := options.Find().
+		SetSort(bson.M{"seq": 1}).
+		SetLimit(int64(limit))
+
+	cursor, err := repo.messages().Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []models.Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (repo *MongoRepo) GetMessage(id primitive.ObjectID) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	var message models.Message
+	err := repo.messages().FindOne(ctx, bson.M{"_id": id}).Decode(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+/*
+ *	Returns up to limit messages of the conversation older than before, newest
+ *	first. A zero before starts from the newest message. Thread replies are
+ *	left out, they are only shown with their thread.
+ */
+func (repo *MongoRepo) GetMessages(conversation primitive.ObjectID, before primitive.ObjectID, limit int) ([]models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"conversation": conversation,
+		"parent":       bson.M{"$exists": false},
+	}
+
+	if !before.IsZero() {
+		filter["_id"] = bson.M{"$lt": before}
+	}
+
+	opts := options.Find().
+		SetSort(bson.M{"_id": -1}).
+		SetLimit(int64(limit))
+
+	cursor, err := repo.messages().Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []models.Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+/*
+ *	Finds the messages matching the search through the text index, newest
+ *	first. Every term is quoted, which makes MongoDB require all of them
+ *	instead of any.
+ */
+func (repo *MongoRepo) SearchMessages(search models.MessageSearch) ([]models.Message, error) {
+	messages := []models.Message{}
+
+	if len(search.Terms) == 0 || len(search.Conversations) == 0 {
+		return messages, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	quoted := make([]string, 0, len(search.Terms))
+	for _, term := range search.Terms {
+		quoted = append(quoted, `"`+term+`"`)
+	}
+
+	filter := bson.M{
+		"$text":        bson.M{"$search": strings.Join(quoted, " ")},
+		"conversation": bson.M{"$in": search.Conversations},
+		"deleted":      bson.M{"$ne": true},
+	}
+
+	if search.Sender != "" {
+		filter["sender"] = search.Sender
+	}
+
+	createdAt := bson.M{}
+
+	if !search.From.IsZero() {
+		createdAt["$gte"] = search.From
+	}
+
+	if !search.To.IsZero() {
+		createdAt["$lt"] = search.To
+	}
+
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+
+	if search.HasAttachment != nil {
+		filter["attachments.0"] = bson.M{"$exists": *search.HasAttachment}
+	}
+
+	if !search.Before.IsZero() {
+		filter["_id"] = bson.M{"$lt": search.Before}
+	}
+
+	opts := options.Find().
+		SetSort(bson.M{"_id": -1}).
+		SetLimit(int64(search.Limit))
+
+	cursor, err := repo.messages().Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+/*
+ *	Returns up to limit messages mentioning the user in any of the given
+ *	conversations that are older than before, newest first.
+ */
+func (repo *MongoRepo) GetMentions(username string, conversations []primitive.ObjectID, before primitive.ObjectID, limit int) ([]models.Message, error) {
+	messages := []models.Message{}
+
+	if len(conversations) == 0 {
+		return messages, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"mentions":     username,
+		"conversation": bson.M{"$in": conversations},
+	}
+
+	if !before.IsZero() {
+		filter["_id"] = bson.M{"$lt": before}
+	}
+
+	opts := options.Find().
+		SetSort(bson.M{"_id": -1}).
+		SetLimit(int64(limit))
+
+	cursor, err := repo.messages().Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+/*
+ *	Returns up to limit replies to the parent newer than after, oldest first,
+ *	so threads read top to bottom. A zero after starts from the first reply.
+ */
+func (repo *MongoRepo) GetThread(parent primitive.ObjectID, after primitive.ObjectID, limit int) ([]models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{"parent": parent}
+
+	if !after.IsZero() {
+		filter["_id"] = bson.M{"$gt": after}
+	}
+
+	opts := options.Find().
+		SetSort(bson.M{"_id": 1}).
+		SetLimit(int64(limit))
+
+	cursor, err := repo.messages().Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []models.Message{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+/*
+ *	Counts a new reply on the parent and moves its last reply time forward.
+ *	Returns the updated parent.
+ */
+func (repo *MongoRepo) AddReply(parent primitive.ObjectID, repliedAt time.Time) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	update := bson.M{
+		"$inc": bson.M{"replyCount": 1},
+		"$max": bson.M{"lastReplyAt": repliedAt},
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var message models.Message
+	err := repo.messages().FindOneAndUpdate(ctx, bson.M{"_id": parent}, update, opts).Decode(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+/*
+ *	Replaces the body of the message, keeping the current version in its edits.
+ *	The update only goes through if the body is still previousBody, so two edits
+ *	racing each other can't lose a version. Returns the updated message, or
+ *	mongo.ErrNoDocuments if there is no such message, it has been deleted or
+ *	its body has changed in the meantime.
+ */
+func (repo *MongoRepo) EditMessage(id primitive.ObjectID, previousBody, body string, editedAt time.Time) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":     id,
+		"body":    previousBody,
+		"deleted": bson.M{"$ne": true},
+	}
+
+	// A pipeline update, so the current version is moved to the edits in the
+	// same write that replaces it
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"edits": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$edits", bson.A{}}},
+				bson.A{bson.M{
+					"body":      "$body",
+					"writtenAt": bson.M{"$ifNull": bson.A{"$editedAt", "$createdAt"}},
+				}},
+			}},
+			// Literal, or a body like "$sender" would be read as a field path
+			"body":     bson.M{"$literal": body},
+			"editedAt": editedAt,
+		}}},
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var message models.Message
+	err := repo.messages().FindOneAndUpdate(ctx, filter, update, opts).Decode(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// Removes a message nobody has heard of yet, without leaving a tombstone
+func (repo *MongoRepo) DiscardMessage(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := repo.messages().DeleteOne(ctx, bson.M{"_id": id})
+
+	return err
+}
+
+/*
+ *	Turns the message into a tombstone, dropping its body and previous versions.
+ *	Returns the tombstone, or mongo.ErrNoDocuments if there is no such message
+ *	or it has already been deleted.
+ */
+func (repo *MongoRepo) DeleteMessage(id primitive.ObjectID, deletedBy string, deletedAt time.Time) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{"_id": id, "deleted": bson.M{"$ne": true}}
+
+	update := bson.M{
+		"$set": bson.M{
+			"body":      "",
+			"deleted":   true,
+			"deletedAt": deletedAt,
+			"deletedBy": deletedBy,
+		},
+		"$unset": bson.M{
+			"edits":        "",
+			"editedAt":     "",
+			"attachments":  "",
+			"reactions":    "",
+			"mentions":     "",
+			"groupMention": "",
+		},
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var message models.Message
+	err := repo.messages().FindOneAndUpdate(ctx, filter, update, opts).Decode(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+/*
+ *	Adds the user to the reactions with the emoji, starting a new one if nobody
+ *	has reacted with it yet. Every step is a single atomic update, so reactions
+ *	made at the same time are never lost. A new emoji is only accepted while the
+ *	message has fewer than maxDistinct different ones, otherwise the error is
+ *	ErrTooManyReactions.
+ */
+func (repo *MongoRepo) AddReaction(id primitive.ObjectID, emoji, username string, maxDistinct int) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	// Another user adding the same emoji can beat us to starting it, in which
+	// case we join theirs on the next round
+	for attempt := 0; attempt < 3; attempt++ {
+		var message models.Message
+
+		err := repo.messages().FindOneAndUpdate(ctx,
+			bson.M{"_id": id, "deleted": bson.M{"$ne": true}, "reactions.emoji": emoji},
+			bson.M{"$addToSet": bson.M{"reactions.$.users": username}},
+			opts,
+		).Decode(&message)
+
+		if err != mongo.ErrNoDocuments {
+			return &message, err
+		}
+
+		err = repo.messages().FindOneAndUpdate(ctx,
+			bson.M{
+				"_id":             id,
+				"deleted":         bson.M{"$ne": true},
+				"reactions.emoji": bson.M{"$ne": emoji},
+				// Only while the array has fewer than maxDistinct entries
+				fmt.Sprintf("reactions.%d", maxDistinct-1): bson.M{"$exists": false},
+			},
+			bson.M{"$push": bson.M{"reactions": models.Reaction{Emoji: emoji, Users: []string{username}}}},
+			opts,
+		).Decode(&message)
+
+		if err != mongo.ErrNoDocuments {
+			return &message, err
+		}
+
+		// Neither matched, find out whether that's down to the limit
+		current, err := repo.GetMessage(id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if current.Deleted {
+			return nil, mongo.ErrNoDocuments
+		}
+
+		if len(current.Reactions) >= maxDistinct && !hasReaction(current, emoji) {
+			return nil, ErrTooManyReactions
+		}
+	}
+
+	return nil, fmt.Errorf("failed to add reaction to message %s after several attempts", id.Hex())
+}
+
+func hasReaction(message *models.Message, emoji string) bool {
+	for _, reaction := range message.Reactions {
+		if reaction.Emoji == emoji {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+ *	Takes the user off the reactions with the emoji, dropping the reaction once
+ *	nobody is left on it.
+ */
+func (repo *MongoRepo) RemoveReaction(id primitive.ObjectID, emoji, username string) (*models.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := repo.messages().UpdateOne(ctx,
+		bson.M{"_id": id, "reactions.emoji": emoji},
+		bson.M{"$pull": bson.M{"reactions.$.users": username}},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Only matches reactions that are still empty, so a user joining in
+	// between the two updates keeps the reaction alive
+	var message models.Message
+	err = repo.messages().FindOneAndUpdate(ctx,
+		bson.M{"_id": id},
+		bson.M{"$pull": bson.M{"reactions": bson.M{"emoji": emoji, "users": bson.M{"$size": 0}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+/*
+ *	Counts the messages the user hasn't read yet in each of the given
+ *	conversations, mapped to the last message they read in it. Their own
+ *	messages don't count. Everything is counted in a single query.
+ */
+func (repo *MongoRepo) CountUnread(username string, lastRead map[primitive.ObjectID]primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	counts := make(map[primitive.ObjectID]int64)
+
+	if len(lastRead) == 0 {
+		return counts, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	conversations := make([]bson.M, 0, len(lastRead))
+	for conversation, messageID := range lastRead {
+		conversations = append(conversations, bson.M{
+			"conversation": conversation,
+			"_id":          bson.M{"$gt": messageID},
+		})
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"$or":    conversations,
+			"sender": bson.M{"$ne": username},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$conversation",
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+
+	cursor, err := repo.messages().Aggregate(ctx, pipeline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var results []struct {
+		Conversation primitive.ObjectID `bson:"_id"`
+		Count        int64              `bson:"count"`
+	}
+
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		counts[result.Conversation] = result.Count
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,280 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+ *	A change to the database, such as creating indexes or reshaping documents.
+ *	Migrations run in the order of their versions, each of them once, and
+ *	which ones ran is stored in the migrations collection. Running one again
+ *	has to be harmless, since instances starting together may race to it.
+ */
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(repo *MongoRepo) error
+}
+
+// Every migration there is, oldest first. New ones go at the end with the next version.
+var Migrations = []Migration{
+	{1, "create user indexes", createUserIndexes},
+	{2, "create session indexes", createSessionIndexes},
+	{3, "create room indexes", createRoomIndexes},
+	{4, "create message indexes", createMessageIndexes},
+}
+
+// Whether a migration ran, and when
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type migrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+func (repo *MongoRepo) migrations() *mongo.Collection {
+	return repo.database.Collection(repo.collections.Migrations)
+}
+
+// Lists every migration along with when it ran, if it did
+func (repo *MongoRepo) MigrationStatus() ([]MigrationStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cursor, err := repo.migrations().Find(ctx, bson.M{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var records []migrationRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time)
+	for _, record := range records {
+		applied[record.Version] = record.AppliedAt
+	}
+
+	statuses := make([]MigrationStatus, 0, len(Migrations))
+
+	for _, migration := range Migrations {
+		status := MigrationStatus{Migration: migration}
+
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+/*
+ *	Runs the migrations that haven't run yet, in order, and returns them. Stops
+ *	at the first one that fails, the ones before it stay applied.
+ */
+func (repo *MongoRepo) Migrate() ([]Migration, error) {
+	statuses, err := repo.MigrationStatus()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			continue
+		}
+
+		if err := status.Up(repo); err != nil {
+			return applied, fmt.Errorf("migration %d (%s) failed: %w", status.Version, status.Name, err)
+		}
+
+		if err := repo.recordMigration(status.Migration); err != nil {
+			return applied, err
+		}
+
+		log.Printf("Applied migration %d (%s)", status.Version, status.Name)
+		applied = append(applied, status.Migration)
+	}
+
+	return applied, nil
+}
+
+func (repo *MongoRepo) recordMigration(migration Migration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := repo.migrations().InsertOne(ctx, migrationRecord{
+		Version:   migration.Version,
+		Name:      migration.Name,
+		AppliedAt: time.Now(),
+	})
+
+	// Another instance got there first, which is just as good
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Unique usernames and emails
+func createUserIndexes(repo *MongoRepo) error {
+	collection := repo.users()
+
+	err := createUniqueIndex(collection, "email", "users-email-index")
+
+	if err != nil {
+		log.Printf("Failed to create unique index for email: %v", err)
+		return err
+	}
+
+	err = createUniqueIndex(collection, "username", "users-username-index")
+
+	if err != nil {
+		log.Printf("Failed to create unique index for username: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// Looking sessions up by user, and letting MongoDB remove them once they expire
+func createSessionIndexes(repo *MongoRepo) error {
+	collection := repo.sessions()
+
+	err := createIndex(collection, "sessions-username-index", mongo.IndexModel{
+		Keys: bson.M{"username": 1},
+	})
+
+	if err != nil {
+		log.Printf("Failed to create index for session usernames: %v", err)
+		return err
+	}
+
+	err = createExpiryIndex(collection, "expiresAt", "sessions-expiry-index")
+
+	if err != nil {
+		log.Printf("Failed to create expiry index for sessions: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// Looking rooms up by member, and one direct conversation per pair of users
+func createRoomIndexes(repo *MongoRepo) error {
+	collection := repo.rooms()
+
+	err := createIndex(collection, "rooms-members-index", mongo.IndexModel{
+		Keys: bson.M{"members.username": 1},
+	})
+
+	if err != nil {
+		log.Printf("Failed to create index for room members: %v", err)
+		return err
+	}
+
+	// Sparse, since only direct conversations have a key
+	err = createIndex(collection, "rooms-direct-key-index", mongo.IndexModel{
+		Keys:    bson.M{"directKey": 1},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	})
+
+	if err != nil {
+		log.Printf("Failed to create unique index for direct conversations: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// Paging, syncing, deduplicating, threads, mentions and searching messages
+func createMessageIndexes(repo *MongoRepo) error {
+	collection := repo.messages()
+
+	// Serves both paging through the history and counting unread messages
+	err := createIndex(collection, "messages-conversation-index", mongo.IndexModel{
+		Keys: bson.D{{Key: "conversation", Value: 1}, {Key: "_id", Value: -1}},
+	})
+
+	if err != nil {
+		log.Printf("Failed to create index for messages: %v", err)
+		return err
+	}
+
+	// Unique, so a sequence number is never handed out twice. Sparse, since
+	// messages stored before there were sequence numbers don't have one.
+	err = createIndex(collection, "messages-seq-index", mongo.IndexModel{
+		Keys:    bson.D{{Key: "conversation", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	})
+
+	if err != nil {
+		log.Printf("Failed to create index for message sequence numbers: %v", err)
+		return err
+	}
+
+	// Makes sending the same message twice fail, however close together
+	err = createIndex(collection, "messages-client-id-index", mongo.IndexModel{
+		Keys: bson.D{{Key: "conversation", Value: 1}, {Key: "sender", Value: 1}, {Key: "clientId", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"clientId": bson.M{"$exists": true}}),
+	})
+
+	if err != nil {
+		log.Printf("Failed to create index for message client IDs: %v", err)
+		return err
+	}
+
+	// Sparse, since only replies have a parent
+	err = createIndex(collection, "messages-thread-index", mongo.IndexModel{
+		Keys:    bson.D{{Key: "parent", Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	})
+
+	if err != nil {
+		log.Printf("Failed to create index for threads: %v", err)
+		return err
+	}
+
+	err = createIndex(collection, "messages-mentions-index", mongo.IndexModel{
+		Keys:    bson.D{{Key: "mentions", Value: 1}, {Key: "_id", Value: -1}},
+		Options: options.Index().SetSparse(true),
+	})
+
+	if err != nil {
+		log.Printf("Failed to create index for mentions: %v", err)
+		return err
+	}
+
+	// No language, so words aren't stemmed and searches work the same in every
+	// language and on both repositories
+	err = createIndex(collection, "messages-text-index", mongo.IndexModel{
+		Keys:    bson.D{{Key: "body", Value: "text"}},
+		Options: options.Index().SetDefaultLanguage("none"),
+	})
+
+	if err != nil {
+		log.Printf("Failed to create text index for messages: %v", err)
+		return err
+	}
+
+	return nil
+}
@@ -1,9 +1,76 @@
 package db
 
-import "chat-module/models"
+import (
+	"chat-module/models"
+	"errors"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Returned by AddReaction when the message already has as many different reactions as it can
+var ErrTooManyReactions = errors.New("too many different reactions on the message")
+
+// Returned by AddMessage when the sender already sent a message with the same client ID
+var ErrDuplicateMessage = errors.New("message with the same client ID exists")
+
+/*
+ *	Lookups that find nothing return mongo.ErrNoDocuments, regardless of the
+ *	implementation, so callers only need to check for that one error.
+ */
 type Repository interface {
 	CheckUserExists(username, email string) (bool, error)
 	AddUser(user models.User) error
 	GetUser(usernameOrEmail string) (*models.User, error)
+	FindUsernames(usernames []string) ([]string, error)
+	ListUsers(query string, skip, limit int) ([]models.User, int64, error)
+	UpdateProfile(username string, update models.ProfileUpdate) (*models.User, error)
+	SetUserSuspended(username string, suspended bool) error
+	SetPasswordReset(username string, reset *models.PasswordReset) error
+	UpdatePassword(username, passwordHash string) error
+	SetLastSeen(username string, lastSeen time.Time) error
+	DeleteUser(username string) error
+
+	AddSession(session models.Session) error
+	GetSession(id primitive.ObjectID) (*models.Session, error)
+	GetUserSessions(username string) ([]models.Session, error)
+	TouchSession(id primitive.ObjectID, lastActivity time.Time) error
+	RevokeSession(username string, id primitive.ObjectID) error
+	RevokeUserSessions(username string) error
+	DeleteStaleSessions(now time.Time) (int64, error)
+
+	AddRoom(room models.Room) error
+	GetRoom(id primitive.ObjectID) (*models.Room, error)
+	GetOrAddDirectRoom(room models.Room) (*models.Room, error)
+	GetUserRooms(username string) ([]models.Room, error)
+	DeleteRoom(id primitive.ObjectID) error
+	AddRoomMember(roomID primitive.ObjectID, member models.RoomMember) error
+	RemoveRoomMember(roomID primitive.ObjectID, username string) error
+	SetRoomMemberRole(roomID primitive.ObjectID, username string, role models.RoomRole) error
+	SetLastRead(roomID primitive.ObjectID, username string, messageID primitive.ObjectID) (bool, error)
+	NextSequence(roomID primitive.ObjectID) (int64, error)
+	ReleaseSequence(roomID primitive.ObjectID, seq int64) error
+
+	AddMessage(message models.Message) error
+	GetMessage(id primitive.ObjectID) (*models.Message, error)
+	GetMessages(conversation primitive.ObjectID, before primitive.ObjectID, limit int) ([]models.Message, error)
+	GetMessagesSince(conversation primitive.ObjectID, afterSeq, upToSeq int64, limit int) ([]models.Message, error)
+	GetMessageByClientID(conversation primitive.ObjectID, sender, clientID string) (*models.Message, error)
+	SearchMessages(search models.MessageSearch) ([]models.Message, error)
+	GetMentions(username string, conversations []primitive.ObjectID, before primitive.ObjectID, limit int) ([]models.Message, error)
+	GetThread(parent primitive.ObjectID, after primitive.ObjectID, limit int) ([]models.Message, error)
+	AddReply(parent primitive.ObjectID, repliedAt time.Time) (*models.Message, error)
+	EditMessage(id primitive.ObjectID, previousBody, body string, editedAt time.Time) (*models.Message, error)
+	DiscardMessage(id primitive.ObjectID) error
+	DeleteMessage(id primitive.ObjectID, deletedBy string, deletedAt time.Time) (*models.Message, error)
+	AddReaction(id primitive.ObjectID, emoji, username string, maxDistinct int) (*models.Message, error)
+	RemoveReaction(id primitive.ObjectID, emoji, username string) (*models.Message, error)
+	AddAttachment(attachment models.Attachment) error
+	GetAttachment(id primitive.ObjectID) (*models.Attachment, error)
+	AttachToMessage(id primitive.ObjectID, uploader string, conversation, message primitive.ObjectID) error
+	DetachFromMessage(id, message primitive.ObjectID) error
+	SetThumbnails(id primitive.ObjectID, status models.ThumbnailStatus, thumbnails []models.Thumbnail) error
+	DeleteAttachment(id primitive.ObjectID) error
+
+	CountUnread(username string, lastRead map[primitive.ObjectID]primitive.ObjectID) (map[primitive.ObjectID]int64, error)
 }
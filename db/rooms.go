@@ -0,0 +1,267 @@
+package db
+
+import (
+	"chat-module/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (repo *MongoRepo) rooms() *mongo.Collection {
+	return repo.database.Collection(repo.collections.Rooms)
+}
+
+func (repo *MongoRepo) AddRoom(room models.Room) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := repo.rooms().InsertOne(ctx, room)
+
+	return err
+}
+
+func (repo *MongoRepo) GetRoom(id primitive.ObjectID) (*models.Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	var room models.Room
+	err := repo.rooms().FindOne(ctx, bson.M{"_id": id}).Decode(&room)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &room, nil
+}
+
+/*
+ *	Returns the direct conversation with the same key as the given room,
+ *	storing the given room first if there isn't one yet.
+ */
+func (repo *MongoRepo) GetOrAddDirectRoom(room models.Room) (*models.Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After)
+
+	var stored models.Room
+	err := repo.rooms().FindOneAndUpdate(ctx,
+		bson.M{"directKey": room.DirectKey},
+		bson.M{"$setOnInsert": room},
+		opts,
+	).Decode(&stored)
+
+	// Somebody else created it at the same time, theirs wins
+	if mongo.IsDuplicateKeyError(err) {
+		err = repo.rooms().FindOne(ctx, bson.M{"directKey": room.DirectKey}).Decode(&stored)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &stored, nil
+}
+
+func (repo *MongoRepo) GetUserRooms(username string) ([]models.Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.M{"name": 1})
+
+	cursor, err := repo.rooms().Find(ctx, bson.M{"members.username": username}, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := []models.Room{}
+	if err := cursor.All(ctx, &rooms); err != nil {
+		return nil, err
+	}
+
+	return rooms, nil
+}
+
+func (repo *MongoRepo) DeleteRoom(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	result, err := repo.rooms().DeleteOne(ctx, bson.M{"_id": id})
+
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+/*
+ *	Adds a member to the room. Returns mongo.ErrNoDocuments if there is no such
+ *	room, or the user is already a member of it.
+ */
+func (repo *MongoRepo) AddRoomMember(roomID primitive.ObjectID, member models.RoomMember) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":              roomID,
+		"members.username": bson.M{"$ne": member.Username},
+	}
+
+	result, err := repo.rooms().UpdateOne(ctx, filter, bson.M{"$push": bson.M{"members": member}})
+
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (repo *MongoRepo) RemoveRoomMember(roomID primitive.ObjectID, username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":              roomID,
+		"members.username": username,
+	}
+
+	update := bson.M{"$pull": bson.M{"members": bson.M{"username": username}}}
+
+	result, err := repo.rooms().UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (repo *MongoRepo) SetRoomMemberRole(roomID primitive.ObjectID, username string, role models.RoomRole) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":              roomID,
+		"members.username": username,
+	}
+
+	update := bson.M{"$set": bson.M{"members.$.role": role}}
+
+	result, err := repo.rooms().UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+/*
+ *	Moves the last read message of the member forward. Returns false if the
+ *	member had already read that far, so there is nothing to announce.
+ */
+func (repo *MongoRepo) SetLastRead(roomID primitive.ObjectID, username string, messageID primitive.ObjectID) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"_id": roomID,
+		"members": bson.M{"$elemMatch": bson.M{
+			"username": username,
+			"$or": []bson.M{
+				{"lastRead": bson.M{"$exists": false}},
+				{"lastRead": bson.M{"$lt": messageID}},
+			},
+		}},
+	}
+
+	update := bson.M{"$set": bson.M{"members.$.lastRead": messageID}}
+
+	result, err := repo.rooms().UpdateOne(ctx, filter, update)
+
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount > 0, nil
+}
+
+/*
+ *	Hands out the next sequence number of the conversation, reserving it until
+ *	ReleaseSequence is called. Sync doesn't go past a reserved number, so a
+ *	message stored late can't be skipped. Every call gets a different number,
+ *	so numbers are skipped when a message doesn't get stored.
+ */
+func (repo *MongoRepo) NextSequence(roomID primitive.ObjectID) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// A pipeline update, so the number is reserved in the same write that
+	// hands it out
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"lastSeq": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$lastSeq", 0}}, 1}},
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"pending": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$pending", bson.A{}}},
+				bson.A{bson.M{"seq": "$lastSeq", "at": time.Now()}},
+			}},
+		}}},
+	}
+
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"lastSeq": 1})
+
+	var room models.Room
+	err := repo.rooms().FindOneAndUpdate(ctx, bson.M{"_id": roomID}, update, opts).Decode(&room)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return room.LastSeq, nil
+}
+
+/*
+ *	Lets sync past a sequence number once its message is stored, or failed to
+ *	be. Reservations that timed out are dropped along the way.
+ */
+func (repo *MongoRepo) ReleaseSequence(roomID primitive.ObjectID, seq int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	update := bson.M{"$pull": bson.M{"pending": bson.M{"$or": bson.A{
+		bson.M{"seq": seq},
+		bson.M{"at": bson.M{"$lt": time.Now().Add(-models.SeqReservationTimeout)}},
+	}}}}
+
+	_, err := repo.rooms().UpdateOne(ctx, bson.M{"_id": roomID}, update)
+
+	return err
+}
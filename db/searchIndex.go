@@ -0,0 +1,74 @@
+package db
+
+import (
+	"chat-module/util"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+ *	Maps every word to the messages containing it, standing in for the text
+ *	index of MongoDB in the in-memory repository. Not safe for concurrent use,
+ *	the repository lock covers it.
+ */
+type invertedIndex struct {
+	postings map[string]map[primitive.ObjectID]bool
+}
+
+func newInvertedIndex() *invertedIndex {
+	return &invertedIndex{postings: make(map[string]map[primitive.ObjectID]bool)}
+}
+
+func (index *invertedIndex) add(id primitive.ObjectID, text string) {
+	for _, term := range util.SearchTerms(text) {
+		if index.postings[term] == nil {
+			index.postings[term] = make(map[primitive.ObjectID]bool)
+		}
+
+		index.postings[term][id] = true
+	}
+}
+
+func (index *invertedIndex) remove(id primitive.ObjectID, text string) {
+	for _, term := range util.SearchTerms(text) {
+		delete(index.postings[term], id)
+
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+		}
+	}
+}
+
+// Returns the messages containing every one of the terms
+func (index *invertedIndex) search(terms []string) map[primitive.ObjectID]bool {
+	if len(terms) == 0 {
+		return nil
+	}
+
+	// Start from the rarest term, so the intersection stays small
+	rarest := index.postings[terms[0]]
+	for _, term := range terms[1:] {
+		if len(index.postings[term]) < len(rarest) {
+			rarest = index.postings[term]
+		}
+	}
+
+	matches := make(map[primitive.ObjectID]bool)
+
+	for id := range rarest {
+		matchesAll := true
+
+		for _, term := range terms {
+			if !index.postings[term][id] {
+				matchesAll = false
+				break
+			}
+		}
+
+		if matchesAll {
+			matches[id] = true
+		}
+	}
+
+	return matches
+}
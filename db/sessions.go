@@ -0,0 +1,142 @@
+package db
+
+import (
+	"chat-module/models"
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (repo *MongoRepo) sessions() *mongo.Collection {
+	return repo.database.Collection(repo.collections.Sessions)
+}
+
+func (repo *MongoRepo) AddSession(session models.Session) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := repo.sessions().InsertOne(ctx, session)
+
+	return err
+}
+
+func (repo *MongoRepo) GetSession(id primitive.ObjectID) (*models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	var session models.Session
+	err := repo.sessions().FindOne(ctx, bson.M{"_id": id}).Decode(&session)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+/*
+ *	Returns the sessions of an user that are neither revoked nor expired,
+ *	most recently active first.
+ */
+func (repo *MongoRepo) GetUserSessions(username string) ([]models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"username":  username,
+		"revoked":   false,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}
+
+	opts := options.Find().SetSort(bson.M{"lastActivity": -1})
+
+	cursor, err := repo.sessions().Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []models.Session{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (repo *MongoRepo) TouchSession(id primitive.ObjectID, lastActivity time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := repo.sessions().UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$max": bson.M{"lastActivity": lastActivity}},
+	)
+
+	return err
+}
+
+func (repo *MongoRepo) RevokeSession(username string, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":      id,
+		"username": username,
+		"revoked":  false,
+	}
+
+	result, err := repo.sessions().UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revoked": true}})
+
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (repo *MongoRepo) RevokeUserSessions(username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"username": username,
+		"revoked":  false,
+	}
+
+	_, err := repo.sessions().UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked": true}})
+
+	return err
+}
+
+/*
+ *	Deletes the sessions that were revoked or expired by now. Their tokens are
+ *	refused either way, an unknown session is as good as a revoked one.
+ */
+func (repo *MongoRepo) DeleteStaleSessions(now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{
+		"$or": bson.A{
+			bson.M{"revoked": true},
+			bson.M{"expiresAt": bson.M{"$lte": now}},
+		},
+	}
+
+	result, err := repo.sessions().DeleteMany(ctx, filter)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
@@ -0,0 +1,232 @@
+package db
+
+import (
+	"chat-module/models"
+	"context"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (repo *MongoRepo) users() *mongo.Collection {
+	return repo.database.Collection(repo.collections.Users)
+}
+
+// Runs an update on a single user, returning mongo.ErrNoDocuments if there is no such user
+func (repo *MongoRepo) updateUser(username string, update bson.M) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	result, err := repo.users().UpdateOne(ctx, bson.M{"username": username}, update)
+
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// Returns which of the given usernames belong to an existing user
+func (repo *MongoRepo) FindUsernames(usernames []string) ([]string, error) {
+	found := []string{}
+
+	if len(usernames) == 0 {
+		return found, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	opts := options.Find().SetProjection(bson.M{"username": 1})
+
+	cursor, err := repo.users().Find(ctx, bson.M{"username": bson.M{"$in": usernames}}, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var users []struct {
+		Username string `bson:"username"`
+	}
+
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		found = append(found, user.Username)
+	}
+
+	return found, nil
+}
+
+/*
+ *	Returns a page of users whose username or email starts with the query, sorted
+ *	by username, along with the total number of matching users.
+ */
+func (repo *MongoRepo) ListUsers(query string, skip, limit int) ([]models.User, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	filter := bson.M{}
+
+	if query != "" {
+		pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query), Options: "i"}
+		filter = bson.M{
+			"$or": []bson.M{
+				{"username": pattern},
+				{"email": pattern},
+			},
+		}
+	}
+
+	total, err := repo.users().CountDocuments(ctx, filter)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.M{"username": 1}).
+		SetSkip(int64(skip)).
+		SetLimit(int64(limit))
+
+	cursor, err := repo.users().Find(ctx, filter, opts)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	users := []models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+func (repo *MongoRepo) SetUserSuspended(username string, suspended bool) error {
+	return repo.updateUser(username, bson.M{"$set": bson.M{"suspended": suspended}})
+}
+
+func (repo *MongoRepo) SetPasswordReset(username string, reset *models.PasswordReset) error {
+	if reset == nil {
+		return repo.updateUser(username, bson.M{"$unset": bson.M{"passwordReset": ""}})
+	}
+
+	return repo.updateUser(username, bson.M{"$set": bson.M{"passwordReset": reset}})
+}
+
+// Sets a new password hash and clears any pending password reset
+func (repo *MongoRepo) UpdatePassword(username, passwordHash string) error {
+	return repo.updateUser(username, bson.M{
+		"$set":   bson.M{"password": passwordHash},
+		"$unset": bson.M{"passwordReset": ""},
+	})
+}
+
+func (repo *MongoRepo) SetLastSeen(username string, lastSeen time.Time) error {
+	return repo.updateUser(username, bson.M{"$max": bson.M{"lastSeen": lastSeen}})
+}
+
+/*
+ *	Deletes the user along with everything that would otherwise carry over to
+ *	whoever registers the same username next: their room memberships, their
+ *	sessions and the mentions of them. Their direct conversations lose the key,
+ *	so the other member keeps the history but a new conversation starts fresh.
+ *	The user goes last, so a failed attempt can simply be tried again.
+ */
+func (repo *MongoRepo) DeleteUser(username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := repo.rooms().UpdateMany(ctx,
+		bson.M{"members.username": username, "kind": models.RoomKindDirect},
+		bson.M{"$unset": bson.M{"directKey": ""}},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.rooms().UpdateMany(ctx, bson.M{"members.username": username}, bson.M{"$pull": bson.M{"members": bson.M{"username": username}}})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.messages().UpdateMany(ctx, bson.M{"mentions": username}, bson.M{"$pull": bson.M{"mentions": username}})
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := repo.sessions().DeleteMany(ctx, bson.M{"username": username}); err != nil {
+		return err
+	}
+
+	result, err := repo.users().DeleteOne(ctx, bson.M{"username": username})
+
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// Applies the profile changes and returns the updated user
+func (repo *MongoRepo) UpdateProfile(username string, update models.ProfileUpdate) (*models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	set := bson.M{"updatedAt": time.Now()}
+	unset := bson.M{}
+
+	fields := map[string]*string{
+		"displayName": update.DisplayName,
+		"bio":         update.Bio,
+		"avatar":      update.Avatar,
+		"statusText":  update.StatusText,
+		"timezone":    update.Timezone,
+	}
+
+	for field, value := range fields {
+		if value == nil {
+			continue
+		}
+
+		if *value == "" {
+			unset[field] = ""
+		} else {
+			set[field] = *value
+		}
+	}
+
+	changes := bson.M{"$set": set}
+	if len(unset) > 0 {
+		changes["$unset"] = unset
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user models.User
+	err := repo.users().FindOneAndUpdate(ctx, bson.M{"username": username}, changes, opts).Decode(&user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
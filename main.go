@@ -1,36 +1,177 @@
 package main
 
 import (
+	"chat-module/attachments"
 	"chat-module/auth"
+	"chat-module/bus"
+	"chat-module/chat"
+	"chat-module/cli"
+	"chat-module/config"
 	"chat-module/db"
+	"chat-module/routes"
+	"chat-module/storage"
+	"chat-module/supervisor"
 	"chat-module/test"
 	"chat-module/util"
+	"context"
+	"fmt"
 	"log"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
 )
 
 func main() {
-	err := db.Init()
+	app := &cli.App{
+		Stdout:  os.Stdout,
+		Stderr:  os.Stderr,
+		Serve:   serve,
+		Connect: db.Connect,
+		OpenBus: bus.Init,
+	}
+
+	os.Exit(app.Run(os.Args[1:]))
+}
+
+// Runs the server until it gets SIGINT or SIGTERM, then shuts it down
+func serve(cfg config.Config) error {
+	auth.Init(cfg.Auth)
+	chat.Configure(cfg.Chat)
+	util.ConfigureRateLimit(cfg.RateLimit)
+
+	err := db.Init(cfg.Database)
+
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	log.Println("We are happy :)")
+
+	if err := storage.Init(cfg.Storage); err != nil {
+		return fmt.Errorf("failed to initialize file storage: %w", err)
+	}
+
+	workers := cfg.Server.ThumbnailWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+
+	thumbnails := attachments.StartThumbnailWorkers(workers)
+
+	messageBus, err := bus.Init(cfg.Bus)
+
+	if err != nil {
+		return fmt.Errorf("failed to initialize message bus: %w", err)
+	}
+
+	hub, err := chat.NewHub(messageBus)
 
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
-	} else {
-		log.Println("We are happy :)")
+		return fmt.Errorf("failed to start chat hub: %w", err)
 	}
 
-	http.Handle("/login", util.RateLimitMiddleware(auth.LoginHandler))
-	http.Handle("/register", util.RateLimitMiddleware(auth.RegisterHandler))
-	http.Handle("/api/test/success", util.RateLimitMiddleware(test.Test200ResponseHandler))
+	go hub.Run()
+
+	// Whatever a revoked session has connected is cut off right away
+	auth.OnRevoke(hub.Revoke)
+
+	mux := routes.New(hub)
+	mux.Handle("/api/test/success", util.RateLimitMiddleware(test.Test200ResponseHandler))
 
-	go util.RateLimit()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	jobs := supervisor.New(context.Background())
+	jobs.Go("rate limit janitor", util.RateLimit)
+	jobs.Go("session janitor", auth.SessionJanitor)
 
 	s := &http.Server{
-		Addr:           ":8080",
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+		Addr:           cfg.Server.Addr,
+		Handler:        routes.RateLimited(mux),
+		ReadTimeout:    cfg.Server.ReadTimeout,
+		WriteTimeout:   cfg.Server.WriteTimeout,
+		MaxHeaderBytes: cfg.Server.MaxHeaderBytes,
+	}
+
+	// Whether the server got a signal or couldn't even listen, everything
+	// that was started is let go of the same way
+	defer func() {
+		timeout := cfg.Server.ShutdownTimeout
+		log.Printf("Shutting down, giving connections %v to finish", timeout)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		shutdown(shutdownCtx, s, hub, messageBus, thumbnails, jobs)
+	}()
+
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- s.ListenAndServe() }()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	// A second signal kills the server right away
+	stop()
+
+	return nil
+}
+
+/*
+ *	Stops the server in order, so nothing that was already accepted gets lost:
+ *	no more connections are accepted, sockets are told to reconnect elsewhere
+ *	once their queued events are written, requests in flight finish, events
+ *	still on their way out go on the bus, and only then are the background
+ *	workers and the database let go of. Whatever isn't done by the time the
+ *	context is, is cut short.
+ */
+func shutdown(ctx context.Context, s *http.Server, hub *chat.Hub, messageBus bus.Bus, thumbnails *attachments.ThumbnailPool, jobs *supervisor.Supervisor) {
+	// Event streams and long polls keep their requests open until the hub
+	// lets go of them, so the server can only finish once it did
+	serverDone := make(chan error, 1)
+	go func() { serverDone <- s.Shutdown(ctx) }()
+
+	if err := hub.Drain(ctx); err != nil {
+		log.Printf("Failed to disconnect every client in time: %v", err)
+	}
+
+	if err := <-serverDone; err != nil {
+		log.Printf("Failed to finish every request in time: %v", err)
+	}
+
+	if err := hub.Stop(ctx); err != nil {
+		log.Printf("Failed to stop the chat hub in time: %v", err)
+	}
+
+	if err := jobs.Stop(ctx); err != nil {
+		log.Printf("Failed to stop the background jobs in time: %v", err)
+	}
+
+	if err := messageBus.Close(); err != nil {
+		log.Printf("Failed to close the message bus: %v", err)
+	}
+
+	thumbnailsDone := make(chan struct{})
+
+	go func() {
+		thumbnails.Stop()
+		close(thumbnailsDone)
+	}()
+
+	select {
+	case <-thumbnailsDone:
+	case <-ctx.Done():
+		log.Printf("Gave up on the thumbnails still being made")
+	}
+
+	if err := db.Close(ctx); err != nil {
+		log.Printf("Failed to disconnect from the database: %v", err)
 	}
 
-	log.Fatal(s.ListenAndServe())
+	log.Println("Shut down")
 }
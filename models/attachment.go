@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ThumbnailStatus string
+
+const (
+	ThumbnailsPending ThumbnailStatus = "pending"
+	ThumbnailsReady   ThumbnailStatus = "ready"
+	ThumbnailsFailed  ThumbnailStatus = "failed"
+)
+
+// A scaled down copy of an image attachment
+type Thumbnail struct {
+	Width       int    `bson:"width" json:"width"`
+	Height      int    `bson:"height" json:"height"`
+	ContentType string `bson:"contentType" json:"contentType"`
+	Size        int64  `bson:"size" json:"size"`
+	StorageKey  string `bson:"storageKey" json:"-"`
+}
+
+/*
+ *	A file uploaded by an user. It starts out unattached, and belongs to the
+ *	conversation of the message it gets attached to once the message is sent.
+ *	The file itself lives in the storage, under StorageKey.
+ */
+type Attachment struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Uploader    string             `bson:"uploader" json:"uploader"`
+	Filename    string             `bson:"filename" json:"filename"`
+	ContentType string             `bson:"contentType" json:"contentType"`
+	Size        int64              `bson:"size" json:"size"`
+	StorageKey  string             `bson:"storageKey" json:"-"`
+	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
+
+	Conversation primitive.ObjectID `bson:"conversation,omitempty" json:"conversation,omitempty"`
+	Message      primitive.ObjectID `bson:"message,omitempty" json:"message,omitempty"`
+
+	// Only images get thumbnails, the status stays empty for everything else
+	ThumbnailStatus ThumbnailStatus `bson:"thumbnailStatus,omitempty" json:"thumbnailStatus,omitempty"`
+	Thumbnails      []Thumbnail     `bson:"thumbnails,omitempty" json:"-"`
+}
+
+// Returns the thumbnail with the given width, or nil if there is none
+func (attachment *Attachment) GetThumbnail(width int) *Thumbnail {
+	for i := range attachment.Thumbnails {
+		if attachment.Thumbnails[i].Width == width {
+			return &attachment.Thumbnails[i]
+		}
+	}
+
+	return nil
+}
+
+func (attachment *Attachment) IsAttached() bool {
+	return !attachment.Message.IsZero()
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Longest a message can be, in characters
+	MaxMessageLength = 4000
+
+	// Largest socket frame needed to send a message. Enough for a message of
+	// MaxMessageLength characters even if every one of them is multi-byte.
+	MaxMessageFrameSize = MaxMessageLength*4 + 1024
+)
+
+// A previous version of an edited message
+type MessageEdit struct {
+	Body string `bson:"body" json:"body"`
+
+	// When this version was written, which is when the message was sent for
+	// the first version and when it was edited for the later ones
+	WrittenAt time.Time `bson:"writtenAt" json:"writtenAt"`
+}
+
+// Everybody who reacted to a message with the same emoji
+type Reaction struct {
+	Emoji string   `bson:"emoji" json:"emoji"`
+	Users []string `bson:"users" json:"users"`
+}
+
+/*
+ *	A message sent to a room. Conversation is the ID of that room.
+ *
+ *	Replies to a message have it as their parent and form its thread. Threads
+ *	are only one level deep, the parent keeps count of its replies.
+ *
+ *	Seq numbers the messages of a conversation in the order they were stored,
+ *	so clients can tell which ones they missed. ClientID is the ID the sending
+ *	client gave the message, which makes sending it again harmless.
+ *
+ *	Edited messages keep their previous versions, oldest first. Deleted messages
+ *	stay in the history as tombstones, with the body, the previous versions,
+ *	the attachments, the reactions and the mentions gone, so the conversation
+ *	around them still makes sense.
+ */
+type Message struct {
+	ID           primitive.ObjectID `bson:"_id" json:"id"`
+	Conversation primitive.ObjectID `bson:"conversation" json:"conversation"`
+	Sender       string             `bson:"sender" json:"sender"`
+	Body         string             `bson:"body" json:"body"`
+	CreatedAt    time.Time          `bson:"createdAt" json:"createdAt"`
+	Seq          int64              `bson:"seq,omitempty" json:"seq,omitempty"`
+	ClientID     string             `bson:"clientId,omitempty" json:"clientId,omitempty"`
+
+	Parent      primitive.ObjectID `bson:"parent,omitempty" json:"parent,omitempty"`
+	ReplyCount  int64              `bson:"replyCount,omitempty" json:"replyCount,omitempty"`
+	LastReplyAt *time.Time         `bson:"lastReplyAt,omitempty" json:"lastReplyAt,omitempty"`
+
+	EditedAt *time.Time    `bson:"editedAt,omitempty" json:"editedAt,omitempty"`
+	Edits    []MessageEdit `bson:"edits,omitempty" json:"edits,omitempty"`
+
+	Attachments []primitive.ObjectID `bson:"attachments,omitempty" json:"attachments,omitempty"`
+
+	Reactions []Reaction `bson:"reactions,omitempty" json:"reactions,omitempty"`
+
+	// Everybody the message mentions, with @room and @here already expanded
+	// into the members they reached. GroupMention is "room" or "here" if the
+	// message used one of them.
+	Mentions     []string `bson:"mentions,omitempty" json:"mentions,omitempty"`
+	GroupMention string   `bson:"groupMention,omitempty" json:"groupMention,omitempty"`
+
+	Deleted   bool       `bson:"deleted,omitempty" json:"deleted,omitempty"`
+	DeletedAt *time.Time `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	DeletedBy string     `bson:"deletedBy,omitempty" json:"deletedBy,omitempty"`
+}
+
+// When the current version of the message was written
+func (message *Message) WrittenAt() time.Time {
+	if message.EditedAt != nil {
+		return *message.EditedAt
+	}
+
+	return message.CreatedAt
+}
+
+func (message *Message) IsReply() bool {
+	return !message.Parent.IsZero()
+}
@@ -0,0 +1,119 @@
+package models
+
+// Site wide role of an user
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// Something an user is allowed to do across the whole site
+type Permission string
+
+const (
+	// Send messages, join rooms, manage their own profile and sessions
+	PermissionChat Permission = "chat"
+
+	// Act as a moderator in every room, even without being a member of it
+	PermissionModerateRooms Permission = "rooms:moderate"
+
+	// View the accounts of other users, including non-public fields
+	PermissionViewUsers Permission = "users:view"
+
+	// Suspend, delete and otherwise manage the accounts of other users
+	PermissionManageUsers Permission = "users:manage"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleUser:      {PermissionChat},
+	RoleModerator: {PermissionChat, PermissionModerateRooms, PermissionViewUsers},
+	RoleAdmin:     {PermissionChat, PermissionModerateRooms, PermissionViewUsers, PermissionManageUsers},
+}
+
+// Used to check that an user only manages accounts ranked below them
+var roleRanks = map[Role]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+func (role Role) IsValid() bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func (role Role) HasPermission(permission Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether this role ranks strictly higher than the other one
+func (role Role) Outranks(other Role) bool {
+	return roleRanks[role] > roleRanks[other]
+}
+
+// Role of an user inside a single room
+type RoomRole string
+
+const (
+	RoomRoleOwner     RoomRole = "owner"
+	RoomRoleModerator RoomRole = "moderator"
+	RoomRoleMember    RoomRole = "member"
+)
+
+// Something a member is allowed to do inside a room
+type RoomPermission string
+
+const (
+	RoomPermissionSend           RoomPermission = "send"
+	RoomPermissionInvite         RoomPermission = "invite"
+	RoomPermissionKick           RoomPermission = "kick"
+	RoomPermissionDeleteMessages RoomPermission = "messages:delete"
+	RoomPermissionManageRoles    RoomPermission = "roles:manage"
+	RoomPermissionDeleteRoom     RoomPermission = "room:delete"
+)
+
+var roomRolePermissions = map[RoomRole][]RoomPermission{
+	RoomRoleMember: {RoomPermissionSend},
+	RoomRoleModerator: {
+		RoomPermissionSend, RoomPermissionInvite, RoomPermissionKick, RoomPermissionDeleteMessages,
+	},
+	RoomRoleOwner: {
+		RoomPermissionSend, RoomPermissionInvite, RoomPermissionKick, RoomPermissionDeleteMessages,
+		RoomPermissionManageRoles, RoomPermissionDeleteRoom,
+	},
+}
+
+// Used to check that an user only acts on members ranked below them
+var roomRoleRanks = map[RoomRole]int{
+	RoomRoleMember:    1,
+	RoomRoleModerator: 2,
+	RoomRoleOwner:     3,
+}
+
+func (role RoomRole) IsValid() bool {
+	_, ok := roomRolePermissions[role]
+	return ok
+}
+
+func (role RoomRole) HasPermission(permission RoomPermission) bool {
+	for _, p := range roomRolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether this role ranks strictly higher than the other one
+func (role RoomRole) Outranks(other RoomRole) bool {
+	return roomRoleRanks[role] > roomRoleRanks[other]
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type RoomMember struct {
+	Username string    `bson:"username" json:"username"`
+	Role     RoomRole  `bson:"role" json:"role"`
+	JoinedAt time.Time `bson:"joinedAt" json:"joinedAt"`
+
+	// The newest message the member has read, zero if they haven't read any
+	LastRead primitive.ObjectID `bson:"lastRead,omitempty" json:"lastRead,omitempty"`
+}
+
+type RoomKind string
+
+const (
+	// A room users are invited into, with an owner and moderators
+	RoomKindGroup RoomKind = "group"
+
+	// A private conversation between exactly two users
+	RoomKindDirect RoomKind = "direct"
+)
+
+/*
+ *	A conversation between its members. Direct messages are rooms too, so
+ *	everything that works on a room works on a direct conversation as well.
+ */
+type Room struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Kind      RoomKind           `bson:"kind,omitempty" json:"kind"`
+	Name      string             `bson:"name" json:"name"`
+	CreatedBy string             `bson:"createdBy" json:"createdBy"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	Members   []RoomMember       `bson:"members" json:"members"`
+
+	// Identifies the pair of users of a direct conversation, so there is only
+	// ever one between the same two users
+	DirectKey string `bson:"directKey,omitempty" json:"-"`
+
+	// Sequence number of the newest message, zero while there are none
+	LastSeq int64 `bson:"lastSeq,omitempty" json:"lastSeq"`
+
+	// Sequence numbers handed out to messages that may not be stored yet
+	Pending []SeqReservation `bson:"pending,omitempty" json:"-"`
+}
+
+type SeqReservation struct {
+	Seq int64     `bson:"seq"`
+	At  time.Time `bson:"at"`
+}
+
+// How long a reserved sequence number holds back sync before its message is given up on
+const SeqReservationTimeout = 30 * time.Second
+
+/*
+ *	The highest sequence number up to which every message is either stored or
+ *	never will be. Messages numbered after it may still be on their way in,
+ *	and another one could land before them.
+ */
+func (room *Room) CommittedSeq(now time.Time) int64 {
+	committed := room.LastSeq
+
+	for _, reservation := range room.Pending {
+		if now.Sub(reservation.At) < SeqReservationTimeout && reservation.Seq <= committed {
+			committed = reservation.Seq - 1
+		}
+	}
+
+	return committed
+}
+
+// Rooms stored before direct conversations were introduced don't have a kind
+func (room *Room) IsDirect() bool {
+	return room.Kind == RoomKindDirect
+}
+
+// The key of the direct conversation between two users, regardless of order
+func DirectKey(first, second string) string {
+	if second < first {
+		first, second = second, first
+	}
+
+	// The length prefix keeps usernames containing the separator from colliding
+	return fmt.Sprintf("%d:%s:%s", len(first), first, second)
+}
+
+// Returns the member entry of the given user, or nil if they aren't in the room
+func (room *Room) GetMember(username string) *RoomMember {
+	for i := range room.Members {
+		if room.Members[i].Username == username {
+			return &room.Members[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+ *	What to look for in messages. Only the conversations listed are searched,
+ *	so callers decide what the user gets to see. Terms must all appear in the
+ *	body. Zero values leave a filter out.
+ */
+type MessageSearch struct {
+	Terms         []string
+	Conversations []primitive.ObjectID
+	Sender        string
+	From          time.Time
+	To            time.Time
+	HasAttachment *bool
+
+	// Paging, newest first
+	Before primitive.ObjectID
+	Limit  int
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+ *	A single login of an user. The hex form of the ID is used as the token ID
+ *	(jti claim) of the JWT issued for that login, so revoking the session
+ *	invalidates the token.
+ */
+type Session struct {
+	ID           primitive.ObjectID `bson:"_id" json:"id"`
+	Username     string             `bson:"username" json:"-"`
+	Role         Role               `bson:"role" json:"-"`
+	UserAgent    string             `bson:"userAgent" json:"userAgent"`
+	IP           string             `bson:"ip" json:"ip"`
+	CreatedAt    time.Time          `bson:"createdAt" json:"createdAt"`
+	LastActivity time.Time          `bson:"lastActivity" json:"lastActivity"`
+	ExpiresAt    time.Time          `bson:"expiresAt" json:"expiresAt"`
+	Revoked      bool               `bson:"revoked" json:"-"`
+}
@@ -1,12 +1,119 @@
 package models
 
 import (
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+/*
+ *	Set on an user when an admin forces them to pick a new password. Only the
+ *	hash of the reset token is stored, the token itself is handed to the admin.
+ */
+type PasswordReset struct {
+	TokenHash string    `bson:"tokenHash"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+/*
+ *	Stored account of an user. This is never sent to clients as is, use
+ *	PublicView or PrivateView instead. The password hash is excluded from JSON
+ *	altogether, so it can't leak by accident either.
+ */
 type User struct {
 	ID       primitive.ObjectID `bson:"_id"`
 	Username *string            `json:"username"`
-	Password *string            `json:"password"`
+	Password *string            `json:"-"`
 	Email    *string            `json:"email"`
+	Role     Role               `json:"role"`
+
+	DisplayName string    `bson:"displayName,omitempty" json:"displayName"`
+	Bio         string    `bson:"bio,omitempty" json:"bio"`
+	Avatar      string    `bson:"avatar,omitempty" json:"avatar"`
+	StatusText  string    `bson:"statusText,omitempty" json:"statusText"`
+	Timezone    string    `bson:"timezone,omitempty" json:"timezone"`
+	CreatedAt   time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt   time.Time `bson:"updatedAt" json:"updatedAt"`
+
+	// Updated by the chat hub when the user's last connection goes away
+	LastSeen *time.Time `bson:"lastSeen,omitempty" json:"lastSeen,omitempty"`
+
+	// Managed by admins, never taken from request bodies
+	Suspended     bool           `bson:"suspended" json:"-"`
+	PasswordReset *PasswordReset `bson:"passwordReset,omitempty" json:"-"`
+}
+
+// Users stored before roles were introduced don't have one, they are regular users
+func (user *User) GetRole() Role {
+	if user.Role == "" {
+		return RoleUser
+	}
+
+	return user.Role
+}
+
+/*
+ *	Changes to the profile of an user. Nil fields are left alone, empty strings
+ *	clear the field.
+ */
+type ProfileUpdate struct {
+	DisplayName *string `json:"displayName"`
+	Bio         *string `json:"bio"`
+	Avatar      *string `json:"avatar"`
+	StatusText  *string `json:"statusText"`
+	Timezone    *string `json:"timezone"`
+}
+
+// What everybody gets to see about an user
+type PublicUser struct {
+	Username    string     `json:"username"`
+	DisplayName string     `json:"displayName,omitempty"`
+	Bio         string     `json:"bio,omitempty"`
+	Avatar      string     `json:"avatar,omitempty"`
+	StatusText  string     `json:"statusText,omitempty"`
+	Timezone    string     `json:"timezone,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastSeen    *time.Time `json:"lastSeen,omitempty"`
+}
+
+// What the user gets to see about themselves
+type PrivateUser struct {
+	PublicUser
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Role      Role      `json:"role"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (user *User) PublicView() PublicUser {
+	view := PublicUser{
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		Avatar:      user.Avatar,
+		StatusText:  user.StatusText,
+		Timezone:    user.Timezone,
+		CreatedAt:   user.CreatedAt,
+		LastSeen:    user.LastSeen,
+	}
+
+	if user.Username != nil {
+		view.Username = *user.Username
+	}
+
+	return view
+}
+
+func (user *User) PrivateView() PrivateUser {
+	view := PrivateUser{
+		PublicUser: user.PublicView(),
+		ID:         user.ID.Hex(),
+		Role:       user.GetRole(),
+		UpdatedAt:  user.UpdatedAt,
+	}
+
+	if user.Email != nil {
+		view.Email = *user.Email
+	}
+
+	return view
 }
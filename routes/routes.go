@@ -0,0 +1,79 @@
+package routes
+
+import (
+	"chat-module/admin"
+	"chat-module/attachments"
+	"chat-module/auth"
+	"chat-module/chat"
+	"chat-module/models"
+	"chat-module/users"
+	"chat-module/util"
+	"net/http"
+)
+
+// The routes anybody can call without signing in, which are worth hammering
+var rateLimited = []string{"/login", "/register", "/reset-password"}
+
+/*
+ *	Every route of the server, with the authentication and permissions each
+ *	one needs. Rate limiting is left to whoever serves it, see RateLimited, so
+ *	the tests can use the same routes without running into it.
+ */
+func New(hub *chat.Hub) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/login", auth.LoginHandler)
+	mux.HandleFunc("/register", auth.RegisterHandler)
+	mux.HandleFunc("/reset-password", auth.ResetPasswordHandler)
+	mux.HandleFunc("/api/sessions", auth.RequireAuth(auth.SessionsHandler))
+	mux.HandleFunc("/api/sessions/{id}", auth.RequireAuth(auth.SessionHandler))
+	mux.HandleFunc("/api/users/me", auth.RequireAuth(users.MeHandler))
+	mux.HandleFunc("/api/users/me/mentions", auth.RequirePermission(models.PermissionChat, chat.MentionsHandler))
+	mux.HandleFunc("/api/search", auth.RequirePermission(models.PermissionChat, chat.SearchHandler))
+	mux.HandleFunc("/api/users/{username}", auth.RequireAuth(users.UserHandler))
+	mux.HandleFunc("/api/rooms", auth.RequirePermission(models.PermissionChat, chat.RoomsHandler))
+	mux.HandleFunc("/api/rooms/{id}", auth.RequirePermission(models.PermissionChat, chat.RoomHandler))
+	mux.HandleFunc("/api/rooms/{id}/members", auth.RequirePermission(models.PermissionChat, chat.RoomMembersHandler))
+	mux.HandleFunc("/api/rooms/{id}/members/{username}", auth.RequirePermission(models.PermissionChat, chat.RoomMemberHandler))
+	mux.HandleFunc("/api/rooms/{id}/messages", auth.RequirePermission(models.PermissionChat, hub.MessagesHandler))
+	mux.HandleFunc("/api/rooms/{id}/messages/{messageId}", auth.RequirePermission(models.PermissionChat, hub.MessageHandler))
+	mux.HandleFunc("/api/rooms/{id}/messages/{messageId}/thread", auth.RequirePermission(models.PermissionChat, hub.ThreadHandler))
+	mux.HandleFunc("/api/rooms/{id}/messages/{messageId}/reactions/{emoji}", auth.RequirePermission(models.PermissionChat, hub.ReactionHandler))
+	mux.HandleFunc("/api/rooms/{id}/read", auth.RequirePermission(models.PermissionChat, hub.ReadHandler))
+	mux.HandleFunc("/api/rooms/{id}/sync", auth.RequirePermission(models.PermissionChat, chat.SyncHandler))
+	mux.HandleFunc("/api/dms", auth.RequirePermission(models.PermissionChat, chat.DirectMessagesHandler))
+	mux.HandleFunc("/api/attachments", auth.RequirePermission(models.PermissionChat, attachments.UploadHandler))
+	mux.HandleFunc("/api/attachments/{id}", auth.RequirePermission(models.PermissionChat, attachments.AttachmentHandler))
+	mux.HandleFunc("/api/attachments/{id}/content", attachments.DownloadHandler)
+	mux.HandleFunc("/api/attachments/{id}/thumbnails/{width}", attachments.ThumbnailHandler)
+	mux.HandleFunc("/api/admin/users", auth.RequirePermission(models.PermissionViewUsers, admin.UsersHandler))
+	mux.HandleFunc("/api/admin/users/{username}", auth.RequirePermission(models.PermissionViewUsers, admin.UserHandler))
+	mux.HandleFunc("/api/admin/users/{username}/suspension", auth.RequirePermission(models.PermissionManageUsers, admin.SuspensionHandler))
+	mux.HandleFunc("/api/admin/users/{username}/password-reset", auth.RequirePermission(models.PermissionManageUsers, admin.PasswordResetHandler))
+	mux.HandleFunc("/api/admin/connections", auth.RequirePermission(models.PermissionViewUsers, hub.ConnectionsHandler))
+	mux.HandleFunc("/api/admin/flood", auth.RequirePermission(models.PermissionModerateRooms, hub.FloodHandler))
+	mux.HandleFunc("/api/admin/flood/{username}", auth.RequirePermission(models.PermissionModerateRooms, hub.FloodUserHandler))
+	mux.HandleFunc("/api/ws", hub.WebSocketHandler)
+	mux.HandleFunc("/api/events", hub.EventStreamHandler)
+	mux.HandleFunc("/api/poll", hub.LongPollHandler)
+	mux.HandleFunc("/api/protocol/schema", chat.ProtocolSchemaHandler)
+	mux.HandleFunc("/api/presence", auth.RequireAuth(hub.PresenceHandler))
+
+	return mux
+}
+
+/*
+ *	Rate limits the routes anybody can call per address, like guessing
+ *	passwords on /login. The rest of the API, realtime connections included,
+ *	is only open to signed in users and far too busy for the same limit.
+ */
+func RateLimited(router http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", router)
+
+	for _, pattern := range rateLimited {
+		mux.Handle(pattern, util.RateLimitMiddleware(router.ServeHTTP))
+	}
+
+	return mux
+}
@@ -0,0 +1,182 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Dialect of the schemas generated here
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+/*
+ *	Builds JSON Schemas from Go types, following the rules encoding/json uses
+ *	to marshal them. Named structs end up in the definitions and are referred
+ *	to by name. Types that marshal themselves need an override, or they allow
+ *	anything.
+ */
+type Generator struct {
+	definitions map[string]any
+	names       map[reflect.Type]string
+	overrides   map[reflect.Type]map[string]any
+}
+
+func NewGenerator() *Generator {
+	generator := &Generator{
+		definitions: make(map[string]any),
+		names:       make(map[reflect.Type]string),
+		overrides:   make(map[reflect.Type]map[string]any),
+	}
+
+	generator.Override(reflect.TypeOf(time.Time{}), map[string]any{"type": "string", "format": "date-time"})
+	generator.Override(reflect.TypeOf(json.RawMessage{}), map[string]any{})
+
+	return generator
+}
+
+// Uses the given schema for every value of the type
+func (generator *Generator) Override(t reflect.Type, schema map[string]any) {
+	generator.overrides[t] = schema
+}
+
+// Everything referred to from the schemas generated so far, by name
+func (generator *Generator) Definitions() map[string]any {
+	return generator.definitions
+}
+
+// Returns the schema of the type, which is a reference for named structs
+func (generator *Generator) Schema(t reflect.Type) map[string]any {
+	if schema, ok := generator.overrides[t]; ok {
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+
+	case reflect.String:
+		return map[string]any{"type": "string"}
+
+	case reflect.Slice, reflect.Array:
+		// Byte slices are marshaled as base64 strings
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+
+		return map[string]any{"type": "array", "items": generator.Schema(t.Elem())}
+
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": generator.Schema(t.Elem())}
+
+	case reflect.Pointer:
+		return generator.Schema(t.Elem())
+
+	case reflect.Struct:
+		return generator.structSchema(t)
+	}
+
+	// Interfaces, which can hold anything
+	return map[string]any{}
+}
+
+func (generator *Generator) structSchema(t reflect.Type) map[string]any {
+	if t.Name() == "" {
+		return generator.object(t)
+	}
+
+	name, ok := generator.names[t]
+
+	if !ok {
+		name = t.Name()
+
+		// Another package has a type of the same name already
+		if _, taken := generator.definitions[name]; taken {
+			name = strings.ReplaceAll(t.PkgPath(), "/", ".") + "." + name
+		}
+
+		// Reserved before generating, so recursive types refer to themselves
+		generator.names[t] = name
+		generator.definitions[name] = map[string]any{}
+		generator.definitions[name] = generator.object(t)
+	}
+
+	return map[string]any{"$ref": "#/$defs/" + name}
+}
+
+func (generator *Generator) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+
+	generator.addFields(t, properties, &required)
+
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+// Adds the fields of the struct, and those of the structs it embeds
+func (generator *Generator) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+
+		if tag == "-" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+		fieldType := field.Type
+
+		if field.Anonymous && name == "" {
+			if fieldType.Kind() == reflect.Pointer {
+				fieldType = fieldType.Elem()
+			}
+
+			if fieldType.Kind() == reflect.Struct {
+				generator.addFields(fieldType, properties, required)
+				continue
+			}
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := generator.Schema(fieldType)
+		omitEmpty := strings.Contains(options, "omitempty")
+
+		// Nil pointers, slices and maps come out as null unless they are left out
+		switch fieldType.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+			if !omitEmpty && len(schema) > 0 {
+				schema = map[string]any{"anyOf": []any{schema, map[string]any{"type": "null"}}}
+			}
+		}
+
+		properties[name] = schema
+
+		if !omitEmpty {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Keeps the files in a directory on the local disk
+type LocalStore struct {
+	Dir string
+}
+
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	return &LocalStore{Dir: dir}, nil
+}
+
+func (store *LocalStore) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+
+	return filepath.Join(store.Dir, filepath.FromSlash(key)), nil
+}
+
+/*
+ *	Writes into a temporary file first and moves it in place once everything
+ *	has arrived, so a failed upload never leaves half a file under the key.
+ */
+func (store *LocalStore) Put(key string, reader io.Reader, size int64, contentType string) error {
+	path, err := store.path(key)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+
+	written, err := io.Copy(file, reader)
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if written != size {
+		return fmt.Errorf("expected %d bytes but got %d", size, written)
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func (store *LocalStore) Get(key string) (io.ReadCloser, error) {
+	path, err := store.path(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (store *LocalStore) Delete(key string) error {
+	path, err := store.path(key)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+
+	return err
+}
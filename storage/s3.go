@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Used when no region is configured, which is what most S3 compatible services expect
+	defaultS3Region = "us-east-1"
+
+	// Uploads are streamed, so the body can't be hashed before it is sent
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+/*
+ *	Keeps the files in a bucket of an S3 compatible service, such as AWS S3 or
+ *	MinIO. Objects are addressed path style, as in {Endpoint}/{Bucket}/{key},
+ *	since that works with every implementation. Requests are signed with
+ *	Signature Version 4.
+ */
+type S3Store struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// Falls back to http.DefaultClient
+	Client *http.Client
+}
+
+func (store *S3Store) client() *http.Client {
+	if store.Client != nil {
+		return store.Client
+	}
+
+	return http.DefaultClient
+}
+
+func (store *S3Store) region() string {
+	if store.Region != "" {
+		return store.Region
+	}
+
+	return defaultS3Region
+}
+
+func (store *S3Store) newRequest(method, key string, body io.Reader) (*http.Request, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("invalid storage key %q", key)
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(store.Endpoint, "/"))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+
+	// Valid keys need no escaping
+	endpoint.Path += "/" + store.Bucket + "/" + key
+
+	return http.NewRequest(method, endpoint.String(), body)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Adds the Signature Version 4 authorization to the request
+func (store *S3Store) sign(r *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + r.URL.Host + "\n" +
+		"x-amz-content-sha256:" + unsignedPayload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + store.region() + "/s3/aws4_request"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashedRequest[:])
+
+	key := hmacSHA256([]byte("AWS4"+store.SecretKey), date)
+	key = hmacSHA256(key, store.region())
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		store.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func (store *S3Store) do(r *http.Request) (*http.Response, error) {
+	store.sign(r, time.Now())
+
+	response, err := store.client().Do(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, ErrNotFound
+	}
+
+	if response.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s failed with %s: %s", r.Method, r.URL.Path, response.Status, message)
+	}
+
+	return response, nil
+}
+
+func (store *S3Store) Put(key string, reader io.Reader, size int64, contentType string) error {
+	r, err := store.newRequest(http.MethodPut, key, reader)
+
+	if err != nil {
+		return err
+	}
+
+	r.ContentLength = size
+	r.Header.Set("Content-Type", contentType)
+
+	response, err := store.do(r)
+
+	if err != nil {
+		return err
+	}
+
+	return response.Body.Close()
+}
+
+func (store *S3Store) Get(key string) (io.ReadCloser, error) {
+	r, err := store.newRequest(http.MethodGet, key, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := store.do(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Body, nil
+}
+
+func (store *S3Store) Delete(key string) error {
+	r, err := store.newRequest(http.MethodDelete, key, nil)
+
+	if err != nil {
+		return err
+	}
+
+	response, err := store.do(r)
+
+	if err != nil {
+		return err
+	}
+
+	return response.Body.Close()
+}
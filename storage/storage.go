@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"chat-module/config"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Returned by Get and Delete when there is nothing stored under the key
+var ErrNotFound = errors.New("no such file")
+
+/*
+ *	Where uploaded files end up. Keys are chosen by us, never by the client, and
+ *	only consist of letters, digits, dashes, dots and slashes.
+ */
+type Store interface {
+	// Streams size bytes from the reader into the store under the key
+	Put(key string, reader io.Reader, size int64, contentType string) error
+
+	// Opens the file stored under the key. The caller has to close it.
+	Get(key string) (io.ReadCloser, error)
+
+	Delete(key string) error
+}
+
+/*
+ *	Singleton store instance, set up by Init. Outside packages should go through
+ *	this object to store and read files.
+ */
+var Files Store
+
+/*
+ *	Sets up the store picked in the configuration. The default is "local",
+ *	which keeps the files in a directory. "s3" talks to an S3 compatible
+ *	service.
+ */
+func Init(cfg config.Storage) error {
+	switch cfg.Backend {
+	case "", "local":
+		store, err := NewLocalStore(cfg.Dir)
+
+		if err != nil {
+			return err
+		}
+
+		Files = store
+
+	case "s3":
+		store := &S3Store{
+			Endpoint:  cfg.S3.Endpoint,
+			Bucket:    cfg.S3.Bucket,
+			Region:    cfg.S3.Region,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: cfg.S3.SecretKey,
+		}
+
+		if store.Endpoint == "" || store.Bucket == "" || store.AccessKey == "" || store.SecretKey == "" {
+			return fmt.Errorf("the S3 endpoint, bucket, access key and secret key must all be set")
+		}
+
+		Files = store
+
+	default:
+		return fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+
+	return nil
+}
+
+// Whether the key only uses the characters we hand out, so it can't escape its directory or bucket
+func validKey(key string) bool {
+	if key == "" || key[0] == '/' {
+		return false
+	}
+
+	for i, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		case c == '.' || c == '/':
+			// No empty, current or parent directory segments
+			if i+1 < len(key) && (key[i+1] == '.' || key[i+1] == '/') {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return key[0] != '.' && key[len(key)-1] != '/'
+}
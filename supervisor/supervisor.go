@@ -0,0 +1,155 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/*
+ *	A background job. It should keep going until the context is done and then
+ *	return nil. Returning an error before that, or panicking, gets it restarted.
+ */
+type Job func(ctx context.Context) error
+
+const (
+	// How long a failed job waits before it is restarted the first time.
+	// Every failure in a row doubles it, up to MaxBackoff.
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+/*
+ *	Runs background jobs for as long as the supervisor lives, restarting the
+ *	ones that fail, and stops all of them together.
+ */
+type Supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	jobs   sync.WaitGroup
+
+	// Must not be changed once jobs are started
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Creates a supervisor whose jobs run until it is stopped or the parent context is done
+func New(parent context.Context) *Supervisor {
+	ctx, cancel := context.WithCancel(parent)
+
+	return &Supervisor{
+		ctx:        ctx,
+		cancel:     cancel,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+}
+
+// Starts the job in the background. The name is only used for logging.
+func (supervisor *Supervisor) Go(name string, job Job) {
+	supervisor.jobs.Add(1)
+
+	go func() {
+		defer supervisor.jobs.Done()
+		supervisor.supervise(name, job)
+	}()
+}
+
+func (supervisor *Supervisor) supervise(name string, job Job) {
+	backoff := supervisor.MinBackoff
+
+	for {
+		started := time.Now()
+		err := run(supervisor.ctx, job)
+
+		if supervisor.ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			log.Printf("Job %s finished", name)
+			return
+		}
+
+		// A job that ran fine for a while starts over with the shortest wait
+		if time.Since(started) > supervisor.MaxBackoff {
+			backoff = supervisor.MinBackoff
+		}
+
+		log.Printf("Job %s failed, restarting in %v: %v", name, backoff, err)
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-timer.C:
+		case <-supervisor.ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		backoff = min(backoff*2, supervisor.MaxBackoff)
+	}
+}
+
+// Runs the job, turning a panic into an error
+func run(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = &PanicError{Value: recovered, Stack: debug.Stack()}
+		}
+	}()
+
+	return job(ctx)
+}
+
+// What a job that panicked failed with
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", err.Value, err.Stack)
+}
+
+/*
+ *	Stops every job and waits for them to return. If they don't by the time
+ *	the context is done, gives up on them and returns the error of the context.
+ */
+func (supervisor *Supervisor) Stop(ctx context.Context) error {
+	supervisor.cancel()
+
+	done := make(chan struct{})
+
+	go func() {
+		supervisor.jobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// A job that runs the task every interval until the context is done
+func Every(interval time.Duration, task func(ctx context.Context)) Job {
+	return func(ctx context.Context) error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				task(ctx)
+			}
+		}
+	}
+}
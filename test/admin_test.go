@@ -0,0 +1,300 @@
+package test
+
+import (
+	"chat-module/auth"
+	"chat-module/chat"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/routes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func login(mux http.Handler, username, password string) int {
+	return doRequest(mux, "GET", "/login", "", map[string]string{"username": username, "password": password}).Code
+}
+
+func TestAdminListUsers(t *testing.T) {
+	mux := newTestRouter(t)
+
+	newTestUser(t, "list-admin", models.RoleAdmin)
+	adminToken := newTestToken(t, "list-admin")
+
+	for i := 0; i < 5; i++ {
+		newTestUser(t, fmt.Sprintf("listed-%d", i), models.RoleUser)
+	}
+
+	rr := doRequest(mux, "GET", "/api/admin/users?q=LISTED&page=2&limit=2", adminToken, nil)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("listing users failed: got %v", rr.Code)
+	}
+
+	if strings.Contains(rr.Body.String(), `"password"`) {
+		t.Errorf("user listing contains password data: %s", rr.Body.String())
+	}
+
+	var page struct {
+		Users []struct {
+			Username string `json:"username"`
+		} `json:"users"`
+		Total int `json:"total"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &page)
+
+	if page.Total != 5 || len(page.Users) != 2 || page.Users[0].Username != "listed-2" {
+		t.Errorf("wrong page of users: %s", rr.Body.String())
+	}
+
+	if rr := doRequest(mux, "GET", "/api/admin/users?limit=1000", adminToken, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("oversized page was accepted: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "GET", "/api/admin/users", newTestToken(t, "listed-0"), nil); rr.Code != http.StatusForbidden {
+		t.Errorf("regular user could list users: got %v", rr.Code)
+	}
+
+	newTestUser(t, "list-mod", models.RoleModerator)
+	modToken := newTestToken(t, "list-mod")
+
+	if rr := doRequest(mux, "GET", "/api/admin/users/listed-0", modToken, nil); rr.Code != http.StatusOK {
+		t.Errorf("moderator couldn't view an user: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "DELETE", "/api/admin/users/listed-0", modToken, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("moderator could delete an user: got %v", rr.Code)
+	}
+}
+
+func TestAdminSuspendUser(t *testing.T) {
+	mux := newTestRouter(t)
+
+	newTestUser(t, "suspend-admin", models.RoleAdmin)
+	adminToken := newTestToken(t, "suspend-admin")
+	userToken := newTestToken(t, "suspended-user")
+
+	if rr := doRequest(mux, "POST", "/api/admin/users/suspended-user/suspension", adminToken, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("suspending failed: got %v", rr.Code)
+	}
+
+	if _, err := auth.ValidateJWT(userToken); !errors.Is(err, auth.ErrTokenInvalid) {
+		t.Errorf("token of suspended user still works: %v", err)
+	}
+
+	if code := login(mux, "suspended-user", testPassword); code != http.StatusForbidden {
+		t.Errorf("suspended user could log in: got %v", code)
+	}
+
+	if rr := doRequest(mux, "DELETE", "/api/admin/users/suspended-user/suspension", adminToken, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("unsuspending failed: got %v", rr.Code)
+	}
+
+	if code := login(mux, "suspended-user", testPassword); code != http.StatusCreated {
+		t.Errorf("unsuspended user couldn't log in: got %v", code)
+	}
+
+	if rr := doRequest(mux, "POST", "/api/admin/users/suspend-admin/suspension", adminToken, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("admin could suspend themselves: got %v", rr.Code)
+	}
+}
+
+func TestAdminForcePasswordReset(t *testing.T) {
+	mux := newTestRouter(t)
+
+	newTestUser(t, "reset-admin", models.RoleAdmin)
+	adminToken := newTestToken(t, "reset-admin")
+	userToken := newTestToken(t, "reset-user")
+
+	rr := doRequest(mux, "POST", "/api/admin/users/reset-user/password-reset", adminToken, nil)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("forcing password reset failed: got %v", rr.Code)
+	}
+
+	var reset struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &reset)
+
+	if _, err := auth.ValidateJWT(userToken); !errors.Is(err, auth.ErrTokenInvalid) {
+		t.Errorf("token survived a password reset: %v", err)
+	}
+
+	if code := login(mux, "reset-user", testPassword); code != http.StatusForbidden {
+		t.Errorf("user could log in before resetting: got %v", code)
+	}
+
+	body := map[string]string{"username": "reset-user", "token": "wrong", "password": "new-password"}
+	if rr := doRequest(mux, "POST", "/reset-password", "", body); rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong reset token was accepted: got %v", rr.Code)
+	}
+
+	body["token"] = reset.Token
+	if rr := doRequest(mux, "POST", "/reset-password", "", body); rr.Code != http.StatusOK {
+		t.Fatalf("resetting the password failed: got %v", rr.Code)
+	}
+
+	if code := login(mux, "reset-user", "new-password"); code != http.StatusCreated {
+		t.Errorf("couldn't log in with the new password: got %v", code)
+	}
+
+	if rr := doRequest(mux, "POST", "/reset-password", "", body); rr.Code != http.StatusBadRequest {
+		t.Errorf("reset token could be used twice: got %v", rr.Code)
+	}
+}
+
+func TestAdminDeleteUser(t *testing.T) {
+	mux := newTestRouter(t)
+
+	newTestUser(t, "delete-admin", models.RoleAdmin)
+	adminToken := newTestToken(t, "delete-admin")
+	userToken := newTestToken(t, "deleted-user")
+
+	if rr := doRequest(mux, "DELETE", "/api/admin/users/deleted-user", adminToken, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("deleting user failed: got %v", rr.Code)
+	}
+
+	if _, err := auth.ValidateJWT(userToken); !errors.Is(err, auth.ErrTokenInvalid) {
+		t.Errorf("token of deleted user still works: %v", err)
+	}
+
+	if rr := doRequest(mux, "GET", "/api/admin/users/deleted-user", adminToken, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("deleted user can still be viewed: got %v", rr.Code)
+	}
+}
+
+func TestDeletedUsernameStartsFresh(t *testing.T) {
+	mux := newTestRouter(t)
+
+	newTestUser(t, "fresh-admin", models.RoleAdmin)
+	adminToken := newTestToken(t, "fresh-admin")
+
+	room := newTestRoom(t, "fresh-owner", "fresh-user")
+	postMessage(t, mux, "fresh-owner", room, "@fresh-user welcome")
+	direct := openDirectRoom(t, "fresh-friend", "fresh-user")
+
+	if rr := doRequest(mux, "DELETE", "/api/admin/users/fresh-user", adminToken, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("deleting user failed: got %v", rr.Code)
+	}
+
+	body := map[string]string{"username": "fresh-user", "password": testPassword, "email": "fresh-again@example.com"}
+	if rr := doRequest(mux, "POST", "/register", "", body); rr.Code != http.StatusCreated {
+		t.Fatalf("registering the name again failed: got %v", rr.Code)
+	}
+
+	token := newTestToken(t, "fresh-user")
+
+	rr := doRequest(mux, "GET", "/api/rooms", token, nil)
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("new user inherited rooms: %v %s", rr.Code, rr.Body.String())
+	}
+
+	rr = doRequest(mux, "GET", "/api/users/me/mentions", token, nil)
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("new user inherited mentions: %v %s", rr.Code, rr.Body.String())
+	}
+
+	if sessions := listSessions(t, mux, token); len(sessions) != 1 {
+		t.Errorf("new user inherited sessions: %+v", sessions)
+	}
+
+	if reopened := openDirectRoom(t, "fresh-friend", "fresh-user"); reopened.ID == direct.ID {
+		t.Errorf("new user inherited the direct conversation")
+	}
+
+	if messages, err := db.Client.GetMessages(room.ID, primitive.NilObjectID, 10); err != nil || len(messages) != 1 || len(messages[0].Mentions) != 0 {
+		t.Errorf("mention of the deleted user was kept: %+v %v", messages, err)
+	}
+}
+
+func TestAdminOnlyManagesLowerRanks(t *testing.T) {
+	mux := newTestRouter(t)
+
+	newTestUser(t, "rank-admin", models.RoleAdmin)
+	newTestUser(t, "rank-other-admin", models.RoleAdmin)
+	newTestUser(t, "rank-moderator", models.RoleModerator)
+	adminToken := newTestToken(t, "rank-admin")
+
+	refused := []struct{ method, path string }{
+		{"POST", "/api/admin/users/rank-other-admin/suspension"},
+		{"DELETE", "/api/admin/users/rank-other-admin/suspension"},
+		{"POST", "/api/admin/users/rank-other-admin/password-reset"},
+		{"DELETE", "/api/admin/users/rank-other-admin"},
+	}
+
+	for _, request := range refused {
+		if rr := doRequest(mux, request.method, request.path, adminToken, nil); rr.Code != http.StatusForbidden {
+			t.Errorf("%s %s on another admin: got %v", request.method, request.path, rr.Code)
+		}
+	}
+
+	if rr := doRequest(mux, "POST", "/api/admin/users/rank-admin/password-reset", adminToken, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("admin could reset their own password: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "GET", "/api/admin/users/rank-other-admin", adminToken, nil); rr.Code != http.StatusOK {
+		t.Errorf("other admin was changed: got %v", rr.Code)
+	} else if strings.Contains(rr.Body.String(), `"suspended":true`) {
+		t.Errorf("other admin was suspended")
+	}
+
+	if rr := doRequest(mux, "POST", "/api/admin/users/rank-moderator/suspension", adminToken, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("admin couldn't suspend a moderator: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "POST", "/api/admin/users/nobody-at-all/suspension", adminToken, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("suspending a missing user: got %v", rr.Code)
+	}
+}
+
+// Expects the event stream to end before long
+func expectStreamEnded(t *testing.T, events <-chan streamedEvent) {
+	timeout := time.After(3 * time.Second)
+
+	for {
+		select {
+		case _, open := <-events:
+			if !open {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("the event stream is still open")
+		}
+	}
+}
+
+func TestAdminActionsDisconnectUser(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+
+	newTestUser(t, "disconnect-admin", models.RoleAdmin)
+	adminToken := newTestToken(t, "disconnect-admin")
+
+	for _, action := range []string{"suspension", "password-reset"} {
+		username := "disconnected-by-" + action
+
+		conn := dialSession(t, server, username, newTestToken(t, username))
+		waitForEvent(t, conn, chat.EventPresence, presenceIs(username, chat.StatusOnline))
+
+		// With the socket away, the user coming back online means the stream is connected
+		setAway(conn, true)
+		waitForEvent(t, conn, chat.EventPresence, presenceIs(username, chat.StatusAway))
+
+		events, _ := openEventStream(t, server, username, "")
+		waitForEvent(t, conn, chat.EventPresence, presenceIs(username, chat.StatusOnline))
+
+		if rr := doRequest(mux, "POST", "/api/admin/users/"+username+"/"+action, adminToken, nil); rr.Code/100 != 2 {
+			t.Fatalf("%s failed: got %v", action, rr.Code)
+		}
+
+		expectRevoked(t, conn)
+		expectStreamEnded(t, events)
+	}
+}
@@ -0,0 +1,356 @@
+package test
+
+import (
+	"bytes"
+	"chat-module/attachments"
+	"chat-module/auth"
+	"chat-module/config"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/routes"
+	"chat-module/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type testAttachment struct {
+	models.Attachment
+	URL string `json:"url"`
+}
+
+func testPNG(t *testing.T) []byte {
+	var buffer bytes.Buffer
+
+	if err := png.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+
+	return buffer.Bytes()
+}
+
+// Uploads the content as the raw request body, the way clients do
+func upload(mux http.Handler, token, filename string, content []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/attachments?filename="+filename, bytes.NewReader(content))
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestAttachments(t *testing.T) {
+	hub, _ := newTestHubServer(t)
+	mux := routes.New(hub)
+
+	room := newTestRoom(t, "attach-alice", "attach-bob")
+	newTestUser(t, "attach-outsider", models.RoleUser)
+	alice := newTestToken(t, "attach-alice")
+
+	// The type is sniffed from the content, not taken from the name
+	if rr := upload(mux, alice, "notes.txt", []byte("<html><script>alert(1)</script></html>")); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("HTML upload was accepted: got %v", rr.Code)
+	}
+
+	req := httptest.NewRequest("POST", "/api/attachments", strings.NewReader("small"))
+	req.Header.Set("Authorization", "Bearer "+alice)
+	req.ContentLength = attachments.MaxAttachmentSize + 1
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized upload was accepted: got %v", rr.Code)
+	}
+
+	content := testPNG(t)
+	rr = upload(mux, alice, "../../cat.png", content)
+
+	var uploaded testAttachment
+	json.Unmarshal(rr.Body.Bytes(), &uploaded)
+
+	if rr.Code != http.StatusCreated || uploaded.ContentType != "image/png" || uploaded.Filename != "cat.png" || uploaded.Size != int64(len(content)) {
+		t.Fatalf("unexpected upload result: %v %+v", rr.Code, uploaded)
+	}
+
+	// Nobody else can see it until it's attached to a message
+	bob := newTestToken(t, "attach-bob")
+	path := "/api/attachments/" + uploaded.ID.Hex()
+
+	if rr := doRequest(mux, "GET", path, bob, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("unattached upload was visible to another user: got %v", rr.Code)
+	}
+
+	rr = doRequest(mux, "POST", "/api/rooms/"+room.ID.Hex()+"/messages", alice, map[string]any{"attachments": []string{uploaded.ID.Hex()}})
+
+	var message models.Message
+	json.Unmarshal(rr.Body.Bytes(), &message)
+
+	if rr.Code != http.StatusCreated || len(message.Attachments) != 1 || message.Attachments[0] != uploaded.ID {
+		t.Fatalf("sending message with attachment failed: %v %+v", rr.Code, message)
+	}
+
+	// An attachment only goes on one message, and only its uploader attaches it
+	rr = doRequest(mux, "POST", "/api/rooms/"+room.ID.Hex()+"/messages", alice, map[string]any{"attachments": []string{uploaded.ID.Hex()}})
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("attachment was reused: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "GET", path, newTestToken(t, "attach-outsider"), nil); rr.Code != http.StatusNotFound {
+		t.Errorf("outsider could see the attachment: got %v", rr.Code)
+	}
+
+	rr = doRequest(mux, "GET", path, bob, nil)
+
+	var shared testAttachment
+	json.Unmarshal(rr.Body.Bytes(), &shared)
+
+	if rr.Code != http.StatusOK || shared.URL == "" {
+		t.Fatalf("member couldn't get the attachment: got %v", rr.Code)
+	}
+
+	// The signed link works without a token, as long as nobody tampers with it
+	rr = doRequest(mux, "GET", shared.URL, "", nil)
+
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) || rr.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("download through the signed link failed: got %v", rr.Code)
+	}
+
+	forged := strings.Replace(shared.URL, uploaded.ID.Hex(), models.Attachment{}.ID.Hex(), 1)
+
+	if rr := doRequest(mux, "GET", forged, "", nil); rr.Code != http.StatusForbidden {
+		t.Errorf("link for another attachment was accepted: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "GET", path+"/content", "", nil); rr.Code != http.StatusForbidden {
+		t.Errorf("unsigned download was allowed: got %v", rr.Code)
+	}
+}
+
+/*
+ *	Just enough of S3 to store, read and delete objects, checking that every
+ *	request carries a Signature Version 4 authorization for the right key.
+ */
+func newS3StandIn(t *testing.T, accessKey string) *httptest.Server {
+	var lock sync.Mutex
+	objects := make(map[string][]byte)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+
+		if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential="+accessKey+"/") ||
+			!strings.Contains(authorization, "Signature=") || r.Header.Get("X-Amz-Date") == "" {
+			http.Error(w, "AccessDenied", http.StatusForbidden)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = body
+
+		case http.MethodGet:
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			w.Write(body)
+
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestS3Store(t *testing.T) {
+	server := newS3StandIn(t, "test-access-key")
+	store := &storage.S3Store{
+		Endpoint:  server.URL,
+		Bucket:    "uploads",
+		AccessKey: "test-access-key",
+		SecretKey: "test-secret-key",
+	}
+
+	content := []byte("hello from the bucket")
+
+	if err := store.Put("attachments/abc", bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	file, err := store.Get("attachments/abc")
+
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+
+	stored, _ := io.ReadAll(file)
+	file.Close()
+
+	if !bytes.Equal(stored, content) {
+		t.Errorf("got back %q", stored)
+	}
+
+	if err := store.Delete("attachments/abc"); err != nil {
+		t.Errorf("delete failed: %v", err)
+	}
+
+	if _, err := store.Get("attachments/abc"); err != storage.ErrNotFound {
+		t.Errorf("expected the object to be gone, got %v", err)
+	}
+
+	if err := store.Put("../escape", bytes.NewReader(content), int64(len(content)), "text/plain"); err == nil {
+		t.Errorf("key outside the bucket was accepted")
+	}
+
+	store.SecretKey = ""
+	store.AccessKey = "wrong-key"
+
+	if err := store.Put("attachments/abc", bytes.NewReader(content), int64(len(content)), "text/plain"); err == nil || !strings.Contains(err.Error(), fmt.Sprint(http.StatusForbidden)) {
+		t.Errorf("expected the stand-in to reject the wrong key, got %v", err)
+	}
+}
+
+// Makes a link request from the result of auth.SignLink
+func linkRequest(link string) *http.Request {
+	return httptest.NewRequest("GET", link, nil)
+}
+
+func TestSignedLinks(t *testing.T) {
+	link := auth.SignLink("/api/attachments/some-id/content", time.Minute)
+
+	if !auth.VerifyLink(linkRequest(link)) {
+		t.Fatalf("a fresh link was rejected")
+	}
+
+	if auth.VerifyLink(linkRequest(strings.Replace(link, "some-id", "other-id", 1))) {
+		t.Errorf("a link was accepted for another path")
+	}
+
+	// Links made without knowing the JWT key don't work, whatever key they used
+	auth.Init(config.Auth{JWTKey: "some-other-key-that-is-long-enough!!"})
+	forged := auth.SignLink("/api/attachments/some-id/content", time.Minute)
+
+	auth.Init(config.Auth{})
+	unkeyed := auth.SignLink("/api/attachments/some-id/content", time.Minute)
+
+	auth.Init(config.Auth{JWTKey: testJWTKey})
+
+	if auth.VerifyLink(linkRequest(forged)) {
+		t.Errorf("a link signed with another key was accepted")
+	}
+
+	if auth.VerifyLink(linkRequest(unkeyed)) {
+		t.Errorf("a link signed with an empty key was accepted")
+	}
+}
+
+// The repository, failing the writes it is told to
+type failingRepo struct {
+	db.Repository
+	failAdd    bool
+	failAttach primitive.ObjectID
+}
+
+func (repo *failingRepo) AddMessage(message models.Message) error {
+	if repo.failAdd {
+		return errors.New("insert failed")
+	}
+
+	return repo.Repository.AddMessage(message)
+}
+
+func (repo *failingRepo) AttachToMessage(id primitive.ObjectID, uploader string, conversation, message primitive.ObjectID) error {
+	if id == repo.failAttach {
+		return mongo.ErrNoDocuments
+	}
+
+	return repo.Repository.AttachToMessage(id, uploader, conversation, message)
+}
+
+func TestFailedSendsLeaveAttachmentsFree(t *testing.T) {
+	hub, _ := newTestHubServer(t)
+	mux := routes.New(hub)
+
+	room := newTestRoom(t, "failed-attach-alice", "failed-attach-bob")
+	alice := newTestToken(t, "failed-attach-alice")
+	path := "/api/rooms/" + room.ID.Hex() + "/messages"
+
+	var first, second testAttachment
+	json.Unmarshal(upload(mux, alice, "first.png", testPNG(t)).Body.Bytes(), &first)
+	json.Unmarshal(upload(mux, alice, "second.png", testPNG(t)).Body.Bytes(), &second)
+
+	draft := map[string]any{"attachments": []string{first.ID.Hex(), second.ID.Hex()}}
+
+	repo := &failingRepo{Repository: db.Client}
+	db.Client = repo
+	t.Cleanup(func() { db.Client = repo.Repository })
+
+	isFree := func(id primitive.ObjectID) bool {
+		attachment, err := repo.Repository.GetAttachment(id)
+		return err == nil && !attachment.IsAttached()
+	}
+
+	// The message never got stored
+	repo.failAdd = true
+
+	if rr := doRequest(mux, "POST", path, alice, draft); rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected the failed insert to fail the send, got %v", rr.Code)
+	}
+
+	if !isFree(first.ID) || !isFree(second.ID) {
+		t.Errorf("a failed send took the attachments")
+	}
+
+	// Another message got to the second one first
+	repo.failAdd = false
+	repo.failAttach = second.ID
+
+	if rr := doRequest(mux, "POST", path, alice, draft); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected the taken attachment to fail the send, got %v", rr.Code)
+	}
+
+	if !isFree(first.ID) {
+		t.Errorf("the attachment that was bound wasn't let go")
+	}
+
+	var history []models.Message
+	json.Unmarshal(doRequest(mux, "GET", path, alice, nil).Body.Bytes(), &history)
+
+	if len(history) != 0 {
+		t.Errorf("the message of the failed send was kept: %+v", history)
+	}
+
+	// Both are still there for the next try
+	repo.failAttach = primitive.NilObjectID
+
+	rr := doRequest(mux, "POST", path, alice, draft)
+
+	var sent models.Message
+	json.Unmarshal(rr.Body.Bytes(), &sent)
+
+	if rr.Code != http.StatusCreated || len(sent.Attachments) != 2 || isFree(first.ID) || isFree(second.ID) {
+		t.Errorf("retrying the send failed: %v %+v", rr.Code, sent)
+	}
+}
@@ -0,0 +1,108 @@
+package test
+
+import (
+	"chat-module/bus"
+	"chat-module/chat"
+	"chat-module/models"
+	"chat-module/routes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Starts a hub with the given slow client policy and a tiny queue
+func newSlowClientServer(t *testing.T, policy chat.SlowClientPolicy) (*chat.Hub, *httptest.Server) {
+	hub, err := chat.NewHub(bus.NewMemoryBus())
+
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+
+	hub.Sockets.QueueSize = 4
+	hub.Sockets.Policy = policy
+
+	go hub.Run()
+
+	server := httptest.NewServer(routes.New(hub))
+	t.Cleanup(server.Close)
+
+	return hub, server
+}
+
+// Sends big events to a client that isn't reading, until its socket buffers fill up
+func flood(hub *chat.Hub, username string) {
+	payload := strings.Repeat("x", 1<<20)
+
+	for i := 0; i < 64; i++ {
+		hub.SendToUsers([]string{username}, chat.NewEvent("flood", payload))
+	}
+}
+
+func connectionStats(t *testing.T, server *httptest.Server, username string) []chat.ConnectionStats {
+	req, _ := http.NewRequest("GET", server.URL+"/api/admin/connections?user="+username, nil)
+	newTestUser(t, "connections-admin", models.RoleAdmin)
+	req.Header.Set("Authorization", "Bearer "+newTestToken(t, "connections-admin"))
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connection stats request failed: %v %v", err, resp)
+	}
+	defer resp.Body.Close()
+
+	var stats []chat.ConnectionStats
+	json.NewDecoder(resp.Body).Decode(&stats)
+
+	return stats
+}
+
+func TestSlowClientsDropOldest(t *testing.T) {
+	hub, server := newSlowClientServer(t, chat.PolicyDropOldest)
+	slow := dialSocket(t, server, "slow-dropped")
+	eventually(t, "the socket is registered", func() bool { return len(connectionStats(t, server, "slow-dropped")) == 1 })
+
+	flood(hub, "slow-dropped")
+
+	stats := connectionStats(t, server, "slow-dropped")
+
+	if len(stats) != 1 || stats[0].Dropped == 0 || stats[0].QueueSize != 4 || stats[0].PeakQueued != 4 {
+		t.Fatalf("expected a connected client with dropped events: %+v", stats)
+	}
+
+	// The client stays connected, and hears that it missed something
+	waitForEventWithin(t, slow, chat.EventResync, 10*time.Second, nil)
+}
+
+func TestSlowClientsDisconnect(t *testing.T) {
+	hub, server := newSlowClientServer(t, chat.PolicyDisconnect)
+	slow := dialSocket(t, server, "slow-disconnected")
+	eventually(t, "the socket is registered", func() bool { return len(connectionStats(t, server, "slow-disconnected")) == 1 })
+
+	flood(hub, "slow-disconnected")
+	eventually(t, "the slow client is gone", func() bool { return len(connectionStats(t, server, "slow-disconnected")) == 0 })
+
+	slow.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	for {
+		_, _, err := slow.ReadMessage()
+
+		var closeErr *websocket.CloseError
+
+		if errors.As(err, &closeErr) {
+			if closeErr.Code != chat.CloseSlowClient {
+				t.Errorf("expected close code %d, got %d", chat.CloseSlowClient, closeErr.Code)
+			}
+			return
+		}
+
+		if err != nil {
+			t.Fatalf("socket failed without a close frame: %v", err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package test
+
+import (
+	"bytes"
+	"chat-module/bus"
+	"chat-module/chat"
+	"chat-module/cli"
+	"chat-module/config"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/routes"
+	"chat-module/util"
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs the command line against the in-memory repository, returning the exit code and the output
+func runCLI(t *testing.T, args ...string) (int, string, string) {
+	return runCLIOn(t, bus.NewMemoryBus(), args...)
+}
+
+// A bus the command line can't close, for the servers that keep using it
+type borrowedBus struct {
+	bus.Bus
+}
+
+func (borrowedBus) Close() error {
+	return nil
+}
+
+// Runs the command line like runCLI, with the servers listening on the given bus
+func runCLIOn(t *testing.T, messageBus bus.Bus, args ...string) (int, string, string) {
+	t.Setenv("MONGODB_URL", "mongodb://unused")
+	t.Setenv("DB_NAME", "unused")
+	t.Setenv("jwtKey", testJWTKey)
+
+	var stdout, stderr bytes.Buffer
+
+	app := &cli.App{
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+		Connect: func(config.Database) error { return nil },
+		OpenBus: func(config.Bus) (bus.Bus, error) { return borrowedBus{messageBus}, nil },
+	}
+
+	code := app.Run(args)
+
+	return code, stdout.String(), stderr.String()
+}
+
+func TestUserCommands(t *testing.T) {
+	code, out, errOut := runCLI(t, "user", "create", "-username", "cli-alice", "-email", "cli-alice@example.com", "-role", "moderator")
+
+	if code != 0 {
+		t.Fatalf("creating a user failed with %d: %s", code, errOut)
+	}
+
+	password := regexp.MustCompile(`Password: (\S+)`).FindStringSubmatch(out)
+
+	if password == nil {
+		t.Fatalf("expected the made up password to be printed, got %q", out)
+	}
+
+	user, err := db.Client.GetUser("cli-alice")
+
+	if err != nil || user.Role != models.RoleModerator || !util.CheckPasswordHash(password[1], *user.Password) {
+		t.Fatalf("user wasn't created as asked: %+v, %v", user, err)
+	}
+
+	if code, _, _ := runCLI(t, "user", "create", "-username", "cli-alice", "-email", "other@example.com"); code != 1 {
+		t.Errorf("expected creating a taken username to fail, got %d", code)
+	}
+
+	if code, _, _ := runCLI(t, "user", "create", "-username", "cli-bob"); code != 2 {
+		t.Errorf("expected a missing email to be a usage error, got %d", code)
+	}
+
+	if code, _, errOut := runCLI(t, "user", "disable", "cli-alice"); code != 0 {
+		t.Fatalf("disabling a user failed with %d: %s", code, errOut)
+	}
+
+	if user, _ := db.Client.GetUser("cli-alice"); !user.Suspended {
+		t.Errorf("disabled user isn't suspended")
+	}
+
+	runCLI(t, "user", "enable", "cli-alice")
+
+	if user, _ := db.Client.GetUser("cli-alice"); user.Suspended {
+		t.Errorf("enabled user is still suspended")
+	}
+
+	code, out, _ = runCLI(t, "user", "reset-password", "cli-alice")
+
+	user, _ = db.Client.GetUser("cli-alice")
+
+	if code != 0 || user.PasswordReset == nil || !strings.Contains(out, "token") {
+		t.Errorf("password reset wasn't forced: %d %q", code, out)
+	}
+
+	if code, _, errOut := runCLI(t, "user", "disable", "cli-nobody"); code != 1 || !strings.Contains(errOut, "doesn't exist") {
+		t.Errorf("expected disabling a missing user to fail, got %d %q", code, errOut)
+	}
+
+	if code, _, _ := runCLI(t, "user", "disable"); code != 2 {
+		t.Errorf("expected a missing username to be a usage error, got %d", code)
+	}
+}
+
+func TestCreateAdmin(t *testing.T) {
+	code, _, errOut := runCLI(t, "create-admin", "-username", "cli-admin", "-email", "cli-admin@example.com", "-password", "admin-password")
+
+	if code != 0 {
+		t.Fatalf("creating an admin failed with %d: %s", code, errOut)
+	}
+
+	user, err := db.Client.GetUser("cli-admin")
+
+	if err != nil || user.Role != models.RoleAdmin || !util.CheckPasswordHash("admin-password", *user.Password) {
+		t.Errorf("admin wasn't created as asked: %+v, %v", user, err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	code, out, _ := runCLI(t, "check-config", "-server.addr", ":9999")
+
+	if code != 0 || !strings.Contains(out, "server.addr = :9999") || !strings.Contains(out, "auth.jwtKey = (set)") {
+		t.Errorf("unexpected output of a valid configuration: %d %q", code, out)
+	}
+
+	if strings.Contains(out, testJWTKey) {
+		t.Errorf("the JWT key was printed")
+	}
+
+	code, _, errOut := runCLI(t, "check-config", "-storage.backend", "ftp", "-rateLimit.requests", "0")
+
+	if code != 1 || !strings.Contains(errOut, "storage.backend") || !strings.Contains(errOut, "rateLimit.requests") {
+		t.Errorf("expected every problem to be reported, got %d %q", code, errOut)
+	}
+
+	if code, _, _ := runCLI(t, "frobnicate"); code != 2 {
+		t.Errorf("expected an unknown command to be a usage error, got %d", code)
+	}
+}
+
+func TestCLISignsOutOfRunningServers(t *testing.T) {
+	// A server of its own, which only hears about revocations over the bus
+	messageBus := bus.NewMemoryBus()
+	hub, err := chat.NewHub(messageBus)
+
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+
+	go hub.Run()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		hub.Stop(ctx)
+	})
+
+	server := httptest.NewServer(routes.New(hub))
+	t.Cleanup(server.Close)
+
+	for _, command := range []string{"disable", "reset-password"} {
+		username := "cli-connected-" + command
+
+		conn := dialSocket(t, server, username)
+		waitForEvent(t, conn, chat.EventPresence, presenceIs(username, chat.StatusOnline))
+
+		// With the default memory bus there is nobody to tell, and it says so
+		code, out, errOut := runCLIOn(t, messageBus, "user", command, username)
+
+		if code != 0 || !strings.Contains(out, "stay up") {
+			t.Errorf("%s with a memory bus: %d %q %q", command, code, out, errOut)
+		}
+
+		runCLI(t, "user", "enable", username)
+
+		t.Setenv("BUS_BACKEND", "mongo")
+		t.Setenv("BUS_DOCUMENT", "bus")
+
+		code, out, errOut = runCLIOn(t, messageBus, "user", command, username)
+
+		if code != 0 || !strings.Contains(out, "out everywhere") {
+			t.Errorf("%s with a shared bus: %d %q %q", command, code, out, errOut)
+		}
+
+		expectRevoked(t, conn)
+
+		t.Setenv("BUS_BACKEND", "memory")
+	}
+}
@@ -0,0 +1,169 @@
+package test
+
+import (
+	"chat-module/bus"
+	"chat-module/chat"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMemoryBus(t *testing.T) {
+	messageBus := bus.NewMemoryBus()
+	received := make(chan string, 10)
+
+	unsubscribe, _ := messageBus.Subscribe("greetings", func(data []byte) { received <- string(data) })
+	messageBus.Subscribe("other", func(data []byte) { received <- "wrong topic" })
+
+	messageBus.Publish("greetings", []byte("one"))
+	messageBus.Publish("greetings", []byte("two"))
+
+	for _, expected := range []string{"one", "two"} {
+		select {
+		case data := <-received:
+			if data != expected {
+				t.Errorf("expected %q, got %q", expected, data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %q never arrived", expected)
+		}
+	}
+
+	unsubscribe()
+	messageBus.Publish("greetings", []byte("three"))
+
+	select {
+	case data := <-received:
+		t.Errorf("got %q after unsubscribing", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	messageBus.Close()
+
+	if err := messageBus.Publish("greetings", nil); err != bus.ErrClosed {
+		t.Errorf("publishing on a closed bus: got %v", err)
+	}
+}
+
+// Waits for the condition to hold, failing the test if it doesn't in time
+func eventually(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/*
+ *	Fails the test if an event of the type arrives within the given time, or
+ *	has arrived since the last read. Nothing can be read from the socket
+ *	afterwards.
+ */
+func expectNoEvent(t *testing.T, conn *websocket.Conn, eventType string, within time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(within))
+
+	for {
+		var event struct {
+			Type string `json:"type"`
+		}
+
+		if err := conn.ReadJSON(&event); err != nil {
+			return
+		}
+
+		if event.Type == eventType {
+			t.Errorf("unexpected %s event", eventType)
+		}
+	}
+}
+
+func TestHubsSharingABus(t *testing.T) {
+	messageBus := bus.NewMemoryBus()
+	hubA, serverA := newTestHubServerOn(t, messageBus)
+	hubB, serverB := newTestHubServerOn(t, messageBus)
+	_, serverC := newTestHubServerOn(t, messageBus)
+
+	room := newTestRoom(t, "cluster-alice", "cluster-bob", "cluster-carol")
+	conversation := room.ID.Hex()
+
+	bob := dialSocket(t, serverB, "cluster-bob")
+	carol := dialSocket(t, serverC, "cluster-carol")
+
+	// Presence of users on another instance
+	alice := dialSocket(t, serverA, "cluster-alice")
+	waitForEvent(t, bob, chat.EventPresence, presenceIs("cluster-alice", chat.StatusOnline))
+
+	if !hubB.Presence.IsOnline("cluster-alice") {
+		t.Errorf("instance B doesn't know that alice is online")
+	}
+
+	// Messages sent on one instance reach the users of all of them, once
+	alice.WriteJSON(map[string]any{
+		"type":    "message",
+		"payload": map[string]any{"conversation": conversation, "body": "hello everyone"},
+	})
+
+	var message struct {
+		ID   string `json:"id"`
+		Body string `json:"body"`
+	}
+
+	json.Unmarshal(waitForEvent(t, bob, chat.EventMessage, messageFrom("cluster-alice")), &message)
+	json.Unmarshal(waitForEvent(t, carol, chat.EventMessage, messageFrom("cluster-alice")), &message)
+	json.Unmarshal(waitForEvent(t, alice, chat.EventMessage, messageFrom("cluster-alice")), &message)
+
+	if message.Body != "hello everyone" {
+		t.Errorf("message changed on the way: %q", message.Body)
+	}
+
+	// Ephemeral events too
+	bob.WriteJSON(map[string]any{
+		"type":    "typing",
+		"payload": map[string]any{"conversation": conversation, "typing": true},
+	})
+	waitForEvent(t, alice, chat.EventTyping, typingIs("cluster-bob", true))
+	waitForEvent(t, carol, chat.EventTyping, typingIs("cluster-bob", true))
+
+	// Alice on two instances stays online until she leaves both
+	aliceOnB := dialSocket(t, serverB, "cluster-alice")
+	eventually(t, "B sees alice connected to it", func() bool { return hubA.Presence.IsOnline("cluster-alice") })
+
+	alice.Close()
+	aliceOnB.WriteJSON(map[string]any{"type": "presence", "payload": map[string]string{"status": "online"}})
+
+	time.Sleep(100 * time.Millisecond)
+
+	if !hubA.Presence.IsOnline("cluster-alice") || !hubB.Presence.IsOnline("cluster-alice") {
+		t.Errorf("alice went offline while still connected to B")
+	}
+
+	aliceOnB.Close()
+	waitForEvent(t, carol, chat.EventPresence, presenceIs("cluster-alice", chat.StatusOffline))
+	eventually(t, "every instance sees alice offline", func() bool {
+		return !hubA.Presence.IsOnline("cluster-alice") && !hubB.Presence.IsOnline("cluster-alice")
+	})
+
+	// The message only ever arrived once
+	expectNoEvent(t, carol, chat.EventMessage, 100*time.Millisecond)
+}
+
+func TestNewInstanceLearnsPresence(t *testing.T) {
+	messageBus := bus.NewMemoryBus()
+	_, serverA := newTestHubServerOn(t, messageBus)
+	newTestRoom(t, "newcomer-alice", "newcomer-bob")
+
+	alice := dialSocket(t, serverA, "newcomer-alice")
+	defer alice.Close()
+	waitForEvent(t, alice, chat.EventPresence, presenceIs("newcomer-alice", chat.StatusOnline))
+
+	// Started after alice connected, so it only hears of her from A catching it up
+	hubB := newTestHubOn(t, messageBus)
+
+	eventually(t, "the new instance sees alice online", func() bool { return hubB.Presence.IsOnline("newcomer-alice") })
+}
@@ -0,0 +1,137 @@
+package test
+
+import (
+	"chat-module/config"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes the contents to a file in a temporary directory and returns its path
+func writeTempFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+
+	return path
+}
+
+func loadConfig(args ...string) (config.Config, error) {
+	return config.Load(flag.NewFlagSet("test", flag.ContinueOnError), args)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeTempFile(t, "config.yaml", `
+server:
+  addr: ":9000"
+  readTimeout: 1s
+database:
+  url: mongodb://from-file
+  name: from-file
+chat:
+  sockets:
+    slowClientPolicy: drop-oldest
+`)
+
+	envFile := writeTempFile(t, ".env", "DB_NAME=from-env-file\nSERVER_READ_TIMEOUT=2s\njwtKey="+testJWTKey+"\n")
+
+	t.Setenv("SERVER_READ_TIMEOUT", "3s")
+	t.Setenv("DB_NAME", "from-env")
+
+	cfg, err := loadConfig("-config", file, "-env-file", envFile, "-database.name", "from-flag")
+
+	if err != nil {
+		t.Fatalf("loading a valid configuration failed: %v", err)
+	}
+
+	// Each source overrides the ones before it
+	if cfg.Server.Addr != ":9000" || cfg.Database.URL != "mongodb://from-file" {
+		t.Errorf("settings only in the file weren't loaded: %+v", cfg.Server)
+	}
+
+	if cfg.Auth.JWTKey != testJWTKey {
+		t.Errorf("settings only in the env file weren't loaded")
+	}
+
+	if cfg.Server.ReadTimeout != 3*time.Second {
+		t.Errorf("expected the environment to win over the files, got %v", cfg.Server.ReadTimeout)
+	}
+
+	if cfg.Database.Name != "from-flag" {
+		t.Errorf("expected the flag to win over everything, got %q", cfg.Database.Name)
+	}
+
+	if cfg.Chat.Sockets.SlowClientPolicy != "drop-oldest" {
+		t.Errorf("nested settings of the file weren't loaded")
+	}
+
+	// Whatever nobody set keeps its default
+	if cfg.Server.WriteTimeout != config.Default().Server.WriteTimeout || cfg.Database.Collections.Users != "users" {
+		t.Errorf("defaults were lost: %+v", cfg)
+	}
+}
+
+func TestConfigReportsEveryProblem(t *testing.T) {
+	t.Setenv("SOCKET_QUEUE_SIZE", "lots")
+
+	_, err := loadConfig("-storage.backend", "s3", "-rateLimit.window", "0s")
+
+	var configErr *config.Error
+
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a configuration error, got %v", err)
+	}
+
+	expected := []string{
+		"database.url (MONGODB_URL) is required",
+		"database.name (DB_NAME) is required",
+		"auth.jwtKey (jwtKey) is required",
+		"storage.s3.endpoint (S3_ENDPOINT) is required",
+		"storage.s3.bucket (S3_BUCKET) is required",
+		"chat.sockets.queueSize (SOCKET_QUEUE_SIZE) from the environment is not a whole number",
+		"rateLimit.window (RATE_LIMIT_WINDOW) must be positive",
+	}
+
+	for _, problem := range expected {
+		found := false
+
+		for _, reported := range configErr.Problems {
+			if strings.HasPrefix(reported, problem) {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("problem %q wasn't reported, got:\n%v", problem, err)
+		}
+	}
+}
+
+func TestConfigFileProblems(t *testing.T) {
+	t.Setenv("MONGODB_URL", "mongodb://localhost")
+	t.Setenv("DB_NAME", "chat")
+	t.Setenv("jwtKey", "too short")
+
+	file := writeTempFile(t, "config.yaml", "server:\n  adress: \":9000\"\n")
+
+	_, err := loadConfig("-config", file)
+
+	if err == nil || !strings.Contains(err.Error(), "adress") {
+		t.Errorf("expected the misspelled setting to be reported, got %v", err)
+	}
+
+	if err == nil || !strings.Contains(err.Error(), "auth.jwtKey (jwtKey) must be at least 32 bytes long") {
+		t.Errorf("expected the short key to be reported along with the file, got %v", err)
+	}
+
+	// Asking for a file that isn't there is a mistake, unlike the default .env missing
+	if _, err := loadConfig("-env-file", filepath.Join(t.TempDir(), "missing.env")); err == nil {
+		t.Errorf("expected a missing env file to be reported")
+	}
+}
@@ -0,0 +1,232 @@
+package test
+
+import (
+	"chat-module/chat"
+	"chat-module/models"
+	"chat-module/routes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func penaltyIs(penalty chat.Penalty) func(json.RawMessage) bool {
+	return func(payload json.RawMessage) bool {
+		var announcement chat.PenaltyPayload
+		json.Unmarshal(payload, &announcement)
+		return announcement.Penalty == penalty
+	}
+}
+
+func sendFrame(conn *websocket.Conn, id, conversation, body string) {
+	conn.WriteJSON(map[string]any{
+		"type":    chat.FrameMessage,
+		"id":      id,
+		"payload": map[string]any{"conversation": conversation, "body": body},
+	})
+}
+
+func floodStates(t *testing.T, hub *chat.Hub) map[string]chat.FloodState {
+	rr := httptest.NewRecorder()
+	hub.FloodHandler(rr, httptest.NewRequest("GET", "/api/admin/flood", nil))
+
+	var states []chat.FloodState
+	json.Unmarshal(rr.Body.Bytes(), &states)
+
+	byUser := make(map[string]chat.FloodState)
+	for _, state := range states {
+		byUser[state.Username] = state
+	}
+
+	return byUser
+}
+
+func TestFloodPenalties(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	room := newTestRoom(t, "flood-alice", "flood-bob")
+	conversation := room.ID.Hex()
+
+	limits := chat.DefaultFloodLimits
+	limits.UserRate = 0.001
+	limits.UserBurst = 3
+	limits.MaxDuplicates = 2
+	limits.MuteAfter = 2
+	limits.DisconnectAfter = 3
+	limits.MuteDuration = 300 * time.Millisecond
+	hub.Flood.SetLimits(limits)
+
+	alice := dialSocket(t, server, "flood-alice")
+
+	for i := 1; i <= 3; i++ {
+		sendFrame(alice, fmt.Sprint(i), conversation, fmt.Sprint("message ", i))
+		waitForEvent(t, alice, chat.EventAck, ackFor(fmt.Sprint(i)))
+	}
+
+	// The first time is a warning, the next a mute
+	sendFrame(alice, "4", conversation, "one too many")
+	waitForEvent(t, alice, chat.EventError, errorFor("4", http.StatusTooManyRequests))
+	waitForEvent(t, alice, chat.EventPenalty, penaltyIs(chat.PenaltyWarning))
+
+	sendFrame(alice, "5", conversation, "and another")
+	waitForEvent(t, alice, chat.EventError, errorFor("5", http.StatusTooManyRequests))
+	waitForEvent(t, alice, chat.EventPenalty, penaltyIs(chat.PenaltyMute))
+
+	sendFrame(alice, "6", conversation, "while muted")
+	waitForEvent(t, alice, chat.EventError, errorFor("6", http.StatusTooManyRequests))
+
+	// Moderators can see where everyone stands
+	state := floodStates(t, hub)["flood-alice"]
+
+	if state.Strikes != 2 || state.MutedUntil == nil || state.LastViolation == nil {
+		t.Errorf("unexpected flood state of a muted user: %+v", state)
+	}
+
+	// Carrying on once the mute is over gets the socket closed
+	time.Sleep(limits.MuteDuration)
+	sendFrame(alice, "7", conversation, "still at it")
+
+	alice.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	for {
+		_, _, err := alice.ReadMessage()
+
+		var closeErr *websocket.CloseError
+
+		if errors.As(err, &closeErr) {
+			if closeErr.Code != websocket.ClosePolicyViolation {
+				t.Errorf("expected close code %d, got %d", websocket.ClosePolicyViolation, closeErr.Code)
+			}
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("socket failed without a close frame: %v", err)
+		}
+	}
+
+	// A pardon lifts the mute that came with it
+	newTestUser(t, "flood-moderator", models.RoleModerator)
+
+	if rr := doRequest(routes.New(hub), "DELETE", "/api/admin/flood/flood-alice", newTestToken(t, "flood-moderator"), nil); rr.Code != http.StatusNoContent {
+		t.Errorf("pardoning a flooder: got %v", rr.Code)
+	}
+
+	if _, ok := floodStates(t, hub)["flood-alice"]; ok {
+		t.Errorf("pardoned user still has a flood state")
+	}
+
+	alice = dialSocket(t, server, "flood-alice")
+	sendFrame(alice, "8", conversation, "sorry")
+	waitForEvent(t, alice, chat.EventAck, ackFor("8"))
+}
+
+func TestDuplicateSpam(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	room := newTestRoom(t, "spam-alice", "spam-bob")
+	conversation := room.ID.Hex()
+
+	limits := chat.DefaultFloodLimits
+	limits.MaxDuplicates = 2
+	hub.Flood.SetLimits(limits)
+
+	alice := dialSocket(t, server, "spam-alice")
+
+	sendFrame(alice, "1", conversation, "buy now")
+	waitForEvent(t, alice, chat.EventAck, ackFor("1"))
+
+	sendFrame(alice, "2", conversation, "BUY NOW ")
+	waitForEvent(t, alice, chat.EventAck, ackFor("2"))
+
+	sendFrame(alice, "3", conversation, "buy now")
+	waitForEvent(t, alice, chat.EventError, errorFor("3", http.StatusTooManyRequests))
+
+	// Something else is fine
+	sendFrame(alice, "4", conversation, "sorry about that")
+	waitForEvent(t, alice, chat.EventAck, ackFor("4"))
+}
+
+func TestOutsidersCantDrainTheRoom(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	room := newTestRoom(t, "drained-alice", "drained-bob")
+	newTestUser(t, "drained-outsider", models.RoleUser)
+	conversation := room.ID.Hex()
+
+	limits := chat.DefaultFloodLimits
+	limits.UserRate = 0.001
+	limits.UserBurst = 3
+	limits.RoomRate = 0.001
+	limits.RoomBurst = 2
+	hub.Flood.SetLimits(limits)
+
+	outsider := dialSocket(t, server, "drained-outsider")
+
+	for i := 1; i <= 3; i++ {
+		sendFrame(outsider, fmt.Sprint(i), conversation, fmt.Sprint("let me in ", i))
+		waitForEvent(t, outsider, chat.EventError, errorFor(fmt.Sprint(i), http.StatusNotFound))
+	}
+
+	// Flooding a conversation they aren't in still counts against them
+	sendFrame(outsider, "4", conversation, "let me in!")
+	waitForEvent(t, outsider, chat.EventError, errorFor("4", http.StatusTooManyRequests))
+	waitForEvent(t, outsider, chat.EventPenalty, penaltyIs(chat.PenaltyWarning))
+
+	// The room still has every token for its members
+	alice := dialSocket(t, server, "drained-alice")
+
+	for i := 1; i <= 2; i++ {
+		sendFrame(alice, fmt.Sprint(i), conversation, fmt.Sprint("hello ", i))
+		waitForEvent(t, alice, chat.EventAck, ackFor(fmt.Sprint(i)))
+	}
+
+	sendFrame(alice, "3", conversation, "hello 3")
+	waitForEvent(t, alice, chat.EventError, errorFor("3", http.StatusTooManyRequests))
+}
+
+func TestFloodLimitsApplyToTheAPI(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+	room := newTestRoom(t, "api-flood-alice", "api-flood-bob")
+	messages := "/api/rooms/" + room.ID.Hex() + "/messages"
+
+	limits := chat.DefaultFloodLimits
+	limits.UserRate = 0.001
+	limits.UserBurst = 2
+	limits.MuteAfter = 1
+	limits.MuteDuration = time.Minute
+	hub.Flood.SetLimits(limits)
+
+	alice := dialSocket(t, server, "api-flood-alice")
+	token := newTestToken(t, "api-flood-alice")
+
+	message := postMessage(t, mux, "api-flood-alice", room, "first")
+
+	// Retrying a message that went through costs nothing
+	draft := map[string]string{"body": "second", "clientId": "draft-1"}
+	for i := 0; i < 3; i++ {
+		if rr := doRequest(mux, "POST", messages, token, draft); rr.Code != http.StatusCreated && rr.Code != http.StatusOK {
+			t.Fatalf("sending a message failed: got %v", rr.Code)
+		}
+	}
+
+	if rr := doRequest(mux, "POST", messages, token, map[string]string{"body": "third"}); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("sending too fast over the API: got %v", rr.Code)
+	}
+
+	waitForEvent(t, alice, chat.EventPenalty, penaltyIs(chat.PenaltyMute))
+
+	// Muted users can't get around it by editing or reacting either
+	path := messages + "/" + message.ID.Hex()
+
+	if rr := doRequest(mux, "PATCH", path, token, map[string]string{"body": "edited"}); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("muted user could edit: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "PUT", path+"/reactions/👍", token, nil); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("muted user could react: got %v", rr.Code)
+	}
+}
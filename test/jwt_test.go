@@ -0,0 +1,136 @@
+package test
+
+import (
+	"chat-module/auth"
+	"chat-module/models"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Signs the claims with the same key the auth package was given, so we can
+// craft tokens that are genuine but have bad claims.
+func signTestToken(t *testing.T, method jwt.SigningMethod, claims jwt.Claims) string {
+	token, err := jwt.NewWithClaims(method, claims).SignedString([]byte(testJWTKey))
+
+	if err != nil {
+		t.Fatalf("failed to sign test token: %v", err)
+	}
+
+	return token
+}
+
+// Claims for a genuine session of test-user, valid from the given time
+func testClaims(t *testing.T, now time.Time) *auth.Claims {
+	_, session, err := auth.CreateSession(newTestUser(t, "test-user", models.RoleUser), httptest.NewRequest("GET", "/login", nil))
+
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+
+	return &auth.Claims{
+		Username: "test-user",
+		Role:     models.RoleUser,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        session.ID.Hex(),
+			Issuer:    auth.TokenIssuer,
+			Subject:   "test-user",
+			Audience:  jwt.ClaimStrings{auth.TokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+	}
+}
+
+func TestValidateJWTAcceptsGeneratedToken(t *testing.T) {
+	token := newTestToken(t, "test-user")
+
+	claims, err := auth.ValidateJWT(token)
+
+	if err != nil {
+		t.Fatalf("generated token was rejected: %v", err)
+	}
+
+	if claims.Username != "test-user" {
+		t.Errorf("wrong username in claims: got %s want test-user", claims.Username)
+	}
+}
+
+func TestValidateJWTExpired(t *testing.T) {
+	claims := testClaims(t, time.Now().Add(-2*time.Hour))
+	token := signTestToken(t, jwt.SigningMethodHS256, claims)
+
+	_, err := auth.ValidateJWT(token)
+
+	if !errors.Is(err, auth.ErrTokenExpired) {
+		t.Errorf("expected an expired token error, got %v", err)
+	}
+}
+
+func TestValidateJWTLeeway(t *testing.T) {
+	// Expired a moment ago, but still within the allowed clock skew
+	claims := testClaims(t, time.Now().Add(-time.Hour))
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-auth.TokenLeeway / 2))
+	token := signTestToken(t, jwt.SigningMethodHS256, claims)
+
+	if _, err := auth.ValidateJWT(token); err != nil {
+		t.Errorf("token within leeway was rejected: %v", err)
+	}
+}
+
+func TestValidateJWTRejectsBadClaims(t *testing.T) {
+	now := time.Now()
+
+	cases := map[string]func(c *auth.Claims){
+		"wrong issuer":     func(c *auth.Claims) { c.Issuer = "someone-else" },
+		"missing issuer":   func(c *auth.Claims) { c.Issuer = "" },
+		"wrong audience":   func(c *auth.Claims) { c.Audience = jwt.ClaimStrings{"another-app"} },
+		"no audience":      func(c *auth.Claims) { c.Audience = nil },
+		"not before":       func(c *auth.Claims) { c.NotBefore = jwt.NewNumericDate(now.Add(time.Hour)) },
+		"no expiry":        func(c *auth.Claims) { c.ExpiresAt = nil },
+		"subject mismatch": func(c *auth.Claims) { c.Subject = "admin" },
+		"unknown session":  func(c *auth.Claims) { c.ID = primitive.NewObjectID().Hex() },
+		"no session":       func(c *auth.Claims) { c.ID = "" },
+		"unknown role":     func(c *auth.Claims) { c.Role = "superuser" },
+	}
+
+	for name, mutate := range cases {
+		claims := testClaims(t, now)
+		mutate(claims)
+		token := signTestToken(t, jwt.SigningMethodHS256, claims)
+
+		_, err := auth.ValidateJWT(token)
+
+		if !errors.Is(err, auth.ErrTokenInvalid) {
+			t.Errorf("%s: expected an invalid token error, got %v", name, err)
+		}
+	}
+}
+
+func TestValidateJWTRejectsOtherAlgorithms(t *testing.T) {
+	claims := testClaims(t, time.Now())
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	if err != nil {
+		t.Fatalf("failed to create unsigned token: %v", err)
+	}
+
+	tokens := map[string]string{
+		"none":  unsigned,
+		"HS512": signTestToken(t, jwt.SigningMethodHS512, claims),
+	}
+
+	for name, token := range tokens {
+		_, err := auth.ValidateJWT(token)
+
+		if !errors.Is(err, auth.ErrTokenInvalid) {
+			t.Errorf("%s: expected an invalid token error, got %v", name, err)
+		}
+	}
+}
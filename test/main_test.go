@@ -0,0 +1,88 @@
+package test
+
+import (
+	"chat-module/auth"
+	"chat-module/config"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/storage"
+	"chat-module/util"
+	"log"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Key the tokens of the tests are signed with
+const testJWTKey = "test-key-that-is-long-enough-to-be-valid"
+
+// All tests run against the in-memory repository, so no database is needed.
+// Uploaded files go to a temporary directory.
+func TestMain(m *testing.M) {
+	db.Client = db.NewMemoryRepo()
+	auth.Init(config.Auth{JWTKey: testJWTKey})
+
+	dir, err := os.MkdirTemp("", "chat-test-uploads-")
+
+	if err != nil {
+		log.Fatalf("Failed to create upload directory: %v", err)
+	}
+
+	if storage.Files, err = storage.NewLocalStore(dir); err != nil {
+		log.Fatalf("Failed to set up file storage: %v", err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+
+	os.Exit(code)
+}
+
+// Password of every user created by newTestUser
+const testPassword = "test-password"
+
+// Returns the test user with the given name, creating it with the role if needed
+func newTestUser(t *testing.T, username string, role models.Role) *models.User {
+	user, err := db.Client.GetUser(username)
+
+	if err == nil {
+		return user
+	}
+
+	email := username + "@example.com"
+	password, err := util.HashPassword(testPassword)
+
+	if err != nil {
+		t.Fatalf("failed to hash test password: %v", err)
+	}
+
+	user = &models.User{
+		ID:       primitive.NewObjectID(),
+		Username: &username,
+		Email:    &email,
+		Password: &password,
+		Role:     role,
+	}
+
+	if err := db.Client.AddUser(*user); err != nil {
+		t.Fatalf("failed to add test user: %v", err)
+	}
+
+	return user
+}
+
+// Starts a session for the given user and returns its token
+func newTestToken(t *testing.T, username string) string {
+	request := httptest.NewRequest("GET", "/login", nil)
+	request.Header.Set("User-Agent", "test-agent")
+
+	token, _, err := auth.CreateSession(newTestUser(t, username, models.RoleUser), request)
+
+	if err != nil {
+		t.Fatalf("failed to generate jwt token: %v", err)
+	}
+
+	return token
+}
@@ -0,0 +1,433 @@
+package test
+
+import (
+	"chat-module/chat"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/routes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns the unread count of the room in the conversation list of the user
+func unreadCount(t *testing.T, mux http.Handler, username string, room models.Room) int64 {
+	rr := doRequest(mux, "GET", "/api/rooms", newTestToken(t, username), nil)
+
+	var rooms []struct {
+		models.Room
+		UnreadCount int64 `json:"unreadCount"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &rooms)
+
+	for _, entry := range rooms {
+		if entry.ID == room.ID {
+			return entry.UnreadCount
+		}
+	}
+
+	t.Fatalf("room %s missing from the rooms of %s", room.ID.Hex(), username)
+	return 0
+}
+
+func messageFrom(sender string) func(json.RawMessage) bool {
+	return func(payload json.RawMessage) bool {
+		var message models.Message
+		json.Unmarshal(payload, &message)
+		return message.Sender == sender
+	}
+}
+
+func TestMessagesAndReadReceipts(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+	room := newTestRoom(t, "read-alice", "read-bob")
+	conversation := room.ID.Hex()
+
+	alice := dialSocket(t, server, "read-alice")
+	bob := dialSocket(t, server, "read-bob")
+
+	for i := 0; i < 3; i++ {
+		alice.WriteJSON(map[string]any{
+			"type":    "message",
+			"payload": map[string]any{"conversation": conversation, "body": "hello"},
+		})
+	}
+
+	var last models.Message
+	for i := 0; i < 3; i++ {
+		json.Unmarshal(waitForEvent(t, bob, chat.EventMessage, messageFrom("read-alice")), &last)
+	}
+
+	if count := unreadCount(t, mux, "read-bob", room); count != 3 {
+		t.Errorf("expected 3 unread messages for the receiver, got %d", count)
+	}
+
+	if count := unreadCount(t, mux, "read-alice", room); count != 0 {
+		t.Errorf("sender has unread messages of their own: %d", count)
+	}
+
+	// History comes newest first
+	rr := doRequest(mux, "GET", "/api/rooms/"+conversation+"/messages?limit=2", newTestToken(t, "read-bob"), nil)
+
+	var history []models.Message
+	json.Unmarshal(rr.Body.Bytes(), &history)
+
+	if rr.Code != http.StatusOK || len(history) != 2 || history[0].ID != last.ID {
+		t.Errorf("unexpected message history: %v %+v", rr.Code, history)
+	}
+
+	bob.WriteJSON(map[string]any{
+		"type":    "read",
+		"payload": map[string]any{"conversation": conversation, "messageId": last.ID.Hex()},
+	})
+
+	waitForEvent(t, alice, chat.EventRead, func(payload json.RawMessage) bool {
+		var receipt chat.ReadPayload
+		json.Unmarshal(payload, &receipt)
+		return receipt.Username == "read-bob" && receipt.MessageID == last.ID
+	})
+
+	if count := unreadCount(t, mux, "read-bob", room); count != 0 {
+		t.Errorf("expected no unread messages after reading, got %d", count)
+	}
+
+	// Moving the read position backwards is ignored
+	rr = doRequest(mux, "POST", "/api/rooms/"+conversation+"/read", newTestToken(t, "read-bob"), map[string]string{"messageId": history[1].ID.Hex()})
+
+	if rr.Code != http.StatusNoContent || unreadCount(t, mux, "read-bob", room) != 0 {
+		t.Errorf("read position moved backwards: got %v", rr.Code)
+	}
+}
+
+func TestMessagesRejectOutsiders(t *testing.T) {
+	hub, _ := newTestHubServer(t)
+	mux := routes.New(hub)
+	room := newTestRoom(t, "outsider-owner")
+	newTestUser(t, "outsider", models.RoleUser)
+	token := newTestToken(t, "outsider")
+
+	rr := doRequest(mux, "POST", "/api/rooms/"+room.ID.Hex()+"/messages", token, map[string]string{"body": "let me in"})
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("outsider could post to the room: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "GET", "/api/rooms/"+room.ID.Hex()+"/messages", token, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("outsider could read the room: got %v", rr.Code)
+	}
+
+	rr = doRequest(mux, "POST", "/api/rooms/"+room.ID.Hex()+"/messages", newTestToken(t, "outsider-owner"), map[string]string{"body": "   "})
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("empty message was accepted: got %v", rr.Code)
+	}
+}
+
+func postMessage(t *testing.T, mux http.Handler, username string, room models.Room, body string) models.Message {
+	rr := doRequest(mux, "POST", "/api/rooms/"+room.ID.Hex()+"/messages", newTestToken(t, username), map[string]string{"body": body})
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("posting message failed: got %v", rr.Code)
+	}
+
+	var message models.Message
+	json.Unmarshal(rr.Body.Bytes(), &message)
+
+	return message
+}
+
+func TestEditAndDeleteMessages(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+	room := newTestRoom(t, "edit-owner", "edit-alice", "edit-bob")
+	path := "/api/rooms/" + room.ID.Hex() + "/messages/"
+
+	bob := dialSocket(t, server, "edit-bob")
+
+	message := postMessage(t, mux, "edit-alice", room, "first version")
+
+	rr := doRequest(mux, "PATCH", path+message.ID.Hex(), newTestToken(t, "edit-alice"), map[string]string{"body": "second version"})
+
+	var edited models.Message
+	json.Unmarshal(rr.Body.Bytes(), &edited)
+
+	if rr.Code != http.StatusOK || edited.Body != "second version" || edited.EditedAt == nil {
+		t.Fatalf("editing own message failed: %v %+v", rr.Code, edited)
+	}
+
+	if len(edited.Edits) != 1 || edited.Edits[0].Body != "first version" || !edited.Edits[0].WrittenAt.Equal(message.CreatedAt) {
+		t.Errorf("previous version wasn't kept: %+v", edited.Edits)
+	}
+
+	waitForEvent(t, bob, chat.EventEdit, func(payload json.RawMessage) bool {
+		var update models.Message
+		json.Unmarshal(payload, &update)
+		return update.ID == message.ID && update.Body == "second version"
+	})
+
+	// Only the sender edits, and members can't delete what others wrote
+	if rr := doRequest(mux, "PATCH", path+message.ID.Hex(), newTestToken(t, "edit-bob"), map[string]string{"body": "hijacked"}); rr.Code != http.StatusForbidden {
+		t.Errorf("member edited someone else's message: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "DELETE", path+message.ID.Hex(), newTestToken(t, "edit-bob"), nil); rr.Code != http.StatusForbidden {
+		t.Errorf("member deleted someone else's message: got %v", rr.Code)
+	}
+
+	// Past the window the sender is locked out, but moderators aren't
+	defer func(window time.Duration) { chat.EditWindow = window }(chat.EditWindow)
+	chat.EditWindow = 0
+
+	if rr := doRequest(mux, "PATCH", path+message.ID.Hex(), newTestToken(t, "edit-alice"), map[string]string{"body": "too late"}); rr.Code != http.StatusForbidden {
+		t.Errorf("message was edited after the window: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "DELETE", path+message.ID.Hex(), newTestToken(t, "edit-alice"), nil); rr.Code != http.StatusForbidden {
+		t.Errorf("message was deleted by its sender after the window: got %v", rr.Code)
+	}
+
+	rr = doRequest(mux, "DELETE", path+message.ID.Hex(), newTestToken(t, "edit-owner"), nil)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("room owner failed to delete message: got %v", rr.Code)
+	}
+
+	waitForEvent(t, bob, chat.EventDelete, func(payload json.RawMessage) bool {
+		var tombstone models.Message
+		json.Unmarshal(payload, &tombstone)
+		return tombstone.ID == message.ID && tombstone.Deleted
+	})
+
+	// The tombstone stays in the history, without any of the content
+	rr = doRequest(mux, "GET", "/api/rooms/"+room.ID.Hex()+"/messages", newTestToken(t, "edit-bob"), nil)
+
+	var history []models.Message
+	json.Unmarshal(rr.Body.Bytes(), &history)
+
+	if len(history) != 1 || !history[0].Deleted || history[0].Body != "" || len(history[0].Edits) != 0 || history[0].DeletedBy != "edit-owner" {
+		t.Errorf("expected a tombstone in the history: %+v", history)
+	}
+
+	if rr := doRequest(mux, "DELETE", path+message.ID.Hex(), newTestToken(t, "edit-owner"), nil); rr.Code != http.StatusNotFound {
+		t.Errorf("deleted message was deleted again: got %v", rr.Code)
+	}
+}
+
+func TestEditToOperatorLikeText(t *testing.T) {
+	hub, _ := newTestHubServer(t)
+	mux := routes.New(hub)
+	room := newTestRoom(t, "literal-alice")
+	path := "/api/rooms/" + room.ID.Hex() + "/messages/"
+
+	message := postMessage(t, mux, "literal-alice", room, "plain text")
+
+	for _, body := range []string{"$sender", "$createdAt", "$$ROOT"} {
+		rr := doRequest(mux, "PATCH", path+message.ID.Hex(), newTestToken(t, "literal-alice"), map[string]string{"body": body})
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("editing the message to %q failed: got %v", body, rr.Code)
+		}
+
+		stored, err := db.Client.GetMessage(message.ID)
+
+		if err != nil || stored.Body != body {
+			t.Errorf("expected the body to read back as %q, got %+v %v", body, stored, err)
+		}
+	}
+}
+
+func TestThreads(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+	room := newTestRoom(t, "thread-alice", "thread-bob")
+	path := "/api/rooms/" + room.ID.Hex() + "/messages"
+	token := newTestToken(t, "thread-bob")
+
+	bob := dialSocket(t, server, "thread-bob")
+
+	root := postMessage(t, mux, "thread-alice", room, "what's for lunch?")
+
+	reply := func(parent models.Message, body string) models.Message {
+		rr := doRequest(mux, "POST", path, newTestToken(t, "thread-alice"), map[string]string{"parent": parent.ID.Hex(), "body": body})
+
+		var message models.Message
+		json.Unmarshal(rr.Body.Bytes(), &message)
+
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("replying failed: got %v", rr.Code)
+		}
+
+		return message
+	}
+
+	first := reply(root, "pizza")
+
+	// Replying to a reply stays in the same thread
+	second := reply(first, "again?")
+
+	if first.Parent != root.ID || second.Parent != root.ID {
+		t.Errorf("replies ended up in the wrong thread: %s %s", first.Parent.Hex(), second.Parent.Hex())
+	}
+
+	waitForEvent(t, bob, chat.EventThread, func(payload json.RawMessage) bool {
+		var thread chat.ThreadPayload
+		json.Unmarshal(payload, &thread)
+		return thread.Parent == root.ID && thread.ReplyCount == 2
+	})
+
+	// The room history only has the root, which keeps count of its replies
+	rr := doRequest(mux, "GET", path, token, nil)
+
+	var history []models.Message
+	json.Unmarshal(rr.Body.Bytes(), &history)
+
+	if len(history) != 1 || history[0].ID != root.ID || history[0].ReplyCount != 2 || history[0].LastReplyAt == nil {
+		t.Errorf("unexpected room history: %+v", history)
+	}
+
+	var thread struct {
+		Parent  models.Message   `json:"parent"`
+		Replies []models.Message `json:"replies"`
+	}
+
+	rr = doRequest(mux, "GET", path+"/"+root.ID.Hex()+"/thread?limit=1", token, nil)
+	json.Unmarshal(rr.Body.Bytes(), &thread)
+
+	if rr.Code != http.StatusOK || len(thread.Replies) != 1 || thread.Replies[0].ID != first.ID {
+		t.Fatalf("unexpected first page of the thread: %v %+v", rr.Code, thread.Replies)
+	}
+
+	rr = doRequest(mux, "GET", path+"/"+root.ID.Hex()+"/thread?after="+first.ID.Hex(), token, nil)
+	json.Unmarshal(rr.Body.Bytes(), &thread)
+
+	if len(thread.Replies) != 1 || thread.Replies[0].ID != second.ID {
+		t.Errorf("unexpected second page of the thread: %+v", thread.Replies)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+
+	// Filling a message up with reactions takes more than the flood limits allow
+	limits := chat.DefaultFloodLimits
+	limits.UserBurst = chat.MaxReactionsPerMessage * 2
+	hub.Flood.SetLimits(limits)
+
+	usernames := []string{"react-alice", "react-bob"}
+	for i := 0; i < 8; i++ {
+		usernames = append(usernames, fmt.Sprintf("react-user-%d", i))
+	}
+
+	room := newTestRoom(t, usernames...)
+	message := postMessage(t, mux, "react-alice", room, "ship it?")
+	path := "/api/rooms/" + room.ID.Hex() + "/messages/" + message.ID.Hex() + "/reactions/"
+
+	alice := dialSocket(t, server, "react-alice")
+
+	// Everybody reacting at once must all end up on the same reaction
+	var wg sync.WaitGroup
+	for _, username := range usernames {
+		wg.Add(1)
+		go func(username string) {
+			defer wg.Done()
+			if _, err := hub.React(username, room.ID.Hex(), message.ID.Hex(), "👍", true); err != nil {
+				t.Errorf("reaction of %s failed: %v", username, err)
+			}
+		}(username)
+	}
+	wg.Wait()
+
+	waitForEvent(t, alice, chat.EventReaction, func(payload json.RawMessage) bool {
+		var reaction chat.ReactionPayload
+		json.Unmarshal(payload, &reaction)
+		return len(reaction.Reactions) == 1 && len(reaction.Reactions[0].Users) == len(usernames)
+	})
+
+	// Taking a reaction back drops it once nobody is left on it
+	token := newTestToken(t, "react-bob")
+	doRequest(mux, "PUT", path+url.PathEscape("🎉"), token, nil)
+	rr := doRequest(mux, "DELETE", path+url.PathEscape("🎉"), token, nil)
+
+	var updated models.Message
+	json.Unmarshal(rr.Body.Bytes(), &updated)
+
+	if rr.Code != http.StatusOK || len(updated.Reactions) != 1 || updated.Reactions[0].Emoji != "👍" {
+		t.Errorf("unexpected reactions after removal: %v %+v", rr.Code, updated.Reactions)
+	}
+
+	if rr := doRequest(mux, "PUT", path+url.PathEscape("not an emoji"), token, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("reaction with spaces was accepted: got %v", rr.Code)
+	}
+
+	for i := 1; i < chat.MaxReactionsPerMessage; i++ {
+		if rr := doRequest(mux, "PUT", path+fmt.Sprintf(":emoji-%d:", i), token, nil); rr.Code != http.StatusOK {
+			t.Fatalf("reaction %d was rejected: got %v", i, rr.Code)
+		}
+	}
+
+	if rr := doRequest(mux, "PUT", path+":one-too-many:", token, nil); rr.Code != http.StatusConflict {
+		t.Errorf("reaction over the limit was accepted: got %v", rr.Code)
+	}
+
+	// Joining an existing reaction is still fine at the limit
+	if rr := doRequest(mux, "PUT", path+":emoji-1:", newTestToken(t, "react-alice"), nil); rr.Code != http.StatusOK {
+		t.Errorf("joining an existing reaction at the limit failed: got %v", rr.Code)
+	}
+}
+
+func TestMentions(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+
+	room := newTestRoom(t, "mention-alice", "mention-bob", "mention-carol")
+	newTestUser(t, "mention-outsider", models.RoleUser)
+
+	bob := dialSocket(t, server, "mention-bob")
+
+	message := postMessage(t, mux, "mention-alice", room, "@mention-bob, @mention-outsider and @mention-alice: mail me at me@mention-carol. @nobody")
+
+	if len(message.Mentions) != 1 || message.Mentions[0] != "mention-bob" {
+		t.Errorf("expected only the member to be mentioned, got %v", message.Mentions)
+	}
+
+	waitForEvent(t, bob, chat.EventMention, func(payload json.RawMessage) bool {
+		var mention chat.MentionPayload
+		json.Unmarshal(payload, &mention)
+		return mention.MessageID == message.ID && mention.Sender == "mention-alice"
+	})
+
+	// @here only reaches whoever is online, @room everybody
+	here := postMessage(t, mux, "mention-alice", room, "anyone @here?")
+
+	if len(here.Mentions) != 1 || here.Mentions[0] != "mention-bob" || here.GroupMention != chat.MentionHere {
+		t.Errorf("unexpected @here mentions: %v %s", here.Mentions, here.GroupMention)
+	}
+
+	everyone := postMessage(t, mux, "mention-alice", room, "@room meeting in 5")
+
+	if len(everyone.Mentions) != 2 || everyone.GroupMention != chat.MentionRoom {
+		t.Errorf("unexpected @room mentions: %v %s", everyone.Mentions, everyone.GroupMention)
+	}
+
+	rr := doRequest(mux, "GET", "/api/users/me/mentions", newTestToken(t, "mention-carol"), nil)
+
+	var mentions []models.Message
+	json.Unmarshal(rr.Body.Bytes(), &mentions)
+
+	if rr.Code != http.StatusOK || len(mentions) != 1 || mentions[0].ID != everyone.ID {
+		t.Errorf("unexpected mentions of carol: %v %+v", rr.Code, mentions)
+	}
+
+	rr = doRequest(mux, "GET", "/api/users/me/mentions?limit=2", newTestToken(t, "mention-bob"), nil)
+	json.Unmarshal(rr.Body.Bytes(), &mentions)
+
+	if len(mentions) != 2 || mentions[0].ID != everyone.ID || mentions[1].ID != here.ID {
+		t.Errorf("unexpected mentions of bob: %+v", mentions)
+	}
+}
@@ -0,0 +1,205 @@
+package test
+
+import (
+	"chat-module/auth"
+	"chat-module/bus"
+	"chat-module/chat"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/routes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Starts a hub behind a test server, returning the server
+func newTestHubServer(t *testing.T) (*chat.Hub, *httptest.Server) {
+	return newTestHubServerOn(t, bus.NewMemoryBus())
+}
+
+// Starts a hub on the given bus, like one instance of several
+func newTestHubOn(t *testing.T, messageBus bus.Bus) *chat.Hub {
+	hub, err := chat.NewHub(messageBus)
+
+	if err != nil {
+		t.Fatalf("failed to create hub: %v", err)
+	}
+
+	go hub.Run()
+	unregister := auth.OnRevoke(hub.Revoke)
+
+	t.Cleanup(func() {
+		unregister()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := hub.Stop(ctx); err != nil {
+			t.Errorf("failed to stop the hub: %v", err)
+		}
+	})
+
+	return hub
+}
+
+// Starts a hub on the given bus behind a test server serving every route
+func newTestHubServerOn(t *testing.T, messageBus bus.Bus) (*chat.Hub, *httptest.Server) {
+	hub := newTestHubOn(t, messageBus)
+
+	server := httptest.NewServer(routes.New(hub))
+	t.Cleanup(server.Close)
+
+	return hub, server
+}
+
+// The routes of the server, on a hub of their own
+func newTestRouter(t *testing.T) *http.ServeMux {
+	return routes.New(newTestHubOn(t, bus.NewMemoryBus()))
+}
+
+// Opens a socket to the test server for the given user
+func dialSocket(t *testing.T, server *httptest.Server, username string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws?token=" + newTestToken(t, username)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+
+	if err != nil {
+		t.Fatalf("failed to open socket for %s: %v", username, err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// Reads events until one of the given type shows up that satisfies the check
+func waitForEvent(t *testing.T, conn *websocket.Conn, eventType string, check func(payload json.RawMessage) bool) json.RawMessage {
+	return waitForEventWithin(t, conn, eventType, 3*time.Second, check)
+}
+
+func waitForEventWithin(t *testing.T, conn *websocket.Conn, eventType string, timeout time.Duration, check func(payload json.RawMessage) bool) json.RawMessage {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	for {
+		var event struct {
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+		}
+
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatalf("no %s event arrived: %v", eventType, err)
+		}
+
+		if event.Type == eventType && (check == nil || check(event.Payload)) {
+			return event.Payload
+		}
+	}
+}
+
+func presenceIs(username string, status chat.PresenceStatus) func(json.RawMessage) bool {
+	return func(payload json.RawMessage) bool {
+		var presence chat.Presence
+		json.Unmarshal(payload, &presence)
+		return presence.Username == username && presence.Status == status
+	}
+}
+
+// Puts the given users in a fresh room together
+func newTestRoom(t *testing.T, usernames ...string) models.Room {
+	room := models.Room{
+		ID:        primitive.NewObjectID(),
+		Name:      "test-room",
+		CreatedBy: usernames[0],
+		CreatedAt: time.Now(),
+	}
+
+	for i, username := range usernames {
+		newTestUser(t, username, models.RoleUser)
+
+		role := models.RoomRoleMember
+		if i == 0 {
+			role = models.RoomRoleOwner
+		}
+
+		room.Members = append(room.Members, models.RoomMember{Username: username, Role: role, JoinedAt: time.Now()})
+	}
+
+	if err := db.Client.AddRoom(room); err != nil {
+		t.Fatalf("failed to add test room: %v", err)
+	}
+
+	return room
+}
+
+func TestPresence(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	newTestRoom(t, "presence-watcher", "presence-user")
+	newTestRoom(t, "presence-stranger", "presence-stranger-friend")
+
+	watcher := dialSocket(t, server, "presence-watcher")
+	waitForEvent(t, watcher, chat.EventPresence, presenceIs("presence-watcher", chat.StatusOnline))
+
+	// Two devices, but only one announcement
+	phone := dialSocket(t, server, "presence-user")
+	waitForEvent(t, watcher, chat.EventPresence, presenceIs("presence-user", chat.StatusOnline))
+	laptop := dialSocket(t, server, "presence-user")
+
+	phone.WriteJSON(map[string]any{"type": "presence", "payload": map[string]string{"status": "away"}})
+
+	// Still online thanks to the laptop
+	laptop.WriteJSON(map[string]any{"type": "presence", "payload": map[string]string{"status": "away"}})
+	waitForEvent(t, watcher, chat.EventPresence, presenceIs("presence-user", chat.StatusAway))
+
+	stranger := dialSocket(t, server, "presence-stranger")
+	defer stranger.Close()
+
+	// Strangers and emails are left out like unknown users
+	query := "presence-user,nobody,presence-stranger,presence-stranger-friend@example.com"
+	req, _ := http.NewRequest("GET", server.URL+"/api/presence?users="+query, nil)
+	req.Header.Set("Authorization", "Bearer "+newTestToken(t, "presence-watcher"))
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("presence query failed: %v", err)
+	}
+
+	var presences []chat.Presence
+	json.NewDecoder(resp.Body).Decode(&presences)
+	resp.Body.Close()
+
+	if len(presences) != 1 || presences[0].Status != chat.StatusAway {
+		t.Errorf("wrong presence from query: %+v", presences)
+	}
+
+	if _, err := hub.Presence.Get("presence-stranger-friend@example.com"); err != mongo.ErrNoDocuments {
+		t.Errorf("presence could be looked up by email: %v", err)
+	}
+
+	phone.Close()
+	laptop.Close()
+	waitForEvent(t, watcher, chat.EventPresence, presenceIs("presence-user", chat.StatusOffline))
+
+	// The last seen time ends up on the user record
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		user, _ := db.Client.GetUser("presence-user")
+
+		if user.LastSeen != nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("last seen time was never stored")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"chat-module/models"
+	"chat-module/users"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUserNeverMarshalsPassword(t *testing.T) {
+	hash := "$2a$10$secret-hash"
+	username := "marshal-user"
+
+	bytes, _ := json.Marshal(models.User{Username: &username, Password: &hash})
+
+	if strings.Contains(string(bytes), hash) {
+		t.Errorf("password hash was marshalled: %s", bytes)
+	}
+}
+
+func TestRegisterIgnoresExtraFields(t *testing.T) {
+	mux := newTestRouter(t)
+
+	body := map[string]string{
+		"username": "sneaky-user",
+		"password": testPassword,
+		"email":    "sneaky@example.com",
+		"role":     "admin",
+	}
+
+	if rr := doRequest(mux, "POST", "/register", "", body); rr.Code != http.StatusCreated {
+		t.Fatalf("registering failed: got %v", rr.Code)
+	}
+
+	rr := doRequest(mux, "GET", "/api/users/me", newTestToken(t, "sneaky-user"), nil)
+
+	var me models.PrivateUser
+	json.Unmarshal(rr.Body.Bytes(), &me)
+
+	if me.Role != models.RoleUser {
+		t.Errorf("role was taken from the request: got %s", me.Role)
+	}
+
+	if me.CreatedAt.IsZero() {
+		t.Errorf("creation time wasn't set")
+	}
+}
+
+func TestProfileUpdate(t *testing.T) {
+	mux := newTestRouter(t)
+	token := newTestToken(t, "profile-user")
+
+	update := map[string]string{
+		"displayName": "Profile User",
+		"bio":         "Just testing",
+		"timezone":    "Europe/Sofia",
+	}
+
+	rr := doRequest(mux, "PATCH", "/api/users/me", token, update)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("updating profile failed: got %v", rr.Code)
+	}
+
+	// Fields that weren't sent are left alone, empty ones are cleared
+	rr = doRequest(mux, "PATCH", "/api/users/me", token, map[string]string{"bio": ""})
+
+	var me models.PrivateUser
+	json.Unmarshal(rr.Body.Bytes(), &me)
+
+	if me.DisplayName != "Profile User" || me.Bio != "" || me.Timezone != "Europe/Sofia" {
+		t.Errorf("wrong profile after update: %s", rr.Body.String())
+	}
+
+	if me.Email != "profile-user@example.com" {
+		t.Errorf("own profile is missing the email: %s", rr.Body.String())
+	}
+
+	invalid := []map[string]string{
+		{"timezone": "Mars/Olympus_Mons"},
+		{"avatar": "not-an-id"},
+		{"statusText": strings.Repeat("a", users.MaxStatusTextLength+1)},
+	}
+
+	for _, body := range invalid {
+		if rr := doRequest(mux, "PATCH", "/api/users/me", token, body); rr.Code != http.StatusBadRequest {
+			t.Errorf("invalid update %v was accepted: got %v", body, rr.Code)
+		}
+	}
+
+	rr = doRequest(mux, "GET", "/api/users/profile-user", newTestToken(t, "profile-viewer"), nil)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("getting public profile failed: got %v", rr.Code)
+	}
+
+	if strings.Contains(rr.Body.String(), "@example.com") || strings.Contains(rr.Body.String(), `"password"`) {
+		t.Errorf("public profile leaks private fields: %s", rr.Body.String())
+	}
+
+	if rr := doRequest(mux, "GET", "/api/users/profile-user@example.com", token, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("profile could be looked up by email: got %v", rr.Code)
+	}
+}
@@ -0,0 +1,169 @@
+package test
+
+import (
+	"chat-module/chat"
+	"chat-module/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+)
+
+func ackFor(frameID string) func(json.RawMessage) bool {
+	return func(payload json.RawMessage) bool {
+		var ack chat.AckPayload
+		json.Unmarshal(payload, &ack)
+		return ack.Frame == frameID
+	}
+}
+
+func errorFor(frameID string, status int) func(json.RawMessage) bool {
+	return func(payload json.RawMessage) bool {
+		var failure chat.ErrorPayload
+		json.Unmarshal(payload, &failure)
+		return failure.Frame == frameID && failure.Status == status
+	}
+}
+
+func TestProtocolFrames(t *testing.T) {
+	_, server := newTestHubServer(t)
+	room := newTestRoom(t, "protocol-alice", "protocol-bob")
+	conversation := room.ID.Hex()
+
+	alice := dialSocket(t, server, "protocol-alice")
+	bob := dialSocket(t, server, "protocol-bob")
+
+	// The conversation on the envelope fills in the payload, and the sender
+	// gets the stored message back in the ack
+	alice.WriteJSON(map[string]any{
+		"v":            chat.ProtocolVersion,
+		"type":         chat.FrameMessage,
+		"id":           "send-1",
+		"conversation": conversation,
+		"payload":      map[string]any{"body": "over the wire"},
+	})
+
+	payload := waitForEvent(t, alice, chat.EventAck, ackFor("send-1"))
+
+	var ack struct {
+		Result models.Message `json:"result"`
+	}
+	json.Unmarshal(payload, &ack)
+
+	if ack.Result.Body != "over the wire" || ack.Result.Seq == 0 {
+		t.Errorf("ack didn't carry the stored message: %s", payload)
+	}
+
+	waitForEvent(t, bob, chat.EventMessage, messageBody("over the wire"))
+
+	// Frames from a future protocol are refused, naming the frame
+	alice.WriteJSON(map[string]any{
+		"v":       chat.ProtocolVersion + 1,
+		"type":    chat.FrameMessage,
+		"id":      "send-2",
+		"payload": map[string]any{"conversation": conversation, "body": "from the future"},
+	})
+	waitForEvent(t, alice, chat.EventError, errorFor("send-2", http.StatusBadRequest))
+
+	alice.WriteJSON(map[string]any{"type": "teleport", "id": "send-3", "payload": map[string]any{}})
+	waitForEvent(t, alice, chat.EventError, errorFor("send-3", http.StatusBadRequest))
+
+	// Failures from the hub carry the same status as the REST API
+	alice.WriteJSON(map[string]any{
+		"type":    chat.FrameMessage,
+		"id":      "send-4",
+		"payload": map[string]any{"conversation": "000000000000000000000000", "body": "nowhere"},
+	})
+	waitForEvent(t, alice, chat.EventError, errorFor("send-4", http.StatusNotFound))
+}
+
+func TestCBORSockets(t *testing.T) {
+	_, server := newTestHubServer(t)
+	room := newTestRoom(t, "cbor-alice", "cbor-bob")
+	conversation := room.ID.Hex()
+
+	dialer := websocket.Dialer{Subprotocols: []string{chat.SubprotocolCBOR}}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws?token=" + newTestToken(t, "cbor-alice")
+
+	conn, _, err := dialer.Dial(url, nil)
+
+	if err != nil {
+		t.Fatalf("failed to open CBOR socket: %v", err)
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != chat.SubprotocolCBOR {
+		t.Fatalf("server didn't agree to CBOR: got %q", conn.Subprotocol())
+	}
+
+	frame, _ := cbor.Marshal(map[string]any{
+		"v":       chat.ProtocolVersion,
+		"type":    chat.FrameMessage,
+		"id":      "cbor-1",
+		"payload": map[string]any{"conversation": conversation, "body": "in binary"},
+	})
+	conn.WriteMessage(websocket.BinaryMessage, frame)
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+
+		if err != nil {
+			t.Fatalf("no ack arrived over CBOR: %v", err)
+		}
+
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("expected binary messages on a CBOR socket, got type %d", messageType)
+		}
+
+		var event struct {
+			Type    string `cbor:"type"`
+			Payload struct {
+				Frame string `cbor:"frame"`
+			} `cbor:"payload"`
+		}
+
+		if err := cbor.Unmarshal(data, &event); err != nil {
+			t.Fatalf("event isn't valid CBOR: %v", err)
+		}
+
+		if event.Type == chat.EventAck && event.Payload.Frame == "cbor-1" {
+			break
+		}
+	}
+}
+
+func TestProtocolSchema(t *testing.T) {
+	rr := httptest.NewRecorder()
+	chat.ProtocolSchemaHandler(rr, httptest.NewRequest("GET", "/api/protocol/schema", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("schema request failed: got %v", rr.Code)
+	}
+
+	var document struct {
+		Defs map[string]json.RawMessage `json:"$defs"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &document)
+
+	for _, name := range []string{"ClientFrame", "ServerEvent", "MessageFrame", "Message"} {
+		if _, ok := document.Defs[name]; !ok {
+			t.Errorf("schema is missing a definition for %s", name)
+		}
+	}
+
+	var serverEvent struct {
+		OneOf []json.RawMessage `json:"oneOf"`
+	}
+	json.Unmarshal(document.Defs["ServerEvent"], &serverEvent)
+
+	if len(serverEvent.OneOf) == 0 {
+		t.Errorf("server events have no variants: %s", document.Defs["ServerEvent"])
+	}
+}
@@ -1,25 +1,26 @@
 package test
 
 import (
-	"chat-module/auth"
+	"chat-module/routes"
+	"chat-module/supervisor"
 	"chat-module/util"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestRateLimit(t *testing.T) {
-	go util.RateLimit()
+	jobs := supervisor.New(context.Background())
+	jobs.Go("rate limit janitor", util.RateLimit)
+	defer jobs.Stop(context.Background())
 
 	// Generate a JWT token, which we will be used for authentication
-	token, err := auth.GenerateJWTToken("test-user")
-
-	if err != nil {
-		t.Fatalf("failed to generate jwt token: %v", err.Error())
-	}
+	token := newTestToken(t, "test-user")
 
 	// Create the request
 	req, err := http.NewRequest("GET", "/api/test/success", nil)
@@ -85,3 +86,44 @@ func TestRateLimit(t *testing.T) {
 			rr.Body.String(), expected)
 	}
 }
+
+func TestOnlyAuthRoutesAreRateLimited(t *testing.T) {
+	hub, _ := newTestHubServer(t)
+	handler := routes.RateLimited(routes.New(hub))
+	token := newTestToken(t, "rate-limited-user")
+
+	// An address of its own, so the other tests don't count against it
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "198.51.100.7:1234"
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	limited := func(rr *httptest.ResponseRecorder) bool {
+		return rr.Code == http.StatusBadRequest && strings.Contains(rr.Body.String(), "maximum allowed requests")
+	}
+
+	for i := 0; i < util.MaximumRequests*2; i++ {
+		if rr := request("GET", "/api/users/me"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d to the API failed: got %v", i+1, rr.Code)
+		}
+	}
+
+	for i := 0; i < util.MaximumRequests; i++ {
+		if rr := request("POST", "/login"); limited(rr) {
+			t.Fatalf("login %d was rate limited already", i+1)
+		}
+	}
+
+	if rr := request("POST", "/login"); !limited(rr) {
+		t.Errorf("login over the limit went through: got %v", rr.Code)
+	}
+
+	if rr := request("GET", "/api/users/me"); rr.Code != http.StatusOK {
+		t.Errorf("the API got rate limited along with login: got %v", rr.Code)
+	}
+}
@@ -0,0 +1,123 @@
+package test
+
+import (
+	"bytes"
+	"chat-module/auth"
+	"chat-module/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Sends a request with the given token and JSON body, returning the recorded response
+func doRequest(handler http.Handler, method, path, token string, body any) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		bodyBytes, _ := json.Marshal(body)
+		reader = bytes.NewReader(bodyBytes)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestRoomRoles(t *testing.T) {
+	mux := newTestRouter(t)
+
+	owner := newTestToken(t, "room-owner")
+	mod := newTestToken(t, "room-mod")
+	member := newTestToken(t, "room-member")
+	outsider := newTestToken(t, "room-outsider")
+
+	newTestUser(t, "site-mod", models.RoleModerator)
+	siteMod := newTestToken(t, "site-mod")
+
+	rr := doRequest(mux, "POST", "/api/rooms", owner, map[string]string{"name": "general"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("creating room failed: got %v", rr.Code)
+	}
+
+	var room models.Room
+	json.Unmarshal(rr.Body.Bytes(), &room)
+	roomPath := "/api/rooms/" + room.ID.Hex()
+
+	for _, username := range []string{"room-mod", "room-member"} {
+		rr = doRequest(mux, "POST", roomPath+"/members", owner, map[string]string{"username": username})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("adding %s failed: got %v", username, rr.Code)
+		}
+	}
+
+	if rr := doRequest(mux, "GET", roomPath, outsider, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("outsider could see the room: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "GET", roomPath, siteMod, nil); rr.Code != http.StatusOK {
+		t.Errorf("site moderator couldn't see the room: got %v", rr.Code)
+	}
+
+	// Regular members can't kick or hand out roles
+	if rr := doRequest(mux, "DELETE", roomPath+"/members/room-mod", member, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("member kicked someone: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "PATCH", roomPath+"/members/room-member", mod, map[string]string{"role": "moderator"}); rr.Code != http.StatusForbidden {
+		t.Errorf("non-owner changed a role: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "PATCH", roomPath+"/members/room-mod", owner, map[string]string{"role": "owner"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("ownership was handed out: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "PATCH", roomPath+"/members/room-mod", owner, map[string]string{"role": "moderator"}); rr.Code != http.StatusOK {
+		t.Fatalf("owner couldn't promote a member: got %v", rr.Code)
+	}
+
+	// Moderators can't act on the owner, or on each other
+	if rr := doRequest(mux, "DELETE", roomPath+"/members/room-owner", mod, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("moderator kicked the owner: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "DELETE", roomPath+"/members/room-mod", siteMod, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("site moderator kicked a room moderator: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "DELETE", roomPath+"/members/room-member", mod, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("moderator couldn't kick a member: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "GET", roomPath, member, nil); rr.Code != http.StatusNotFound {
+		t.Errorf("kicked member could still see the room: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "DELETE", roomPath, mod, nil); rr.Code != http.StatusForbidden {
+		t.Errorf("moderator deleted the room: got %v", rr.Code)
+	}
+
+	if rr := doRequest(mux, "DELETE", roomPath, owner, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("owner couldn't delete the room: got %v", rr.Code)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	handler := http.HandlerFunc(auth.RequirePermission(models.PermissionManageUsers, Test200ResponseHandler))
+
+	if rr := doRequest(handler, "GET", "/", newTestToken(t, "plain-user"), nil); rr.Code != http.StatusForbidden {
+		t.Errorf("regular user passed an admin check: got %v", rr.Code)
+	}
+
+	newTestUser(t, "admin-user", models.RoleAdmin)
+
+	if rr := doRequest(handler, "GET", "/", newTestToken(t, "admin-user"), nil); rr.Code != http.StatusOK {
+		t.Errorf("admin failed an admin check: got %v", rr.Code)
+	}
+}
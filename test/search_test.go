@@ -0,0 +1,106 @@
+package test
+
+import (
+	"chat-module/chat"
+	"chat-module/routes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func search(t *testing.T, mux http.Handler, username string, query url.Values) []chat.SearchResult {
+	rr := doRequest(mux, "GET", "/api/search?"+query.Encode(), newTestToken(t, username), nil)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("search failed: got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	var results []chat.SearchResult
+	json.Unmarshal(rr.Body.Bytes(), &results)
+
+	return results
+}
+
+func TestSearch(t *testing.T) {
+	hub, _ := newTestHubServer(t)
+	mux := routes.New(hub)
+
+	shared := newTestRoom(t, "search-alice", "search-bob")
+	private := newTestRoom(t, "search-carol", "search-bob")
+	direct := openDirectRoom(t, "search-alice", "search-bob")
+
+	postMessage(t, mux, "search-alice", shared, "The Quokka report is ready")
+	postMessage(t, mux, "search-bob", shared, "quokka sightings: <none> yet")
+	postMessage(t, mux, "search-alice", direct, "Did you read the quokka report?")
+	postMessage(t, mux, "search-carol", private, "secret quokka report")
+	deleted := postMessage(t, mux, "search-alice", shared, "old quokka report")
+	doRequest(mux, "DELETE", "/api/rooms/"+shared.ID.Hex()+"/messages/"+deleted.ID.Hex(), newTestToken(t, "search-alice"), nil)
+
+	// Every word has to match, in any case
+	results := search(t, mux, "search-alice", url.Values{"q": {"QUOKKA Report"}})
+
+	if len(results) != 2 {
+		t.Fatalf("expected the room and direct message to match, got %d results", len(results))
+	}
+
+	if results[0].Conversation != direct.ID || results[1].Conversation != shared.ID {
+		t.Errorf("results aren't newest first")
+	}
+
+	if results[1].Snippet != "The <mark>Quokka</mark> <mark>report</mark> is ready" {
+		t.Errorf("unexpected snippet: %s", results[1].Snippet)
+	}
+
+	// Nothing from rooms the user isn't a member of, even when asked for
+	results = search(t, mux, "search-alice", url.Values{"q": {"secret"}})
+
+	if len(results) != 0 {
+		t.Errorf("search leaked %d messages from another room", len(results))
+	}
+
+	results = search(t, mux, "search-alice", url.Values{"q": {"quokka"}, "room": {private.ID.Hex()}})
+
+	if len(results) != 0 {
+		t.Errorf("search leaked %d messages from a room given explicitly", len(results))
+	}
+
+	// Filters
+	results = search(t, mux, "search-bob", url.Values{"q": {"quokka"}, "sender": {"search-bob"}})
+
+	if len(results) != 1 || !strings.Contains(results[0].Snippet, "&lt;none&gt;") {
+		t.Errorf("expected the message of the sender, escaped: %v", results)
+	}
+
+	results = search(t, mux, "search-bob", url.Values{"q": {"quokka"}, "room": {private.ID.Hex()}})
+
+	if len(results) != 1 || results[0].Sender != "search-carol" {
+		t.Errorf("expected only the message of the room, got %d results", len(results))
+	}
+
+	results = search(t, mux, "search-bob", url.Values{"q": {"quokka"}, "hasAttachment": {"true"}})
+
+	if len(results) != 0 {
+		t.Errorf("expected no messages with attachments, got %d", len(results))
+	}
+
+	results = search(t, mux, "search-bob", url.Values{"q": {"quokka"}, "to": {"2000-01-01"}})
+
+	if len(results) != 0 {
+		t.Errorf("expected no messages before 2000, got %d", len(results))
+	}
+
+	results = search(t, mux, "search-bob", url.Values{"q": {"quokka"}, "limit": {"2"}})
+	older := search(t, mux, "search-bob", url.Values{"q": {"quokka"}, "before": {results[1].ID.Hex()}})
+
+	if len(results) != 2 || len(older) != 2 {
+		t.Errorf("paging returned %d and %d results", len(results), len(older))
+	}
+
+	rr := doRequest(mux, "GET", "/api/search?q=%20", newTestToken(t, "search-bob"), nil)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an empty query to be refused: got %v", rr.Code)
+	}
+}
@@ -0,0 +1,223 @@
+package test
+
+import (
+	"chat-module/auth"
+	"chat-module/bus"
+	"chat-module/chat"
+	"chat-module/db"
+	"chat-module/routes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type testSession struct {
+	ID        string `json:"id"`
+	UserAgent string `json:"userAgent"`
+	Current   bool   `json:"current"`
+}
+
+func listSessions(t *testing.T, mux http.Handler, token string) []testSession {
+	rr := doRequest(mux, "GET", "/api/sessions", token, nil)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("listing sessions failed: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var sessions []testSession
+	if err := json.Unmarshal(rr.Body.Bytes(), &sessions); err != nil {
+		t.Fatalf("failed to decode sessions: %v", err)
+	}
+
+	return sessions
+}
+
+func revokeSession(mux http.Handler, token, id string) int {
+	return doRequest(mux, "DELETE", "/api/sessions/"+id, token, nil).Code
+}
+
+func TestSessionsListAndRevoke(t *testing.T) {
+	mux := newTestRouter(t)
+	laptop := newTestToken(t, "session-user")
+	phone := newTestToken(t, "session-user")
+	other := newTestToken(t, "other-session-user")
+
+	sessions := listSessions(t, mux, laptop)
+
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+
+	var phoneSession string
+	for _, session := range sessions {
+		if !session.Current {
+			phoneSession = session.ID
+		}
+
+		if session.UserAgent != "test-agent" {
+			t.Errorf("wrong user agent recorded: got %s", session.UserAgent)
+		}
+	}
+
+	if phoneSession == "" {
+		t.Fatalf("current session was not marked")
+	}
+
+	// Other users can't touch our sessions
+	if code := revokeSession(mux, other, phoneSession); code != http.StatusNotFound {
+		t.Errorf("revoking another user's session: got %v want %v", code, http.StatusNotFound)
+	}
+
+	if code := revokeSession(mux, laptop, phoneSession); code != http.StatusNoContent {
+		t.Fatalf("revoking session failed: got %v want %v", code, http.StatusNoContent)
+	}
+
+	if _, err := auth.ValidateJWT(phone); !errors.Is(err, auth.ErrTokenInvalid) {
+		t.Errorf("token of revoked session was accepted: %v", err)
+	}
+
+	if _, err := auth.ValidateJWT(laptop); err != nil {
+		t.Errorf("token of remaining session was rejected: %v", err)
+	}
+
+	if sessions := listSessions(t, mux, laptop); len(sessions) != 1 {
+		t.Errorf("expected 1 session after revoking, got %d", len(sessions))
+	}
+
+	if code := revokeSession(mux, laptop, phoneSession); code != http.StatusNotFound {
+		t.Errorf("revoking a session twice: got %v want %v", code, http.StatusNotFound)
+	}
+}
+
+func TestStaleSessionsAreDeleted(t *testing.T) {
+	mux := newTestRouter(t)
+	kept := newTestToken(t, "stale-session-user")
+	revoked := newTestToken(t, "stale-session-user")
+
+	for _, session := range listSessions(t, mux, kept) {
+		if !session.Current {
+			revokeSession(mux, kept, session.ID)
+		}
+	}
+
+	deleted, err := db.Client.DeleteStaleSessions(time.Now())
+
+	if err != nil || deleted == 0 {
+		t.Fatalf("expected the revoked session to be deleted: %d %v", deleted, err)
+	}
+
+	// Gone is as good as revoked
+	if _, err := auth.ValidateJWT(revoked); !errors.Is(err, auth.ErrTokenInvalid) {
+		t.Errorf("token of deleted session was accepted: %v", err)
+	}
+
+	if _, err := auth.ValidateJWT(kept); err != nil {
+		t.Errorf("token of remaining session was rejected: %v", err)
+	}
+
+	// Once they expire, the rest go too
+	if _, err := db.Client.DeleteStaleSessions(time.Now().Add(auth.TokenLifetime + time.Minute)); err != nil {
+		t.Fatalf("deleting expired sessions failed: %v", err)
+	}
+
+	if _, err := auth.ValidateJWT(kept); !errors.Is(err, auth.ErrTokenInvalid) {
+		t.Errorf("token of expired, deleted session was accepted: %v", err)
+	}
+}
+
+// Opens a socket to the test server with the given token
+func dialSession(t *testing.T, server *httptest.Server, username, token string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws?token=" + token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+
+	if err != nil {
+		t.Fatalf("failed to open socket for %s: %v", username, err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// Expects the socket to be closed because its session was revoked
+func expectRevoked(t *testing.T, conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	for {
+		_, _, err := conn.ReadMessage()
+
+		if err == nil {
+			continue
+		}
+
+		var closeErr *websocket.CloseError
+
+		if !errors.As(err, &closeErr) || closeErr.Code != chat.CloseSessionRevoked {
+			t.Errorf("expected the socket to be closed as revoked, got %v", err)
+		}
+
+		return
+	}
+}
+
+func setAway(conn *websocket.Conn, away bool) {
+	status := chat.StatusOnline
+	if away {
+		status = chat.StatusAway
+	}
+
+	conn.WriteJSON(map[string]any{"type": "presence", "payload": map[string]any{"status": status}})
+}
+
+func TestRevokedSessionIsDisconnected(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+
+	laptopToken := newTestToken(t, "revoked-socket-user")
+	phoneToken := newTestToken(t, "revoked-socket-user")
+
+	laptop := dialSession(t, server, "revoked-socket-user", laptopToken)
+	waitForEvent(t, laptop, chat.EventPresence, presenceIs("revoked-socket-user", chat.StatusOnline))
+
+	// With the laptop away, the user coming back online means the phone is connected
+	setAway(laptop, true)
+	waitForEvent(t, laptop, chat.EventPresence, presenceIs("revoked-socket-user", chat.StatusAway))
+
+	phone := dialSession(t, server, "revoked-socket-user", phoneToken)
+	waitForEvent(t, laptop, chat.EventPresence, presenceIs("revoked-socket-user", chat.StatusOnline))
+
+	claims, err := auth.ValidateJWT(phoneToken)
+
+	if err != nil {
+		t.Fatalf("failed to read the claims of the phone: %v", err)
+	}
+
+	if code := revokeSession(mux, laptopToken, claims.ID); code != http.StatusNoContent {
+		t.Fatalf("revoking session failed: got %v want %v", code, http.StatusNoContent)
+	}
+
+	expectRevoked(t, phone)
+
+	// The laptop keeps its socket, and is all that is left of the user
+	waitForEvent(t, laptop, chat.EventPresence, presenceIs("revoked-socket-user", chat.StatusAway))
+}
+
+func TestRevocationReachesOtherInstances(t *testing.T) {
+	messageBus := bus.NewMemoryBus()
+	first := newTestHubOn(t, messageBus)
+	_, server := newTestHubServerOn(t, messageBus)
+
+	conn := dialSession(t, server, "revoked-elsewhere", newTestToken(t, "revoked-elsewhere"))
+	waitForEvent(t, conn, chat.EventPresence, presenceIs("revoked-elsewhere", chat.StatusOnline))
+
+	// Every session of the user, as when they are suspended
+	first.Revoke("revoked-elsewhere", "")
+
+	expectRevoked(t, conn)
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"chat-module/chat"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDrainAndStop(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	newTestRoom(t, "drain-alice", "drain-bob")
+
+	alice := dialSocket(t, server, "drain-alice")
+	waitForEvent(t, alice, chat.EventPresence, presenceIs("drain-alice", chat.StatusOnline))
+
+	events, _ := openEventStream(t, server, "drain-bob", "")
+	waitForStreamEvent(t, events, chat.EventPresence, presenceIs("drain-bob", chat.StatusOnline))
+
+	// Whatever was queued before the drain still arrives
+	hub.SendToUsers([]string{"drain-alice", "drain-bob"}, chat.NewEvent(chat.EventMessage, map[string]string{"body": "last words"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := hub.Drain(ctx); err != nil {
+		t.Fatalf("draining the hub failed: %v", err)
+	}
+
+	waitForEvent(t, alice, chat.EventMessage, messageBody("last words"))
+
+	_, _, err := alice.ReadMessage()
+
+	var closeErr *websocket.CloseError
+
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseServiceRestart {
+		t.Errorf("expected the socket to be closed with a restart, got %v", err)
+	}
+
+	waitForStreamEvent(t, events, chat.EventMessage, messageBody("last words"))
+
+	for range events {
+	}
+
+	// Nobody new gets in
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws?token=" + newTestToken(t, "drain-alice")
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected new sockets to be refused while draining, got %v", resp)
+	}
+
+	if err := hub.Stop(ctx); err != nil {
+		t.Fatalf("stopping the hub failed: %v", err)
+	}
+
+	// A stopped hub doesn't hold anybody up
+	done := make(chan struct{})
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			hub.SendToUsers([]string{"drain-alice"}, chat.NewEvent(chat.EventMessage, nil))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Errorf("sending to a stopped hub blocked")
+	}
+
+	// Nor do the requests that need the Run loop
+	inspected := make(chan int, 1)
+
+	go func() {
+		rr := httptest.NewRecorder()
+		hub.ConnectionsHandler(rr, httptest.NewRequest("GET", "/api/admin/connections", nil))
+		inspected <- rr.Code
+	}()
+
+	select {
+	case code := <-inspected:
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("inspecting a stopped hub: got %v", code)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("inspecting a stopped hub blocked")
+	}
+}
@@ -0,0 +1,238 @@
+package test
+
+import (
+	"bufio"
+	"chat-module/chat"
+	"chat-module/routes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type streamedEvent struct {
+	// The ID of the stream rather than the one inside the event
+	ID      string          `json:"-"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+/*
+ *	Opens an event stream for the user, resuming after lastEventID if given.
+ *	The events come out of the channel until the stream is closed.
+ */
+func openEventStream(t *testing.T, server *httptest.Server, username, lastEventID string) (<-chan streamedEvent, func()) {
+	req, _ := http.NewRequest("GET", server.URL+"/api/events?token="+newTestToken(t, username), nil)
+
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("failed to open event stream: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected event stream response: %v %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan streamedEvent, 64)
+
+	go func() {
+		defer close(events)
+
+		reader := bufio.NewReader(resp.Body)
+		var event streamedEvent
+
+		for {
+			line, err := reader.ReadString('\n')
+
+			if err != nil {
+				return
+			}
+
+			line = strings.TrimSuffix(line, "\n")
+
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+			case line == "" && event.Type != "":
+				events <- event
+				event = streamedEvent{}
+			}
+		}
+	}()
+
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return events, func() { resp.Body.Close() }
+}
+
+func waitForStreamEvent(t *testing.T, events <-chan streamedEvent, eventType string, check func(payload json.RawMessage) bool) streamedEvent {
+	timeout := time.After(3 * time.Second)
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("event stream ended before a %s event arrived", eventType)
+			}
+
+			if event.Type == eventType && (check == nil || check(event.Payload)) {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %s event arrived", eventType)
+		}
+	}
+}
+
+func messageBody(body string) func(json.RawMessage) bool {
+	return func(payload json.RawMessage) bool {
+		var message struct {
+			Body string `json:"body"`
+		}
+		json.Unmarshal(payload, &message)
+		return message.Body == body
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+	room := newTestRoom(t, "sse-alice", "sse-bob")
+
+	events, disconnect := openEventStream(t, server, "sse-bob", "")
+	waitForStreamEvent(t, events, chat.EventPresence, presenceIs("sse-bob", chat.StatusOnline))
+
+	postMessage(t, mux, "sse-alice", room, "first")
+	last := waitForStreamEvent(t, events, chat.EventMessage, messageBody("first"))
+
+	// Whatever is sent while the client reconnects comes once it's back
+	disconnect()
+	postMessage(t, mux, "sse-alice", room, "while away")
+
+	events, disconnect = openEventStream(t, server, "sse-bob", last.ID)
+	resumed := waitForStreamEvent(t, events, chat.EventMessage, nil)
+
+	if !messageBody("while away")(resumed.Payload) {
+		t.Errorf("expected the missed message first after resuming, got %s", resumed.Payload)
+	}
+
+	disconnect()
+
+	// Sessions that are gone can't be resumed
+	events, _ = openEventStream(t, server, "sse-bob", "000000000000000000000000-3")
+	first := <-events
+
+	if first.Type != chat.EventResync {
+		t.Errorf("expected a resync event for an unknown session, got %s", first.Type)
+	}
+
+	// Nor can somebody else's
+	events, _ = openEventStream(t, server, "sse-alice", last.ID)
+
+	if first := <-events; first.Type != chat.EventResync {
+		t.Errorf("expected a resync event for the session of another user, got %s", first.Type)
+	}
+
+	resp, _ := http.Get(server.URL + "/api/events")
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("event stream without a token: got %v", resp.StatusCode)
+	}
+}
+
+type pollResponse struct {
+	Cursor string          `json:"cursor"`
+	Events []streamedEvent `json:"events"`
+}
+
+func poll(t *testing.T, server *httptest.Server, username, cursor string) pollResponse {
+	query := url.Values{"token": {newTestToken(t, username)}, "cursor": {cursor}}
+	resp, err := http.Get(server.URL + "/api/poll?" + query.Encode())
+
+	if err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	var response pollResponse
+	json.NewDecoder(resp.Body).Decode(&response)
+
+	return response
+}
+
+func TestLongPolling(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+	room := newTestRoom(t, "poll-alice", "poll-bob")
+
+	// The first poll only hands out a cursor
+	started := poll(t, server, "poll-bob", "")
+
+	if started.Cursor == "" || len(started.Events) != 0 {
+		t.Fatalf("unexpected first poll: %+v", started)
+	}
+
+	postMessage(t, mux, "poll-alice", room, "queued")
+
+	// Events wait for the next poll, which waits for events
+	waiting := make(chan pollResponse)
+	cursor := started.Cursor
+
+	go func() {
+		for {
+			response := poll(t, server, "poll-bob", cursor)
+			cursor = response.Cursor
+
+			for _, event := range response.Events {
+				if event.Type == chat.EventMessage {
+					waiting <- response
+					return
+				}
+			}
+		}
+	}()
+
+	select {
+	case response := <-waiting:
+		if !messageBody("queued")(response.Events[len(response.Events)-1].Payload) {
+			t.Errorf("expected the queued message")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("poll never returned the queued message")
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		postMessage(t, mux, "poll-alice", room, "live")
+	}()
+
+	response := poll(t, server, "poll-bob", cursor)
+
+	if len(response.Events) != 1 || !messageBody("live")(response.Events[0].Payload) {
+		t.Errorf("waiting poll didn't get the new message: %+v", response.Events)
+	}
+
+	// Polling again from an older cursor after it was confirmed leaves a gap
+	response = poll(t, server, "poll-bob", started.Cursor)
+
+	if len(response.Events) == 0 || response.Events[0].Type != chat.EventResync {
+		t.Errorf("expected a resync event for events no longer kept")
+	}
+
+	response = poll(t, server, "poll-bob", "000000000000000000000000-1")
+
+	if len(response.Events) != 1 || response.Events[0].Type != chat.EventResync || response.Cursor == "" {
+		t.Errorf("expected a resync event and a new cursor for an unknown session: %+v", response)
+	}
+}
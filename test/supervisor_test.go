@@ -0,0 +1,96 @@
+package test
+
+import (
+	"chat-module/supervisor"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSupervisorRestartsFailedJobs(t *testing.T) {
+	jobs := supervisor.New(context.Background())
+	jobs.MinBackoff = 10 * time.Millisecond
+	jobs.MaxBackoff = 40 * time.Millisecond
+
+	var starts, finishes atomic.Int32
+	stopped := make(chan struct{})
+
+	jobs.Go("flaky", func(ctx context.Context) error {
+		switch starts.Add(1) {
+		case 1:
+			panic("first start")
+		case 2:
+			return errors.New("second start")
+		}
+
+		<-ctx.Done()
+		close(stopped)
+		return nil
+	})
+
+	jobs.Go("one-off", func(ctx context.Context) error {
+		finishes.Add(1)
+		return nil
+	})
+
+	eventually(t, "the flaky job is running for the third time", func() bool { return starts.Load() == 3 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := jobs.Stop(ctx); err != nil {
+		t.Fatalf("stopping the jobs failed: %v", err)
+	}
+
+	select {
+	case <-stopped:
+	default:
+		t.Errorf("the flaky job didn't see its context end")
+	}
+
+	// Jobs that finish on their own aren't started again
+	if finishes.Load() != 1 {
+		t.Errorf("expected the one-off job to run once, ran %d times", finishes.Load())
+	}
+}
+
+func TestSupervisorGivesUpOnStuckJobs(t *testing.T) {
+	jobs := supervisor.New(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+
+	jobs.Go("stuck", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := jobs.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected stopping a stuck job to time out, got %v", err)
+	}
+}
+
+func TestPeriodicJobs(t *testing.T) {
+	jobs := supervisor.New(context.Background())
+
+	var runs atomic.Int32
+	jobs.Go("ticking", supervisor.Every(5*time.Millisecond, func(ctx context.Context) { runs.Add(1) }))
+
+	eventually(t, "the job ran a few times", func() bool { return runs.Load() >= 3 })
+
+	if err := jobs.Stop(context.Background()); err != nil {
+		t.Fatalf("stopping the periodic job failed: %v", err)
+	}
+
+	// Nothing runs once it is stopped
+	after := runs.Load()
+	time.Sleep(20 * time.Millisecond)
+
+	if runs.Load() != after {
+		t.Errorf("periodic job kept running after being stopped")
+	}
+}
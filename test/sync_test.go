@@ -0,0 +1,214 @@
+package test
+
+import (
+	"chat-module/chat"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/routes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSequenceNumbersAndCatchUp(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+
+	room := newTestRoom(t, "sync-alice", "sync-bob")
+	conversation := room.ID.Hex()
+
+	first := postMessage(t, mux, "sync-alice", room, "one")
+	postMessage(t, mux, "sync-alice", room, "two")
+
+	rr := doRequest(mux, "POST", "/api/rooms/"+conversation+"/messages", newTestToken(t, "sync-alice"),
+		map[string]string{"body": "three", "parent": first.ID.Hex()})
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("posting reply failed: got %v", rr.Code)
+	}
+
+	// Bob saw the first message before his socket dropped, and gets the rest,
+	// thread replies included
+	bob := dialSocket(t, server, "sync-bob")
+	bob.WriteJSON(map[string]any{
+		"type":    "sync",
+		"payload": map[string]any{"conversations": map[string]int64{conversation: first.Seq}},
+	})
+
+	var missed chat.SyncPayload
+	json.Unmarshal(waitForEvent(t, bob, chat.EventSync, nil), &missed)
+
+	if len(missed.Messages) != 2 || missed.Messages[0].Body != "two" || missed.Messages[1].Body != "three" {
+		t.Fatalf("expected the two missed messages in order, got %+v", missed.Messages)
+	}
+
+	if missed.Messages[0].Seq != first.Seq+1 || missed.Messages[1].Seq != first.Seq+2 || missed.LastSeq != first.Seq+2 || missed.HasMore {
+		t.Errorf("unexpected sequence numbers: %+v", missed)
+	}
+
+	// Paging over HTTP
+	rr = doRequest(mux, "GET", "/api/rooms/"+conversation+"/sync?after=0&limit=2", newTestToken(t, "sync-bob"), nil)
+
+	var page chat.SyncPayload
+	json.Unmarshal(rr.Body.Bytes(), &page)
+
+	if rr.Code != http.StatusOK || len(page.Messages) != 2 || !page.HasMore || page.Messages[0].Seq != first.Seq {
+		t.Errorf("unexpected first page: %v %+v", rr.Code, page)
+	}
+
+	rr = doRequest(mux, "GET", "/api/rooms/"+conversation+"/sync?after=0", newTestToken(t, "sync-outsider"), nil)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("outsider caught up on the room: got %v", rr.Code)
+	}
+}
+
+func TestIdempotentSends(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	mux := routes.New(hub)
+	room := newTestRoom(t, "idempotent-alice", "idempotent-bob")
+	path := "/api/rooms/" + room.ID.Hex() + "/messages"
+	token := newTestToken(t, "idempotent-alice")
+
+	draft := map[string]string{"body": "only once", "clientId": "draft-1"}
+
+	rr := doRequest(mux, "POST", path, token, draft)
+
+	var sent models.Message
+	json.Unmarshal(rr.Body.Bytes(), &sent)
+
+	if rr.Code != http.StatusCreated || sent.ClientID != "draft-1" {
+		t.Fatalf("sending failed: got %v", rr.Code)
+	}
+
+	rr = doRequest(mux, "POST", path, token, draft)
+
+	var again models.Message
+	json.Unmarshal(rr.Body.Bytes(), &again)
+
+	if rr.Code != http.StatusOK || again.ID != sent.ID {
+		t.Errorf("sending again created another message: got %v", rr.Code)
+	}
+
+	// Other users can use the same client IDs
+	rr = doRequest(mux, "POST", path, newTestToken(t, "idempotent-bob"), draft)
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("client ID of another user rejected: got %v", rr.Code)
+	}
+
+	// Retries racing each other still end up as one message
+	var wg sync.WaitGroup
+	ids := make(chan string, 10)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rr := doRequest(mux, "POST", path, token, map[string]string{"body": "raced", "clientId": "draft-2"})
+
+			var message models.Message
+			json.Unmarshal(rr.Body.Bytes(), &message)
+			ids <- message.ID.Hex()
+		}()
+	}
+
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		seen[id] = true
+	}
+
+	if len(seen) != 1 {
+		t.Errorf("concurrent retries created %d messages", len(seen))
+	}
+
+	// Over the socket, the resent message is confirmed to the sender alone
+	alice := dialSocket(t, server, "idempotent-alice")
+	alice.WriteJSON(map[string]any{
+		"type":    "message",
+		"payload": map[string]any{"conversation": room.ID.Hex(), "body": "only once", "clientId": "draft-1"},
+	})
+
+	waitForEvent(t, alice, chat.EventMessage, func(payload json.RawMessage) bool {
+		var message models.Message
+		json.Unmarshal(payload, &message)
+		return message.ID == sent.ID
+	})
+
+	rr = doRequest(mux, "POST", path, token, map[string]string{"body": "x", "clientId": fmt.Sprintf("%065d", 0)})
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an overlong client ID to be refused: got %v", rr.Code)
+	}
+}
+
+func TestSyncWaitsForMessagesBeingStored(t *testing.T) {
+	hub, _ := newTestHubServer(t)
+	mux := routes.New(hub)
+
+	room := newTestRoom(t, "stored-alice", "stored-bob")
+	path := "/api/rooms/" + room.ID.Hex() + "/sync?after=0"
+
+	// A send that got its number but hasn't stored its message yet
+	slowSeq, err := db.Client.NextSequence(room.ID)
+
+	if err != nil {
+		t.Fatalf("reserving a sequence number failed: %v", err)
+	}
+
+	fast := postMessage(t, mux, "stored-alice", room, "fast")
+
+	var sync chat.SyncPayload
+	json.Unmarshal(doRequest(mux, "GET", path, newTestToken(t, "stored-bob"), nil).Body.Bytes(), &sync)
+
+	if len(sync.Messages) != 0 || sync.LastSeq != slowSeq-1 {
+		t.Fatalf("sync went past a message still being stored: %+v", sync)
+	}
+
+	slow := models.Message{
+		ID:           primitive.NewObjectID(),
+		Conversation: room.ID,
+		Sender:       "stored-bob",
+		Body:         "slow",
+		CreatedAt:    time.Now(),
+		Seq:          slowSeq,
+	}
+
+	if err := db.Client.AddMessage(slow); err != nil {
+		t.Fatalf("storing the slow message failed: %v", err)
+	}
+
+	db.Client.ReleaseSequence(room.ID, slowSeq)
+
+	json.Unmarshal(doRequest(mux, "GET", path, newTestToken(t, "stored-bob"), nil).Body.Bytes(), &sync)
+
+	if len(sync.Messages) != 2 || sync.Messages[0].Body != "slow" || sync.Messages[1].Body != "fast" || sync.LastSeq != fast.Seq {
+		t.Errorf("expected both messages in order once stored, got %+v", sync)
+	}
+}
+
+func TestAbandonedSequenceNumbersTimeOut(t *testing.T) {
+	now := time.Now()
+
+	room := models.Room{
+		LastSeq: 5,
+		Pending: []models.SeqReservation{{Seq: 3, At: now}, {Seq: 4, At: now.Add(-models.SeqReservationTimeout)}},
+	}
+
+	if committed := room.CommittedSeq(now); committed != 2 {
+		t.Errorf("expected sync to stop before the reserved number, got %d", committed)
+	}
+
+	if committed := room.CommittedSeq(now.Add(models.SeqReservationTimeout)); committed != 5 {
+		t.Errorf("expected reservations to be given up on, got %d", committed)
+	}
+}
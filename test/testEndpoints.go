@@ -19,12 +19,14 @@ func Test200ResponseHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
 
 	_, err = auth.ValidateJWT(token)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusForbidden)
+		auth.WriteTokenError(w, err)
+		return
 	}
 
 	// Send a success response
@@ -0,0 +1,197 @@
+package test
+
+import (
+	"bytes"
+	"chat-module/attachments"
+	"chat-module/models"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+var startThumbnailWorkers sync.Once
+
+// An image with its left half red and its right half blue
+func halvesImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, image.Rect(0, 0, width/2, height), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(width/2, 0, width, height), image.NewUniform(color.RGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+	return img
+}
+
+// A JPEG with an Exif segment saying it's rotated a quarter clockwise, followed by some private data
+func jpegWithExif(t *testing.T, img image.Image) []byte {
+	var encoded bytes.Buffer
+
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("failed to encode test JPEG: %v", err)
+	}
+
+	exif := []byte("Exif\x00\x00II\x2A\x00\x08\x00\x00\x00")
+	exif = append(exif, 1, 0)                         // one entry
+	exif = append(exif, 0x12, 0x01, 3, 0, 1, 0, 0, 0) // orientation, SHORT, one value
+	exif = append(exif, 6, 0, 0, 0)                   // rotated a quarter clockwise
+	exif = append(exif, 0, 0, 0, 0)                   // no next directory
+	exif = append(exif, []byte("GPS 60.1699N 24.9384E")...)
+
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(exif)+2))
+
+	data := encoded.Bytes()
+	withExif := append([]byte{}, data[:2]...)
+	withExif = append(withExif, segment...)
+	withExif = append(withExif, exif...)
+
+	return append(withExif, data[2:]...)
+}
+
+// A PNG with a text chunk right before the end
+func pngWithText(t *testing.T, img image.Image, text string) []byte {
+	var encoded bytes.Buffer
+
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("failed to encode test PNG: %v", err)
+	}
+
+	data := encoded.Bytes()
+	end := len(data) - 12
+
+	chunk := make([]byte, 8, 12+len(text))
+	binary.BigEndian.PutUint32(chunk, uint32(len(text)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	withText := append([]byte{}, data[:end]...)
+	withText = append(withText, chunk...)
+
+	return append(withText, data[end:]...)
+}
+
+// Uploads the image and waits for its thumbnails
+func uploadImage(t *testing.T, mux http.Handler, token string, content []byte) testAttachmentWithThumbnails {
+	rr := upload(mux, token, "photo", content)
+
+	var uploaded testAttachmentWithThumbnails
+	json.Unmarshal(rr.Body.Bytes(), &uploaded)
+
+	if rr.Code != http.StatusCreated || uploaded.ThumbnailStatus != models.ThumbnailsPending {
+		t.Fatalf("unexpected upload result: %v %+v", rr.Code, uploaded)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for uploaded.ThumbnailStatus == models.ThumbnailsPending && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+
+		rr = doRequest(mux, "GET", "/api/attachments/"+uploaded.ID.Hex(), token, nil)
+		json.Unmarshal(rr.Body.Bytes(), &uploaded)
+	}
+
+	if uploaded.ThumbnailStatus != models.ThumbnailsReady {
+		t.Fatalf("thumbnails weren't made: %s", uploaded.ThumbnailStatus)
+	}
+
+	return uploaded
+}
+
+type testAttachmentWithThumbnails struct {
+	testAttachment
+	Thumbnails []struct {
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+		URL    string `json:"url"`
+	} `json:"thumbnails"`
+}
+
+// The routes of the server, with workers running to make the thumbnails
+func newThumbnailsRouter(t *testing.T) *http.ServeMux {
+	startThumbnailWorkers.Do(func() { attachments.StartThumbnailWorkers(2) })
+
+	return newTestRouter(t)
+}
+
+func TestJPEGMetadataAndOrientation(t *testing.T) {
+	mux := newThumbnailsRouter(t)
+	newTestUser(t, "thumb-user", models.RoleUser)
+	token := newTestToken(t, "thumb-user")
+
+	uploaded := uploadImage(t, mux, token, jpegWithExif(t, halvesImage(40, 20)))
+
+	// The original comes without the private data, but keeps its orientation
+	rr := doRequest(mux, "GET", uploaded.URL, "", nil)
+
+	if rr.Code != http.StatusOK || bytes.Contains(rr.Body.Bytes(), []byte("GPS")) {
+		t.Fatalf("metadata wasn't stripped from the original: %v", rr.Code)
+	}
+
+	if !bytes.Contains(rr.Body.Bytes(), []byte("Exif\x00\x00")) {
+		t.Errorf("orientation was stripped along with the metadata")
+	}
+
+	if _, err := jpeg.Decode(bytes.NewReader(rr.Body.Bytes())); err != nil {
+		t.Errorf("stripped JPEG doesn't decode: %v", err)
+	}
+
+	// Both widths fit the small image, so there is only one thumbnail, turned
+	// upright so the left half of the stored image is on top
+	if len(uploaded.Thumbnails) != 1 || uploaded.Thumbnails[0].Width != 20 || uploaded.Thumbnails[0].Height != 40 {
+		t.Fatalf("unexpected thumbnails: %+v", uploaded.Thumbnails)
+	}
+
+	rr = doRequest(mux, "GET", uploaded.Thumbnails[0].URL, "", nil)
+	thumbnail, _, err := image.Decode(bytes.NewReader(rr.Body.Bytes()))
+
+	if err != nil {
+		t.Fatalf("thumbnail doesn't decode: %v", err)
+	}
+
+	top, bottom := thumbnail.At(10, 5), thumbnail.At(10, 35)
+
+	if r, _, b, _ := top.RGBA(); r < b {
+		t.Errorf("expected red on top of the upright thumbnail, got %v", top)
+	}
+
+	if r, _, b, _ := bottom.RGBA(); b < r {
+		t.Errorf("expected blue at the bottom of the upright thumbnail, got %v", bottom)
+	}
+}
+
+func TestPNGThumbnails(t *testing.T) {
+	mux := newThumbnailsRouter(t)
+	newTestUser(t, "thumb-user", models.RoleUser)
+	token := newTestToken(t, "thumb-user")
+
+	uploaded := uploadImage(t, mux, token, pngWithText(t, halvesImage(1200, 600), "Location\x00home"))
+
+	if len(uploaded.Thumbnails) != len(attachments.ThumbnailWidths) {
+		t.Fatalf("expected a thumbnail for every width, got %+v", uploaded.Thumbnails)
+	}
+
+	for i, thumbnail := range uploaded.Thumbnails {
+		width := attachments.ThumbnailWidths[i]
+
+		if thumbnail.Width != width || thumbnail.Height != width/2 {
+			t.Errorf("thumbnail %d is %dx%d", i, thumbnail.Width, thumbnail.Height)
+		}
+	}
+
+	rr := doRequest(mux, "GET", uploaded.URL, "", nil)
+
+	if bytes.Contains(rr.Body.Bytes(), []byte("Location")) {
+		t.Errorf("text chunk wasn't stripped from the PNG")
+	}
+
+	if _, err := png.Decode(bytes.NewReader(rr.Body.Bytes())); err != nil {
+		t.Errorf("stripped PNG doesn't decode: %v", err)
+	}
+}
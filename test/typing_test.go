@@ -0,0 +1,97 @@
+package test
+
+import (
+	"chat-module/chat"
+	"chat-module/models"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func openDirectRoom(t *testing.T, from, to string) models.Room {
+	newTestUser(t, to, models.RoleUser)
+
+	rr := doRequest(newTestRouter(t), "POST", "/api/dms", newTestToken(t, from), map[string]string{"username": to})
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("opening direct conversation failed: got %v", rr.Code)
+	}
+
+	var room models.Room
+	json.Unmarshal(rr.Body.Bytes(), &room)
+
+	return room
+}
+
+func TestDirectRoomsAreUnique(t *testing.T) {
+	first := openDirectRoom(t, "dm-alice", "dm-bob")
+	second := openDirectRoom(t, "dm-bob", "dm-alice")
+
+	if first.ID != second.ID || !first.IsDirect() || len(first.Members) != 2 {
+		t.Errorf("expected the same direct conversation both ways: %+v %+v", first, second)
+	}
+
+	// Site moderators don't get to read other people's direct messages
+	newTestUser(t, "dm-mod", models.RoleModerator)
+	mux := newTestRouter(t)
+
+	if rr := doRequest(mux, "GET", "/api/rooms/"+first.ID.Hex(), newTestToken(t, "dm-mod"), nil); rr.Code != http.StatusNotFound {
+		t.Errorf("site moderator could see a direct conversation: got %v", rr.Code)
+	}
+}
+
+func typingIs(username string, typing bool) func(json.RawMessage) bool {
+	return func(payload json.RawMessage) bool {
+		var indicator chat.TypingPayload
+		json.Unmarshal(payload, &indicator)
+		return indicator.Username == username && indicator.Typing == typing
+	}
+}
+
+func TestTypingIndicators(t *testing.T) {
+	hub, server := newTestHubServer(t)
+	room := openDirectRoom(t, "typing-alice", "typing-bob")
+	conversation := room.ID.Hex()
+
+	alice := dialSocket(t, server, "typing-alice")
+	bob := dialSocket(t, server, "typing-bob")
+	outsider := dialSocket(t, server, "typing-outsider")
+
+	typing := func(typing bool) map[string]any {
+		return map[string]any{
+			"type":    "typing",
+			"payload": map[string]any{"conversation": conversation, "typing": typing},
+		}
+	}
+
+	alice.WriteJSON(typing(true))
+	waitForEvent(t, bob, chat.EventTyping, typingIs("typing-alice", true))
+
+	alice.WriteJSON(typing(false))
+	waitForEvent(t, bob, chat.EventTyping, typingIs("typing-alice", false))
+
+	// Without a refresh the indicator goes away on its own
+	time.Sleep(1100 * time.Millisecond)
+	alice.WriteJSON(typing(true))
+	waitForEvent(t, bob, chat.EventTyping, typingIs("typing-alice", true))
+
+	started := time.Now()
+	waitForEventWithin(t, bob, chat.EventTyping, chat.TypingTimeout+2*time.Second, typingIs("typing-alice", false))
+
+	if elapsed := time.Since(started); elapsed < chat.TypingTimeout-time.Second {
+		t.Errorf("typing indicator expired too early, after %v", elapsed)
+	}
+
+	if hub.Typing.IsTyping(conversation, "typing-alice") {
+		t.Errorf("expired typing indicator is still tracked")
+	}
+
+	// Strangers can't announce themselves in other people's conversations
+	outsider.WriteJSON(typing(true))
+	waitForEvent(t, outsider, chat.EventError, nil)
+
+	if hub.Typing.IsTyping(conversation, "typing-outsider") {
+		t.Errorf("outsider was marked as typing")
+	}
+}
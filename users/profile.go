@@ -0,0 +1,155 @@
+package users
+
+import (
+	"chat-module/auth"
+	"chat-module/db"
+	"chat-module/models"
+	"chat-module/util"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	MaxDisplayNameLength = 64
+	MaxBioLength         = 500
+	MaxStatusTextLength  = 140
+)
+
+func validateLength(value *string, name string, max int) error {
+	if value != nil && utf8.RuneCountInString(*value) > max {
+		return fmt.Errorf("%s can't be longer than %d characters", name, max)
+	}
+
+	return nil
+}
+
+// Checks the profile changes, returning an error meant for the client
+func validateProfileUpdate(update *models.ProfileUpdate) error {
+	if err := validateLength(update.DisplayName, "Display name", MaxDisplayNameLength); err != nil {
+		return err
+	}
+
+	if err := validateLength(update.Bio, "Bio", MaxBioLength); err != nil {
+		return err
+	}
+
+	if err := validateLength(update.StatusText, "Status text", MaxStatusTextLength); err != nil {
+		return err
+	}
+
+	if update.Timezone != nil && *update.Timezone != "" {
+		if _, err := time.LoadLocation(*update.Timezone); err != nil || *update.Timezone == "Local" {
+			return fmt.Errorf("Unknown timezone")
+		}
+	}
+
+	if update.Avatar != nil && *update.Avatar != "" {
+		if _, err := primitive.ObjectIDFromHex(*update.Avatar); err != nil {
+			return fmt.Errorf("Invalid avatar reference")
+		}
+	}
+
+	return nil
+}
+
+// Looks up an user by their exact username
+func getUser(username string) (*models.User, error) {
+	user, err := db.Client.GetUser(username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// GetUser also matches emails, which we don't want to expose here
+	if user.Username == nil || *user.Username != username {
+		return nil, mongo.ErrNoDocuments
+	}
+
+	return user, nil
+}
+
+/*
+ *	GET   /api/users/me - returns the profile of the logged in user
+ *	PATCH /api/users/me - updates the profile of the logged in user
+ */
+func MeHandler(w http.ResponseWriter, r *http.Request) {
+	claims := auth.GetClaims(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		user, err := getUser(claims.Username)
+
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Such an user doesn't exist", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to find document", http.StatusInternalServerError)
+			log.Printf("Failed to find document for user %s: %v", claims.Username, err)
+			return
+		}
+
+		util.WriteJSON(w, http.StatusOK, user.PrivateView())
+
+	case http.MethodPatch:
+		var update models.ProfileUpdate
+
+		if err := util.ReadJSON(r, &update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := validateProfileUpdate(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := db.Client.UpdateProfile(claims.Username, update)
+
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Such an user doesn't exist", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+			log.Printf("Failed to update profile of user %s: %v", claims.Username, err)
+			return
+		}
+
+		util.WriteJSON(w, http.StatusOK, user.PrivateView())
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+ *	GET /api/users/{username}
+ *
+ *	Returns the public profile of an user.
+ */
+func UserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.PathValue("username")
+	user, err := getUser(username)
+
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Such an user doesn't exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to find document", http.StatusInternalServerError)
+		log.Printf("Failed to find document for user %s: %v", username, err)
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, user.PublicView())
+}
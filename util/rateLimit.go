@@ -1,6 +1,8 @@
 package util
 
 import (
+	"chat-module/config"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -24,15 +26,35 @@ const (
 	CacheClearMinutes = 1440
 )
 
+// The limits in use, the constants above unless ConfigureRateLimit changes them
+var (
+	maximumRequests = MaximumRequests
+	timeSlot        = TimeSlotSeconds * time.Second
+	cacheClear      = CacheClearMinutes * time.Minute
+)
+
+// Replaces the default limits. Has to be called before RateLimit is started.
+func ConfigureRateLimit(cfg config.RateLimit) {
+	maximumRequests = cfg.Requests
+	timeSlot = cfg.Window
+	cacheClear = cfg.CacheClear
+}
+
 // This function will act as a reset switch, checking every TimeSlotSeconds
 // and resetting the counters for each user. When CacheClearMinutes passes
-// this function will clear all gathered keys in the map.
-func RateLimit() {
-	resetTicker := time.NewTicker(TimeSlotSeconds * time.Second)
-	clearTicker := time.NewTicker((CacheClearMinutes * 60) * time.Second)
+// this function will clear all gathered keys in the map. It is a background
+// job that returns once the context is done.
+func RateLimit(ctx context.Context) error {
+	resetTicker := time.NewTicker(timeSlot)
+	clearTicker := time.NewTicker(cacheClear)
+
+	defer resetTicker.Stop()
+	defer clearTicker.Stop()
 
 	for {
 		select {
+		case <-ctx.Done():
+			return nil
 		case t := <-resetTicker.C:
 			log.Println("Resetting all user request counters at", t)
 			IpRegistry.SetAll(0)
@@ -52,10 +74,10 @@ func CheckForRateLimit(request *http.Request) error {
 		return nil
 	}
 
-	if counter < MaximumRequests {
+	if counter < maximumRequests {
 		IpRegistry.Set(remoteAddr, counter+1)
 		return nil
 	}
 
-	return fmt.Errorf("Reached maximum allowed requests. Try again in %d seconds", TimeSlotSeconds)
+	return fmt.Errorf("Reached maximum allowed requests. Try again in %d seconds", int(timeSlot.Seconds()))
 }
@@ -1,57 +1,20 @@
 package util
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
+	"unicode"
 
-	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func LoadEnvFile() error {
-	// Check if it the .env file has not already been loaded
-	if _, exists := os.LookupEnv("DB_NAME"); !exists {
-		currentDir, err := os.Getwd()
-
-		if err != nil {
-			log.Fatalf("Couldn't get current working directory: %v", err)
-		}
-
-		for {
-			// Check if the go.mod file exists in the current directory
-			if _, err := os.Stat(filepath.Join(currentDir, ".env")); err == nil {
-				break
-			}
-
-			// Move up one directory level
-			parent := filepath.Dir(currentDir)
-			if parent == currentDir {
-				// If the parent directory is the same as the current, we've reached the root
-				// but still the .env file is nowhere to be found
-				return fmt.Errorf("Reached the root directory, but couldn't find .env file")
-			}
-
-			currentDir = parent
-		}
-
-		envPath := filepath.Join(currentDir, ".env")
-
-		err = godotenv.Load(envPath)
-
-		if err != nil {
-			log.Fatalf("Couldn't load .env file: %v", err)
-		}
-
-		return err
-	}
-
-	return nil
-}
-
 func HashPassword(password string) (string, error) {
 	// Generate a salted hash using bcrypt
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -102,3 +65,91 @@ func GetAuthHeader(request *http.Request) (string, error) {
 
 	return parts[1], nil
 }
+
+// Marshals the value to JSON and writes it as the response with the given status
+func WriteJSON(w http.ResponseWriter, status int, value any) {
+	responseBytes, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, "Failed to marshal the response", http.StatusInternalServerError)
+		log.Printf("Failed to marshal response: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseBytes)
+}
+
+// The largest JSON body ReadJSON is willing to read
+const MaxJSONBodyBytes = 1 << 20
+
+// Reads the body of the request and unmarshals it into the given value. The
+// returned error is meant to be sent back to the client as a bad request.
+func ReadJSON(r *http.Request, value any) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxJSONBodyBytes+1))
+	if err != nil {
+		return fmt.Errorf("Cannot read request body")
+	}
+	defer r.Body.Close()
+
+	if len(body) == 0 {
+		return fmt.Errorf("Empty body")
+	}
+
+	if len(body) > MaxJSONBodyBytes {
+		return fmt.Errorf("Request body too large")
+	}
+
+	if err := json.Unmarshal(body, value); err != nil {
+		return fmt.Errorf("Invalid JSON format")
+	}
+
+	return nil
+}
+
+// Generates a random token with the given number of bytes of entropy, hex encoded
+func GenerateRandomToken(length int) (string, error) {
+	bytes := make([]byte, length)
+
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
+// Hashes a random token for storage. Unlike passwords these have plenty of
+// entropy already, so a plain SHA-256 is enough and lets us look them up.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Longest word considered when searching, longer ones are cut short
+const maxSearchTermLength = 64
+
+/*
+ *	Splits text into lowercase words for searching, without repeats. Anything
+ *	that isn't a letter or a digit separates words.
+ */
+func SearchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := []string{}
+	seen := make(map[string]bool)
+
+	for _, word := range words {
+		if runes := []rune(word); len(runes) > maxSearchTermLength {
+			word = string(runes[:maxSearchTermLength])
+		}
+
+		if !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+
+	return terms
+}